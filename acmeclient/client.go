@@ -0,0 +1,446 @@
+// Package acmeclient - минимальный ACME (RFC 8555) клиент, которым демон сам получает
+// сертификат для своих TLS слушателей, публикуя DNS-01 записи в собственном хранилище.
+package acmeclient
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pollInterval - период опроса статуса авторизаций и заказа
+const pollInterval = 2 * time.Second
+
+// Solver публикует и удаляет TXT записи DNS-01 проверки
+type Solver interface {
+	Present(name, value string) error
+	CleanUp(name, value string) error
+}
+
+// Problem - ошибка ACME сервера (RFC 7807)
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Problem `json:"error"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+type authorization struct {
+	Identifier identifier  `json:"identifier"`
+	Status     string      `json:"status"`
+	Challenges []challenge `json:"challenges"`
+}
+
+// Client - ACME аккаунт у одного CA
+type Client struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	http         *http.Client
+
+	mutex  sync.Mutex
+	dir    *directory
+	kid    string   // URL аккаунта после регистрации
+	nonces []string // Replay-Nonce из предыдущих ответов
+}
+
+// NewClient создает клиента для directoryURL с ключом аккаунта key (P-256)
+func NewClient(directoryURL string, key *ecdsa.PrivateKey) *Client {
+	return &Client{
+		directoryURL: directoryURL,
+		key:          key,
+		http:         &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Register создает аккаунт (или находит существующий для этого ключа)
+func (c *Client) Register(ctx context.Context, email string) error {
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := c.post(ctx, dir.NewAccount, req)
+	if err != nil {
+		return fmt.Errorf("register account: %w", err)
+	}
+	kid := resp.Header.Get("Location")
+	if kid == "" {
+		return errors.New("register account: no Location in response")
+	}
+	c.mutex.Lock()
+	c.kid = kid
+	c.mutex.Unlock()
+	return nil
+}
+
+// Obtain выпускает сертификат для domains с ключом certKey, проходя DNS-01 проверки через
+// solver. Возвращает цепочку сертификатов в PEM
+func (c *Client) Obtain(ctx context.Context, domains []string, certKey crypto.Signer, solver Solver) ([]byte, error) {
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]identifier, len(domains))
+	for i, domain := range domains {
+		ids[i] = identifier{Type: "dns", Value: domain}
+	}
+	var o order
+	resp, body, err := c.post(ctx, dir.NewOrder, map[string]interface{}{"identifiers": ids})
+	if err != nil {
+		return nil, fmt.Errorf("new order: %w", err)
+	}
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, fmt.Errorf("new order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	// сначала публикуем все записи, потом просим CA проверить: у wildcard и apex
+	// одно имя _acme-challenge с разными значениями
+	type pending struct {
+		authzURL     string
+		challengeURL string
+		name, value  string
+	}
+	var challenges []pending
+	defer func() {
+		for _, p := range challenges {
+			if err := solver.CleanUp(p.name, p.value); err != nil {
+				log.Printf("Failed to clean up %s: %v", p.name, err)
+			}
+		}
+	}()
+	for _, authzURL := range o.Authorizations {
+		var authz authorization
+		if err := c.postAsGet(ctx, authzURL, &authz); err != nil {
+			return nil, fmt.Errorf("authorization: %w", err)
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		var ch *challenge
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == "dns-01" {
+				ch = &authz.Challenges[i]
+			}
+		}
+		if ch == nil {
+			return nil, fmt.Errorf("no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		keyAuth := ch.Token + "." + c.thumbprint()
+		sum := sha256.Sum256([]byte(keyAuth))
+		p := pending{
+			authzURL:     authzURL,
+			challengeURL: ch.URL,
+			name:         "_acme-challenge." + authz.Identifier.Value + ".",
+			value:        base64.RawURLEncoding.EncodeToString(sum[:]),
+		}
+		if err := solver.Present(p.name, p.value); err != nil {
+			return nil, fmt.Errorf("present %s: %w", p.name, err)
+		}
+		challenges = append(challenges, p)
+	}
+	for _, p := range challenges {
+		if _, _, err := c.post(ctx, p.challengeURL, struct{}{}); err != nil {
+			return nil, fmt.Errorf("accept challenge for %s: %w", p.name, err)
+		}
+	}
+	for _, p := range challenges {
+		if err := c.waitAuthorization(ctx, p.authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, certKey)
+	if err != nil {
+		return nil, fmt.Errorf("create CSR: %w", err)
+	}
+	if _, _, err := c.post(ctx, o.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}); err != nil {
+		return nil, fmt.Errorf("finalize: %w", err)
+	}
+	for {
+		if err := c.postAsGet(ctx, orderURL, &o); err != nil {
+			return nil, fmt.Errorf("order: %w", err)
+		}
+		if o.Status == "valid" {
+			break
+		}
+		if o.Status == "invalid" {
+			if o.Error != nil {
+				return nil, o.Error
+			}
+			return nil, errors.New("order is invalid")
+		}
+		if err := sleep(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+	}
+	_, chain, err := c.post(ctx, o.Certificate, nil)
+	if err != nil {
+		return nil, fmt.Errorf("download certificate: %w", err)
+	}
+	return chain, nil
+}
+
+// waitAuthorization ждет, пока CA проверит авторизацию
+func (c *Client) waitAuthorization(ctx context.Context, url string) error {
+	for {
+		var authz authorization
+		if err := c.postAsGet(ctx, url, &authz); err != nil {
+			return fmt.Errorf("authorization: %w", err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "invalid", "deactivated", "expired", "revoked":
+			for _, ch := range authz.Challenges {
+				if ch.Error != nil {
+					return fmt.Errorf("authorization of %s failed: %w", authz.Identifier.Value, ch.Error)
+				}
+			}
+			return fmt.Errorf("authorization of %s is %s", authz.Identifier.Value, authz.Status)
+		}
+		if err := sleep(ctx, pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) directory(ctx context.Context) (*directory, error) {
+	c.mutex.Lock()
+	dir := c.dir
+	c.mutex.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch directory: %s", resp.Status)
+	}
+	dir = &directory{}
+	if err := json.NewDecoder(resp.Body).Decode(dir); err != nil {
+		return nil, fmt.Errorf("fetch directory: %w", err)
+	}
+	c.mutex.Lock()
+	c.dir = dir
+	c.mutex.Unlock()
+	return dir, nil
+}
+
+// nonce берет сохраненный Replay-Nonce или запрашивает новый
+func (c *Client) nonce(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mutex.Unlock()
+		return nonce, nil
+	}
+	c.mutex.Unlock()
+
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("new nonce: %w", err)
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("new nonce: no Replay-Nonce in response")
+	}
+	return nonce, nil
+}
+
+func (c *Client) postAsGet(ctx context.Context, url string, result interface{}) error {
+	_, body, err := c.post(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// post отправляет JWS запрос; payload nil - POST-as-GET. Ошибку badNonce повторяет один раз
+func (c *Client) post(ctx context.Context, url string, payload interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.postOnce(ctx, url, payload)
+		var problem *Problem
+		if attempt == 0 && errors.As(err, &problem) && problem.Type == "urn:ietf:params:acme:error:badNonce" {
+			continue
+		}
+		return resp, body, err
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, url string, payload interface{}) (*http.Response, []byte, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mutex.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mutex.Unlock()
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		problem := &Problem{Status: resp.StatusCode}
+		if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+			problem.Type, problem.Detail = "http", resp.Status
+		}
+		return nil, nil, problem
+	}
+	return resp, data, nil
+}
+
+// sign собирает JWS (flattened JSON) с ES256: до регистрации с jwk, после - с kid
+func (c *Client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	c.mutex.Lock()
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	c.mutex.Unlock()
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	encHeader := base64.RawURLEncoding.EncodeToString(header)
+	encBody := base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(encHeader + "." + encBody))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// подпись JWS - r и s фиксированной длины подряд, а не DER
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{
+		"protected": encHeader,
+		"payload":   encBody,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// jwk - открытый ключ аккаунта; порядок полей по RFC 7638 нужен для отпечатка
+func (c *Client) jwk() map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(pad32(c.key.X)),
+		"y":   base64.RawURLEncoding.EncodeToString(pad32(c.key.Y)),
+	}
+}
+
+// thumbprint - отпечаток ключа аккаунта (RFC 7638) для key authorization
+func (c *Client) thumbprint() string {
+	// json.Marshal сортирует ключи map, что совпадает с каноническим порядком RFC 7638
+	data, _ := json.Marshal(c.jwk())
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func pad32(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
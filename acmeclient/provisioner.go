@@ -0,0 +1,205 @@
+package acmeclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// Config - настройки самостоятельного получения сертификата
+type Config struct {
+	Directory   string   // URL ACME directory CA
+	Email       string   // контакт аккаунта (необязательно)
+	Domains     []string // имена сертификата, первое - CommonName
+	CacheDir    string   // account.key, cert.pem и key.pem
+	RenewBefore time.Duration
+}
+
+// Provisioner получает и продлевает сертификат для TLS слушателей демона, публикуя
+// DNS-01 записи через RecordManager, то есть в DNS этого же демона
+type Provisioner struct {
+	config  Config
+	records *storage.RecordManager
+	client  *Client
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+// NewProvisioner загружает ключ аккаунта и сертификат из CacheDir (создает ключ, если его нет)
+func NewProvisioner(config Config, records *storage.RecordManager) (*Provisioner, error) {
+	if config.Directory == "" || len(config.Domains) == 0 {
+		return nil, errors.New("ACME directory and domains are required")
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateKey(filepath.Join(config.CacheDir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("account key: %w", err)
+	}
+	// корневые сертификаты читаются лениво при первом соединении; загружаем их сейчас,
+	// пока chroot еще не закрыл доступ к /etc/ssl
+	if _, err := x509.SystemCertPool(); err != nil {
+		log.Printf("Failed to load system root certificates: %v", err)
+	}
+	p := &Provisioner{
+		config:  config,
+		records: records,
+		client:  NewClient(config.Directory, key),
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(config.CacheDir, "cert.pem"), filepath.Join(config.CacheDir, "key.pem"))
+	if err == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			p.cert = &cert
+			log.Printf("Loaded ACME certificate for %s, expires %s", strings.Join(cert.Leaf.DNSNames, ","), cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return p, nil
+}
+
+// GetCertificate - функция для tls.Config; пока сертификат не получен, соединения отклоняются
+func (p *Provisioner) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.cert == nil {
+		return nil, errors.New("ACME certificate is not obtained yet")
+	}
+	return p.cert, nil
+}
+
+// Run получает сертификат, если его нет или пора продлевать, и дальше проверяет срок
+// каждые 12 часов; после ошибки повторяет через час. Возвращается после закрытия stop
+func (p *Provisioner) Run(stop <-chan struct{}) {
+	for {
+		wait := 12 * time.Hour
+		if p.needsRenewal() {
+			if err := p.obtain(); err != nil {
+				log.Printf("Failed to obtain ACME certificate: %v", err)
+				wait = time.Hour
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// needsRenewal - сертификата нет, он скоро истечет или не покрывает настроенные имена
+func (p *Provisioner) needsRenewal() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.cert == nil {
+		return true
+	}
+	if time.Until(p.cert.Leaf.NotAfter) < p.config.RenewBefore {
+		return true
+	}
+	have := append([]string(nil), p.cert.Leaf.DNSNames...)
+	want := append([]string(nil), p.config.Domains...)
+	sort.Strings(have)
+	sort.Strings(want)
+	return strings.Join(have, ",") != strings.Join(want, ",")
+}
+
+func (p *Provisioner) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	log.Printf("Requesting ACME certificate for %s from %s", strings.Join(p.config.Domains, ","), p.config.Directory)
+	if err := p.client.Register(ctx, p.config.Email); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := p.client.Obtain(ctx, p.config.Domains, key, p)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("issued certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := writeFile(filepath.Join(p.config.CacheDir, "key.pem"), keyPEM); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(p.config.CacheDir, "cert.pem"), chain); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.cert = &cert
+	p.mutex.Unlock()
+	log.Printf("Obtained ACME certificate for %s, expires %s", strings.Join(cert.Leaf.DNSNames, ","), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Present и CleanUp делают Provisioner решателем DNS-01 через собственное хранилище
+func (p *Provisioner) Present(name, value string) error {
+	return p.records.Add(storage.Source{Interface: "acme-client"}, name, value)
+}
+
+func (p *Provisioner) CleanUp(name, value string) error {
+	return p.records.Remove(storage.Source{Interface: "acme-client"}, name, value)
+}
+
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	log.Printf("Created ACME account key %s", path)
+	return key, nil
+}
+
+// writeFile записывает файл атомарно через временный файл и rename
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
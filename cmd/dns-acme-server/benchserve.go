@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// benchWorker - счетчики одного потока нагрузки
+type benchWorker struct {
+	sent      int
+	timeouts  int
+	errors    int
+	rcodes    map[int]int
+	latencies []time.Duration
+}
+
+// runBenchServeCommand - dns-acme-server bench-serve: нагрузка на работающий экземпляр по UDP,
+// чтобы узнать предельный QPS на своем железе. Каждый поток держит один сокет и ждет ответа
+// перед следующим вопросом, поэтому -concurrency задает число вопросов в полете.
+// Код возврата 1, если не пришло ни одного ответа.
+func runBenchServeCommand(args []string) int {
+	fs := flag.NewFlagSet("bench-serve", flag.ContinueOnError)
+	server := fs.String("server", "127.0.0.1:53", "DNS address of the running instance, host[:port]")
+	name := fs.String("name", storage.DefaultChallengePrefix+".example.com", "Name to query")
+	qtype := fs.String("type", "TXT", "Query type")
+	duration := fs.Duration("duration", 10*time.Second, "How long to send queries")
+	concurrency := fs.Int("concurrency", 64, "Queries in flight, one UDP socket each")
+	rate := fs.Int("rate", 0, "Total queries per second, 0 - as fast as the server answers")
+	timeout := fs.Duration("timeout", time.Second, "Timeout of one query, counted as lost")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench-serve [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	typ, ok := dns.StringToType[strings.ToUpper(*qtype)]
+	if !ok || *concurrency < 1 || *duration <= 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if _, _, err := net.SplitHostPort(*server); err != nil {
+		*server = net.JoinHostPort(*server, "53")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(*name), typ)
+	m.RecursionDesired = false
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	packed, err := m.Pack()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid query: %v\n", err)
+		return 2
+	}
+
+	fmt.Printf("Querying %s %s at %s for %v, %d in flight\n", dns.Fqdn(*name), dns.TypeToString[typ], *server, *duration, *concurrency)
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Duration(*concurrency) * time.Second / time.Duration(*rate)
+	}
+	workers := make([]*benchWorker, *concurrency)
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range workers {
+		w := &benchWorker{rcodes: make(map[int]int)}
+		workers[i] = w
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			w.run(*server, packed, id, deadline, interval, *timeout)
+		}(uint16(i) << 8)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := &benchWorker{rcodes: make(map[int]int)}
+	for _, w := range workers {
+		total.sent += w.sent
+		total.timeouts += w.timeouts
+		total.errors += w.errors
+		for rcode, n := range w.rcodes {
+			total.rcodes[rcode] += n
+		}
+		total.latencies = append(total.latencies, w.latencies...)
+	}
+	answered := len(total.latencies)
+	fmt.Printf("Sent %d queries in %v: %.0f answers per second\n", total.sent, elapsed.Round(time.Millisecond), float64(answered)/elapsed.Seconds())
+	fmt.Printf("Answered %d, timed out %d, errors %d\n", answered, total.timeouts, total.errors)
+	if answered == 0 {
+		return 1
+	}
+	var rcodes []string
+	for rcode, n := range total.rcodes {
+		rcodes = append(rcodes, fmt.Sprintf("%s=%d", dns.RcodeToString[rcode], n))
+	}
+	sort.Strings(rcodes)
+	fmt.Printf("Rcodes: %s\n", strings.Join(rcodes, " "))
+	sort.Slice(total.latencies, func(i, j int) bool { return total.latencies[i] < total.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return total.latencies[int(float64(answered-1)*p)].Round(time.Microsecond)
+	}
+	fmt.Printf("Latency: p50 %v, p90 %v, p99 %v, max %v\n", percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	return 0
+}
+
+// run шлет вопросы до deadline; ответ сверяется только по ID и коду ответа, без полного разбора,
+// чтобы нагрузка упиралась в сервер, а не в клиента
+func (w *benchWorker) run(server string, packed []byte, id uint16, deadline time.Time, interval, timeout time.Duration) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		w.errors++
+		return
+	}
+	defer conn.Close()
+	query := append([]byte(nil), packed...)
+	buf := make([]byte, dns.MaxMsgSize)
+	next := time.Now()
+	for time.Now().Before(deadline) {
+		if interval > 0 {
+			time.Sleep(time.Until(next))
+			next = next.Add(interval)
+		}
+		// ID меняется с каждым вопросом: опоздавший ответ на прошлый вопрос не засчитывается текущему
+		id++
+		binary.BigEndian.PutUint16(query, id)
+		sent := time.Now()
+		if _, err := conn.Write(query); err != nil {
+			w.errors++
+			continue
+		}
+		w.sent++
+		conn.SetReadDeadline(sent.Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					w.timeouts++
+				} else {
+					w.errors++
+				}
+				break
+			}
+			if n < 12 || binary.BigEndian.Uint16(buf) != id {
+				continue
+			}
+			w.latencies = append(w.latencies, time.Since(sent))
+			w.rcodes[int(buf[3]&0x0f)]++
+			break
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"dns-acme-server/fcgiapi"
+)
+
+// runHookCommand - клиент для certbot: dns-acme-server hook add|remove.
+// Домен и значение берутся из CERTBOT_DOMAIN и CERTBOT_VALIDATION.
+func runHookCommand(args []string) int {
+	fs := flag.NewFlagSet("hook", flag.ContinueOnError)
+	apiURL := fs.String("api-url", envOr("DNS_ACME_API_URL", "http://127.0.0.1:8053"), "Management API URL of the running daemon")
+	token := fs.String("api-token", os.Getenv("DNS_ACME_API_TOKEN"), "Bearer token for the management API")
+	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s hook [flags] add|remove\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var path string
+	switch fs.Arg(0) {
+	case "add":
+		path = "/certbot/auth"
+	case "remove":
+		path = "/certbot/cleanup"
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	domain := os.Getenv("CERTBOT_DOMAIN")
+	if domain == "" {
+		fmt.Fprintln(os.Stderr, "CERTBOT_DOMAIN is not set")
+		return 1
+	}
+	form := url.Values{
+		"CERTBOT_DOMAIN":     {domain},
+		"CERTBOT_VALIDATION": {os.Getenv("CERTBOT_VALIDATION")},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*apiURL, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid request: %v\n", err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Request failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	var result fcgiapi.HookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid response (%s): %v\n", resp.Status, err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Hook %s failed: %s\n", fs.Arg(0), result.Error)
+		return 1
+	}
+	fmt.Printf("%s %s ok\n", fs.Arg(0), result.FQDN)
+	return 0
+}
+
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
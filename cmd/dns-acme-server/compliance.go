@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// complianceChecker задает вопросы работающему экземпляру и пишет результаты в report
+type complianceChecker struct {
+	server  string
+	timeout time.Duration
+	report  *validateReport
+}
+
+// runComplianceCommand - dns-acme-server check-compliance: проверки соответствия протоколу
+// (EDNS, TCP, TC, SOA, NS, коды ответа), на которых спотыкаются резолверы удостоверяющих
+// центров и Zonemaster. Код возврата 1, если есть ошибки.
+func runComplianceCommand(args []string) int {
+	fs := flag.NewFlagSet("check-compliance", flag.ContinueOnError)
+	server := fs.String("server", "127.0.0.1:53", "DNS address of the running instance, host[:port]")
+	zone := fs.String("zone", "", "Zone served by the instance, SOA and NS are checked at its apex")
+	name := fs.String("name", "", "TXT name to query (default "+storage.DefaultChallengePrefix+".ZONE)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of one query")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-compliance -zone ZONE [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *zone == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if _, _, err := net.SplitHostPort(*server); err != nil {
+		*server = net.JoinHostPort(*server, "53")
+	}
+	apex := dns.Fqdn(strings.ToLower(*zone))
+	txtName := dns.Fqdn(*name)
+	if *name == "" {
+		txtName = storage.DefaultChallengePrefix + "." + apex
+	}
+
+	c := &complianceChecker{server: *server, timeout: *timeout, report: &validateReport{}}
+	c.checkUDP(txtName)
+	c.checkCase(txtName)
+	c.checkEDNS(txtName)
+	c.checkTCP(txtName)
+	c.checkTruncation(txtName)
+	c.checkApex(apex, dns.TypeSOA)
+	c.checkApex(apex, dns.TypeNS)
+	c.checkNegative(apex)
+	c.checkRcodes(txtName)
+
+	if c.report.failed > 0 {
+		fmt.Printf("\n%d checks failed\n", c.report.failed)
+		return 1
+	}
+	return 0
+}
+
+// complianceQuery - вопрос без рекурсии, как его задают валидаторы авторитетному серверу
+func complianceQuery(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	return m
+}
+
+func (c *complianceChecker) exchange(proto string, m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: proto, Timeout: c.timeout, UDPSize: dns.MaxMsgSize}
+	resp, _, err := client.Exchange(m, c.server)
+	return resp, err
+}
+
+// answerable - ответ на вопрос к нашему имени: NOERROR или NXDOMAIN с флагом AA
+func answerable(resp *dns.Msg) error {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	if !resp.Authoritative {
+		return fmt.Errorf("AA flag is not set")
+	}
+	return nil
+}
+
+func (c *complianceChecker) checkUDP(name string) {
+	resp, err := c.exchange("udp", complianceQuery(name, dns.TypeTXT))
+	switch {
+	case err != nil:
+		c.report.fail("udp", "%s TXT: %v", name, err)
+	case answerable(resp) != nil:
+		c.report.fail("udp", "%s TXT: %v", name, answerable(resp))
+	case resp.IsEdns0() != nil:
+		c.report.fail("udp", "OPT record in the reply to a query without EDNS (RFC 6891, 7)")
+	default:
+		truncated := ""
+		if resp.Truncated {
+			truncated = ", truncated"
+		}
+		c.report.ok("udp", "%s TXT: %s, %d answers%s", name, dns.RcodeToString[resp.Rcode], len(resp.Answer), truncated)
+	}
+}
+
+// checkCase - валидаторы с 0x20 сверяют регистр имени в вопросе ответа
+func (c *complianceChecker) checkCase(name string) {
+	mixed := []byte(strings.ToLower(name))
+	for i := 0; i < len(mixed); i += 2 {
+		if mixed[i] >= 'a' && mixed[i] <= 'z' {
+			mixed[i] -= 'a' - 'A'
+		}
+	}
+	resp, err := c.exchange("udp", complianceQuery(string(mixed), dns.TypeTXT))
+	switch {
+	case err != nil:
+		c.report.fail("case", "%v", err)
+	case len(resp.Question) != 1 || resp.Question[0].Name != string(mixed):
+		c.report.fail("case", "question case is not preserved, 0x20 validating resolvers will drop the reply")
+	default:
+		c.report.ok("case", "question %s returned unchanged", mixed)
+	}
+}
+
+func (c *complianceChecker) checkEDNS(name string) {
+	m := complianceQuery(name, dns.TypeTXT)
+	m.SetEdns0(1232, false)
+	resp, err := c.exchange("udp", m)
+	switch {
+	case err != nil:
+		c.report.fail("edns", "%v", err)
+	case resp.IsEdns0() == nil:
+		c.report.fail("edns", "no OPT record in the reply to an EDNS query")
+	case resp.IsEdns0().Version() != 0:
+		c.report.fail("edns", "reply has EDNS version %d", resp.IsEdns0().Version())
+	default:
+		c.report.ok("edns", "OPT with UDP size %d", resp.IsEdns0().UDPSize())
+	}
+
+	// RFC 6891, 6.1.3: на неизвестную версию BADVERS с версией 0
+	m = complianceQuery(name, dns.TypeTXT)
+	m.SetEdns0(1232, false)
+	m.IsEdns0().SetVersion(1)
+	resp, err = c.exchange("udp", m)
+	switch {
+	case err != nil:
+		c.report.fail("edns-version", "%v", err)
+	case resp.Rcode != dns.RcodeBadVers || resp.IsEdns0() == nil || resp.IsEdns0().Version() != 0:
+		c.report.fail("edns-version", "EDNS version 1 answered with %s, want BADVERS and OPT version 0", dns.RcodeToString[resp.Rcode])
+	default:
+		c.report.ok("edns-version", "EDNS version 1 answered with BADVERS")
+	}
+
+	// неизвестная опция игнорируется и не повторяется в ответе (RFC 6891, 6.1.2)
+	m = complianceQuery(name, dns.TypeTXT)
+	m.SetEdns0(1232, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}})
+	resp, err = c.exchange("udp", m)
+	switch {
+	case err != nil:
+		c.report.fail("edns-option", "%v", err)
+	case answerable(resp) != nil:
+		c.report.fail("edns-option", "query with an unknown option: %v", answerable(resp))
+	case resp.IsEdns0() != nil && hasOption(resp.IsEdns0(), 65001):
+		c.report.fail("edns-option", "unknown option is echoed in the reply")
+	default:
+		c.report.ok("edns-option", "unknown option ignored")
+	}
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *complianceChecker) checkTCP(name string) {
+	resp, err := c.exchange("tcp", complianceQuery(name, dns.TypeTXT))
+	switch {
+	case err != nil:
+		c.report.fail("tcp", "%s TXT over TCP: %v", name, err)
+	case answerable(resp) != nil:
+		c.report.fail("tcp", "%s TXT over TCP: %v", name, answerable(resp))
+	case resp.Truncated:
+		c.report.fail("tcp", "TC flag set in a TCP reply")
+	default:
+		c.report.ok("tcp", "%s TXT: %d answers", name, len(resp.Answer))
+	}
+}
+
+// checkTruncation - ответ без EDNS не больше 512 байт, а обрезанный ответ приходит с TC
+// и пустыми секциями, чтобы резолвер повторил запрос по TCP, а не принял часть значений
+func (c *complianceChecker) checkTruncation(name string) {
+	resp, err := c.exchange("udp", complianceQuery(name, dns.TypeTXT))
+	if err != nil {
+		c.report.fail("tc", "%v", err)
+		return
+	}
+	// размер на проводе: сервер сжимает имена, при повторной упаковке тоже сжимаем
+	resp.Compress = true
+	packed, err := resp.Pack()
+	if err != nil {
+		c.report.fail("tc", "%v", err)
+		return
+	}
+	switch {
+	case len(packed) > dns.MinMsgSize:
+		c.report.fail("tc", "%d byte UDP reply to a query without EDNS, the limit is %d", len(packed), dns.MinMsgSize)
+	case resp.Truncated && len(resp.Answer) > 0:
+		c.report.fail("tc", "truncated reply carries %d answers, resolvers may accept a partial RRset", len(resp.Answer))
+	case resp.Truncated:
+		full, err := c.exchange("tcp", complianceQuery(name, dns.TypeTXT))
+		if err != nil || len(full.Answer) == 0 {
+			c.report.fail("tc", "reply is truncated but the TCP retry returns no answers")
+			return
+		}
+		c.report.ok("tc", "reply truncated without EDNS, TCP returns %d answers", len(full.Answer))
+	default:
+		c.report.ok("tc", "%d byte reply fits without EDNS", len(packed))
+	}
+}
+
+// checkApex - SOA и NS у вершины зоны; их отсутствие не мешает выпуску, но без SOA
+// резолверы кэшируют отрицательные ответы по своим настройкам
+func (c *complianceChecker) checkApex(zone string, qtype uint16) {
+	check := strings.ToLower(dns.TypeToString[qtype])
+	resp, err := c.exchange("udp", complianceQuery(zone, qtype))
+	if err != nil {
+		c.report.fail(check, "%s %s: %v", zone, dns.TypeToString[qtype], err)
+		return
+	}
+	if err := answerable(resp); err != nil {
+		c.report.fail(check, "%s %s: %v", zone, dns.TypeToString[qtype], err)
+		return
+	}
+	var records []string
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, zone) {
+			records = append(records, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+	}
+	if len(records) == 0 {
+		c.report.warn(check, "no %s at %s, add it with -static-record or -zone-file", dns.TypeToString[qtype], zone)
+		return
+	}
+	c.report.ok(check, "%s", strings.Join(records, ", "))
+}
+
+// checkNegative - пустой ответ к несуществующему имени несет SOA в authority (RFC 2308)
+func (c *complianceChecker) checkNegative(zone string) {
+	token := make([]byte, 6)
+	rand.Read(token)
+	name := "_dns-acme-compliance-" + hex.EncodeToString(token) + "." + zone
+	resp, err := c.exchange("udp", complianceQuery(name, dns.TypeTXT))
+	switch {
+	case err != nil:
+		c.report.fail("negative", "%v", err)
+	case answerable(resp) != nil:
+		c.report.fail("negative", "%s TXT: %v", name, answerable(resp))
+	case len(resp.Answer) > 0:
+		c.report.fail("negative", "%s TXT: %d answers for a random name", name, len(resp.Answer))
+	case !hasSOA(resp.Ns):
+		c.report.warn("negative", "no SOA in the authority section, resolvers cache the negative answer by their defaults (see -negative-ttl)")
+	default:
+		c.report.ok("negative", "%s with SOA", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRcodes - коды ответа на некорректные и неподдерживаемые запросы вместо пустого NOERROR
+func (c *complianceChecker) checkRcodes(name string) {
+	chaos := complianceQuery(name, dns.TypeTXT)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	iquery := complianceQuery(name, dns.TypeTXT)
+	iquery.Opcode = dns.OpcodeIQuery
+	twoQuestions := complianceQuery(name, dns.TypeTXT)
+	twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+
+	checks := []struct {
+		check string
+		what  string
+		m     *dns.Msg
+		rcode int
+	}{
+		{"class", "CH class query", chaos, dns.RcodeRefused},
+		{"opcode", "IQUERY", iquery, dns.RcodeNotImplemented},
+		{"qdcount", "query with two questions", twoQuestions, dns.RcodeFormatError},
+	}
+	for _, tt := range checks {
+		resp, err := c.exchange("udp", tt.m)
+		switch {
+		case err != nil:
+			c.report.fail(tt.check, "%s: %v", tt.what, err)
+		case resp.Rcode != tt.rcode:
+			c.report.fail(tt.check, "%s answered with %s, want %s", tt.what, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+		default:
+			c.report.ok(tt.check, "%s answered with %s", tt.what, dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// envPrefix - префикс переменных окружения с настройками, например ANGIE_DNS_FCGI_TXT_TTL
+// для -txt-ttl: в контейнере флаги задаются окружением без шаблонов файла конфигурации
+const envPrefix = "ANGIE_DNS_FCGI_"
+
+// envFlagName - имя переменной окружения для флага
+func envFlagName(name string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// applyEnvFlags задает флаги, не указанные в командной строке, из переменных окружения.
+// У повторяемых флагов значения разделяются переводом строки. Переменные с префиксом,
+// которым не соответствует ни один флаг, скорее всего опечатки и попадают в журнал.
+func applyEnvFlags() (int, error) {
+	set := setFlags()
+	known := make(map[string]bool)
+	count := 0
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		known[envFlagName(f.Name)] = true
+		if set[f.Name] || err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(envFlagName(f.Name))
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = strings.FieldsFunc(value, func(r rune) bool { return r == '\n' })
+		}
+		for _, v := range values {
+			if err = flag.Set(f.Name, strings.TrimSpace(v)); err != nil {
+				err = fmt.Errorf("%s: %v", envFlagName(f.Name), err)
+				return
+			}
+		}
+		count++
+	})
+	for _, env := range os.Environ() {
+		if name, _, _ := strings.Cut(env, "="); strings.HasPrefix(name, envPrefix) && !known[name] {
+			log.Printf("Ignoring %s: no such option", name)
+		}
+	}
+	return count, err
+}
+
+// loadConfigFile задает флаги, не указанные в командной строке и окружении,
+// из файла конфигурации. Формат: "имя-флага = значение" на строку, # - комментарий;
+// повторяемые флаги (-static-record, -zone-file и т.п.) указываются несколькими строками.
+func loadConfigFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	set := setFlags()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return count, fmt.Errorf("%s:%d: expected name = value", path, lineNo)
+		}
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		value = unquote(strings.TrimSpace(value))
+		if flag.Lookup(name) == nil || name == "config" {
+			return count, fmt.Errorf("%s:%d: unknown option %q", path, lineNo, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return count, fmt.Errorf("%s:%d: invalid %s: %v", path, lineNo, name, err)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// setFlags - флаги, которые уже заданы (командной строкой или flag.Set)
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// unquote снимает двойные кавычки вокруг значения, если они есть
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
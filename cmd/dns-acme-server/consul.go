@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dns-acme-server/consul"
+)
+
+// consulService - регистрация по первому адресу -dns-addr; адрес 0.0.0.0 или [::]
+// заменяется адресом агента
+func consulService(name, dnsAddr string) (consul.Service, error) {
+	if i := strings.LastIndex(dnsAddr, "@"); i >= 0 {
+		dnsAddr = dnsAddr[:i]
+	}
+	host, portText, err := net.SplitHostPort(dnsAddr)
+	if err != nil {
+		return consul.Service{}, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return consul.Service{}, err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	hostname, _ := os.Hostname()
+	return consul.Service{
+		ID:      name + "-" + hostname,
+		Name:    name,
+		Address: host,
+		Port:    port,
+		Tags:    []string{"dns"},
+	}, nil
+}
+
+func consulContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
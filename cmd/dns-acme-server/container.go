@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dns-acme-server/responder"
+)
+
+// Адреса по умолчанию в контейнере: порт DNS без привилегий (публикуется как -p 53:5353/udp),
+// FastCGI на всех адресах, ведь Angie подключается из другого контейнера
+const (
+	containerDNSAddr     = "0.0.0.0:5353"
+	containerFastCGIAddr = "0.0.0.0:9000"
+)
+
+// inContainer - процесс запущен в контейнере Docker или Podman
+func inContainer() bool {
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// overridePort заменяет порт во всех адресах; адрес может заканчиваться @интерфейс
+func overridePort(addrs []string, port int) []string {
+	result := make([]string, len(addrs))
+	for i, spec := range addrs {
+		addr, iface, hasIface := strings.Cut(spec, "@")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = strings.Trim(addr, "[]")
+		}
+		result[i] = net.JoinHostPort(host, strconv.Itoa(port))
+		if hasIface {
+			result[i] += "@" + iface
+		}
+	}
+	return result
+}
+
+// listenRetry открывает сокеты, повторяя попытку раз в секунду в течение retry: в контейнере
+// адрес или интерфейс может появиться позже, чем запустится процесс
+func listenRetry(retry time.Duration, listen func() (responder.Listeners, error)) (responder.Listeners, error) {
+	deadline := time.Now().Add(retry)
+	for attempt := 1; ; attempt++ {
+		listeners, err := listen()
+		if err == nil || !time.Now().Before(deadline) {
+			if err == nil && attempt > 1 {
+				log.Printf("Bound listeners after %d attempts", attempt)
+			}
+			return listeners, err
+		}
+		if attempt == 1 {
+			log.Printf("Failed to bind listeners: %v; retrying for up to %v", err, retry)
+		}
+		time.Sleep(time.Second)
+	}
+}
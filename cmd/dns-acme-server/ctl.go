@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dns-acme-server/fcgiapi"
+	"dns-acme-server/storage"
+)
+
+// runCtlCommand - ручное управление записями работающего демона через HTTP API:
+// dns-acme-server ctl add|remove|list|export|import. Адрес API - URL или unix:/path к сокету -api-addr.
+func runCtlCommand(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	apiURL := fs.String("api-url", envOr("DNS_ACME_API_URL", "http://127.0.0.1:8053"), "Management API URL of the running daemon or unix:/path/to/api.sock")
+	token := fs.String("api-token", os.Getenv("DNS_ACME_API_TOKEN"), "Bearer token for the management API")
+	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
+	jsonOutput := fs.Bool("json", false, "Print the raw JSON response")
+	prefix := fs.String("challenge-prefix", storage.DefaultChallengePrefix, "Record name prefix configured on the daemon")
+	replace := fs.Bool("replace", false, "With import, remove records that are not in the snapshot")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ctl [flags] command\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "  add DOMAIN VALUE       publish VALUE at PREFIX.DOMAIN\n")
+		fmt.Fprintf(fs.Output(), "  remove DOMAIN [VALUE]  remove VALUE (or all values) of PREFIX.DOMAIN\n")
+		fmt.Fprintf(fs.Output(), "  list [DOMAIN]          show published records and how often they were queried\n")
+		fmt.Fprintf(fs.Output(), "  export                 write all records as a JSON snapshot to stdout\n")
+		fmt.Fprintf(fs.Output(), "  import FILE            restore records from a snapshot (- reads stdin)\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	client := newCtlClient(*apiURL, *token, *timeout)
+	labelPrefix := strings.ToLower(strings.Trim(*prefix, ".")) + "."
+
+	command, rest := fs.Arg(0), fs.Args()
+	if len(rest) > 0 {
+		rest = rest[1:]
+	}
+	// export и import вызываются и без ctl, флаги тогда идут после команды
+	if command == "export" || command == "import" {
+		if err := fs.Parse(rest); err != nil {
+			return 2
+		}
+		rest = fs.Args()
+	}
+	switch {
+	case command == "add" && len(rest) == 2, command == "remove" && (len(rest) == 1 || len(rest) == 2):
+		req := map[string]string{"value": ""}
+		if len(rest) == 2 {
+			req["value"] = rest[1]
+		}
+		// имя с префиксом передается как есть, иначе демон добавит префикс сам
+		if strings.HasPrefix(strings.ToLower(rest[0]), labelPrefix) {
+			req["fqdn"] = rest[0]
+		} else {
+			req["domain"] = rest[0]
+		}
+		path := "/present"
+		if command == "remove" {
+			path = "/cleanup"
+		}
+		var result fcgiapi.HookResponse
+		raw, status, err := client.do(http.MethodPost, path, req, &result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Request failed: %v\n", err)
+			return 1
+		}
+		if *jsonOutput {
+			os.Stdout.Write(raw)
+		}
+		if status != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "%s failed: %s\n", command, result.Error)
+			return 1
+		}
+		if !*jsonOutput {
+			fmt.Printf("%s %s ok\n", command, result.FQDN)
+		}
+		return 0
+	case command == "list" && len(rest) <= 1:
+		path := "/records"
+		if len(rest) == 1 {
+			name := rest[0]
+			if !strings.HasPrefix(strings.ToLower(name), labelPrefix) {
+				name = labelPrefix + name
+			}
+			path += "?fqdn=" + url.QueryEscape(name)
+		}
+		var records []fcgiapi.RecordUsage
+		raw, status, err := client.do(http.MethodGet, path, nil, &records)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Request failed: %v\n", err)
+			return 1
+		}
+		if status != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "list failed: %s\n", strings.TrimSpace(string(raw)))
+			return 1
+		}
+		if *jsonOutput {
+			os.Stdout.Write(raw)
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FQDN\tVALUE\tTTL\tAGE\tQUERIES\tNETWORKS")
+		for _, r := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%d\n", r.FQDN, r.Value, r.TTL, time.Since(r.AddedAt).Round(time.Second), r.Queries, len(r.Networks))
+		}
+		tw.Flush()
+		return 0
+	case command == "export" && len(rest) == 0:
+		var snap storage.Snapshot
+		raw, status, err := client.do(http.MethodGet, "/snapshot", nil, &snap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Request failed: %v\n", err)
+			return 1
+		}
+		if status != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "export failed: %s\n", strings.TrimSpace(string(raw)))
+			return 1
+		}
+		os.Stdout.Write(raw)
+		fmt.Fprintf(os.Stderr, "Exported %d records and %d hosted records\n", len(snap.Records), len(snap.Hosted))
+		return 0
+	case command == "import" && len(rest) == 1:
+		var data []byte
+		var err error
+		if rest[0] == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(rest[0])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read snapshot: %v\n", err)
+			return 1
+		}
+		var snap storage.Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid snapshot %s: %v\n", rest[0], err)
+			return 1
+		}
+		path := "/snapshot"
+		if *replace {
+			path += "?replace=1"
+		}
+		var result struct {
+			fcgiapi.HookResponse
+			storage.SnapshotResult
+		}
+		raw, status, err := client.do(http.MethodPost, path, &snap, &result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Request failed: %v\n", err)
+			return 1
+		}
+		if *jsonOutput {
+			os.Stdout.Write(raw)
+		}
+		if status != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "import failed: %s\n", result.Error)
+			return 1
+		}
+		if !*jsonOutput {
+			fmt.Printf("import ok: %d values restored, %d removed\n", result.Restored, result.Removed)
+		}
+		return 0
+	}
+	fs.Usage()
+	return 2
+}
+
+// ctlClient - HTTP клиент API, умеющий ходить через unix сокет
+type ctlClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newCtlClient(apiURL, token string, timeout time.Duration) *ctlClient {
+	c := &ctlClient{base: strings.TrimSuffix(apiURL, "/"), token: token, http: &http.Client{Timeout: timeout}}
+	if path := strings.TrimPrefix(apiURL, "unix:"); path != apiURL {
+		c.base = "http://unix"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c
+}
+
+// do отправляет запрос и разбирает JSON ответ в out; возвращает и исходное тело
+func (c *ctlClient) do(method, path string, in, out interface{}) ([]byte, int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(raw, out); err != nil && resp.StatusCode == http.StatusOK {
+		return raw, resp.StatusCode, fmt.Errorf("invalid response: %v", err)
+	}
+	return raw, resp.StatusCode, nil
+}
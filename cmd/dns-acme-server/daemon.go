@@ -0,0 +1,1085 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"dns-acme-server/acmeclient"
+	"dns-acme-server/consul"
+	"dns-acme-server/dnsserver"
+	"dns-acme-server/fcgiapi"
+	"dns-acme-server/geoip"
+	"dns-acme-server/hooks"
+	"dns-acme-server/k8s"
+	"dns-acme-server/metrics"
+	"dns-acme-server/plugins"
+	"dns-acme-server/responder"
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+	"dns-acme-server/vault"
+)
+
+// daemon - состояние работающего демона, которое настройка одной подсистемы передает
+// следующим. Ошибка настройки возвращается из run, а не завершает процесс, поэтому
+// уже запущенное останавливается в обратном порядке
+type daemon struct {
+	*daemonFlags
+	build buildInfo
+
+	listeners       responder.Listeners
+	upgraded        bool // сокеты получены от предыдущего процесса при Upgrade
+	metricsListener net.Listener
+	grpcListener    net.Listener
+	debugNets       []*net.IPNet
+	zones           []*dnsserver.Zone
+	memoryGuard     *MemoryGuard
+
+	secrets          *SecretManager
+	configWatcher    *ConfigWatcher
+	consulClient     *consul.Client
+	k8sClient        *k8s.Client
+	configMapStorage *k8s.ConfigMapStorage
+	consulStorage    *consul.KVStorage
+	encrypted        *storage.Encrypted
+	labels           string // префикс challenge-записей
+
+	srv           *responder.Responder
+	tenants       *storage.Tenants
+	usage         *fcgiapi.UsageTracker
+	events        *fcgiapi.EventHub
+	secondary     *dnsserver.Secondary
+	apiAuth       fcgiapi.Authenticator // nil - авторизация выключена
+	keyAuthPolicy fcgiapi.KeyAuthPolicy
+	provisioner   *acmeclient.Provisioner
+	certSource    metrics.CertificateSource // сертификат API для dns_acme_tls_certificate_expiry_days
+	retryQueue    *storage.RetryQueue
+
+	// при Upgrade регистрация в Consul остается за новым процессом
+	handedOver bool
+	cleanup    []func()
+}
+
+// run настраивает подсистемы по порядку и обслуживает запросы до сигнала остановки
+func (d *daemon) run() error {
+	defer d.shutdown()
+	log.Printf("Starting DNS ACME Server (TXT only), %s", d.build)
+	buildInfoGauge.Set(1, d.build.Version, d.build.Commit, d.build.Date, d.build.GoVersion)
+	if responder.ReapChildren() {
+		log.Printf("Running as PID 1, reaping orphaned child processes")
+	}
+	for _, setup := range []func() error{
+		d.listen,
+		d.openStorage,
+		d.setupRecords,
+		d.setupObservers,
+		d.setupDNS,
+		d.setupAPI,
+		d.start,
+	} {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	return d.serve()
+}
+
+// onStop добавляет действие для shutdown
+func (d *daemon) onStop(fn func()) {
+	d.cleanup = append(d.cleanup, fn)
+}
+
+// shutdown выполняет действия onStop в обратном порядке, как отложенные вызовы
+func (d *daemon) shutdown() {
+	for i := len(d.cleanup) - 1; i >= 0; i-- {
+		d.cleanup[i]()
+	}
+	d.cleanup = nil
+}
+
+// listen получает сокеты: от предыдущего процесса, от systemd или открывает сам
+func (d *daemon) listen() error {
+	if inContainer() {
+		set := setFlags()
+		if !set["dns-addr"] {
+			d.dnsAddrs.addrs = []string{containerDNSAddr}
+		}
+		if !set["fastcgi-addr"] {
+			d.fastcgiAddrs.addrs = []string{containerFastCGIAddr}
+		}
+	}
+	if *d.dnsPort < 0 || *d.dnsPort > 65535 || *d.fastcgiPort < 0 || *d.fastcgiPort > 65535 {
+		return fmt.Errorf("invalid -dns-port or -fastcgi-port: ports are 1-65535")
+	}
+	if *d.dnsPort != 0 {
+		d.dnsAddrs.addrs = overridePort(d.dnsAddrs.addrs, *d.dnsPort)
+	}
+	if *d.fastcgiPort != 0 {
+		d.fastcgiAddrs.addrs = overridePort(d.fastcgiAddrs.addrs, *d.fastcgiPort)
+	}
+	var err error
+	if d.zones, err = parseZones(d.zoneSpecs, d.zoneTokens, d.zoneListen); err != nil {
+		return fmt.Errorf("invalid -zone: %w", err)
+	}
+	// адреса -zone-listen слушаются вместе с -dns-addr и так же передаются при Upgrade
+	for _, z := range d.zones {
+		d.dnsAddrs.addrs = append(d.dnsAddrs.addrs, z.Listen...)
+	}
+	log.Printf("DNS Address: %s", d.dnsAddrs)
+	log.Printf("FastCGI Address: %s", d.fastcgiAddrs)
+
+	limit, err := parseSize(*d.memoryLimit)
+	if err != nil {
+		return fmt.Errorf("invalid -memory-limit: %w", err)
+	}
+	limit = ConfigureMemory(limit, *d.gcPercent)
+	d.memoryGuard = NewMemoryGuard(limit, *d.memoryPressure)
+
+	var apiAddrs []string
+	if *d.apiAddr != "" {
+		apiAddrs = append(apiAddrs, *d.apiAddr)
+	}
+	d.listeners, d.upgraded, err = responder.InheritedListeners()
+	if err != nil {
+		return fmt.Errorf("failed to use sockets of the previous process: %w", err)
+	}
+	activated := false
+	if d.upgraded {
+		log.Printf("Took over %d DNS UDP, %d DNS TCP, %d FastCGI, %d API and %d gRPC sockets from the previous process",
+			len(d.listeners.DNSPacketConns), len(d.listeners.DNSListeners), len(d.listeners.FastCGI), len(d.listeners.API), len(d.listeners.GRPC))
+	} else if d.listeners, activated, err = responder.SystemdListeners(); err != nil {
+		return fmt.Errorf("failed to use systemd sockets: %w", err)
+	}
+	if activated {
+		log.Printf("Using %d DNS UDP, %d DNS TCP, %d FastCGI and %d API sockets from systemd",
+			len(d.listeners.DNSPacketConns), len(d.listeners.DNSListeners), len(d.listeners.FastCGI), len(d.listeners.API))
+	} else if !d.upgraded {
+		d.listeners, err = listenRetry(*d.bindRetry, func() (responder.Listeners, error) {
+			return responder.ListenAllFallback(d.dnsAddrs.addrs, d.fastcgiAddrs.addrs, apiAddrs, *d.dnsFallbackPort)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to bind listeners: %w", err)
+		}
+	}
+
+	d.debugNets, err = parseCIDRList(*d.debugAllow)
+	if err != nil {
+		return fmt.Errorf("invalid -debug-allow: %w", err)
+	}
+	if *d.debugEndpoints && *d.metricsAddr == "" && len(d.listeners.Metrics) == 0 {
+		return fmt.Errorf("-debug-endpoints requires -metrics-addr")
+	}
+	if len(d.listeners.Metrics) > 0 {
+		d.metricsListener = d.listeners.Metrics[0]
+	} else if *d.metricsAddr != "" {
+		if d.metricsListener, err = net.Listen("tcp", *d.metricsAddr); err != nil {
+			return fmt.Errorf("failed to bind metrics listener: %w", err)
+		}
+		d.listeners.Metrics = append(d.listeners.Metrics, d.metricsListener)
+	}
+	if len(d.listeners.GRPC) > 0 {
+		d.grpcListener = d.listeners.GRPC[0]
+	} else if *d.grpcAddr != "" {
+		if d.grpcListener, err = net.Listen("tcp", *d.grpcAddr); err != nil {
+			return fmt.Errorf("failed to bind gRPC listener: %w", err)
+		}
+		d.listeners.GRPC = append(d.listeners.GRPC, d.grpcListener)
+	}
+	return nil
+}
+
+// openStorage подключает Vault, Consul и Kubernetes и открывает хранилище записей
+func (d *daemon) openStorage() error {
+	var err error
+	var vaultClient *vault.Client
+	var login func(ctx context.Context) (vault.TokenLease, error)
+	if *d.vaultAddr != "" {
+		vaultClient = vault.NewClient(*d.vaultAddr, "", *d.vaultNamespace)
+		login = vaultLogin(vaultClient, *d.vaultToken, *d.vaultAppRoleMount, *d.vaultRoleID, *d.vaultSecretID)
+	}
+	d.secrets, err = NewSecretManager(vaultClient, login, *d.vaultRefresh)
+	if err != nil {
+		return fmt.Errorf("failed to set up Vault: %w", err)
+	}
+	if vaultClient != nil {
+		log.Printf("Reading secrets from Vault at %s", *d.vaultAddr)
+	}
+	// ACL токен один на хранилище и регистрацию, меняется при ротации
+	if *d.storageBackend == "consul" || *d.consulRegister {
+		token, err := d.secrets.Load("consul-token", *d.consulToken, func(token string) error {
+			d.consulClient.SetToken(token)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid -consul-token: %w", err)
+		}
+		d.consulClient = consul.NewClient(*d.consulAddr, token)
+	}
+
+	if *d.k8sMode || *d.storageBackend == "configmap" {
+		if d.k8sClient, err = k8s.InCluster(); err != nil {
+			return fmt.Errorf("failed to set up Kubernetes client: %w", err)
+		}
+	}
+
+	var backend storage.Storage
+	switch *d.storageBackend {
+	case "configmap":
+		if d.configMapStorage, err = k8s.NewConfigMapStorage(d.k8sClient, *d.k8sConfigMap); err != nil {
+			return fmt.Errorf("failed to open ConfigMap storage: %w", err)
+		}
+		backend = d.configMapStorage
+		log.Printf("Using ConfigMap %s/%s storage", d.k8sClient.Namespace(), *d.k8sConfigMap)
+	case "consul":
+		if d.consulStorage, err = consul.NewKVStorage(d.consulClient, *d.consulPrefix); err != nil {
+			return fmt.Errorf("failed to open Consul storage: %w", err)
+		}
+		backend = d.consulStorage
+		log.Printf("Using Consul KV storage at %s/%s", *d.consulAddr, *d.consulPrefix)
+	case "memory":
+		memoryStorage := storage.NewMemory()
+		d.memoryGuard.OnPressure(memoryStorage.Compact)
+		backend = memoryStorage
+	default:
+		if path := strings.TrimPrefix(*d.storageBackend, plugins.StoragePrefix); path != *d.storageBackend {
+			if backend, err = plugins.OpenStorage(path, *d.storageDSN); err != nil {
+				return fmt.Errorf("failed to open storage plugin: %w", err)
+			}
+			if closer, ok := backend.(io.Closer); ok {
+				d.onStop(func() { closer.Close() })
+			}
+			log.Printf("Using storage from plugin %s", path)
+			break
+		}
+		sqlStorage, err := storage.OpenSQL(*d.storageBackend, *d.storageDSN, storage.SQLPool{
+			MaxOpen:     *d.storageMaxOpen,
+			MaxIdle:     *d.storageMaxIdle,
+			MaxLifetime: *d.storageConnLifetime,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to open %s storage: %w", *d.storageBackend, err)
+		}
+		d.onStop(func() { sqlStorage.Close() })
+		backend = sqlStorage
+		log.Printf("Using %s storage", *d.storageBackend)
+	}
+	backendName := *d.storageBackend
+	if strings.HasPrefix(backendName, plugins.StoragePrefix) {
+		backendName = "plugin"
+	}
+	instrumented := storage.NewInstrumented(backendName, backend)
+	instrumented.SetTimeout(*d.storageTimeout)
+	var records storage.Storage = instrumented
+	if *d.storageEncryptionKey != "" {
+		if *d.storageBackend == "memory" {
+			log.Printf("-storage-encryption-key has no effect with memory storage")
+		} else {
+			material, err := d.secrets.Load("storage-encryption-key", *d.storageEncryptionKey, nil)
+			if err != nil {
+				return fmt.Errorf("failed to load -storage-encryption-key: %w", err)
+			}
+			key, err := storage.ParseEncryptionKey(material)
+			if err != nil {
+				return fmt.Errorf("invalid -storage-encryption-key: %w", err)
+			}
+			if d.encrypted, err = storage.NewEncrypted(records, key); err != nil {
+				return fmt.Errorf("invalid -storage-encryption-key: %w", err)
+			}
+			records = d.encrypted
+			log.Printf("Record values are encrypted in storage")
+		}
+	}
+	if *d.readOnly {
+		// отказы read-only не попадают в ошибки хранилища
+		if *d.storageBackend == "memory" {
+			return fmt.Errorf("-read-only requires a shared storage backend, not memory")
+		}
+		records = storage.NewReadOnly(records)
+		log.Printf("Read-only replica: record changes are rejected")
+	}
+	d.labels, err = storage.ParseChallengePrefix(*d.challengePrefix)
+	if err != nil {
+		return fmt.Errorf("invalid -challenge-prefix: %w", err)
+	}
+	d.srv = responder.NewResponder(records, d.listeners, d.labels)
+	return nil
+}
+
+// setupRecords задает TTL, задержку удаления и ограничения изменений записей
+func (d *daemon) setupRecords() error {
+	if *d.txtTTLFlag > storage.MaxTTL {
+		return fmt.Errorf("invalid -txt-ttl: must be at most %d", storage.MaxTTL)
+	}
+	d.srv.Records.SetDefaultTTL(uint32(*d.txtTTLFlag))
+	if *d.removeDelay > 0 {
+		if *d.readOnly {
+			return fmt.Errorf("-remove-delay cannot be used with -read-only")
+		}
+		d.srv.Records.SetRemoveDelay(*d.removeDelay)
+		// при остановке отложенные удаления выполняются сразу, до закрытия хранилища
+		d.onStop(func() {
+			if err := d.srv.Records.FlushRemovals(); err != nil {
+				log.Printf("Records left in storage: %v", err)
+			}
+		})
+	}
+
+	// файлы токенов, списка доменов и TLS перечитываются при изменении
+	if *d.allowedDomains != "" && *d.allowedDomainsFile != "" {
+		return fmt.Errorf("-allowed-domains and -allowed-domains-file are mutually exclusive")
+	}
+	if *d.allowedDomains != "" {
+		d.srv.Records.SetAllowedDomains(storage.ParseDomainACL(*d.allowedDomains, d.labels))
+	}
+	if *d.allowedDomainsFile != "" {
+		acl, err := storage.LoadDomainACLFile(*d.allowedDomainsFile, d.labels)
+		if err != nil {
+			return fmt.Errorf("failed to load allowed domains: %w", err)
+		}
+		d.srv.Records.SetAllowedDomains(acl)
+		d.configWatcher.Add("allowed-domains", *d.allowedDomainsFile, func() (string, error) {
+			acl, err := storage.LoadDomainACLFile(*d.allowedDomainsFile, d.labels)
+			if err != nil {
+				return "", err
+			}
+			d.srv.Records.SetAllowedDomains(acl)
+			return fmt.Sprintf("entries=%d", acl.Size()), nil
+		})
+	}
+
+	if len(d.zones) > 0 {
+		access := storage.NewZones()
+		for _, z := range d.zones {
+			if err := access.Add(z.Name, z.Tokens); err != nil {
+				return fmt.Errorf("invalid -zone: %w", err)
+			}
+		}
+		d.srv.Records.SetZones(access)
+	}
+
+	// регистрации -register-zone - тоже заказчики, поэтому включают их и без -tenants-file
+	if *d.tenantsFile != "" || *d.registerZone != "" {
+		var list []storage.Tenant
+		var err error
+		if *d.tenantsFile != "" {
+			list, err = storage.LoadTenantsFile(*d.tenantsFile)
+		}
+		if err == nil {
+			d.tenants, err = storage.NewTenants(list, d.labels)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load tenants: %w", err)
+		}
+		d.srv.Records.SetTenants(d.tenants)
+		d.srv.Records.Observe(d.tenants)
+		d.srv.APIServer.EnableTenants(d.tenants)
+	}
+	if *d.tenantsFile != "" {
+		d.configWatcher.Add("tenants", *d.tenantsFile, func() (string, error) {
+			list, err := storage.LoadTenantsFile(*d.tenantsFile)
+			if err == nil {
+				err = d.tenants.Replace(list)
+			}
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("tenants=%d", len(list)), nil
+		})
+	}
+
+	// с заказчиками значения учитываются всегда: max_records можно задать при перечитывании
+	if *d.maxRecords > 0 || *d.maxRecordsPerToken > 0 || *d.tokenQuotas != "" || d.tenants != nil {
+		overrides, err := parseQuotaOverrides(*d.tokenQuotas)
+		if err != nil {
+			return fmt.Errorf("invalid -token-quota: %w", err)
+		}
+		d.srv.Records.SetQuota(storage.NewRecordQuota(*d.maxRecords, *d.maxRecordsPerToken, overrides))
+	}
+	if *d.changeRate < 0 || *d.changeBurst < 0 {
+		return fmt.Errorf("invalid -change-rate/-change-burst: must not be negative")
+	}
+	if *d.changeRate > 0 {
+		d.srv.Records.SetRateLimit(storage.NewRateLimiter(*d.changeRate, *d.changeBurst))
+	}
+	return nil
+}
+
+// setupObservers подключает трассировку, журналы, хуки и события изменений
+func (d *daemon) setupObservers() error {
+	if *d.otlpEndpoint != "" {
+		tracer := tracing.NewTracer(*d.otlpEndpoint, *d.otlpService)
+		tracing.Enable(tracer)
+		d.srv.Records.Observe(tracer)
+		go tracer.Run(5 * time.Second)
+		log.Printf("Exporting traces to %s", tracer.Endpoint())
+	}
+
+	if *d.dnstapTarget != "" {
+		identity := *d.dnstapIdentity
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		tap := dnsserver.NewDnstap(*d.dnstapTarget, identity)
+		d.srv.DNSServer.SetDnstap(tap)
+		go tap.Run()
+		d.onStop(func() { tap.Close() })
+	}
+
+	lifecycle := responder.NewLifecycleTracker(*d.successWebhook)
+	d.srv.Records.Observe(lifecycle)
+	d.srv.DNSServer.OnTXTAnswer(lifecycle.Queried)
+
+	d.usage = fcgiapi.NewUsageTracker(d.srv.Records)
+	if len(d.geoipDBs) > 0 {
+		geoDB, err := geoip.Open(d.geoipDBs)
+		if err != nil {
+			return fmt.Errorf("failed to open -geoip-db: %w", err)
+		}
+		log.Printf("GeoIP databases: %s", strings.Join(geoDB.Types(), ", "))
+		d.srv.DNSServer.SetGeoIP(geoDB)
+		if *d.asnDB == "" && geoDB.HasASN() {
+			d.usage.SetASNLookup(geoDB)
+		}
+	}
+	if *d.asnDB != "" {
+		table, err := geoip.LoadASNTable(*d.asnDB)
+		if err != nil {
+			return fmt.Errorf("failed to load -asn-db: %w", err)
+		}
+		log.Printf("Loaded %d ASN ranges from %s", table.Len(), *d.asnDB)
+		d.usage.SetASNLookup(table)
+	}
+	d.srv.Records.Observe(d.usage)
+	d.srv.DNSServer.OnTXTAnswer(d.usage.Queried)
+	d.srv.APIServer.EnableRecordList(d.usage)
+	d.srv.APIServer.EnableQueryDebug(func(name string, qtype uint16) interface{} {
+		return d.srv.DNSServer.Trace(name, qtype)
+	})
+
+	if *d.accessLogPath != "" {
+		maxSize, err := parseSize(*d.accessLogMaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid -access-log-max-size: %w", err)
+		}
+		accessLog, err := fcgiapi.OpenAccessLog(*d.accessLogPath, maxSize, *d.accessLogMaxAge, *d.accessLogMaxBackups)
+		if err != nil {
+			return fmt.Errorf("failed to open access log: %w", err)
+		}
+		d.onStop(func() { accessLog.Close() })
+		d.srv.AccessLog = accessLog
+	}
+
+	if *d.auditLogPath != "" {
+		audit, err := fcgiapi.OpenAuditLog(*d.auditLogPath)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		audit.SetTenants(d.tenants)
+		d.srv.Records.Observe(audit)
+		d.srv.Hosted.Observe(audit)
+		d.srv.APIServer.EnableAudit(audit)
+	}
+	if *d.recordHistory > 0 {
+		history := fcgiapi.NewRecordHistory(*d.recordHistory)
+		d.srv.Records.Observe(history)
+		d.srv.APIServer.EnableHistory(history)
+	}
+
+	if len(d.changeHooks) > 0 {
+		for _, kv := range d.changeHookEnv {
+			if !strings.Contains(kv, "=") {
+				return fmt.Errorf("invalid -change-hook-env %q, expected KEY=VALUE", kv)
+			}
+		}
+		changeHook := hooks.New(*d.changeHookTimeout, d.changeHookEnv)
+		for _, spec := range d.changeHooks {
+			if err := changeHook.Add(spec); err != nil {
+				return fmt.Errorf("invalid -change-hook: %w", err)
+			}
+		}
+		d.srv.Records.SetChangeHook(changeHook.Before)
+		d.srv.Records.Observe(changeHook)
+		log.Printf("Running %d change hooks with timeout %v", changeHook.Len(), *d.changeHookTimeout)
+	}
+
+	d.events = fcgiapi.NewEventHub()
+	webhookSecret, err := d.secrets.Load("event-webhook-secret", *d.eventWebhookSecret, func(secret string) error {
+		d.events.SetWebhookSecret(secret)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid -event-webhook-secret: %w", err)
+	}
+	for _, url := range d.eventWebhooks {
+		d.events.AddWebhook(url, webhookSecret)
+	}
+	d.srv.Records.Observe(d.events)
+	d.srv.Hosted.Observe(d.events)
+	d.srv.APIServer.EnableEvents(d.events)
+	if *d.apiUI {
+		d.srv.DNSServer.SetQueryHistory(200)
+		d.srv.APIServer.EnableUI(d.usage, d.events, func() interface{} {
+			return d.srv.DNSServer.RecentQueries()
+		})
+	}
+	return nil
+}
+
+// setupDNS настраивает ответы DNS сервера: политики, зоны, статические записи, передачу зоны
+func (d *daemon) setupDNS() error {
+	dnsServer := d.srv.DNSServer
+	if *d.negativeTTL > storage.MaxTTL {
+		return fmt.Errorf("invalid -negative-ttl: must be at most %d", storage.MaxTTL)
+	}
+	dnsServer.SetNegativeTTL(*d.negativeTTL)
+	dnsServer.SetLimits(*d.dnsWorkers, *d.dnsQueryTimeout)
+	dnsServer.SetMaxUDPSize(*d.dnsMaxUDPSize)
+	cookieMode, err := dnsserver.ParseCookieMode(*d.dnsCookies)
+	if err != nil {
+		return fmt.Errorf("invalid -dns-cookies: %w", err)
+	}
+	cookieSecret, err := d.secrets.Load("dns-cookie-secret", *d.dnsCookieSecret, dnsServer.RotateCookieSecret)
+	if err != nil {
+		return fmt.Errorf("invalid -dns-cookie-secret: %w", err)
+	}
+	if err := dnsServer.SetCookies(cookieMode, cookieSecret); err != nil {
+		return fmt.Errorf("invalid -dns-cookie-secret: %w", err)
+	}
+	dnsServer.SetTCPLimits(*d.dnsTCPMaxConns, *d.dnsTCPIdleTimeout, *d.dnsTCPMaxQueries)
+	dnsServer.SetCache(*d.dnsCacheSize, *d.dnsCacheMaxAge)
+	d.memoryGuard.OnPressure(dnsServer.PurgeCache)
+
+	var updateKey *dnsserver.TSIGKey
+	tsigValue, err := d.secrets.Load("tsig-key", *d.tsigKey, func(value string) error {
+		key, err := dnsserver.ParseTSIGKey(value)
+		if err != nil {
+			return err
+		}
+		dnsServer.SetTSIGKey(key)
+		if d.secondary != nil {
+			d.secondary.SetTSIGKey(key)
+		}
+		log.Printf("TSIG key replaced with %s", key.Name)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid -tsig-key: %w", err)
+	}
+	if tsigValue != "" {
+		if updateKey, err = dnsserver.ParseTSIGKey(tsigValue); err != nil {
+			return fmt.Errorf("invalid -tsig-key: %w", err)
+		}
+		dnsServer.EnableUpdates(updateKey)
+		log.Printf("RFC 2136 dynamic updates enabled for key %s", updateKey.Name)
+	}
+
+	policy, err := dnsserver.ParseQtypePolicy(*d.qtypePolicy)
+	if err != nil {
+		return fmt.Errorf("invalid -qtype-policy: %w", err)
+	}
+	if policy.NeedsUpstream() && *d.forwardUpstream == "" {
+		return fmt.Errorf("-qtype-policy uses forward but -forward-upstream is not set")
+	}
+	upstream := ""
+	if *d.forwardUpstream != "" {
+		upstream = withDefaultPort(*d.forwardUpstream, "53")
+	}
+	dnsServer.SetQtypePolicy(policy, upstream)
+	if *d.fallbackUpstream != "" {
+		dnsServer.SetFallbackUpstream(withDefaultPort(*d.fallbackUpstream, "53"))
+	}
+	anyAnswer, err := dnsserver.ParseAnyPolicy(*d.anyPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid -any-policy: %w", err)
+	}
+	dnsServer.SetAnyPolicy(anyAnswer)
+	if !*d.hideVersion {
+		dnsServer.SetVersion(d.build.chaosVersion())
+	}
+	views, err := parseViews(d.viewSpecs, d.viewRecords, d.viewZoneFiles)
+	if err != nil {
+		return fmt.Errorf("invalid -view: %w", err)
+	}
+	dnsServer.SetViews(views)
+	// TXT у вершины зоны - обычные статические записи, перечитываются вместе с ними
+	for _, entry := range d.apexTXT {
+		record, err := dnsserver.ApexTXTRecord(entry)
+		if err != nil {
+			return fmt.Errorf("invalid -apex-txt: %w", err)
+		}
+		d.staticRecords = append(d.staticRecords, record)
+	}
+	// SOA и NS зон -zone - тоже статические записи
+	for _, z := range d.zones {
+		d.staticRecords = append(d.staticRecords, z.Records()...)
+		log.Printf("Serving zone %s, NS %s", z.Name, strings.Join(z.NS, ", "))
+	}
+	if err := dnsServer.SetZones(d.zones); err != nil {
+		return fmt.Errorf("invalid -zone-listen: %w", err)
+	}
+	if err := dnsServer.LoadStatic(d.staticRecords, d.zoneFiles); err != nil {
+		return fmt.Errorf("failed to load static records: %w", err)
+	}
+	if *d.nsName != "" {
+		if len(d.nsAddrs) == 0 {
+			return fmt.Errorf("-ns-name requires at least one -ns-addr")
+		}
+		if err := dnsServer.SetSelfAddresses(*d.nsName, d.nsAddrs); err != nil {
+			return fmt.Errorf("invalid -ns-addr: %w", err)
+		}
+	}
+	if *d.transferZone != "" {
+		allowed, err := parseCIDRList(*d.transferAllow)
+		if err != nil {
+			return fmt.Errorf("invalid -transfer-allow: %w", err)
+		}
+		var notify []string
+		for _, addr := range splitList(*d.notifyAddrs) {
+			notify = append(notify, withDefaultPort(addr, "53"))
+		}
+		dnsServer.SetTransfer(*d.transferZone, *d.nsName, allowed, notify)
+	} else if *d.secondaryOf != "" || *d.transferAllow != "" || *d.notifyAddrs != "" {
+		return fmt.Errorf("-secondary-of, -transfer-allow and -notify require -transfer-zone")
+	}
+	if *d.secondaryOf != "" {
+		if *d.readOnly {
+			return fmt.Errorf("-secondary-of cannot copy records in -read-only mode")
+		}
+		d.secondary = dnsserver.NewSecondary(d.srv.Records, *d.transferZone, withDefaultPort(*d.secondaryOf, "53"), updateKey)
+		dnsServer.SetSecondary(d.secondary)
+		log.Printf("Secondary for zone %s of %s", *d.transferZone, *d.secondaryOf)
+	}
+	for _, entry := range d.caaPolicies {
+		if err := dnsServer.AddCAAPolicy(entry); err != nil {
+			return fmt.Errorf("invalid -caa: %w", err)
+		}
+	}
+	return nil
+}
+
+// setupAPI настраивает авторизацию, TLS и ограничения FastCGI и HTTP API
+func (d *daemon) setupAPI() error {
+	var authenticators fcgiapi.Authenticators
+	if *d.apiTokensFile != "" {
+		tokens, err := fcgiapi.LoadTokenFile(*d.apiTokensFile)
+		if err != nil {
+			return fmt.Errorf("failed to load API tokens: %w", err)
+		}
+		authenticators = append(authenticators, tokens)
+		d.configWatcher.Add("api-tokens", *d.apiTokensFile, func() (string, error) {
+			count, err := tokens.Reload(*d.apiTokensFile)
+			return fmt.Sprintf("tokens=%d", count), err
+		})
+	}
+	if *d.authPlugin != "" {
+		auth, err := plugins.OpenAuthenticator(*d.authPlugin, *d.authPluginConfig)
+		if err != nil {
+			return fmt.Errorf("failed to load -auth-plugin: %w", err)
+		}
+		authenticators = append(authenticators, auth)
+		log.Printf("API clients are checked by plugin %s", *d.authPlugin)
+	}
+	if *d.registerZone != "" {
+		if *d.registerFile == "" {
+			return fmt.Errorf("-register-zone requires -register-file")
+		}
+		allow, err := parseCIDRList(*d.registerAllow)
+		if err != nil {
+			return fmt.Errorf("invalid -register-allow: %w", err)
+		}
+		if len(allow) == 0 {
+			log.Printf("-register-allow is empty, POST /register rejects every client")
+		}
+		registered, err := fcgiapi.OpenRegistrations(*d.registerFile, *d.registerZone, *d.registerMaxRecords, allow, d.tenants)
+		if err != nil {
+			return fmt.Errorf("failed to load registrations: %w", err)
+		}
+		authenticators = append(authenticators, registered)
+		d.srv.APIServer.EnableRegistration(registered)
+		log.Printf("Registration open for zone %s, %d accounts", *d.registerZone, registered.Len())
+	}
+	if len(authenticators) > 0 {
+		d.apiAuth = authenticators
+		d.srv.APIServer.RequireAuth(d.apiAuth)
+	}
+	if *d.apiTokensFile != "" || *d.registerZone != "" {
+		if *d.rotateGrace < 0 {
+			return fmt.Errorf("invalid -rotate-grace: must not be negative")
+		}
+		d.srv.APIServer.EnableRotation(*d.rotateGrace)
+	}
+	if *d.acmeDirectory != "" {
+		if *d.readOnly {
+			return fmt.Errorf("-acme-directory cannot publish challenges in -read-only mode")
+		}
+		if *d.apiTLSCert != "" || *d.apiTLSKey != "" {
+			return fmt.Errorf("-acme-directory and -api-tls-cert/-api-tls-key are mutually exclusive")
+		}
+		var err error
+		d.provisioner, err = acmeclient.NewProvisioner(acmeclient.Config{
+			Directory:   *d.acmeDirectory,
+			Email:       *d.acmeEmail,
+			Domains:     splitList(*d.acmeDomains),
+			CacheDir:    *d.acmeCacheDir,
+			RenewBefore: *d.acmeRenewBefore,
+		}, d.srv.Records)
+		if err != nil {
+			return fmt.Errorf("failed to set up ACME client: %w", err)
+		}
+		d.srv.APITLS = &tls.Config{
+			GetCertificate: d.provisioner.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		d.certSource = d.provisioner
+	} else if strings.HasPrefix(*d.apiTLSCert, "vault:") {
+		// сертификат и ключ - поля одного секрета Vault, меняются вместе
+		certRef, _, err := parseSecretRef(*d.apiTLSCert)
+		if err != nil {
+			return fmt.Errorf("invalid -api-tls-cert: %w", err)
+		}
+		keyRef, _, err := parseSecretRef(*d.apiTLSKey)
+		if err != nil {
+			return fmt.Errorf("invalid -api-tls-key: %w", err)
+		}
+		var cert *fcgiapi.CertificateFile
+		pair, err := d.secrets.LoadVault("api-tls", []secretRef{certRef, keyRef}, func(pair []string) error {
+			return cert.SetPEM([]byte(pair[0]), []byte(pair[1]))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load API TLS certificate: %w", err)
+		}
+		if cert, err = fcgiapi.NewCertificatePEM([]byte(pair[0]), []byte(pair[1])); err != nil {
+			return fmt.Errorf("failed to load API TLS certificate: %w", err)
+		}
+		d.srv.APITLS = &tls.Config{
+			GetCertificate: cert.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		d.certSource = cert
+	} else if *d.apiTLSCert != "" || *d.apiTLSKey != "" {
+		certFile, keyFile := strings.TrimPrefix(*d.apiTLSCert, "file:"), strings.TrimPrefix(*d.apiTLSKey, "file:")
+		cert, err := fcgiapi.LoadCertificateFile(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load API TLS certificate: %w", err)
+		}
+		d.srv.APITLS = &tls.Config{
+			GetCertificate: cert.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		d.certSource = cert
+		reloadCert := func() (string, error) {
+			return "", cert.Reload()
+		}
+		d.configWatcher.Add("api-tls", certFile, reloadCert)
+		d.configWatcher.Add("api-tls", keyFile, reloadCert)
+	}
+	if *d.apiClientCA != "" {
+		if d.srv.APITLS == nil {
+			return fmt.Errorf("-api-client-ca requires TLS: set -api-tls-cert/-api-tls-key or -acme-directory")
+		}
+		policy, err := fcgiapi.LoadClientCertPolicy(*d.apiClientCA, splitList(*d.apiClientAllowed))
+		if err != nil {
+			return fmt.Errorf("failed to load API client CA: %w", err)
+		}
+		policy.Apply(d.srv.APITLS)
+	}
+	if *d.propagationServers != "" {
+		d.srv.EnablePropagationCheck(fcgiapi.NewPropagationChecker(*d.propagationServers, *d.propagationTimeout))
+	}
+	if *d.certManagerGroup != "" {
+		d.srv.APIServer.EnableCertManager(*d.certManagerGroup, *d.certManagerSolver)
+	}
+
+	if err := d.srv.Handler.SetResponseFormat(*d.responseFormat); err != nil {
+		return fmt.Errorf("invalid -response-format: %w", err)
+	}
+	if *d.retryQueuePath != "" {
+		if *d.readOnly {
+			return fmt.Errorf("-retry-queue cannot be used with -read-only")
+		}
+		var err error
+		if d.retryQueue, err = storage.NewRetryQueue(d.srv.Records, *d.retryQueuePath, *d.retryMaxAge); err != nil {
+			return fmt.Errorf("failed to open retry queue: %w", err)
+		}
+		d.srv.Handler.SetRetryQueue(d.retryQueue)
+		d.srv.APIServer.SetRetryQueue(d.retryQueue)
+	}
+	d.srv.Handler.SetRequestTimeout(*d.requestTimeout)
+	d.srv.APIServer.SetRequestTimeout(*d.requestTimeout)
+	d.srv.Handler.SetStrictMutations(*d.strictMutations)
+	d.srv.APIServer.SetStrictMutations(*d.strictMutations)
+	d.srv.Handler.AllowAnyValues(*d.allowAnyValue)
+	d.keyAuthPolicy = fcgiapi.KeyAuthPolicy{Digest: *d.digestInput, Thumbprints: splitList(*d.accountThumbprints)}
+	for _, t := range d.keyAuthPolicy.Thumbprints {
+		if err := fcgiapi.CheckThumbprint(t); err != nil {
+			return fmt.Errorf("invalid -account-thumbprint %s: %w", t, err)
+		}
+	}
+	d.srv.Handler.SetKeyAuthPolicy(d.keyAuthPolicy)
+	d.srv.APIServer.SetKeyAuthPolicy(d.keyAuthPolicy)
+	d.srv.Handler.SetNoAutoPrefix(*d.noAutoPrefix)
+	formLimit, err := parseSize(*d.maxFormSize)
+	if err != nil {
+		return fmt.Errorf("invalid -max-form-size: %w", err)
+	}
+	if *d.maxValueLength < 1 || *d.maxValueLength > 255 {
+		return fmt.Errorf("invalid -max-value-length: must be between 1 and 255, a TXT string is at most 255 bytes")
+	}
+	d.srv.Handler.SetSizeLimits(formLimit, *d.maxValueLength)
+	d.srv.APIServer.AllowAnyValues(*d.allowAnyValue)
+	return nil
+}
+
+// start сбрасывает привилегии и запускает серверы и фоновые задачи
+func (d *daemon) start() error {
+	// Все сокеты и файлы открыты, root больше не нужен. После Upgrade от непривилегированного
+	// процесса новый уже запущен от нужного пользователя
+	if d.upgraded && os.Getuid() != 0 {
+		log.Printf("Privileges were already dropped by the previous process")
+	} else if err := DropPrivileges(*d.runUser, *d.runGroup, *d.chrootDir); err != nil {
+		return fmt.Errorf("failed to drop privileges: %w", err)
+	}
+	if *d.runUser != "" || *d.runGroup != "" || *d.chrootDir != "" {
+		log.Printf("Running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
+
+	if err := d.srv.DNS.Start(); err != nil {
+		return fmt.Errorf("failed to start DNS server: %w", err)
+	}
+	d.onStop(func() { d.srv.DNS.Stop() })
+	if *d.publicAddr != "" {
+		if *d.publicProbeURL != "" && *d.publicProbeZone == "" {
+			return fmt.Errorf("-public-probe-url requires -public-probe-zone")
+		}
+		var bound []string
+		for _, conn := range d.listeners.DNSPacketConns {
+			bound = append(bound, conn.LocalAddr().String())
+		}
+		go probePublic(d.srv.DNSServer, withDefaultPort(*d.publicAddr, "53"), *d.publicProbeZone, *d.publicProbeURL, bound)
+	}
+
+	// сертификат получаем, когда DNS уже отвечает: проверки CA придут к нам же
+	if d.provisioner != nil {
+		stopProvisioner := make(chan struct{})
+		d.onStop(func() { close(stopProvisioner) })
+		go d.provisioner.Run(stopProvisioner)
+	}
+	if d.certSource != nil {
+		stopCertWatch := make(chan struct{})
+		d.onStop(func() { close(stopCertWatch) })
+		go metrics.NewCertificateWatch("api", d.certSource, *d.tlsExpiryWarning).Run(stopCertWatch)
+	}
+	if d.secondary != nil {
+		stopSecondary := make(chan struct{})
+		d.onStop(func() { close(stopSecondary) })
+		go d.secondary.Run(stopSecondary)
+	}
+
+	if d.configMapStorage != nil {
+		stopWatch := make(chan struct{})
+		d.onStop(func() { close(stopWatch) })
+		go d.configMapStorage.Watch(stopWatch)
+	}
+	if d.consulStorage != nil {
+		stopWatch := make(chan struct{})
+		d.onStop(func() { close(stopWatch) })
+		go d.consulStorage.Watch(stopWatch)
+	}
+	// read-only реплика не участвует в выборах: лидер должен уметь чистить записи
+	if *d.k8sMode && !*d.readOnly {
+		elector := k8s.NewLeaderElector(d.k8sClient, *d.k8sLease, podIdentity(), *d.k8sLeaseDuration)
+		if d.configMapStorage != nil && *d.k8sRecordMaxAge > 0 {
+			// забытые записи чистит только лидер, чтобы реплики не писали одно и то же
+			elector.OnElected(func(stop <-chan struct{}) {
+				sweepConfigMap(d.configMapStorage, d.srv.Records, d.encrypted, *d.k8sRecordMaxAge, stop)
+			})
+		}
+		// при остановке ждем, пока лидер отдаст Lease, иначе реплики ждут истечения срока
+		stopElector, electorDone := make(chan struct{}), make(chan struct{})
+		d.onStop(func() {
+			close(stopElector)
+			<-electorDone
+		})
+		go func() {
+			elector.Run(stopElector)
+			close(electorDone)
+		}()
+	}
+	if d.retryQueue != nil {
+		stopRetry := make(chan struct{})
+		d.onStop(func() { close(stopRetry) })
+		go d.retryQueue.Run(stopRetry)
+	}
+
+	if err := d.srv.API.Start(); err != nil {
+		return fmt.Errorf("failed to start FastCGI server: %w", err)
+	}
+	d.onStop(func() { d.srv.API.Stop() })
+	// потоки /events держат соединения, их надо закрыть до остановки HTTP API
+	d.onStop(func() { d.events.Close() })
+
+	if d.grpcListener != nil {
+		grpcServer := fcgiapi.NewGRPCServer(d.srv.Records, d.usage)
+		if d.apiAuth != nil {
+			grpcServer.RequireAuth(d.apiAuth)
+		}
+		grpcServer.AllowAnyValues(*d.allowAnyValue)
+		grpcServer.SetKeyAuthPolicy(d.keyAuthPolicy)
+		go func() {
+			if err := grpcServer.Serve(d.grpcListener, d.srv.APITLS); err != nil {
+				log.Printf("gRPC server error: %v", err)
+			}
+		}()
+		d.onStop(func() { grpcServer.Stop() })
+	}
+
+	go d.memoryGuard.Run(10*time.Second, nil)
+
+	d.secrets.Watch(d.configWatcher)
+	stopConfigWatcher := make(chan struct{})
+	d.onStop(func() { close(stopConfigWatcher) })
+	go d.configWatcher.Run(stopConfigWatcher)
+	go d.secrets.Run(stopConfigWatcher)
+
+	if d.metricsListener != nil {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Default)
+		metricsServer := &http.Server{Handler: metricsMux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+		if *d.debugEndpoints {
+			registerDebug(metricsMux, d.debugNets, d.usage)
+			// CPU профиль и trace пишутся дольше обычного ответа (?seconds=30)
+			metricsServer.WriteTimeout = 2 * time.Minute
+			log.Printf("Serving debug endpoints on %s/debug/pprof/ and /debug/vars", d.metricsListener.Addr())
+		}
+		log.Printf("Serving metrics on %s/metrics", d.metricsListener.Addr())
+		go func() {
+			if err := metricsServer.Serve(d.metricsListener); err != nil && err != http.ErrServerClosed {
+				log.Printf("Metrics server error: %v", err)
+			}
+		}()
+		d.onStop(func() { metricsServer.Close() })
+	}
+
+	if *d.pushgatewayURL != "" || *d.statsdAddr != "" {
+		if *d.metricsPushInterval <= 0 {
+			return fmt.Errorf("invalid -metrics-push-interval: must be positive")
+		}
+		pusher := metrics.NewPusher(metrics.Default, *d.metricsPushInterval)
+		if *d.pushgatewayURL != "" {
+			hostname, _ := os.Hostname()
+			pusher.SetPushgateway(*d.pushgatewayURL, *d.pushgatewayJob, hostname)
+			log.Printf("Pushing metrics to %s every %v", *d.pushgatewayURL, *d.metricsPushInterval)
+		}
+		if *d.statsdAddr != "" {
+			if err := pusher.SetStatsd(*d.statsdAddr, *d.statsdPrefix, *d.statsdTags); err != nil {
+				return fmt.Errorf("invalid -statsd-addr: %w", err)
+			}
+			log.Printf("Sending metrics to statsd %s every %v", *d.statsdAddr, *d.metricsPushInterval)
+		}
+		stopPusher := make(chan struct{})
+		pusherDone := make(chan struct{})
+		go func() {
+			pusher.Run(stopPusher)
+			close(pusherDone)
+		}()
+		// при остановке метрики отправляются последний раз
+		d.onStop(func() {
+			close(stopPusher)
+			<-pusherDone
+		})
+	}
+
+	if *d.consulRegister {
+		service, err := consulService(*d.consulServiceName, d.dnsAddrs.addrs[0])
+		if err != nil {
+			return fmt.Errorf("invalid -dns-addr for Consul registration: %w", err)
+		}
+		ctx, cancel := consulContext()
+		err = d.consulClient.RegisterService(ctx, service)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to register in Consul: %w", err)
+		}
+		log.Printf("Registered Consul service %s (%s)", service.Name, service.ID)
+		d.onStop(func() {
+			if d.handedOver {
+				return
+			}
+			ctx, cancel := consulContext()
+			defer cancel()
+			if err := d.consulClient.DeregisterService(ctx, service.ID); err != nil {
+				log.Printf("Failed to deregister from Consul: %v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// serve ждет сигналов: SIGHUP перечитывает статические записи, сигнал Upgrade передает
+// сокеты новому процессу; ошибка сервера возвращается, чтобы супервизор перезапустил демон
+func (d *daemon) serve() error {
+	log.Printf("Server is running. Press Ctrl+C to stop.")
+	if err := responder.Notify("READY=1"); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+	if err := responder.UpgradeReady(); err != nil {
+		log.Printf("Failed to notify the previous process: %v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if upgradeSignal != nil {
+		signal.Notify(signals, upgradeSignal)
+	}
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-serviceStop:
+			log.Printf("Service stop requested, shutting down")
+			return nil
+		case err := <-d.srv.Errors():
+			// сервер, который не отвечает, хуже упавшего: пусть супервизор перезапустит
+			responder.Notify("STOPPING=1")
+			return fmt.Errorf("server failed: %w", err)
+		}
+		if sig == upgradeSignal {
+			// новый процесс получает копии сокетов, поэтому запросы не теряются
+			if *d.chrootDir != "" {
+				log.Printf("Upgrade is not supported with -chroot, restart the service instead")
+				continue
+			}
+			log.Printf("Received %v, starting new process", sig)
+			if err := responder.Upgrade(d.listeners, 30*time.Second); err != nil {
+				log.Printf("Upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+			log.Printf("New process is ready, shutting down")
+			d.handedOver = true
+			return nil
+		}
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down", sig)
+			responder.Notify("STOPPING=1")
+			return nil
+		}
+
+		// SIGHUP перечитывает статические записи и зонные файлы
+		responder.Notify("RELOADING=1")
+		if err := d.srv.DNSServer.LoadStatic(d.staticRecords, d.zoneFiles); err != nil {
+			log.Printf("Reload failed, keeping previous static records: %v", err)
+		} else {
+			log.Printf("Static records reloaded")
+		}
+		responder.Notify("READY=1")
+	}
+}
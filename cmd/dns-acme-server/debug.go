@@ -0,0 +1,65 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"dns-acme-server/fcgiapi"
+)
+
+// parseCIDRList разбирает список сетей через запятую; отдельный IP считается сетью /32 или /128
+func parseCIDRList(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", item, err)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// debugACL пропускает к обработчику только клиентов из разрешенных сетей
+func debugACL(allowed []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err == nil && ip != nil {
+			for _, network := range allowed {
+				if network.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		log.Printf("Debug endpoint %s rejected for %s", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// registerDebug подключает /debug/pprof/ и /debug/vars к mux листенера метрик
+func registerDebug(mux *http.ServeMux, allowed []*net.IPNet, usage *fcgiapi.UsageTracker) {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("records", expvar.Func(func() interface{} { return len(usage.List("")) }))
+
+	mux.Handle("/debug/pprof/", debugACL(allowed, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", debugACL(allowed, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", debugACL(allowed, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", debugACL(allowed, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", debugACL(allowed, http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/debug/vars", debugACL(allowed, expvar.Handler()))
+}
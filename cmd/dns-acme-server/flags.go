@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/dnsserver"
+)
+
+// stringList - флаг, который можно указывать несколько раз
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// addrList - список адресов через запятую, флаг можно повторять.
+// Первое явное значение заменяет значение по умолчанию.
+type addrList struct {
+	addrs []string
+	set   bool
+}
+
+func newAddrList(defaults ...string) *addrList {
+	return &addrList{addrs: defaults}
+}
+
+func (l *addrList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.addrs, ",")
+}
+
+func (l *addrList) Set(value string) error {
+	if !l.set {
+		l.addrs = nil
+		l.set = true
+	}
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			l.addrs = append(l.addrs, addr)
+		}
+	}
+	return nil
+}
+
+// withDefaultPort добавляет порт к адресу, если он не указан
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// parseSize разбирает размер вида 128MiB, 200MB, 1G или число байт
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1},
+	}
+	multiplier := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s = strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			multiplier = u.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// splitList разбирает список через запятую, пропуская пустые элементы
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseQuotaOverrides разбирает список name=N через запятую
+func parseQuotaOverrides(value string) (map[string]int, error) {
+	overrides := make(map[string]int)
+	for _, item := range splitList(value) {
+		name, limit, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || strings.TrimSpace(name) == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid quota %q, expected name=N", item)
+		}
+		overrides[strings.TrimSpace(name)] = n
+	}
+	return overrides, nil
+}
+
+// parseViews собирает представления из -view NAME=CIDR,... и записей -view-record NAME=RR,
+// -view-zone-file NAME=PATH; порядок представлений - порядок флагов -view
+func parseViews(specs, records, zoneFiles []string) ([]*dnsserver.View, error) {
+	var views []*dnsserver.View
+	byName := make(map[string]*dnsserver.View)
+	for _, spec := range specs {
+		name, networks, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid view %q, expected name=cidr,...", spec)
+		}
+		if byName[name] != nil {
+			return nil, fmt.Errorf("duplicate view %s", name)
+		}
+		nets, err := parseCIDRList(networks)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %v", name, err)
+		}
+		if len(nets) == 0 {
+			return nil, fmt.Errorf("view %s has no networks", name)
+		}
+		view := &dnsserver.View{Name: name, Networks: nets}
+		views = append(views, view)
+		byName[name] = view
+	}
+	for _, item := range records {
+		name, record, ok := strings.Cut(item, "=")
+		view := byName[strings.TrimSpace(name)]
+		if !ok || view == nil {
+			return nil, fmt.Errorf("invalid view record %q, expected a -view name=record", item)
+		}
+		view.Records = append(view.Records, record)
+	}
+	for _, item := range zoneFiles {
+		name, path, ok := strings.Cut(item, "=")
+		view := byName[strings.TrimSpace(name)]
+		if !ok || view == nil {
+			return nil, fmt.Errorf("invalid view zone file %q, expected a -view name=path", item)
+		}
+		view.ZoneFiles = append(view.ZoneFiles, strings.TrimSpace(path))
+	}
+	return views, nil
+}
+
+// parseZones собирает зоны из -zone ZONE=NS,..., клиентов -zone-tokens ZONE=NAME,...
+// и адреса -zone-listen ZONE=ADDR,...
+func parseZones(specs, tokens, listen []string) ([]*dnsserver.Zone, error) {
+	var zones []*dnsserver.Zone
+	byName := make(map[string]*dnsserver.Zone)
+	for _, spec := range specs {
+		name, nsList, ok := strings.Cut(spec, "=")
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid zone %q, expected zone=ns,...", spec)
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid zone name %q", name)
+		}
+		if byName[name] != nil {
+			return nil, fmt.Errorf("duplicate zone %s", name)
+		}
+		zone := &dnsserver.Zone{Name: name, NS: splitList(nsList)}
+		if len(zone.NS) == 0 {
+			return nil, fmt.Errorf("zone %s has no NS names", name)
+		}
+		for _, ns := range zone.NS {
+			if _, ok := dns.IsDomainName(ns); !ok {
+				return nil, fmt.Errorf("zone %s: invalid NS name %q", name, ns)
+			}
+		}
+		zones = append(zones, zone)
+		byName[name] = zone
+	}
+	for _, item := range tokens {
+		name, list, ok := strings.Cut(item, "=")
+		zone := byName[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))]
+		if !ok || zone == nil {
+			return nil, fmt.Errorf("invalid zone tokens %q, expected a -zone name=token,...", item)
+		}
+		zone.Tokens = append(zone.Tokens, splitList(list)...)
+	}
+	for _, item := range listen {
+		name, list, ok := strings.Cut(item, "=")
+		zone := byName[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))]
+		if !ok || zone == nil {
+			return nil, fmt.Errorf("invalid zone listen address %q, expected a -zone name=addr,...", item)
+		}
+		for _, addr := range splitList(list) {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("zone %s: invalid listen address %q, expected host:port", name, addr)
+			}
+			zone.Listen = append(zone.Listen, addr)
+		}
+	}
+	return zones, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"dns-acme-server/k8s"
+	"dns-acme-server/storage"
+)
+
+// podIdentity - имя реплики для Lease: POD_NAME из downward API или имя хоста
+func podIdentity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// sweepConfigMap удаляет забытые записи раз в минуту, пока реплика остается лидером;
+// encrypted (может быть nil) расшифровывает значения для наблюдателей
+func sweepConfigMap(records *k8s.ConfigMapStorage, manager *storage.RecordManager, encrypted *storage.Encrypted, maxAge time.Duration, stop <-chan struct{}) {
+	expired := manager.Expired
+	if encrypted != nil {
+		expired = func(name, value string) {
+			manager.Expired(name, encrypted.Reveal(name, value))
+		}
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		removed, err := records.Sweep(maxAge, expired)
+		if err != nil {
+			log.Printf("ConfigMap cleanup failed: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Removed %d records older than %v from the ConfigMap", removed, maxAge)
+		}
+	}
+}
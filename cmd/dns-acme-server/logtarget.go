@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Уровни syslog (RFC 5424), которыми помечаются строки журнала
+const (
+	severityErr     = 3
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// logSeverity определяет уровень строки по ее тексту: демон пишет журнал через log.Printf
+// без уровней, ошибки и отказы узнаются по словам в сообщении
+func logSeverity(line string) int {
+	for _, word := range strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		switch word {
+		case "failed", "error":
+			return severityErr
+		}
+	}
+	lower := strings.ToLower(line)
+	for _, marker := range []string{"rejected", "invalid", "ignoring", "skipping", "pressure", "did not"} {
+		if strings.Contains(lower, marker) {
+			return severityWarning
+		}
+	}
+	return severityInfo
+}
+
+// journalWriter добавляет к строкам префикс <N> (sd-daemon(3)), по которому journald
+// выставляет приоритет; время не пишется, его ставит сам journald
+type journalWriter struct {
+	out io.Writer
+}
+
+func (w journalWriter) Write(p []byte) (int, error) {
+	if _, err := fmt.Fprintf(w.out, "<%d>%s", logSeverity(string(p)), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setupLogging направляет журнал в target: stderr, syslog или journald. Если stderr
+// подключен к journald (systemd выставляет JOURNAL_STREAM), stderr работает как journald.
+func setupLogging(target, syslogAddr, facility string) error {
+	switch target {
+	case "stderr":
+		if stderrIsJournal() {
+			log.SetFlags(0)
+			log.SetOutput(journalWriter{os.Stderr})
+		}
+	case "journald":
+		log.SetFlags(0)
+		log.SetOutput(journalWriter{os.Stderr})
+	case "syslog":
+		w, err := openSyslog(syslogAddr, facility)
+		if err != nil {
+			return err
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	default:
+		return fmt.Errorf("unknown log target %q, expected stderr, syslog or journald", target)
+	}
+	return nil
+}
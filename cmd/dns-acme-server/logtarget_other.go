@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog: syslog на этой платформе не поддерживается
+func openSyslog(addr, facility string) (io.Writer, error) {
+	return nil, errors.New("-log-target syslog is not supported on this platform")
+}
+
+func stderrIsJournal() bool {
+	return false
+}
@@ -0,0 +1,405 @@
+// Команда dns-acme-server - демон, отвечающий на DNS-01 challenge для модуля acme Angie.
+// Сам responder живет в пакете responder и может быть встроен в другую программу.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"dns-acme-server/dnsserver"
+	"dns-acme-server/fcgiapi"
+	"dns-acme-server/storage"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hook" {
+		os.Exit(runHookCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtlCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		os.Exit(runCtlCommand(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-compliance" {
+		os.Exit(runComplianceCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench-serve" {
+		os.Exit(runBenchServeCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		os.Exit(runServiceCommand(os.Args[2:]))
+	}
+	os.Exit(runDaemon())
+}
+
+// runDaemon разбирает флаги из os.Args и работает до сигнала остановки
+// (или закрытия serviceStop, если демон запущен менеджером служб); возвращает код выхода
+func runDaemon() int {
+	// validate принимает те же флаги, что и демон, но только проверяет конфигурацию
+	validateOnly := len(os.Args) > 1 && os.Args[1] == "validate"
+	if validateOnly {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	f := defineDaemonFlags()
+	flag.Parse()
+
+	build := currentBuild()
+	if *f.showVersion {
+		fmt.Printf("dns-acme-server %s\n", build)
+		return 0
+	}
+	envCount, err := applyEnvFlags()
+	if err != nil {
+		log.Printf("Invalid environment configuration: %v", err)
+		return 1
+	}
+	if envCount > 0 {
+		log.Printf("Loaded %d options from %s* environment variables", envCount, envPrefix)
+	}
+	if *f.configFile != "" {
+		count, err := loadConfigFile(*f.configFile)
+		if err != nil {
+			log.Printf("Failed to load config: %v", err)
+			return 1
+		}
+		log.Printf("Loaded %d options from %s", count, *f.configFile)
+	}
+	if *f.k8sMode && !setFlags()["storage"] {
+		*f.storageBackend = "configmap"
+	}
+	if validateOnly {
+		return runValidate()
+	}
+	if err := setupLogging(*f.logTarget, *f.syslogAddr, *f.syslogFacility); err != nil {
+		log.Printf("Invalid -log-target: %v", err)
+		return 1
+	}
+
+	d := &daemon{daemonFlags: f, build: build, configWatcher: &ConfigWatcher{}}
+	if err := d.run(); err != nil {
+		log.Printf("Stopped: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// daemonFlags - флаги демона; указатели заполняет flag.Parse
+type daemonFlags struct {
+	logTarget            *string
+	syslogAddr           *string
+	syslogFacility       *string
+	configFile           *string
+	fastcgiAddrs         *addrList
+	dnsAddrs             *addrList
+	publicAddr           *string
+	publicProbeZone      *string
+	publicProbeURL       *string
+	dnsPort              *int
+	fastcgiPort          *int
+	bindRetry            *time.Duration
+	dnsFallbackPort      *int
+	apiAddr              *string
+	apiTLSCert           *string
+	apiTLSKey            *string
+	tlsExpiryWarning     *time.Duration
+	apiClientCA          *string
+	apiClientAllowed     *string
+	acmeDirectory        *string
+	acmeEmail            *string
+	acmeDomains          *string
+	acmeCacheDir         *string
+	acmeRenewBefore      *time.Duration
+	certManagerGroup     *string
+	certManagerSolver    *string
+	grpcAddr             *string
+	apiUI                *bool
+	apiTokensFile        *string
+	authPlugin           *string
+	authPluginConfig     *string
+	tsigKey              *string
+	qtypePolicy          *string
+	forwardUpstream      *string
+	transferZone         *string
+	transferAllow        *string
+	notifyAddrs          *string
+	secondaryOf          *string
+	fallbackUpstream     *string
+	anyPolicy            *string
+	staticRecords        stringList
+	apexTXT              stringList
+	nsName               *string
+	nsAddrs              stringList
+	caaPolicies          stringList
+	maxFormSize          *string
+	maxValueLength       *int
+	responseFormat       *string
+	memoryLimit          *string
+	gcPercent            *int
+	memoryPressure       *float64
+	recordHistory        *int
+	auditLogPath         *string
+	allowedDomains       *string
+	allowedDomainsFile   *string
+	allowAnyValue        *bool
+	accountThumbprints   *string
+	digestInput          *bool
+	noAutoPrefix         *bool
+	challengePrefix      *string
+	maxRecords           *int
+	maxRecordsPerToken   *int
+	tenantsFile          *string
+	rotateGrace          *time.Duration
+	registerZone         *string
+	registerFile         *string
+	registerAllow        *string
+	registerMaxRecords   *int
+	tokenQuotas          *string
+	changeRate           *int
+	changeBurst          *int
+	geoipDBs             stringList
+	asnDB                *string
+	removeDelay          *time.Duration
+	retryQueuePath       *string
+	retryMaxAge          *time.Duration
+	requestTimeout       *time.Duration
+	strictMutations      *bool
+	changeHooks          stringList
+	changeHookEnv        stringList
+	changeHookTimeout    *time.Duration
+	eventWebhooks        stringList
+	eventWebhookSecret   *string
+	successWebhook       *string
+	zoneFiles            stringList
+	zoneSpecs            stringList
+	zoneTokens           stringList
+	zoneListen           stringList
+	viewSpecs            stringList
+	viewRecords          stringList
+	viewZoneFiles        stringList
+	propagationServers   *string
+	propagationTimeout   *time.Duration
+	txtTTLFlag           *uint
+	negativeTTL          *int
+	dnsWorkers           *int
+	dnsQueryTimeout      *time.Duration
+	dnsTCPMaxConns       *int
+	dnsTCPIdleTimeout    *time.Duration
+	dnsTCPMaxQueries     *int
+	dnsCookies           *string
+	dnsCookieSecret      *string
+	dnsMaxUDPSize        *int
+	dnsCacheSize         *int
+	dnsCacheMaxAge       *time.Duration
+	storageBackend       *string
+	readOnly             *bool
+	storageTimeout       *time.Duration
+	storageDSN           *string
+	storageEncryptionKey *string
+	storageMaxOpen       *int
+	storageMaxIdle       *int
+	storageConnLifetime  *time.Duration
+	pushgatewayURL       *string
+	pushgatewayJob       *string
+	statsdAddr           *string
+	statsdPrefix         *string
+	statsdTags           *bool
+	metricsPushInterval  *time.Duration
+	metricsAddr          *string
+	debugEndpoints       *bool
+	debugAllow           *string
+	otlpEndpoint         *string
+	otlpService          *string
+	dnstapTarget         *string
+	dnstapIdentity       *string
+	accessLogPath        *string
+	accessLogMaxSize     *string
+	accessLogMaxAge      *time.Duration
+	accessLogMaxBackups  *int
+	runUser              *string
+	runGroup             *string
+	chrootDir            *string
+	k8sMode              *bool
+	k8sConfigMap         *string
+	k8sLease             *string
+	k8sLeaseDuration     *time.Duration
+	k8sRecordMaxAge      *time.Duration
+	consulAddr           *string
+	consulToken          *string
+	consulPrefix         *string
+	consulRegister       *bool
+	consulServiceName    *string
+	vaultAddr            *string
+	vaultToken           *string
+	vaultNamespace       *string
+	vaultRoleID          *string
+	vaultSecretID        *string
+	vaultAppRoleMount    *string
+	vaultRefresh         *time.Duration
+	showVersion          *bool
+	hideVersion          *bool
+}
+
+// defineDaemonFlags регистрирует флаги демона в flag.CommandLine
+func defineDaemonFlags() *daemonFlags {
+	f := &daemonFlags{}
+	f.logTarget = flag.String("log-target", "stderr", "Where to write the log: stderr (with journald priorities when stderr is the journal), syslog or journald")
+	f.syslogAddr = flag.String("syslog-addr", "", "Syslog server for -log-target syslog, e.g. udp://192.0.2.10:514 (empty uses the local syslog)")
+	f.syslogFacility = flag.String("syslog-facility", "daemon", "Syslog facility for -log-target syslog")
+	f.configFile = flag.String("config", "", "Configuration file with \"flag-name = value\" lines for flags not given on the command line")
+	f.fastcgiAddrs = newAddrList("127.0.0.1:9000")
+	flag.Var(f.fastcgiAddrs, "fastcgi-addr", "FastCGI addresses to listen on (comma-separated or repeated)")
+	f.dnsAddrs = newAddrList("0.0.0.0:53")
+	flag.Var(f.dnsAddrs, "dns-addr", "DNS addresses to listen on (comma-separated or repeated), e.g. 0.0.0.0:53,[::]:53 or 192.0.2.1:53@eth0")
+	f.publicAddr = flag.String("public-addr", "", "Public DNS address of this server, e.g. 203.0.113.10 or 203.0.113.10:53 when -dns-addr is another port behind DNAT; probed at startup (empty disables)")
+	f.publicProbeZone = flag.String("public-probe-zone", "", "Zone delegated to this server, e.g. acme.example.com; the -public-addr probe record is created under it")
+	f.publicProbeURL = flag.String("public-probe-url", "", "DNS over HTTPS resolver to probe -public-probe-zone from outside, e.g. https://dns.google/dns-query (empty probes -public-addr directly only)")
+	f.dnsPort = flag.Int("dns-port", 0, "Port for every -dns-addr address, e.g. ANGIE_DNS_FCGI_DNS_PORT=5353 in a container (0 keeps the ports of -dns-addr)")
+	f.fastcgiPort = flag.Int("fastcgi-port", 0, "Port for every -fastcgi-addr address (0 keeps the ports of -fastcgi-addr)")
+	f.bindRetry = flag.Duration("bind-retry", 0, "Keep retrying to bind the listeners for this long, e.g. 30s while a container network namespace is being set up (0 fails at once)")
+	f.dnsFallbackPort = flag.Int("dns-fallback-port", 0, "Listen on this port of the same host when a -dns-addr port is taken or needs privileges, e.g. 5353 behind a port redirect (0 fails instead)")
+	f.apiAddr = flag.String("api-addr", "", "HTTP management API address, e.g. 127.0.0.1:8053 or unix:/run/dns-acme/api.sock (empty disables)")
+	f.apiTLSCert = flag.String("api-tls-cert", "", "TLS certificate file for the HTTP API (enables HTTPS), or vault:path#field")
+	f.apiTLSKey = flag.String("api-tls-key", "", "TLS private key file for the HTTP API, or vault:path#field of the same secret as -api-tls-cert")
+	f.tlsExpiryWarning = flag.Duration("tls-expiry-warning", 14*24*time.Hour, "Log a warning when the HTTP API certificate expires sooner than this")
+	f.apiClientCA = flag.String("api-client-ca", "", "PEM CA bundle; if set, HTTP API clients must present a certificate signed by it (mTLS, requires TLS)")
+	f.apiClientAllowed = flag.String("api-client-allowed", "", "Comma-separated client certificate SANs allowed with -api-client-ca: DNS names (*.suffix), emails or URIs (empty allows any)")
+	f.acmeDirectory = flag.String("acme-directory", "", "ACME directory URL to obtain the HTTP API certificate from via DNS-01 served by this daemon, e.g. https://acme-v02.api.letsencrypt.org/directory (empty disables)")
+	f.acmeEmail = flag.String("acme-email", "", "Contact email of the ACME account")
+	f.acmeDomains = flag.String("acme-domains", "", "Comma-separated names of the self-provisioned certificate")
+	f.acmeCacheDir = flag.String("acme-cache-dir", "/var/lib/dns-acme/acme", "Directory for the ACME account key and the obtained certificate")
+	f.acmeRenewBefore = flag.Duration("acme-renew-before", 30*24*time.Hour, "Renew the self-provisioned certificate this long before it expires")
+	f.certManagerGroup = flag.String("certmanager-group", "", "API group of the cert-manager webhook solver, e.g. acme.example.com (empty disables)")
+	f.certManagerSolver = flag.String("certmanager-solver", "angie-dns", "Solver name of the cert-manager webhook")
+	f.grpcAddr = flag.String("grpc-addr", "", "gRPC management API address, e.g. 127.0.0.1:8054 (empty disables); uses the TLS, client CA and tokens of the HTTP API")
+	f.apiUI = flag.Bool("api-ui", false, "Serve the admin web UI on /ui/ of the HTTP API: live records, recent DNS queries, hook history, health and manual add/remove")
+	f.apiTokensFile = flag.String("api-tokens-file", "", "File with name:token lines required for HTTP API requests (Basic or Bearer auth)")
+	f.authPlugin = flag.String("auth-plugin", "", "Go plugin (.so) exporting NewAuthenticator that checks HTTP and gRPC API clients, after -api-tokens-file")
+	f.authPluginConfig = flag.String("auth-plugin-config", "", "Configuration string passed to NewAuthenticator of -auth-plugin")
+	f.tsigKey = flag.String("tsig-key", "", "TSIG key for RFC 2136 updates, [alg:]name:secret, file:/path or vault:path#field (empty disables updates)")
+	f.qtypePolicy = flag.String("qtype-policy", "", "Actions for non-TXT queries to owned names, e.g. A=static,AAAA=forward,default=nodata")
+	f.forwardUpstream = flag.String("forward-upstream", "", "Upstream resolver for the forward policy action")
+	f.transferZone = flag.String("transfer-zone", "", "Zone with the challenge records to serve to secondaries via AXFR/IXFR, or to pull with -secondary-of, e.g. acme.example.com")
+	f.transferAllow = flag.String("transfer-allow", "", "Comma-separated networks allowed to transfer -transfer-zone (requests signed with -tsig-key are always allowed)")
+	f.notifyAddrs = flag.String("notify", "", "Comma-separated secondaries (host:port) to send NOTIFY to when records of -transfer-zone change")
+	f.secondaryOf = flag.String("secondary-of", "", "Primary server (host:port) to copy the TXT records of -transfer-zone from via IXFR/AXFR")
+	f.fallbackUpstream = flag.String("fallback-upstream", "", "Resolver to forward TXT queries for names this server does not manage to, instead of an empty answer (e.g. the old DNS during migration)")
+	f.anyPolicy = flag.String("any-policy", "hinfo", "Answer to ANY queries for owned names: hinfo (RFC 8482 minimal answer), full (all records) or empty")
+	flag.Var(&f.staticRecords, "static-record", "Static record in zone file format (repeatable)")
+	flag.Var(&f.apexTXT, "apex-txt", `TXT record at a zone apex served together with dynamic TXT records, ZONE=TEXT, e.g. "acme.example.com=v=spf1 -all" (repeatable)`)
+	f.nsName = flag.String("ns-name", "", "Name of this server in the NS delegation, e.g. ns.acme.example.com, to answer its own A/AAAA")
+	flag.Var(&f.nsAddrs, "ns-addr", "IPv4 or IPv6 address returned for -ns-name (repeatable)")
+	flag.Var(&f.caaPolicies, "caa", `CAA policy domain=[flags] tag value, e.g. example.com=issue "letsencrypt.org" ("." for default, "none" for empty answer; repeatable)`)
+	f.maxFormSize = flag.String("max-form-size", "1MiB", "Reject FastCGI hooks whose QUERY_STRING or body is larger than this with 413")
+	f.maxValueLength = flag.Int("max-value-length", fcgiapi.DefaultMaxValueLength, "Reject FastCGI hooks with a longer ACME_KEYAUTH with 413")
+	f.responseFormat = flag.String("response-format", "text", "FastCGI response format: text or json (json is also used for Accept: application/json)")
+	f.memoryLimit = flag.String("memory-limit", "", "Soft memory limit like GOMEMLIMIT, e.g. 96MiB (empty keeps runtime default)")
+	f.gcPercent = flag.Int("gc-percent", 0, "GC target percentage like GOGC (0 keeps runtime default, -1 disables GC)")
+	f.memoryPressure = flag.Float64("memory-pressure", 0.8, "Fraction of the memory limit at which caches are shrunk")
+	f.recordHistory = flag.Int("record-history", 10, "Changes per name kept in memory for GET /history and POST /rollback of the HTTP API (0 disables)")
+	f.auditLogPath = flag.String("audit-log", "", "Append-only JSON lines file recording every record add/remove (queryable via GET /audit)")
+	f.allowedDomains = flag.String("allowed-domains", "", "Comma-separated domains whose _acme-challenge records may be published: exact names and *.suffix entries; =name allows a record name as is (empty allows any)")
+	f.allowedDomainsFile = flag.String("allowed-domains-file", "", "File with -allowed-domains entries, one per line; reloaded automatically when it changes")
+	f.allowAnyValue = flag.Bool("allow-any-value", false, "Accept any TXT value instead of requiring a 43 character base64url SHA-256 key authorization digest")
+	f.accountThumbprints = flag.String("account-thumbprint", "", "Comma-separated ACME account key thumbprints (RFC 7638); a full token.thumbprint key authorization passed instead of the digest must end with one of them and is published as its digest")
+	f.digestInput = flag.Bool("digest-input", false, "Publish the SHA-256 digest of values that look like a full token.thumbprint key authorization instead of rejecting them")
+	f.noAutoPrefix = flag.Bool("no-auto-prefix", false, "Treat FastCGI ACME_DOMAIN as the full record name instead of prepending -challenge-prefix")
+	f.challengePrefix = flag.String("challenge-prefix", storage.DefaultChallengePrefix, "Label(s) prepended to domains to form the TXT record name, e.g. _delegation_challenge for other TXT validation schemes")
+	f.maxRecords = flag.Int("max-records", 0, "Maximum number of published TXT values; adds beyond it fail with 507 (0 is unlimited)")
+	f.maxRecordsPerToken = flag.Int("max-records-per-token", 0, "Maximum number of TXT values one API token or TSIG key may publish; adds beyond it fail with 429 (0 is unlimited)")
+	f.tenantsFile = flag.String("tenants-file", "", "JSON file with tenants: clients changing records only in their own namespace, with a shared quota; reloaded automatically when it changes")
+	f.rotateGrace = flag.Duration("rotate-grace", 24*time.Hour, "How long the previous secret stays valid after POST /credentials/rotate, also the largest ?grace= a client may ask for")
+	f.registerZone = flag.String("register-zone", "", "Enable POST /register: each registration gets credentials and a random subdomain of this zone to CNAME _acme-challenge records to, like acme-dns")
+	f.registerFile = flag.String("register-file", "", "JSON file keeping -register-zone accounts with hashed passwords")
+	f.registerAllow = flag.String("register-allow", "", "Comma-separated networks allowed to call POST /register, e.g. 0.0.0.0/0,::/0 for anyone (empty denies all)")
+	f.registerMaxRecords = flag.Int("register-max-records", 2, "TXT values one registered account may publish (0 falls back to -max-records-per-token)")
+	f.tokenQuotas = flag.String("token-quota", "", "Per-token overrides of -max-records-per-token, e.g. ci=100,dev=5")
+	f.changeRate = flag.Int("change-rate", 0, "Maximum record changes per minute per API token, TSIG key or client IP; changes beyond it fail with 429 (0 is unlimited)")
+	f.changeBurst = flag.Int("change-burst", 0, "Number of changes a client may make at once under -change-rate (0 is the per-minute rate)")
+	flag.Var(&f.geoipDBs, "geoip-db", "MaxMind DB (GeoLite2-Country, -City or -ASN .mmdb) to tag DNS query logs, traces and metrics with the resolver's country and ASN (repeatable)")
+	f.asnDB = flag.String("asn-db", "", "iptoasn.com table (ip2asn-combined.tsv[.gz]) to show which autonomous systems queried each challenge in GET /records")
+	f.removeDelay = flag.Duration("remove-delay", 0, "Keep serving a removed TXT record this long before deleting it, for CAs that re-check after cleanup, e.g. 30s (0 removes at once)")
+	f.retryQueuePath = flag.String("retry-queue", "", "File of a local queue for record changes that failed because the storage was unreachable; such hooks get 202 Accepted and the change is retried with backoff (empty disables)")
+	f.retryMaxAge = flag.Duration("retry-max-age", time.Hour, "Drop queued changes older than this instead of applying them (0 keeps them forever)")
+	f.requestTimeout = flag.Duration("request-timeout", 30*time.Second, "Fail a hook or API record change with 504 when it takes longer than this, including waiting for storage (0 disables)")
+	f.strictMutations = flag.Bool("strict-mutations", false, "Make add fail with 409 if the name holds a different value and remove require the matching keyauth (ACME_FORCE=1 or ?force=1 overrides)")
+	flag.Var(&f.changeHooks, "change-hook", "Command or webhook to run on record changes, STAGE=COMMAND or STAGE=URL with stage pre-add, post-add, pre-remove or post-remove; a failing pre hook rejects the change (repeatable)")
+	flag.Var(&f.changeHookEnv, "change-hook-env", "KEY=VALUE added to the environment of -change-hook commands (repeatable)")
+	f.changeHookTimeout = flag.Duration("change-hook-timeout", 10*time.Second, "Time limit of one -change-hook run; a pre hook that times out rejects the change")
+	flag.Var(&f.eventWebhooks, "event-webhook", "URL to POST a JSON event to on every record add, remove and expiry (repeatable)")
+	f.eventWebhookSecret = flag.String("event-webhook-secret", "", "HMAC-SHA256 key for the X-Signature-256 header of -event-webhook requests (or file:/path, vault:path#field)")
+	f.successWebhook = flag.String("success-webhook", "", "URL to POST a JSON event to after a challenge was added, queried and removed")
+	flag.Var(&f.zoneFiles, "zone-file", "Zone file with static records to serve (repeatable)")
+	flag.Var(&f.zoneSpecs, "zone", "Zone delegated to this server, ZONE=NS,... with its NS names; SOA and NS are served at its apex and records outside the zones cannot be changed (repeatable)")
+	flag.Var(&f.zoneTokens, "zone-tokens", "Clients allowed to change records of a -zone, ZONE=NAME,... with API token names, TSIG key names or cert:SAN (repeatable; unlisted zones allow any client)")
+	flag.Var(&f.zoneListen, "zone-listen", "Extra DNS address answering only a -zone, ZONE=ADDR,..., e.g. acme.customer.example=203.0.113.11:53 (repeatable)")
+	flag.Var(&f.viewSpecs, "view", "Split-horizon view NAME=CIDR,... whose clients also see its own static records; the first matching view wins (repeatable)")
+	flag.Var(&f.viewRecords, "view-record", "Static record of a view, NAME=record in zone file format (repeatable)")
+	flag.Var(&f.viewZoneFiles, "view-zone-file", "Zone file with static records of a view, NAME=path (repeatable)")
+	f.propagationServers = flag.String("propagation-check", "", `Before answering add hooks, wait until the TXT is visible on these servers, e.g. 1.1.1.1,8.8.8.8 ("ns" for the zone's NS set; empty disables)`)
+	f.propagationTimeout = flag.Duration("propagation-timeout", 60*time.Second, "How long add hooks wait for propagation")
+	f.txtTTLFlag = flag.Uint("txt-ttl", storage.DefaultTXTTTL, "TTL of dynamic TXT answers in seconds (ACME_TTL overrides per record)")
+	f.negativeTTL = flag.Int("negative-ttl", -1, "TTL of the SOA added to empty answers of names in -transfer-zone or under static NS records without a static zone SOA, and the cap on the negative TTL of static SOAs (-1: only static SOAs are added)")
+	f.dnsWorkers = flag.Int("dns-workers", 256, "Maximum number of DNS queries handled concurrently (0 is unlimited)")
+	f.dnsQueryTimeout = flag.Duration("dns-query-timeout", 2*time.Second, "Answer SERVFAIL when a DNS query waits longer than this for a worker or storage (0 disables)")
+	f.dnsTCPMaxConns = flag.Int("dns-tcp-max-conns", 1000, "Maximum concurrent TCP DNS connections; extra connections are reset right after accept (0 is unlimited)")
+	f.dnsTCPIdleTimeout = flag.Duration("dns-tcp-idle-timeout", 8*time.Second, "Close TCP DNS connections idle for this long")
+	f.dnsTCPMaxQueries = flag.Int("dns-tcp-max-queries", 128, "Maximum queries on one TCP DNS connection (-1 is unlimited)")
+	f.dnsCookies = flag.String("dns-cookies", "on", "DNS Cookies (RFC 7873): off, on (issue server cookies) or require (BADCOOKIE to UDP clients with a cookie but no valid server cookie)")
+	f.dnsCookieSecret = flag.String("dns-cookie-secret", "", "16-byte hex secret for server cookies, shared by replicas behind one address, or file:/path, vault:path#field (empty generates a random one)")
+	f.dnsMaxUDPSize = flag.Int("dns-max-udp-size", dnsserver.DefaultMaxUDPSize, "Largest UDP response advertised in EDNS; larger answers are truncated with TC so clients retry over TCP")
+	f.dnsCacheSize = flag.Int("dns-cache-size", 4096, "Number of packed DNS responses to cache for hot names (0 disables)")
+	f.dnsCacheMaxAge = flag.Duration("dns-cache-max-age", time.Second, "Maximum age of a cached DNS response; changes made by this process invalidate it immediately")
+	f.storageBackend = flag.String("storage", "memory", "Record storage: "+storage.Backends()+", configmap (Kubernetes), consul, plugin:PATH (Go plugin exporting NewStorage, configured by -storage-dsn)")
+	f.readOnly = flag.Bool("read-only", false, "Serve DNS from a shared storage backend filled by other instances and reject all record changes (edge replica)")
+	f.storageTimeout = flag.Duration("storage-timeout", 10*time.Second, "Fail a single SQL, ConfigMap or Consul storage operation that takes longer than this (0 disables)")
+	f.storageDSN = flag.String("storage-dsn", "", "Storage connection string, e.g. /var/lib/dns-acme/records.db for sqlite or postgres://user:pass@db/acme")
+	f.storageEncryptionKey = flag.String("storage-encryption-key", "", "Encrypt record values in SQL, ConfigMap or Consul storage with this 32 byte key in hex or base64, or an age identity (or file:/path, vault:path#field)")
+	f.storageMaxOpen = flag.Int("storage-max-open-conns", 10, "Maximum open connections to the SQL storage")
+	f.storageMaxIdle = flag.Int("storage-max-idle-conns", 2, "Maximum idle connections to the SQL storage")
+	f.storageConnLifetime = flag.Duration("storage-conn-max-lifetime", 30*time.Minute, "Maximum lifetime of a SQL storage connection (0 keeps connections forever)")
+	f.pushgatewayURL = flag.String("pushgateway-url", "", "Prometheus Pushgateway to push metrics to every -metrics-push-interval, e.g. http://pushgateway:9091 (empty disables)")
+	f.pushgatewayJob = flag.String("pushgateway-job", "dns-acme-server", "Job name of the Pushgateway group; the instance is the host name")
+	f.statsdAddr = flag.String("statsd-addr", "", "statsd or DogStatsD UDP address to send metrics to every -metrics-push-interval, e.g. 127.0.0.1:8125 (empty disables)")
+	f.statsdPrefix = flag.String("statsd-prefix", "", "Prefix of statsd metric names, e.g. acme.")
+	f.statsdTags = flag.Bool("statsd-tags", false, "Send labels as DogStatsD tags instead of appending label values to statsd metric names")
+	f.metricsPushInterval = flag.Duration("metrics-push-interval", 15*time.Second, "Interval of pushing metrics to -pushgateway-url and -statsd-addr")
+	f.metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on /metrics, e.g. 127.0.0.1:9153 (empty disables)")
+	f.debugEndpoints = flag.Bool("debug-endpoints", false, "Serve net/http/pprof on /debug/pprof/ and expvar on /debug/vars on the metrics listener")
+	f.debugAllow = flag.String("debug-allow", "127.0.0.1,::1", "Comma-separated IPs or networks allowed to use the debug endpoints")
+	f.otlpEndpoint = flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export traces to, e.g. http://127.0.0.1:4318 (empty disables)")
+	f.otlpService = flag.String("otlp-service-name", envOr("OTEL_SERVICE_NAME", "dns-acme-server"), "service.name reported in exported traces")
+	f.dnstapTarget = flag.String("dnstap", "", "Write dnstap of all DNS queries and responses to unix:/path/to/socket or a file (empty disables)")
+	f.dnstapIdentity = flag.String("dnstap-identity", "", "dnstap identity field (default: hostname)")
+	f.accessLogPath = flag.String("access-log", "", "JSON lines access log of FastCGI and HTTP API requests (empty disables)")
+	f.accessLogMaxSize = flag.String("access-log-max-size", "", "Rotate the access log when it exceeds this size, e.g. 100MiB (empty disables)")
+	f.accessLogMaxAge = flag.Duration("access-log-max-age", 0, "Rotate the access log when it is older than this, e.g. 24h (0 disables)")
+	f.accessLogMaxBackups = flag.Int("access-log-max-backups", 7, "Number of rotated access logs to keep (0 keeps all)")
+	f.runUser = flag.String("user", "", "Switch to this user after binding sockets (requires starting as root)")
+	f.runGroup = flag.String("group", "", "Switch to this group after binding sockets (default: primary group of -user)")
+	f.chrootDir = flag.String("chroot", "", "Chroot into this directory after binding sockets")
+	f.k8sMode = flag.Bool("k8s", false, "Kubernetes mode: store records in a ConfigMap unless -storage is given, elect a leader via a Lease")
+	f.k8sConfigMap = flag.String("k8s-configmap", "dns-acme-records", "ConfigMap holding the records with -storage configmap")
+	f.k8sLease = flag.String("k8s-lease", "dns-acme-leader", "Lease used for leader election in -k8s mode")
+	f.k8sLeaseDuration = flag.Duration("k8s-lease-duration", 15*time.Second, "How long the leader Lease stays valid without renewal")
+	f.k8sRecordMaxAge = flag.Duration("k8s-record-max-age", 24*time.Hour, "The leader removes ConfigMap records older than this that clients never cleaned up (0 disables)")
+	f.consulAddr = flag.String("consul-addr", envOr("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500"), "Consul agent HTTP API address for -storage consul and -consul-register")
+	f.consulToken = flag.String("consul-token", os.Getenv("CONSUL_HTTP_TOKEN"), "Consul ACL token (or file:/path, vault:path#field)")
+	f.consulPrefix = flag.String("consul-prefix", "dns-acme/records", "Consul KV prefix holding the records with -storage consul")
+	f.consulRegister = flag.Bool("consul-register", false, "Register the DNS service in the Consul catalog with a TCP health check and deregister it on shutdown")
+	f.consulServiceName = flag.String("consul-service", "dns-acme", "Service name for -consul-register")
+	f.vaultAddr = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Vault address for vault:path#field secret references, e.g. https://vault:8200 (empty disables)")
+	f.vaultToken = flag.String("vault-token", os.Getenv("VAULT_TOKEN"), "Vault token, renewed while running (or file:/path)")
+	f.vaultNamespace = flag.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace")
+	f.vaultRoleID = flag.String("vault-role-id", "", "AppRole role_id to log in to Vault instead of -vault-token")
+	f.vaultSecretID = flag.String("vault-secret-id", "", "AppRole secret_id (or file:/path)")
+	f.vaultAppRoleMount = flag.String("vault-approle-mount", "approle", "Mount path of the AppRole auth method")
+	f.vaultRefresh = flag.Duration("vault-refresh", 5*time.Minute, "How often to re-read secrets from Vault; leased secrets are re-read after 2/3 of the lease")
+
+	f.showVersion = flag.Bool("version", false, "Print the build version and exit")
+	f.hideVersion = flag.Bool("hide-version", false, "Refuse CH TXT version.bind and version.server queries instead of answering with the build version")
+	return f
+}
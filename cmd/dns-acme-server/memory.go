@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// MemoryGuard следит за размером кучи и при приближении к лимиту
+// просит подсистемы освободить память (сжать кэши, укоротить историю)
+type MemoryGuard struct {
+	limit     int64
+	threshold float64
+
+	mutex    sync.Mutex
+	handlers []func()
+}
+
+// ConfigureMemory применяет -memory-limit и -gc-percent и возвращает действующий лимит.
+// limit <= 0 и gcPercent == 0 оставляют значения рантайма (в том числе GOMEMLIMIT/GOGC).
+func ConfigureMemory(limit int64, gcPercent int) int64 {
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+	}
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+	}
+	// отрицательное значение только читает текущий лимит
+	return debug.SetMemoryLimit(-1)
+}
+
+func NewMemoryGuard(limit int64, threshold float64) *MemoryGuard {
+	return &MemoryGuard{
+		limit:     limit,
+		threshold: threshold,
+	}
+}
+
+// OnPressure регистрирует обработчик нехватки памяти
+func (g *MemoryGuard) OnPressure(f func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.handlers = append(g.handlers, f)
+}
+
+// Run периодически проверяет кучу, пока не закрыт stop
+func (g *MemoryGuard) Run(interval time.Duration, stop <-chan struct{}) {
+	if g.limit <= 0 || g.limit == math.MaxInt64 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			g.check()
+		}
+	}
+}
+
+func (g *MemoryGuard) check() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if float64(stats.HeapAlloc) < float64(g.limit)*g.threshold {
+		return
+	}
+
+	log.Printf("Memory pressure: heap %d bytes of %d limit, shrinking caches", stats.HeapAlloc, g.limit)
+	g.mutex.Lock()
+	handlers := append([]func(){}, g.handlers...)
+	g.mutex.Unlock()
+	for _, f := range handlers {
+		f()
+	}
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// DropPrivileges на этой платформе не поддерживается
+func DropPrivileges(userName, groupName, chroot string) error {
+	if userName == "" && groupName == "" && chroot == "" {
+		return nil
+	}
+	return fmt.Errorf("-user, -group and -chroot are not supported on this platform")
+}
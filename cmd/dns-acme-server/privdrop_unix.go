@@ -0,0 +1,74 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges переключает процесс на непривилегированного пользователя
+// (и, если задано, выполняет chroot). Вызывается после открытия сокетов и файлов,
+// для которых нужен root. Пустой userName - ничего не делать.
+func DropPrivileges(userName, groupName, chroot string) error {
+	if userName == "" && groupName == "" && chroot == "" {
+		return nil
+	}
+	if os.Getuid() != 0 {
+		return fmt.Errorf("dropping privileges requires running as root")
+	}
+
+	// Учетные записи ищем до chroot, пока доступен /etc/passwd
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return fmt.Errorf("unknown user %q", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("chroot %s: %w", chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir after chroot: %w", err)
+		}
+	}
+
+	// Порядок важен: после setuid сменить группы уже нельзя
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
+		// Проверяем, что вернуть root уже невозможно
+		if err := syscall.Setuid(0); err == nil {
+			return fmt.Errorf("privileges were not dropped: setuid(0) still succeeds")
+		}
+	}
+	return nil
+}
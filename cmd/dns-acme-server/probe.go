@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/dnsserver"
+	"dns-acme-server/metrics"
+)
+
+var publicProbeOK = metrics.Default.NewGaugeVec("dns_acme_public_probe_ok",
+	"Whether the startup probe of -public-addr succeeded (1) or failed (0) by path: udp, tcp or doh", "path")
+
+// probeTimeout ограничивает одну проверку публичного адреса
+const probeTimeout = 10 * time.Second
+
+// probePublic проверяет, что запросы к публичному адресу (например, 53 порт, перенаправленный
+// DNAT на -dns-addr :5353) доходят до этого демона: публикует временную TXT запись со случайным
+// именем и запрашивает ее по UDP и TCP напрямую у addr, а с dohURL - еще и через публичный
+// резолвер по делегированию зоны zone. Результаты пишутся в журнал и метрику
+func probePublic(ds *dnsserver.Server, addr, zone, dohURL string, bound []string) {
+	if zone == "" {
+		zone = "probe.invalid."
+	}
+	token := make([]byte, 8)
+	rand.Read(token)
+	name := "_dns-acme-probe-" + hex.EncodeToString(token) + "." + dns.Fqdn(zone)
+	value := hex.EncodeToString(token)
+	remove := ds.AddProbe(name, value)
+	defer remove()
+
+	for _, proto := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: proto, Timeout: probeTimeout}
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeTXT)
+		resp, _, err := client.Exchange(q, addr)
+		if err == nil {
+			err = checkProbeAnswer(resp, value)
+		}
+		if err != nil {
+			publicProbeOK.Set(0, proto)
+			log.Printf("Public address %s does not reach this server over %s: %v; check that port %s/%s is forwarded to %s "+
+				"(a probe from this host may bypass DNAT rules for external traffic, use -public-probe-url to test from outside)",
+				addr, strings.ToUpper(proto), err, portOf(addr), proto, strings.Join(bound, ", "))
+			continue
+		}
+		publicProbeOK.Set(1, proto)
+		log.Printf("Public address %s reaches this server over %s", addr, strings.ToUpper(proto))
+	}
+
+	if dohURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if err := probeDoH(ctx, dohURL, name, value); err != nil {
+		publicProbeOK.Set(0, "doh")
+		log.Printf("Resolver %s does not reach this server for %s: %v; check the NS delegation of %s and forwarding to %s",
+			dohURL, name, err, zone, addr)
+		return
+	}
+	publicProbeOK.Set(1, "doh")
+	log.Printf("Resolver %s reaches this server through the delegation of %s", dohURL, zone)
+}
+
+// probeDoH запрашивает name через DNS over HTTPS (RFC 8484, GET ?dns=)
+func probeDoH(ctx context.Context, dohURL, name, value string) error {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeTXT)
+	q.Id = 0
+	q.RecursionDesired = true
+	packed, err := q.Pack()
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(dohURL)
+	if err != nil {
+		return err
+	}
+	params := u.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return fmt.Errorf("invalid DoH response: %w", err)
+	}
+	return checkProbeAnswer(answer, value)
+}
+
+// checkProbeAnswer - ответ содержит TXT проверки; иначе на адресе отвечает другой сервер
+func checkProbeAnswer(resp *dns.Msg, value string) error {
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("answered %s, probably by another server", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("answer has no probe record, probably from another server")
+}
+
+func portOf(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "53"
+	}
+	return port
+}
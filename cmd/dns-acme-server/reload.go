@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"dns-acme-server/metrics"
+)
+
+var configReloads = metrics.Default.NewCounterVec("dns_acme_config_reloads_total",
+	"Automatic reloads of watched configuration files", "kind", "result")
+
+// reloadDelay - пауза после последнего события: редакторы и kubelet меняют файл в несколько шагов
+const reloadDelay = 500 * time.Millisecond
+
+// watchedFile - файл конфигурации и функция, применяющая его новое содержимое
+type watchedFile struct {
+	kind   string
+	path   string
+	reload func() (string, error) // описание результата для журнала
+	sum    [sha256.Size]byte
+}
+
+// ConfigWatcher перечитывает файлы токенов, списка доменов и TLS при их изменении.
+// Следит за каталогами, а не за самими файлами: так замечаются атомарная замена
+// через rename и подмена симлинков ConfigMap/Secret в Kubernetes.
+type ConfigWatcher struct {
+	files []*watchedFile
+}
+
+// Add регистрирует файл; reload вызывается, только если содержимое изменилось
+func (w *ConfigWatcher) Add(kind, path string, reload func() (string, error)) {
+	file := &watchedFile{kind: kind, path: path, reload: reload}
+	file.sum, _ = fileSum(path)
+	w.files = append(w.files, file)
+}
+
+// Run следит за файлами, пока не закрыт stop
+func (w *ConfigWatcher) Run(stop <-chan struct{}) {
+	if len(w.files) == 0 {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Config watcher disabled: %v", err)
+		return
+	}
+	defer watcher.Close()
+	dirs := make(map[string]bool)
+	for _, file := range w.files {
+		dir := filepath.Dir(file.path)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Config watcher: cannot watch %s: %v", dir, err)
+			continue
+		}
+		dirs[dir] = true
+	}
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-watcher.Events:
+			if dirs[filepath.Dir(event.Name)] {
+				timer.Reset(reloadDelay)
+			}
+		case err := <-watcher.Errors:
+			log.Printf("Config watcher error: %v", err)
+		case <-timer.C:
+			w.check()
+		}
+	}
+}
+
+// check перечитывает файлы, содержимое которых изменилось
+func (w *ConfigWatcher) check() {
+	for _, file := range w.files {
+		sum, err := fileSum(file.path)
+		if err != nil || bytes.Equal(sum[:], file.sum[:]) {
+			// пропавший файл не повод менять конфигурацию: скорее всего, его сейчас заменяют
+			continue
+		}
+		file.sum = sum
+		result, err := file.reload()
+		if err != nil {
+			configReloads.Inc(file.kind, "error")
+			log.Printf("Config reload: kind=%s file=%s status=failed error=%q, keeping previous config", file.kind, file.path, err)
+			continue
+		}
+		configReloads.Inc(file.kind, "ok")
+		if result != "" {
+			result = " " + result
+		}
+		log.Printf("Config reload: kind=%s file=%s status=ok%s", file.kind, file.path, result)
+	}
+}
+
+func fileSum(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"dns-acme-server/metrics"
+	"dns-acme-server/vault"
+)
+
+var secretReloads = metrics.Default.NewCounterVec("dns_acme_secret_reloads_total",
+	"Secrets re-read from Vault or files and applied on change", "name", "result")
+
+// Секретные флаги (-tsig-key, -event-webhook-secret, -dns-cookie-secret, -consul-token,
+// -api-tls-cert/-api-tls-key) принимают вместо значения ссылку:
+//
+//	file:/run/secrets/tsig       - содержимое файла без пробелов по краям, перечитывается при изменении
+//	vault:secret/data/dns#tsig   - поле секрета Vault, перечитывается каждые -vault-refresh,
+//	                               динамический секрет - по истечении 2/3 аренды
+type secretRef struct {
+	scheme string // file или vault
+	path   string
+	field  string // только vault
+}
+
+// parseSecretRef разбирает ссылку; false - value не ссылка, а само значение
+func parseSecretRef(value string) (secretRef, bool, error) {
+	scheme, rest, found := strings.Cut(value, ":")
+	if !found {
+		return secretRef{}, false, nil
+	}
+	switch scheme {
+	case "file":
+		if rest == "" {
+			return secretRef{}, true, fmt.Errorf("empty path in %q", value)
+		}
+		return secretRef{scheme: scheme, path: rest}, true, nil
+	case "vault":
+		path, field, _ := strings.Cut(rest, "#")
+		if path == "" || field == "" {
+			return secretRef{}, true, fmt.Errorf("invalid %q, expected vault:path#field", value)
+		}
+		return secretRef{scheme: scheme, path: strings.Trim(path, "/"), field: field}, true, nil
+	}
+	return secretRef{}, false, nil
+}
+
+// vaultSecret - секрет (одно или несколько полей одного пути Vault) и его применение
+type vaultSecret struct {
+	name   string
+	path   string
+	fields []string
+	values []string
+	apply  func(values []string) error
+	next   time.Time // время следующего чтения
+}
+
+// SecretManager достает секреты флагов из файлов и Vault и применяет их новые значения
+// без перезапуска; токен Vault продлевается, пока демон работает
+type SecretManager struct {
+	vault   *vault.Client // nil - Vault не настроен
+	login   func(ctx context.Context) (vault.TokenLease, error)
+	refresh time.Duration
+	token   vault.TokenLease
+
+	vaultSecrets []*vaultSecret
+	files        []fileSecret
+}
+
+type fileSecret struct {
+	name  string
+	path  string
+	apply func(value string) error
+}
+
+// NewSecretManager создает менеджер; client nil - ссылки vault: не принимаются.
+// login (может быть nil) получает новый токен, когда прежний нельзя продлить
+func NewSecretManager(client *vault.Client, login func(ctx context.Context) (vault.TokenLease, error), refresh time.Duration) (*SecretManager, error) {
+	m := &SecretManager{vault: client, login: login, refresh: refresh}
+	if client == nil {
+		return m, nil
+	}
+	ctx, cancel := secretContext()
+	defer cancel()
+	var err error
+	if login != nil {
+		m.token, err = login(ctx)
+	} else {
+		m.token, err = client.LookupSelf(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vault authentication: %w", err)
+	}
+	return m, nil
+}
+
+// Load возвращает значение секретного флага name: само value или то, на что оно ссылается.
+// apply вызывается с новым значением при его изменении (nil - секрет читается один раз)
+func (m *SecretManager) Load(name, value string, apply func(value string) error) (string, error) {
+	ref, isRef, err := parseSecretRef(value)
+	if err != nil || !isRef {
+		return value, err
+	}
+	if ref.scheme == "file" {
+		if apply != nil {
+			m.files = append(m.files, fileSecret{name: name, path: ref.path, apply: apply})
+		}
+		return readSecretFile(value)
+	}
+	values, err := m.LoadVault(name, []secretRef{ref}, func(values []string) error {
+		if apply == nil {
+			return nil
+		}
+		return apply(values[0])
+	})
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// LoadVault читает несколько полей одного секрета Vault (сертификат и ключ TLS), чтобы они
+// менялись вместе
+func (m *SecretManager) LoadVault(name string, refs []secretRef, apply func(values []string) error) ([]string, error) {
+	if m.vault == nil {
+		return nil, fmt.Errorf("%s refers to Vault but -vault-addr is not set", name)
+	}
+	s := &vaultSecret{name: name, path: refs[0].path, apply: apply}
+	for _, ref := range refs {
+		if ref.scheme != "vault" || ref.path != s.path {
+			return nil, fmt.Errorf("%s: all parts must be fields of the same Vault secret", name)
+		}
+		s.fields = append(s.fields, ref.field)
+	}
+	if _, err := m.read(s); err != nil {
+		return nil, err
+	}
+	m.vaultSecrets = append(m.vaultSecrets, s)
+	return s.values, nil
+}
+
+// read читает секрет и планирует следующее чтение; true - значения изменились
+func (m *SecretManager) read(s *vaultSecret) (bool, error) {
+	ctx, cancel := secretContext()
+	defer cancel()
+	secret, err := m.vault.Read(ctx, s.path)
+	if err != nil {
+		return false, fmt.Errorf("read %s from Vault: %w", s.path, err)
+	}
+	values := make([]string, len(s.fields))
+	for i, field := range s.fields {
+		if values[i], err = secret.Field(field); err != nil {
+			return false, fmt.Errorf("vault secret %s: %w", s.path, err)
+		}
+	}
+	wait := m.refresh
+	if secret.LeaseDuration > 0 && secret.LeaseDuration*2/3 < wait {
+		wait = secret.LeaseDuration * 2 / 3
+	}
+	s.next = time.Now().Add(wait)
+	changed := s.values != nil && strings.Join(values, "\x00") != strings.Join(s.values, "\x00")
+	s.values = values
+	return changed, nil
+}
+
+// Watch регистрирует файловые секреты в ConfigWatcher
+func (m *SecretManager) Watch(watcher *ConfigWatcher) {
+	for _, file := range m.files {
+		file := file
+		watcher.Add("secret", file.path, func() (string, error) {
+			value, err := readSecretFile("file:" + file.path)
+			if err == nil {
+				err = file.apply(value)
+			}
+			if err != nil {
+				secretReloads.Inc(file.name, "failed")
+				return "", err
+			}
+			secretReloads.Inc(file.name, "ok")
+			return file.name + " updated", nil
+		})
+	}
+}
+
+// Run перечитывает секреты Vault и продлевает токен, пока не закрыт stop
+func (m *SecretManager) Run(stop <-chan struct{}) {
+	if m.vault == nil {
+		return
+	}
+	renewAt := m.renewTime()
+	for {
+		next := renewAt
+		for _, s := range m.vaultSecrets {
+			if next.IsZero() || s.next.Before(next) {
+				next = s.next
+			}
+		}
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !renewAt.IsZero() && !time.Now().Before(renewAt) {
+			m.renewToken()
+			renewAt = m.renewTime()
+		}
+		for _, s := range m.vaultSecrets {
+			if time.Now().Before(s.next) {
+				continue
+			}
+			changed, err := m.read(s)
+			if err != nil {
+				// прежнее значение остается, повтор через минуту
+				secretReloads.Inc(s.name, "failed")
+				log.Printf("Failed to refresh secret %s: %v", s.name, err)
+				s.next = time.Now().Add(time.Minute)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := s.apply(s.values); err != nil {
+				secretReloads.Inc(s.name, "failed")
+				log.Printf("Failed to apply new secret %s: %v", s.name, err)
+				continue
+			}
+			secretReloads.Inc(s.name, "ok")
+			log.Printf("Secret %s updated from Vault", s.name)
+		}
+	}
+}
+
+// renewTime - когда продлевать токен: по истечении 2/3 срока; нулевое - токен бессрочный
+func (m *SecretManager) renewTime() time.Time {
+	if m.token.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(m.token.TTL * 2 / 3)
+}
+
+// renewToken продлевает токен, а если это невозможно - входит заново
+func (m *SecretManager) renewToken() {
+	ctx, cancel := secretContext()
+	defer cancel()
+	var err error
+	if m.token.Renewable {
+		if m.token, err = m.vault.RenewSelf(ctx); err == nil {
+			return
+		}
+		log.Printf("Failed to renew Vault token: %v", err)
+	}
+	if m.login == nil {
+		if err != nil {
+			// повтор через минуту
+			m.token = vault.TokenLease{TTL: time.Minute + time.Minute/2, Renewable: true}
+			return
+		}
+		log.Printf("Vault token is not renewable, secrets stop refreshing when it expires")
+		m.token.TTL = 0
+		return
+	}
+	if m.token, err = m.login(ctx); err != nil {
+		log.Printf("Failed to log in to Vault: %v", err)
+		m.token = vault.TokenLease{TTL: time.Minute}
+	}
+}
+
+// vaultLogin настраивает вход в Vault: по AppRole, по токену из файла (его перечитывает
+// при каждом входе, файл обновляет Vault Agent) или по токену из флага - тогда login nil
+func vaultLogin(client *vault.Client, token, mount, roleID, secretID string) func(ctx context.Context) (vault.TokenLease, error) {
+	switch {
+	case roleID != "":
+		return func(ctx context.Context) (vault.TokenLease, error) {
+			id, err := readSecretFile(secretID)
+			if err != nil {
+				return vault.TokenLease{}, err
+			}
+			return client.LoginAppRole(ctx, mount, roleID, id)
+		}
+	case strings.HasPrefix(token, "file:"):
+		return func(ctx context.Context) (vault.TokenLease, error) {
+			value, err := readSecretFile(token)
+			if err != nil {
+				return vault.TokenLease{}, err
+			}
+			client.SetToken(value)
+			return client.LookupSelf(ctx)
+		}
+	}
+	client.SetToken(token)
+	return nil
+}
+
+// readSecretFile - значение или содержимое файла для ссылки file:
+func readSecretFile(value string) (string, error) {
+	path := strings.TrimPrefix(value, "file:")
+	if path == value {
+		return value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func secretContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// serviceStop закрывается, когда менеджер служб (Windows SCM, launchd, OpenRC) просит остановиться
+var serviceStop = make(chan struct{})
+
+// serviceProgram запускает демон внутри обертки kardianos/service
+type serviceProgram struct {
+	done chan struct{}
+}
+
+func (p *serviceProgram) Start(s service.Service) error {
+	p.done = make(chan struct{})
+	go func() {
+		code := runDaemon()
+		close(p.done)
+		select {
+		case <-serviceStop:
+		default:
+			// демон завершился сам (сигнал, ошибка сервера): обертка ждать не должна
+			os.Exit(code)
+		}
+	}()
+	return nil
+}
+
+func (p *serviceProgram) Stop(s service.Service) error {
+	close(serviceStop)
+	select {
+	case <-p.done:
+	case <-time.After(30 * time.Second):
+		log.Printf("Daemon did not stop in 30s")
+	}
+	return nil
+}
+
+// serviceLogWriter направляет log в журнал службы: Event Log на Windows, syslog на остальных
+type serviceLogWriter struct {
+	logger service.Logger
+}
+
+func (w serviceLogWriter) Write(p []byte) (int, error) {
+	return len(p), w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+}
+
+// runServiceCommand - dns-acme-server service [-name N] install|uninstall|start|stop|restart|status|run [флаги демона].
+// Флаги после команды install сохраняются в описании службы и передаются демону при запуске.
+func runServiceCommand(args []string) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	name := fs.String("name", "dns-acme-server", "Service name")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s service [-name NAME] install|uninstall|start|stop|restart|status|run [daemon flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	action, daemonArgs := fs.Arg(0), fs.Args()[1:]
+
+	config := &service.Config{
+		Name:        *name,
+		DisplayName: "DNS ACME challenge server",
+		Description: "Answers ACME DNS-01 challenges published via FastCGI and the HTTP API",
+		Arguments:   append([]string{"service", "-name", *name, "run"}, daemonArgs...),
+	}
+	program := &serviceProgram{}
+	s, err := service.New(program, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Service manager is not available: %v\n", err)
+		return 1
+	}
+
+	switch action {
+	case "run":
+		if !service.Interactive() {
+			logger, err := s.Logger(nil)
+			if err == nil {
+				log.SetFlags(0)
+				log.SetOutput(serviceLogWriter{logger})
+			}
+		}
+		os.Args = append([]string{os.Args[0]}, daemonArgs...)
+		if err := s.Run(); err != nil {
+			log.Printf("Service failed: %v", err)
+			return 1
+		}
+		return 0
+	case "status":
+		status, err := s.Status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Status of %s: %v\n", *name, err)
+			return 1
+		}
+		switch status {
+		case service.StatusRunning:
+			fmt.Printf("%s: running\n", *name)
+		case service.StatusStopped:
+			fmt.Printf("%s: stopped\n", *name)
+		default:
+			fmt.Printf("%s: unknown\n", *name)
+		}
+		return 0
+	}
+	if err := service.Control(s, action); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", action, *name, err)
+		return 1
+	}
+	fmt.Printf("%s %s ok (%s)\n", action, *name, s.Platform())
+	return 0
+}
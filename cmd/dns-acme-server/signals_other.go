@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignal: на этой платформе обновление без простоя не поддерживается
+var upgradeSignal os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal запускает обновление бинарника без простоя (см. responder.Upgrade)
+var upgradeSignal os.Signal = syscall.SIGUSR2
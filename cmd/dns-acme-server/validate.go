@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/dnsserver"
+	"dns-acme-server/fcgiapi"
+	"dns-acme-server/geoip"
+	"dns-acme-server/hooks"
+	"dns-acme-server/plugins"
+	"dns-acme-server/storage"
+)
+
+// validateReport - результат проверок validate: ok, warn и FAIL строки
+type validateReport struct {
+	failed int
+}
+
+func (r *validateReport) ok(check, format string, args ...interface{}) {
+	fmt.Printf("ok    %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *validateReport) warn(check, format string, args ...interface{}) {
+	fmt.Printf("warn  %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *validateReport) fail(check, format string, args ...interface{}) {
+	r.failed++
+	fmt.Printf("FAIL  %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// flagString и flagList читают значения уже разобранных флагов демона
+func flagString(name string) string {
+	return flag.Lookup(name).Value.String()
+}
+
+func flagList(name string) []string {
+	if list, ok := flag.Lookup(name).Value.(*stringList); ok {
+		return *list
+	}
+	return nil
+}
+
+// runValidate проверяет конфигурацию демона, не открывая сокетов: разбирает записи и
+// политики, проверяет TSIG и TLS, и сверяет делегирование зоны с -ns-name.
+// Код возврата 1, если есть ошибки.
+func runValidate() int {
+	report := &validateReport{}
+
+	backend := flagString("storage")
+	switch {
+	case backend == "configmap":
+		report.ok("storage", "configmap %s (requires running in Kubernetes)", flagString("k8s-configmap"))
+	case backend == "consul":
+		report.ok("storage", "consul %s/%s", flagString("consul-addr"), flagString("consul-prefix"))
+	case strings.HasPrefix(backend, plugins.StoragePrefix):
+		validatePlugin(report, "storage", strings.TrimPrefix(backend, plugins.StoragePrefix))
+	case !containsString(strings.Split(storage.Backends(), ", "), backend):
+		report.fail("storage", "unknown backend %q, this build supports %s", backend, storage.Backends())
+	case backend != "memory" && flagString("storage-dsn") == "":
+		report.fail("storage", "%s requires -storage-dsn", backend)
+	case flagString("read-only") == "true" && backend == "memory":
+		report.fail("storage", "-read-only requires a shared storage backend, not memory")
+	default:
+		report.ok("storage", "%s", backend)
+	}
+	if flagString("storage-encryption-key") != "" {
+		if backend == "memory" {
+			report.warn("encryption", "-storage-encryption-key has no effect with memory storage")
+		} else if material, ok := validateSecret(report, "encryption", "storage-encryption-key"); ok {
+			if _, err := storage.ParseEncryptionKey(material); err != nil {
+				report.fail("encryption", "-storage-encryption-key: %v", err)
+			} else {
+				report.ok("encryption", "record values are encrypted")
+			}
+		}
+	}
+	if flagString("read-only") == "true" && flagString("acme-directory") != "" {
+		report.fail("read-only", "-acme-directory cannot publish challenges in -read-only mode")
+	}
+	if flagString("read-only") == "true" && flagString("remove-delay") != "0s" {
+		report.fail("read-only", "-remove-delay cannot be used with -read-only")
+	}
+	if path := flagString("retry-queue"); path != "" {
+		if flagString("read-only") == "true" {
+			report.fail("retry-queue", "-retry-queue cannot be used with -read-only")
+		} else if backend == "memory" {
+			report.warn("retry-queue", "memory storage never fails, -retry-queue has no effect")
+		} else {
+			report.ok("retry-queue", "%s", path)
+		}
+	}
+	if flagString("public-probe-url") != "" && flagString("public-probe-zone") == "" {
+		report.fail("public-addr", "-public-probe-url requires -public-probe-zone")
+	} else if flagString("public-probe-url") != "" && flagString("public-addr") == "" {
+		report.warn("public-addr", "-public-probe-url has no effect without -public-addr")
+	}
+	for _, t := range splitList(flagString("account-thumbprint")) {
+		if err := fcgiapi.CheckThumbprint(t); err != nil {
+			report.fail("thumbprint", "%s: %v", t, err)
+		} else {
+			report.ok("thumbprint", "%s", t)
+		}
+	}
+	if flagString("api-ui") == "true" {
+		switch {
+		case flagString("api-addr") == "":
+			report.warn("api-ui", "-api-ui has no effect without -api-addr")
+		case flagString("api-tokens-file") == "" && flagString("auth-plugin") == "":
+			report.warn("api-ui", "anyone who can reach %s can add and remove records from the UI; set -api-tokens-file", flagString("api-addr"))
+		default:
+			report.ok("api-ui", "http(s)://%s/ui/", flagString("api-addr"))
+		}
+	}
+
+	static := validateStatic(report)
+	validatePolicies(report)
+	validateTSIG(report)
+	validateTLS(report)
+	validateFiles(report)
+	validateDelegation(report, static)
+
+	if report.failed > 0 {
+		fmt.Printf("%d problems found\n", report.failed)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+// validateStatic разбирает статические записи и зонные файлы и проверяет NS записи
+func validateStatic(report *validateReport) *dnsserver.StaticRecords {
+	static := dnsserver.NewStaticRecords()
+	count := 0
+	for _, record := range flagList("static-record") {
+		if err := static.AddString(record); err != nil {
+			report.fail("static", "%v", err)
+			continue
+		}
+		count++
+	}
+	for _, entry := range flagList("apex-txt") {
+		record, err := dnsserver.ApexTXTRecord(entry)
+		if err == nil {
+			err = static.AddString(record)
+		}
+		if err != nil {
+			report.fail("apex-txt", "%v", err)
+			continue
+		}
+		count++
+	}
+	for _, path := range flagList("zone-file") {
+		n, err := static.LoadZoneFile(path)
+		if err != nil {
+			report.fail("zone-file", "%v", err)
+			continue
+		}
+		report.ok("zone-file", "%s: %d records", path, n)
+	}
+	if count > 0 {
+		report.ok("static", "%d records", count)
+	}
+	if zones, err := parseZones(flagList("zone"), flagList("zone-tokens"), flagList("zone-listen")); err != nil {
+		report.fail("zone", "%v", err)
+	} else {
+		for _, zone := range zones {
+			if soa, ok := static.ZoneSOA(zone.Name); ok && dns.Fqdn(zone.Name) == soa.Hdr.Name {
+				report.fail("zone", "%s: the static records already have its SOA, remove it or the -zone", zone.Name)
+				continue
+			}
+			for _, record := range zone.Records() {
+				if err := static.AddString(record); err != nil {
+					report.fail("zone", "%s: %v", zone.Name, err)
+				}
+			}
+			if len(zone.Tokens) > 0 && flagString("api-tokens-file") == "" && flagString("auth-plugin") == "" && flagString("tsig-key") == "" {
+				report.warn("zone", "%s: without -api-tokens-file, -auth-plugin or -tsig-key clients have no names and cannot change records of the zone", zone.Name)
+			}
+			report.ok("zone", "%s: NS %s, %d clients, %d listen addresses", zone.Name, strings.Join(zone.NS, ", "), len(zone.Tokens), len(zone.Listen))
+		}
+	}
+	if views, err := parseViews(flagList("view"), flagList("view-record"), flagList("view-zone-file")); err != nil {
+		report.fail("view", "%v", err)
+	} else {
+		for _, view := range views {
+			failed := report.failed
+			viewStatic := dnsserver.NewStaticRecords()
+			for _, record := range view.Records {
+				if err := viewStatic.AddString(record); err != nil {
+					report.fail("view", "%s: %v", view.Name, err)
+				}
+			}
+			for _, path := range view.ZoneFiles {
+				if _, err := viewStatic.LoadZoneFile(path); err != nil {
+					report.fail("view", "%s: %v", view.Name, err)
+				}
+			}
+			if report.failed == failed {
+				report.ok("view", "%s: %d networks", view.Name, len(view.Networks))
+			}
+		}
+	}
+
+	nsName := flagString("ns-name")
+	nsAddrs := flagList("ns-addr")
+	if nsName != "" {
+		if len(nsAddrs) == 0 {
+			report.fail("ns", "-ns-name %s requires at least one -ns-addr", nsName)
+		}
+		for _, addr := range nsAddrs {
+			if net.ParseIP(addr) == nil {
+				report.fail("ns", "invalid -ns-addr %q", addr)
+			}
+		}
+	}
+	for _, rr := range static.ByType(dns.TypeNS) {
+		ns := rr.(*dns.NS)
+		zone := ns.Hdr.Name
+		switch {
+		case nsName != "" && !strings.EqualFold(dns.Fqdn(nsName), ns.Ns) && !zoneHasNS(static, zone, nsName):
+			report.warn("ns", "zone %s lists NS %s but not -ns-name %s", zone, ns.Ns, nsName)
+		case dns.IsSubDomain(zone, ns.Ns) && !strings.EqualFold(dns.Fqdn(nsName), ns.Ns) &&
+			len(static.Lookup(ns.Ns, dns.TypeA))+len(static.Lookup(ns.Ns, dns.TypeAAAA)) == 0:
+			report.warn("ns", "NS %s of zone %s is inside the zone but has no A/AAAA record", ns.Ns, zone)
+		default:
+			report.ok("ns", "zone %s: NS %s", zone, ns.Ns)
+		}
+	}
+	return static
+}
+
+func zoneHasNS(static *dnsserver.StaticRecords, zone, name string) bool {
+	for _, rr := range static.Lookup(zone, dns.TypeNS) {
+		if strings.EqualFold(rr.(*dns.NS).Ns, dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePolicies(report *validateReport) {
+	policy, err := dnsserver.ParseQtypePolicy(flagString("qtype-policy"))
+	if err != nil {
+		report.fail("qtype-policy", "%v", err)
+	} else if policy.NeedsUpstream() && flagString("forward-upstream") == "" {
+		report.fail("qtype-policy", "uses forward but -forward-upstream is not set")
+	}
+	if _, err := dnsserver.ParseAnyPolicy(flagString("any-policy")); err != nil {
+		report.fail("any-policy", "%v", err)
+	}
+	if mode, err := dnsserver.ParseCookieMode(flagString("dns-cookies")); err != nil {
+		report.fail("cookies", "%v", err)
+	} else if secret, ok := validateSecret(report, "cookies", "dns-cookie-secret"); ok {
+		if err := dnsserver.NewServer(nil).SetCookies(mode, secret); err != nil {
+			report.fail("cookies", "%v", err)
+		}
+	}
+	validateSecret(report, "events", "event-webhook-secret")
+	if specs := flagList("change-hook"); len(specs) > 0 {
+		changeHook := hooks.New(time.Second, nil)
+		for _, spec := range specs {
+			if err := changeHook.Add(spec); err != nil {
+				report.fail("hooks", "%v", err)
+			}
+		}
+		if changeHook.Len() == len(specs) {
+			report.ok("hooks", "%d change hooks", len(specs))
+		}
+	}
+	validateSecret(report, "consul", "consul-token")
+	if flagString("transfer-zone") == "" && (flagString("secondary-of") != "" || flagString("transfer-allow") != "" || flagString("notify") != "") {
+		report.fail("transfer", "-secondary-of, -transfer-allow and -notify require -transfer-zone")
+	}
+	if _, err := parseCIDRList(flagString("transfer-allow")); err != nil {
+		report.fail("transfer", "%v", err)
+	}
+	if flagString("secondary-of") != "" && flagString("read-only") == "true" {
+		report.fail("transfer", "-secondary-of cannot copy records in -read-only mode")
+	}
+	caa := dnsserver.NewCAAPolicy()
+	for _, entry := range flagList("caa") {
+		if err := caa.Add(entry); err != nil {
+			report.fail("caa", "%v", err)
+		}
+	}
+}
+
+func validateTSIG(report *validateReport) {
+	value, ok := validateSecret(report, "tsig", "tsig-key")
+	if !ok || value == "" {
+		return
+	}
+	key, err := dnsserver.ParseTSIGKey(value)
+	if err != nil {
+		report.fail("tsig", "%v", err)
+		return
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	switch {
+	case err != nil:
+		report.fail("tsig", "secret of key %s is not valid base64: %v", key.Name, err)
+	case len(secret) < 16:
+		report.warn("tsig", "secret of key %s is only %d bytes", key.Name, len(secret))
+	default:
+		report.ok("tsig", "key %s (%s)", key.Name, strings.TrimSuffix(key.Algorithm, "."))
+	}
+}
+
+// validateSecret - значение секретного флага name для проверки: ссылка file: читается,
+// ссылка vault: только проверяется на -vault-addr (секрет читается при запуске). false - значения нет
+func validateSecret(report *validateReport, check, name string) (string, bool) {
+	value := flagString(name)
+	ref, isRef, err := parseSecretRef(value)
+	switch {
+	case err != nil:
+		report.fail(check, "-%s: %v", name, err)
+		return "", false
+	case !isRef:
+		return value, true
+	case ref.scheme == "file":
+		if value, err = readSecretFile(value); err != nil {
+			report.fail(check, "-%s: %v", name, err)
+			return "", false
+		}
+		return value, true
+	}
+	if flagString("vault-addr") == "" {
+		report.fail(check, "-%s refers to Vault but -vault-addr is not set", name)
+	} else {
+		report.ok(check, "-%s from Vault secret %s", name, ref.path)
+	}
+	return "", false
+}
+
+func validateTLS(report *validateReport) {
+	certFile, keyFile := flagString("api-tls-cert"), flagString("api-tls-key")
+	if flagString("acme-directory") != "" {
+		if certFile != "" || keyFile != "" {
+			report.fail("tls", "-acme-directory and -api-tls-cert/-api-tls-key are mutually exclusive")
+		} else if flagString("acme-domains") == "" {
+			report.fail("tls", "-acme-directory requires -acme-domains")
+		}
+	}
+	if strings.HasPrefix(certFile, "vault:") {
+		validateSecret(report, "tls", "api-tls-cert")
+		validateSecret(report, "tls", "api-tls-key")
+	} else if certFile != "" || keyFile != "" {
+		certFile, keyFile = strings.TrimPrefix(certFile, "file:"), strings.TrimPrefix(keyFile, "file:")
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			report.fail("tls", "%v", err)
+		} else if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			report.fail("tls", "%v", err)
+		} else {
+			left := time.Until(leaf.NotAfter)
+			switch {
+			case left <= 0:
+				report.fail("tls", "%s expired on %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+			case left < 14*24*time.Hour:
+				report.warn("tls", "%s expires on %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+			default:
+				report.ok("tls", "%s valid until %s (%s)", certFile, leaf.NotAfter.Format(time.RFC3339), strings.Join(leaf.DNSNames, ", "))
+			}
+		}
+	}
+	if caFile := flagString("api-client-ca"); caFile != "" {
+		if certFile == "" && flagString("acme-directory") == "" {
+			report.fail("mtls", "-api-client-ca requires TLS")
+		}
+		if _, err := fcgiapi.LoadClientCertPolicy(caFile, splitList(flagString("api-client-allowed"))); err != nil {
+			report.fail("mtls", "%v", err)
+		} else {
+			report.ok("mtls", "client CA %s", caFile)
+		}
+	}
+}
+
+func validateFiles(report *validateReport) {
+	if path := flagString("api-tokens-file"); path != "" {
+		if _, err := fcgiapi.LoadTokenFile(path); err != nil {
+			report.fail("api-tokens", "%v", err)
+		} else {
+			report.ok("api-tokens", "%s", path)
+		}
+	}
+	if path := flagString("auth-plugin"); path != "" {
+		validatePlugin(report, "auth-plugin", path)
+	}
+	if _, err := parseQuotaOverrides(flagString("token-quota")); err != nil {
+		report.fail("quota", "%v", err)
+	}
+	if path := flagString("allowed-domains-file"); path != "" {
+		if flagString("allowed-domains") != "" {
+			report.fail("allowed", "-allowed-domains and -allowed-domains-file are mutually exclusive")
+		}
+		if acl, err := storage.LoadDomainACLFile(path, flagString("challenge-prefix")); err != nil {
+			report.fail("allowed", "%v", err)
+		} else {
+			report.ok("allowed", "%s: %d entries", path, acl.Size())
+		}
+	}
+	if path := flagString("tenants-file"); path != "" {
+		list, err := storage.LoadTenantsFile(path)
+		if err == nil {
+			_, err = storage.NewTenants(list, flagString("challenge-prefix"))
+		}
+		switch {
+		case err != nil:
+			report.fail("tenants", "%v", err)
+		case flagString("api-tokens-file") == "" && flagString("auth-plugin") == "" && flagString("tsig-key") == "":
+			report.warn("tenants", "%s: without -api-tokens-file, -auth-plugin or -tsig-key clients have no names and cannot change records of tenants", path)
+		default:
+			report.ok("tenants", "%s: %d tenants", path, len(list))
+		}
+	}
+	if zone := flagString("register-zone"); zone != "" {
+		_, err := parseCIDRList(flagString("register-allow"))
+		switch {
+		case flagString("register-file") == "":
+			report.fail("register", "-register-zone requires -register-file")
+		case err != nil:
+			report.fail("register", "-register-allow: %v", err)
+		case flagString("register-allow") == "":
+			report.warn("register", "%s: anyone who reaches the API can register, limit it with -register-allow", zone)
+		default:
+			report.ok("register", "%s: accounts in %s", zone, flagString("register-file"))
+		}
+	}
+	if paths := flagList("geoip-db"); len(paths) > 0 {
+		if db, err := geoip.Open(paths); err != nil {
+			report.fail("geoip", "%v", err)
+		} else {
+			report.ok("geoip", "%s", strings.Join(db.Types(), ", "))
+		}
+	}
+	if path := flagString("asn-db"); path != "" {
+		if table, err := geoip.LoadASNTable(path); err != nil {
+			report.fail("asn-db", "%v", err)
+		} else {
+			report.ok("asn-db", "%s: %d ranges", path, table.Len())
+		}
+	}
+}
+
+// validateDelegation проверяет через системный резолвер, что зоны, которые обслуживает
+// демон (владельцы статических SOA/NS и родитель -ns-name), делегированы на -ns-name
+// validatePlugin проверяет, что плагин есть и сборка умеет его загрузить; сам плагин
+// не загружается - выгрузить его обратно нельзя, а код инициализации может иметь побочные эффекты
+func validatePlugin(report *validateReport, check, path string) {
+	if !plugins.Supported {
+		report.fail(check, "%s: this build cannot load plugins, rebuild with CGO_ENABLED=1 on linux, darwin or freebsd", path)
+	} else if _, err := os.Stat(path); err != nil {
+		report.fail(check, "%v", err)
+	} else {
+		report.ok(check, "%s", path)
+	}
+}
+
+func validateDelegation(report *validateReport, static *dnsserver.StaticRecords) {
+	nsName := flagString("ns-name")
+	zones := make(map[string]bool)
+	for _, rr := range append(static.ByType(dns.TypeSOA), static.ByType(dns.TypeNS)...) {
+		zones[strings.ToLower(rr.Header().Name)] = true
+	}
+	if nsName != "" {
+		labels := dns.SplitDomainName(nsName)
+		if len(labels) > 2 {
+			zones[dns.Fqdn(strings.ToLower(strings.Join(labels[1:], ".")))] = true
+		}
+	}
+	if len(zones) == 0 {
+		report.warn("delegation", "no zone to check: set -ns-name or add SOA/NS static records")
+		return
+	}
+	var names []string
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var resolver net.Resolver
+	for _, zone := range names {
+		nss, err := resolver.LookupNS(ctx, zone)
+		if err != nil {
+			report.warn("delegation", "%s: %v", zone, err)
+			continue
+		}
+		var hosts []string
+		delegated := false
+		for _, ns := range nss {
+			hosts = append(hosts, ns.Host)
+			delegated = delegated || strings.EqualFold(ns.Host, dns.Fqdn(nsName))
+		}
+		if nsName != "" && !delegated {
+			report.fail("delegation", "%s is delegated to %s, not to -ns-name %s", zone, strings.Join(hosts, ", "), nsName)
+			continue
+		}
+		report.ok("delegation", "%s: NS %s", zone, strings.Join(hosts, ", "))
+	}
+	if nsName == "" {
+		return
+	}
+	addrs, err := resolver.LookupHost(ctx, nsName)
+	if err != nil {
+		report.warn("delegation", "%s does not resolve: %v", nsName, err)
+		return
+	}
+	for _, addr := range addrs {
+		if !containsString(flagList("ns-addr"), addr) {
+			report.warn("delegation", "%s resolves to %s which is not in -ns-addr", nsName, addr)
+		}
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"dns-acme-server/metrics"
+)
+
+// version, commit и date задаются при сборке:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%FT%TZ)"
+//
+// Без них берутся данные, которые go build записывает сам (модуль и VCS)
+var (
+	version string
+	commit  string
+	date    string
+)
+
+var buildInfoGauge = metrics.Default.NewGaugeVec("dns_acme_build_info",
+	"Build of the running binary, always 1", "version", "commit", "date", "goversion")
+
+// buildInfo - версия сборки для -version, журнала, метрик и CH TXT version.bind
+type buildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		modified := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+					if len(b.Commit) > 12 {
+						b.Commit = b.Commit[:12]
+					}
+				}
+			case "vcs.time":
+				if b.Date == "" {
+					b.Date = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && commit == "" && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.Date == "" {
+		b.Date = "unknown"
+	}
+	return b
+}
+
+// String - строка key=value для журнала и -version, ее удобно разбирать скриптами
+func (b buildInfo) String() string {
+	return fmt.Sprintf("version=%s commit=%s date=%s go=%s", b.Version, b.Commit, b.Date, b.GoVersion)
+}
+
+// chaosVersion - текст ответа на CH TXT version.bind
+func (b buildInfo) chaosVersion() string {
+	return "dns-acme-server " + strings.TrimPrefix(b.Version, "v")
+}
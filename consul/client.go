@@ -0,0 +1,105 @@
+// Package consul - хранение записей в Consul KV и регистрация демона в каталоге сервисов
+// Consul через HTTP API агента, без клиентских библиотек.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatusError - ответ агента с кодом ошибки
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("consul API: %d %s", e.Code, e.Message)
+}
+
+// IsNotFound - ключа или сервиса нет
+func IsNotFound(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) && status.Code == http.StatusNotFound
+}
+
+// Client обращается к HTTP API агента Consul
+type Client struct {
+	base string
+	http *http.Client
+	// для блокирующих запросов: без общего таймаута
+	stream *http.Client
+
+	mutex sync.RWMutex
+	token string
+}
+
+// NewClient создает клиента агента addr (http://127.0.0.1:8500 или host:port) с ACL токеном token
+func NewClient(addr, token string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		base:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		stream: &http.Client{},
+	}
+}
+
+// SetToken меняет ACL токен (ротация секрета)
+func (c *Client) SetToken(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.token = token
+}
+
+// do выполняет запрос; in - тело как есть ([]byte) или JSON, out может быть nil.
+// Возвращает X-Consul-Index ответа для блокирующих запросов (есть и у ответа 404)
+func (c *Client) do(ctx context.Context, client *http.Client, method, path string, in, out interface{}) (uint64, error) {
+	var body io.Reader
+	switch v := in.(type) {
+	case nil:
+	case []byte:
+		body = bytes.NewReader(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return 0, err
+	}
+	c.mutex.RLock()
+	token := c.token
+	c.mutex.RUnlock()
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return index, &StatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if out == nil {
+		return index, nil
+	}
+	return index, json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,275 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxWriteRetries - сколько раз повторять изменение при конкурентной записи другой реплики
+const maxWriteRetries = 10
+
+// writeTimeout - предел изменения без контекста запроса
+const writeTimeout = 30 * time.Second
+
+// kvPair - ключ из ответа /v1/kv
+type kvPair struct {
+	Key         string
+	Value       []byte // base64 в JSON
+	ModifyIndex uint64
+}
+
+// KVStorage хранит записи в Consul KV: ключ prefix/<имя>, значение - JSON список значений.
+// Реплики держат локальную копию через блокирующие запросы и отвечают на DNS из нее,
+// изменения применяются check-and-set, чтобы реплики не затирали записи друг друга.
+type KVStorage struct {
+	client *Client
+	prefix string // с завершающим /
+
+	mutex   sync.RWMutex
+	records map[string][]string
+	index   uint64
+}
+
+// NewKVStorage загружает записи из prefix
+func NewKVStorage(client *Client, prefix string) (*KVStorage, error) {
+	s := &KVStorage{client: client, prefix: strings.Trim(prefix, "/") + "/"}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.load(ctx, s.client.http, 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *KVStorage) keyPath(name string) string {
+	return "/v1/kv/" + s.prefix + url.PathEscape(name)
+}
+
+// load читает все записи; index > 0 - блокирующий запрос, ждущий изменений после index
+func (s *KVStorage) load(ctx context.Context, hc *http.Client, index uint64) error {
+	path := "/v1/kv/" + s.prefix + "?recurse=true"
+	if index > 0 {
+		path += "&index=" + strconv.FormatUint(index, 10) + "&wait=5m"
+	}
+	var pairs []kvPair
+	newIndex, err := s.client.do(ctx, hc, "GET", path, nil, &pairs)
+	if IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	records := make(map[string][]string, len(pairs))
+	for _, pair := range pairs {
+		name, err := url.PathUnescape(strings.TrimPrefix(pair.Key, s.prefix))
+		if err != nil || name == "" {
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(pair.Value, &values); err != nil {
+			log.Printf("Skipping malformed record %s in Consul: %v", pair.Key, err)
+			continue
+		}
+		records[name] = values
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+	s.index = newIndex
+	return nil
+}
+
+// update читает ключ name, применяет change к значениям и записывает результат check-and-set;
+// change возвращает nil, если ничего не изменилось
+func (s *KVStorage) update(ctx context.Context, name string, change func([]string) []string) error {
+	for attempt := 0; ; attempt++ {
+		var pairs []kvPair
+		_, err := s.client.do(ctx, s.client.http, "GET", s.keyPath(name), nil, &pairs)
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+		var current []string
+		var modifyIndex uint64
+		if len(pairs) == 1 {
+			if err := json.Unmarshal(pairs[0].Value, &current); err != nil {
+				return fmt.Errorf("malformed record %s in Consul: %w", name, err)
+			}
+			modifyIndex = pairs[0].ModifyIndex
+		}
+		values := change(current)
+		if values == nil {
+			s.set(name, current)
+			return nil
+		}
+		cas := "?cas=" + strconv.FormatUint(modifyIndex, 10)
+		var ok bool
+		if len(values) == 0 {
+			_, err = s.client.do(ctx, s.client.http, "DELETE", s.keyPath(name)+cas, nil, &ok)
+		} else {
+			data, _ := json.Marshal(values)
+			_, err = s.client.do(ctx, s.client.http, "PUT", s.keyPath(name)+cas, data, &ok)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok && attempt < maxWriteRetries {
+			// ключ изменила другая реплика
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("record %s in Consul keeps changing, giving up", name)
+		}
+		s.set(name, values)
+		return nil
+	}
+}
+
+// set обновляет локальную копию, не дожидаясь блокирующего запроса
+func (s *KVStorage) set(name string, values []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(values) == 0 {
+		delete(s.records, name)
+	} else {
+		s.records[name] = values
+	}
+}
+
+func (s *KVStorage) AddTXTValue(domain, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return s.AddTXTValueContext(ctx, domain, value)
+}
+
+func (s *KVStorage) AddTXTValueContext(ctx context.Context, domain, value string) error {
+	return s.change(ctx, domain, value, false, nil)
+}
+
+func (s *KVStorage) RemoveTXTValue(domain, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return s.RemoveTXTValueContext(ctx, domain, value)
+}
+
+func (s *KVStorage) RemoveTXTValueContext(ctx context.Context, domain, value string) error {
+	return s.change(ctx, domain, value, true, nil)
+}
+
+// UpdateTXTValue проверяет значения и меняет запись одним check-and-set: если ключ успела
+// изменить другая реплика, check вызывается снова на ее значениях
+func (s *KVStorage) UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	return s.change(ctx, domain, value, remove, check)
+}
+
+// change добавляет value или удаляет его (пустое - все значения), если check (может быть
+// nil) принимает текущие значения
+func (s *KVStorage) change(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	var rejected error
+	err := s.update(ctx, domain, func(values []string) []string {
+		if check != nil {
+			if rejected = check(values); rejected != nil {
+				return nil
+			}
+		}
+		if remove {
+			return removeValue(values, value)
+		}
+		return addValue(values, value)
+	})
+	switch {
+	case rejected != nil:
+		return rejected
+	case err != nil && remove:
+		return fmt.Errorf("remove TXT record %s: %w", domain, err)
+	case err != nil:
+		return fmt.Errorf("store TXT record %s: %w", domain, err)
+	case !remove:
+		log.Printf("DNS TXT record added: %s -> %s", domain, value)
+	case value != "":
+		log.Printf("DNS TXT record removed: %s -> %s", domain, value)
+	default:
+		log.Printf("DNS TXT record removed: %s", domain)
+	}
+	return nil
+}
+
+// addValue - значения с value в конце, nil - value уже есть
+func addValue(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return nil
+		}
+	}
+	return append(values, value)
+}
+
+// removeValue - значения без value (пустое - без всех), nil - удалять нечего
+func removeValue(values []string, value string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	if value == "" {
+		return []string{}
+	}
+	kept := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == len(values) {
+		return nil
+	}
+	return kept
+}
+
+func (s *KVStorage) GetTXTValues(domain string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]string(nil), s.records[domain]...), nil
+}
+
+// GetTXTValuesContext читает локальную копию и не ждет агента
+func (s *KVStorage) GetTXTValuesContext(ctx context.Context, domain string) ([]string, error) {
+	return s.GetTXTValues(domain)
+}
+
+// ListTXTValues возвращает все записи локальной копии
+func (s *KVStorage) ListTXTValues() (map[string][]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	all := make(map[string][]string, len(s.records))
+	for name, values := range s.records {
+		all[name] = append([]string(nil), values...)
+	}
+	return all, nil
+}
+
+// Watch поддерживает локальную копию актуальной, пока не закрыт stop
+func (s *KVStorage) Watch(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for ctx.Err() == nil {
+		s.mutex.RLock()
+		index := s.index
+		s.mutex.RUnlock()
+		if err := s.load(ctx, s.client.stream, index); err != nil && ctx.Err() == nil {
+			log.Printf("Consul KV watch failed: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
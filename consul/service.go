@@ -0,0 +1,48 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Service - регистрация демона в каталоге: DNS на Address:Port с TCP проверкой здоровья
+type Service struct {
+	ID      string
+	Name    string
+	Address string // пусто - адрес агента
+	Port    int
+	Tags    []string
+}
+
+// RegisterService регистрирует сервис у локального агента. Проверка - TCP соединение с
+// DNS портом каждые 10 секунд; сервис, не проходящий ее 10 минут, агент удаляет сам
+func (c *Client) RegisterService(ctx context.Context, s Service) error {
+	checkAddr := s.Address
+	if checkAddr == "" {
+		checkAddr = "127.0.0.1"
+	}
+	registration := map[string]interface{}{
+		"ID":      s.ID,
+		"Name":    s.Name,
+		"Address": s.Address,
+		"Port":    s.Port,
+		"Tags":    s.Tags,
+		"Check": map[string]string{
+			"Name":                           s.Name + " DNS",
+			"TCP":                            net.JoinHostPort(checkAddr, strconv.Itoa(s.Port)),
+			"Interval":                       "10s",
+			"Timeout":                        "2s",
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	}
+	_, err := c.do(ctx, c.http, "PUT", "/v1/agent/service/register", registration, nil)
+	return err
+}
+
+// DeregisterService снимает регистрацию при остановке
+func (c *Client) DeregisterService(ctx context.Context, id string) error {
+	_, err := c.do(ctx, c.http, "PUT", "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil)
+	return err
+}
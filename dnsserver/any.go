@@ -0,0 +1,56 @@
+package dnsserver
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// AnyPolicy - как отвечать на запросы типа ANY к нашим именам
+type AnyPolicy int
+
+const (
+	// AnyHINFO - минимальный ответ из одной HINFO записи (RFC 8482)
+	AnyHINFO AnyPolicy = iota
+	// AnyFull - все записи имени: динамические TXT, статические и собственные адреса
+	AnyFull
+	// AnyEmpty - пустой NOERROR, как раньше
+	AnyEmpty
+)
+
+var anyPolicies = map[string]AnyPolicy{
+	"hinfo": AnyHINFO,
+	"full":  AnyFull,
+	"empty": AnyEmpty,
+}
+
+// ParseAnyPolicy разбирает значение -any-policy: hinfo, full или empty
+func ParseAnyPolicy(name string) (AnyPolicy, error) {
+	p, ok := anyPolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown ANY policy %q, expected hinfo, full or empty", name)
+	}
+	return p, nil
+}
+
+// SetAnyPolicy задает ответ на запросы ANY
+func (ds *Server) SetAnyPolicy(p AnyPolicy) {
+	ds.anyPolicy = p
+}
+
+// answerAny заполняет ответ на ANY запрос к нашему имени; values - значения динамической TXT записи
+func (ds *Server) answerAny(m *dns.Msg, static *StaticRecords, qname string, values []string) {
+	switch ds.anyPolicy {
+	case AnyHINFO:
+		m.Answer = append(m.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: ds.records.TTL(qname)},
+			Cpu: "RFC8482",
+		})
+	case AnyFull:
+		m.Answer = append(m.Answer, static.LookupAll(qname)...)
+		m.Answer = append(m.Answer, ds.self.LookupAll(qname)...)
+		for _, value := range values {
+			m.Answer = append(m.Answer, ds.txtRecord(qname, value))
+		}
+	}
+}
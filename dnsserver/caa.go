@@ -0,0 +1,82 @@
+package dnsserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// CAAPolicy хранит CAA записи по доменам; политика домена действует и на его поддомены
+type CAAPolicy struct {
+	records map[string][]*dns.CAA // ключ - storage.NormalizeDomain(домен), "" - политика по умолчанию
+}
+
+func NewCAAPolicy() *CAAPolicy {
+	return &CAAPolicy{
+		records: make(map[string][]*dns.CAA),
+	}
+}
+
+// Add разбирает запись вида `example.com=0 issue "letsencrypt.org"`.
+// Домен "." задает политику по умолчанию, значение "none" - явный пустой ответ.
+func (p *CAAPolicy) Add(entry string) error {
+	domain, rdata, ok := strings.Cut(entry, "=")
+	if !ok || strings.TrimSpace(domain) == "" {
+		return fmt.Errorf("invalid CAA entry %q, expected domain=[flags] tag value", entry)
+	}
+	key := storage.NormalizeDomain(strings.TrimSpace(domain))
+
+	rdata = strings.TrimSpace(rdata)
+	if strings.EqualFold(rdata, "none") {
+		p.records[key] = []*dns.CAA{}
+		return nil
+	}
+	// флаги можно не указывать
+	if fields := strings.Fields(rdata); len(fields) > 0 && !isDigits(fields[0]) {
+		rdata = "0 " + rdata
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf(". 300 IN CAA %s", rdata))
+	if err != nil {
+		return fmt.Errorf("invalid CAA entry %q: %w", entry, err)
+	}
+	p.records[key] = append(p.records[key], rr.(*dns.CAA))
+	return nil
+}
+
+// Lookup ищет политику ближайшего настроенного домена; ok=false если политики нет,
+// fallback - найдена политика по умолчанию ".", а не домена
+func (p *CAAPolicy) Lookup(qname string) (rrs []dns.RR, fallback, ok bool) {
+	name := storage.NormalizeDomain(qname)
+	for {
+		if records, exists := p.records[name]; exists {
+			result := make([]dns.RR, 0, len(records))
+			for _, caa := range records {
+				c := dns.Copy(caa)
+				c.Header().Name = qname
+				result = append(result, c)
+			}
+			return result, name == "", true
+		}
+		if name == "" {
+			return nil, false, false
+		}
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = ""
+		}
+	}
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,172 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// responseCache хранит упакованные ответы на частые запросы (например, мониторинг,
+// опрашивающий одно имя), чтобы не собирать и не упаковывать ответ заново.
+// Запись сбрасывается при изменении имени, а maxAge ограничивает устаревание,
+// если хранилище общее с другими репликами.
+type responseCache struct {
+	size   int
+	maxAge time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]map[cacheKey]*cachedResponse // ключ - storage.NormalizeDomain(qname)
+	count   int
+}
+
+type cacheKey struct {
+	qname   string // как в запросе: ответ повторяет регистр имени
+	qtype   uint16
+	qclass  uint16
+	udpSize uint16 // 0 для TCP
+	edns    bool   // OPT в ответе только на запрос с OPT (RFC 6891 6.1.1)
+	do      bool   // бит DO повторяется в OPT ответа
+	flags   uint8  // RD и CD копируются в ответ
+	view    string // у разных представлений разные ответы
+	cookie  bool   // ответ заканчивается опцией COOKIE, которая подменяется при отдаче из кэша
+}
+
+type cachedResponse struct {
+	packed  []byte
+	dynamic []string // динамические записи в ответе, о которых нужно уведомить наблюдателей
+	expires time.Time
+}
+
+func newResponseCache(size int, maxAge time.Duration) *responseCache {
+	return &responseCache{
+		size:    size,
+		maxAge:  maxAge,
+		entries: make(map[string]map[cacheKey]*cachedResponse),
+	}
+}
+
+// SetCache включает кэш упакованных ответов на size записей (0 выключает).
+// Вызывается до Serve.
+func (ds *Server) SetCache(size int, maxAge time.Duration) {
+	ds.cache = nil
+	if size > 0 && maxAge > 0 {
+		ds.cache = newResponseCache(size, maxAge)
+		ds.records.Observe(ds.cache)
+		if ds.hosted != nil {
+			ds.hosted.Observe(ds.cache)
+		}
+	}
+}
+
+// PurgeCache очищает кэш ответов, например, при нехватке памяти
+func (ds *Server) PurgeCache() {
+	if ds.cache != nil {
+		ds.cache.purge()
+	}
+}
+
+// key возвращает ключ кэша; false, если ответ на такой запрос не кэшируется
+func (c *responseCache) key(w dns.ResponseWriter, r *dns.Msg) (cacheKey, bool) {
+	if c == nil || len(r.Question) != 1 || r.IsTsig() != nil {
+		return cacheKey{}, false
+	}
+	q := r.Question[0]
+	key := cacheKey{qname: q.Name, qtype: q.Qtype, qclass: q.Qclass}
+	opt := r.IsEdns0()
+	if opt != nil {
+		key.edns, key.do = true, opt.Do()
+	}
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); !tcp {
+		key.udpSize = dns.MinMsgSize
+		if opt != nil {
+			key.udpSize = opt.UDPSize()
+		}
+	}
+	if r.RecursionDesired {
+		key.flags |= 1
+	}
+	if r.CheckingDisabled {
+		key.flags |= 2
+	}
+	return key, true
+}
+
+func (c *responseCache) get(key cacheKey) (*cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	name := storage.NormalizeDomain(key.qname)
+	e, ok := c.entries[name][key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries[name], key)
+		c.count--
+		return nil, false
+	}
+	return e, true
+}
+
+func (c *responseCache) put(key cacheKey, m *dns.Msg, dynamic []string) {
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.count >= c.size {
+		// проще начать заново, чем вести LRU: горячие имена вернутся в кэш сразу же
+		c.entries = make(map[string]map[cacheKey]*cachedResponse)
+		c.count = 0
+	}
+	name := storage.NormalizeDomain(key.qname)
+	byKey := c.entries[name]
+	if byKey == nil {
+		byKey = make(map[cacheKey]*cachedResponse)
+		c.entries[name] = byKey
+	}
+	if _, exists := byKey[key]; !exists {
+		c.count++
+	}
+	byKey[key] = &cachedResponse{packed: packed, dynamic: dynamic, expires: time.Now().Add(c.maxAge)}
+}
+
+func (c *responseCache) invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	name = storage.NormalizeDomain(name)
+	c.count -= len(c.entries[name])
+	delete(c.entries, name)
+}
+
+func (c *responseCache) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]map[cacheKey]*cachedResponse)
+	c.count = 0
+}
+
+// RecordAdded и RecordRemoved делают кэш наблюдателем RecordManager
+func (c *responseCache) RecordAdded(src storage.Source, name, value string) {
+	c.invalidate(name)
+}
+
+func (c *responseCache) RecordRemoved(src storage.Source, name, value string) {
+	c.invalidate(name)
+}
+
+// writePacked отправляет закэшированный ответ с ID текущего запроса; tail (cookie этого
+// клиента) заменяет столько же последних байт ответа
+func writePacked(w dns.ResponseWriter, id uint16, packed, tail []byte) error {
+	msg := make([]byte, len(packed))
+	copy(msg, packed)
+	binary.BigEndian.PutUint16(msg, id)
+	copy(msg[len(msg)-len(tail):], tail)
+	_, err := w.Write(msg)
+	return err
+}
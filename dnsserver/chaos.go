@@ -0,0 +1,39 @@
+package dnsserver
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// versionNames - имена CH TXT, по которым BIND, NSD и Unbound сообщают версию
+var versionNames = map[string]bool{"version.bind.": true, "version.server.": true}
+
+// SetVersion включает ответ version на CH TXT version.bind и version.server;
+// пусто - такие запросы, как и прочие не-IN, получают REFUSED
+func (ds *Server) SetVersion(version string) {
+	ds.version = version
+}
+
+// answerVersion отвечает на запрос версии в классе CH; false - это не запрос версии
+func (ds *Server) answerVersion(w dns.ResponseWriter, r *dns.Msg) bool {
+	q := r.Question[0]
+	if ds.version == "" || q.Qclass != dns.ClassCHAOS || !versionNames[strings.ToLower(q.Name)] {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{ds.version},
+		})
+	}
+	ds.fitResponse(m, r, w.RemoteAddr())
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package dnsserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/metrics"
+)
+
+var dnsCookies = metrics.Default.NewCounterVec("dns_acme_dns_cookies_total",
+	"DNS Cookies (RFC 7873) in queries: new, valid, invalid, malformed or badcookie", "result")
+
+// CookieMode - как сервер обращается с DNS Cookies (RFC 7873)
+type CookieMode int
+
+const (
+	// CookiesOff - опция COOKIE игнорируется
+	CookiesOff CookieMode = iota
+	// CookiesOn - клиенту с cookie выдается серверный cookie, запросы без него обслуживаются как обычно
+	CookiesOn
+	// CookiesRequire - UDP запрос с cookie, но без действующего серверного cookie получает
+	// BADCOOKIE с новым cookie и повторяется клиентом; клиенты без cookie обслуживаются как обычно
+	CookiesRequire
+)
+
+// ParseCookieMode разбирает значение -dns-cookies: off, on или require
+func ParseCookieMode(s string) (CookieMode, error) {
+	switch s {
+	case "off":
+		return CookiesOff, nil
+	case "on", "":
+		return CookiesOn, nil
+	case "require":
+		return CookiesRequire, nil
+	}
+	return CookiesOff, fmt.Errorf("unknown cookie mode %q, expected off, on or require", s)
+}
+
+const (
+	cookieVersion = 1
+	// серверный cookie действует час и может быть из будущего на 5 минут (RFC 9018, 4.3)
+	cookieMaxAge  = time.Hour
+	cookieMaxSkew = 5 * time.Minute
+	// длина клиентского и серверного cookie, которые выдает сервер (RFC 9018)
+	clientCookieLen = 8
+	serverCookieLen = 16
+)
+
+// SetCookies включает DNS Cookies. secret - 16 байт hex, общий для реплик за одним адресом,
+// чтобы cookie одной реплики принимала другая; пустой - случайный при запуске. Вызывается до Serve
+func (ds *Server) SetCookies(mode CookieMode, secret string) error {
+	ds.cookies = mode
+	if secret == "" {
+		if _, err := rand.Read(ds.cookieSecret[:]); err != nil {
+			return err
+		}
+		return nil
+	}
+	key, err := parseCookieSecret(secret)
+	if err != nil {
+		return err
+	}
+	ds.cookieSecret = key
+	return nil
+}
+
+// RotateCookieSecret меняет секрет на работающем сервере. Cookie, выданные с прежним
+// секретом, принимаются до истечения их срока (RFC 9018, 5)
+func (ds *Server) RotateCookieSecret(secret string) error {
+	key, err := parseCookieSecret(secret)
+	if err != nil {
+		return err
+	}
+	ds.cookieMutex.Lock()
+	defer ds.cookieMutex.Unlock()
+	if key != ds.cookieSecret {
+		old := ds.cookieSecret
+		ds.cookieOld = &old
+		ds.cookieSecret = key
+	}
+	return nil
+}
+
+func parseCookieSecret(secret string) ([16]byte, error) {
+	var key [16]byte
+	raw, err := hex.DecodeString(secret)
+	if err != nil || len(raw) != len(key) {
+		return key, fmt.Errorf("cookie secret must be %d bytes in hex", len(key))
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// queryCookie - опция COOKIE запроса
+type queryCookie struct {
+	client  []byte // клиентский cookie, nil - в запросе нет cookie
+	valid   bool   // серверный cookie выдан нами и не устарел
+	invalid bool   // серверный cookie есть, но не наш или устарел
+}
+
+// checkCookie разбирает COOKIE запроса; false - опция некорректна, ответ FORMERR (RFC 7873, 5.2.2)
+func (ds *Server) checkCookie(r *dns.Msg, client net.Addr) (queryCookie, bool) {
+	var c queryCookie
+	opt := r.IsEdns0()
+	if ds.cookies == CookiesOff || opt == nil {
+		return c, true
+	}
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		raw, err := hex.DecodeString(cookie.Cookie)
+		// клиентский cookie - 8 байт, серверный - от 8 до 32
+		if err != nil || (len(raw) != clientCookieLen && (len(raw) < 16 || len(raw) > 40)) {
+			dnsCookies.Inc("malformed")
+			return c, false
+		}
+		c.client = raw[:clientCookieLen]
+		server := raw[clientCookieLen:]
+		switch {
+		case len(server) == 0:
+			dnsCookies.Inc("new")
+		case ds.validServerCookie(c.client, server, clientIP(client), time.Now()):
+			c.valid = true
+			dnsCookies.Inc("valid")
+		default:
+			c.invalid = true
+			dnsCookies.Inc("invalid")
+		}
+		return c, true
+	}
+	return c, true
+}
+
+// serverCookie - серверный cookie по RFC 9018: версия, 3 байта резерва, время и SipHash-2-4
+// от клиентского cookie, этих полей и адреса клиента
+func (ds *Server) serverCookie(clientCookie []byte, ip net.IP, now time.Time) []byte {
+	ds.cookieMutex.RLock()
+	secret := ds.cookieSecret
+	ds.cookieMutex.RUnlock()
+	return makeServerCookie(secret, clientCookie, ip, now)
+}
+
+func makeServerCookie(secret [16]byte, clientCookie []byte, ip net.IP, now time.Time) []byte {
+	cookie := make([]byte, 8, serverCookieLen)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], uint32(now.Unix()))
+	input := make([]byte, 0, clientCookieLen+8+net.IPv6len)
+	input = append(input, clientCookie...)
+	input = append(input, cookie...)
+	if ip4 := ip.To4(); ip4 != nil {
+		input = append(input, ip4...)
+	} else {
+		input = append(input, ip.To16()...)
+	}
+	return binary.LittleEndian.AppendUint64(cookie, siphash24(secret, input))
+}
+
+func (ds *Server) validServerCookie(clientCookie, server []byte, ip net.IP, now time.Time) bool {
+	if len(server) != serverCookieLen || server[0] != cookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if now.Sub(issued) > cookieMaxAge || issued.Sub(now) > cookieMaxSkew {
+		return false
+	}
+	ds.cookieMutex.RLock()
+	secret, old := ds.cookieSecret, ds.cookieOld
+	ds.cookieMutex.RUnlock()
+	if bytes.Equal(makeServerCookie(secret, clientCookie, ip, issued), server) {
+		return true
+	}
+	return old != nil && bytes.Equal(makeServerCookie(*old, clientCookie, ip, issued), server)
+}
+
+// cookieBytes - клиентский и новый серверный cookie для ответа
+func (ds *Server) cookieBytes(c queryCookie, client net.Addr) []byte {
+	return append(append([]byte(nil), c.client...), ds.serverCookie(c.client, clientIP(client), time.Now())...)
+}
+
+// addCookie добавляет в OPT ответа клиентский и новый серверный cookie. COOKIE - последняя
+// опция ответа: в закэшированном ответе cookie подменяется по фиксированному смещению с конца
+func (ds *Server) addCookie(m, r *dns.Msg, c queryCookie, client net.Addr) {
+	if c.client == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(uint16(ds.maxUDPSize), r.IsEdns0().Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(ds.cookieBytes(c, client)),
+	})
+}
+
+// rejectCookie отвечает BADCOOKIE с новым cookie, чтобы клиент повторил запрос с ним (RFC 7873, 5.2.3)
+func (ds *Server) rejectCookie(w dns.ResponseWriter, r *dns.Msg, c queryCookie) {
+	dnsCookies.Inc("badcookie")
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeBadCookie)
+	ds.addCookie(m, r, c, w.RemoteAddr())
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
+
+// formatError отвечает FORMERR на некорректный запрос или запрос с некорректной опцией.
+// Вопрос повторяется в ответе, только если он один
+func (ds *Server) formatError(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeFormatError)
+	if len(r.Question) != 1 {
+		m.Question = nil
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(uint16(ds.maxUDPSize), opt.Do())
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// siphash24 - SipHash-2-4 (RFC 9018 требует именно его для совместимости серверов разных реализаций)
+func siphash24(key [16]byte, p []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var last [8]byte
+	copy(last[:], p)
+	last[7] = byte(n)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,361 @@
+package dnsserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnstap (https://dnstap.info): protobuf сообщения dnstap.Dnstap в потоке Frame Streams,
+// который понимают dnstap-read, golang-dnstap, vector и т.п. Кодирование сделано вручную,
+// чтобы не тянуть protobuf ради одного сообщения.
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Типы управляющих кадров Frame Streams
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+)
+
+// Значения перечислений из dnstap.proto
+const (
+	dnstapTypeMessage  = 1
+	dnstapAuthQuery    = 1
+	dnstapAuthResponse = 2
+	dnstapFamilyINET   = 1
+	dnstapFamilyINET6  = 2
+	dnstapProtocolUDP  = 1
+	dnstapProtocolTCP  = 2
+)
+
+// Типы полей protobuf (wire types)
+const (
+	protoWireVarint  = 0
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+const dnstapReconnectBackoff = 5 * time.Second
+
+// Dnstap асинхронно пишет запросы и ответы в файл или unix сокет.
+// Если приемник не успевает, сообщения отбрасываются, DNS ответы не задерживаются.
+type Dnstap struct {
+	target   string // unix:/path или путь к файлу
+	identity []byte
+	frames   chan []byte
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewDnstap создает писатель; target - "unix:/run/dnstap.sock" или путь к файлу
+func NewDnstap(target, identity string) *Dnstap {
+	return &Dnstap{
+		target:   target,
+		identity: []byte(identity),
+		frames:   make(chan []byte, 8192),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Close дописывает накопленные кадры и STOP, чтобы поток корректно завершился
+func (t *Dnstap) Close() {
+	close(t.stop)
+	select {
+	case <-t.stopped:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// Query записывает входящий запрос
+func (t *Dnstap) Query(w dns.ResponseWriter, r *dns.Msg, at time.Time) {
+	packed, err := r.Pack()
+	if err != nil {
+		return
+	}
+	t.send(t.encode(dnstapAuthQuery, w, packed, at))
+}
+
+// Response записывает отправленный ответ
+func (t *Dnstap) Response(w dns.ResponseWriter, m *dns.Msg, queryAt, at time.Time) {
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	t.responsePacked(w, packed, queryAt, at)
+}
+
+func (t *Dnstap) responsePacked(w dns.ResponseWriter, packed []byte, queryAt, at time.Time) {
+	t.send(t.encode(dnstapAuthResponse, w, packed, at, queryAt))
+}
+
+func (t *Dnstap) send(frame []byte) {
+	select {
+	case t.frames <- frame:
+	default:
+	}
+}
+
+// encode собирает dnstap.Dnstap{type: MESSAGE, message: Message{...}}.
+// Для ответа times = [время ответа, время запроса].
+func (t *Dnstap) encode(msgType uint64, w dns.ResponseWriter, packed []byte, times ...time.Time) []byte {
+	var msg []byte
+	msg = protoVarint(msg, 1, msgType)
+
+	remoteIP, remotePort := addrIPPort(w.RemoteAddr())
+	localIP, localPort := addrIPPort(w.LocalAddr())
+	family := uint64(dnstapFamilyINET)
+	if remoteIP.To4() == nil {
+		family = dnstapFamilyINET6
+	} else {
+		remoteIP, localIP = remoteIP.To4(), localIP.To4()
+	}
+	protocol := uint64(dnstapProtocolUDP)
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		protocol = dnstapProtocolTCP
+	}
+	msg = protoVarint(msg, 2, family)
+	msg = protoVarint(msg, 3, protocol)
+	msg = protoBytes(msg, 4, remoteIP) // query_address - адрес клиента
+	msg = protoBytes(msg, 5, localIP)  // response_address - наш адрес
+	msg = protoVarint(msg, 6, uint64(remotePort))
+	msg = protoVarint(msg, 7, uint64(localPort))
+
+	if msgType == dnstapAuthQuery {
+		msg = protoVarint(msg, 8, uint64(times[0].Unix()))
+		msg = protoFixed32(msg, 9, uint32(times[0].Nanosecond()))
+		msg = protoBytes(msg, 10, packed)
+	} else {
+		if len(times) > 1 {
+			msg = protoVarint(msg, 8, uint64(times[1].Unix()))
+			msg = protoFixed32(msg, 9, uint32(times[1].Nanosecond()))
+		}
+		msg = protoVarint(msg, 12, uint64(times[0].Unix()))
+		msg = protoFixed32(msg, 13, uint32(times[0].Nanosecond()))
+		msg = protoBytes(msg, 14, packed)
+	}
+
+	var frame []byte
+	frame = protoBytes(frame, 1, t.identity)
+	frame = protoBytes(frame, 2, []byte("dns-acme-server"))
+	frame = protoBytes(frame, 14, msg)
+	frame = protoVarint(frame, 15, dnstapTypeMessage)
+	return frame
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return net.IPv4zero, 0
+}
+
+func protoKey(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = protoKey(b, field, protoWireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoFixed32(b []byte, field int, v uint32) []byte {
+	b = protoKey(b, field, protoWireFixed32)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = protoKey(b, field, protoWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// Run пишет кадры в приемник; для unix сокета переподключается при обрыве
+func (t *Dnstap) Run() {
+	defer close(t.stopped)
+	for {
+		err := t.runOnce()
+		if err == nil {
+			return
+		}
+		log.Printf("dnstap output %s: %v", t.target, err)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(dnstapReconnectBackoff):
+		}
+	}
+}
+
+func (t *Dnstap) runOnce() error {
+	var conn io.ReadWriteCloser
+	bidirectional := false
+	if path, ok := cutPrefix(t.target, "unix:"); ok {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return err
+		}
+		conn, bidirectional = c, true
+	} else {
+		f, err := os.OpenFile(t.target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+		if err != nil {
+			return err
+		}
+		conn = f
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	if bidirectional {
+		// READY -> ACCEPT с нашим content type
+		if err := writeControl(conn, fstrmControlReady); err != nil {
+			return err
+		}
+		if err := readControl(conn, fstrmControlAccept); err != nil {
+			return err
+		}
+	}
+	if err := writeControl(w, fstrmControlStart); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Writing dnstap to %s", t.target)
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case frame := <-t.frames:
+			if err := writeDataFrame(w, frame); err != nil {
+				return err
+			}
+		case <-flush.C:
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case <-t.stop:
+			return t.finish(w, conn, bidirectional)
+		}
+	}
+}
+
+// finish дописывает очередь и завершает поток: STOP, а для сокета еще ждет FINISH
+func (t *Dnstap) finish(w *bufio.Writer, conn io.Reader, bidirectional bool) error {
+	for len(t.frames) > 0 {
+		if err := writeDataFrame(w, <-t.frames); err != nil {
+			return err
+		}
+	}
+	if err := writeControl(w, fstrmControlStop); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if bidirectional {
+		return readControl(conn, fstrmControlFinish)
+	}
+	return nil
+}
+
+func writeDataFrame(w *bufio.Writer, frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	w.Write(length[:])
+	_, err := w.Write(frame)
+	return err
+}
+
+// writeControl пишет управляющий кадр: escape 0, длина, тип и поле CONTENT_TYPE
+func writeControl(w io.Writer, controlType uint32) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, controlType)
+	if controlType != fstrmControlStop && controlType != fstrmControlFinish {
+		body = binary.BigEndian.AppendUint32(body, fstrmFieldContentType)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(dnstapContentType)))
+		body = append(body, dnstapContentType...)
+	}
+	var frame []byte
+	frame = binary.BigEndian.AppendUint32(frame, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	frame = append(frame, body...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readControl читает управляющий кадр и проверяет его тип
+func readControl(r io.Reader, expected uint32) error {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return fmt.Errorf("expected control frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > 512 {
+		return fmt.Errorf("invalid control frame length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if got := binary.BigEndian.Uint32(body[:4]); got != expected {
+		return fmt.Errorf("unexpected control frame type %d, expected %d", got, expected)
+	}
+	if expected == fstrmControlAccept && !strings.Contains(string(body[4:]), dnstapContentType) {
+		return fmt.Errorf("receiver does not accept %s", dnstapContentType)
+	}
+	return nil
+}
+
+// dnstapResponseWriter записывает в dnstap ответ, отправленный обработчиком
+type dnstapResponseWriter struct {
+	dns.ResponseWriter
+	tap     *Dnstap
+	queryAt time.Time
+}
+
+func (w *dnstapResponseWriter) WriteMsg(m *dns.Msg) error {
+	err := w.ResponseWriter.WriteMsg(m)
+	if err == nil {
+		w.tap.Response(w.ResponseWriter, m, w.queryAt, time.Now())
+	}
+	return err
+}
+
+// Write - уже упакованный ответ (из кэша)
+func (w *dnstapResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil {
+		w.tap.responsePacked(w.ResponseWriter, b, w.queryAt, time.Now())
+	}
+	return n, err
+}
+
+// cutPrefix - strings.CutPrefix, которого нет в Go 1.19
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
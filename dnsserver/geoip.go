@@ -0,0 +1,53 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"dns-acme-server/geoip"
+	"dns-acme-server/metrics"
+	"dns-acme-server/tracing"
+)
+
+var queriesByOrigin = metrics.Default.NewCounterVec("dns_acme_dns_queries_by_origin_total",
+	"DNS queries by country and ASN of the resolver (with -geoip-db)", "country", "asn")
+
+// SetGeoIP включает определение страны и ASN резолверов: они попадают в журнал запросов,
+// трассировку и метрику. Вызывается до Serve
+func (ds *Server) SetGeoIP(l geoip.Locator) {
+	ds.geo = l
+}
+
+type originKey struct{}
+
+// locateClient определяет резолвер запроса и учитывает его в метрике; местоположение
+// передается в resolve через контекст
+func (ds *Server) locateClient(ctx context.Context, span *tracing.Span, client net.Addr) context.Context {
+	if ds.geo == nil {
+		return ctx
+	}
+	ip, _ := addrIPPort(client)
+	loc := ds.geo.Locate(ip)
+	country, asn := loc.Country, "unknown"
+	if country == "" {
+		country = "unknown"
+	} else {
+		span.SetAttr("client.geo.country_iso_code", loc.Country)
+	}
+	if loc.ASN.Number != 0 {
+		asn = "AS" + strconv.FormatUint(uint64(loc.ASN.Number), 10)
+		span.SetAttr("client.as.number", asn)
+	}
+	queriesByOrigin.Inc(country, asn)
+	return context.WithValue(ctx, originKey{}, loc)
+}
+
+// clientOrigin - " [DE AS3320 ...]" для журнала запросов, пусто без GeoIP
+func clientOrigin(ctx context.Context) string {
+	loc, ok := ctx.Value(originKey{}).(geoip.Location)
+	if !ok || loc.String() == "" {
+		return ""
+	}
+	return " [" + loc.String() + "]"
+}
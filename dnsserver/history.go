@@ -0,0 +1,91 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"dns-acme-server/geoip"
+
+	"github.com/miekg/dns"
+)
+
+// QueryInfo - обслуженный запрос в истории последних запросов
+type QueryInfo struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Rcode   string    `json:"rcode"`
+	Answers int       `json:"answers"`
+	Cached  bool      `json:"cached,omitempty"`
+	Origin  string    `json:"origin,omitempty"` // страна и ASN резолвера с -geoip-db
+}
+
+// queryHistory - кольцо последних запросов
+type queryHistory struct {
+	mutex sync.Mutex
+	items []QueryInfo
+	next  int
+	full  bool
+}
+
+// SetQueryHistory включает историю последних size запросов для панели управления;
+// вызывается до Serve
+func (ds *Server) SetQueryHistory(size int) {
+	if size > 0 {
+		ds.history = &queryHistory{items: make([]QueryInfo, size)}
+	}
+}
+
+// RecentQueries - последние запросы, новые первыми; nil - история выключена
+func (ds *Server) RecentQueries() []QueryInfo {
+	h := ds.history
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.items)
+	}
+	result := make([]QueryInfo, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, h.items[(h.next-i+len(h.items))%len(h.items)])
+	}
+	return result
+}
+
+// recordQuery добавляет ответ m (или упакованный ответ из кэша packed) в историю
+func (ds *Server) recordQuery(ctx context.Context, r *dns.Msg, client net.Addr, m *dns.Msg, packed []byte) {
+	h := ds.history
+	if h == nil || len(r.Question) == 0 {
+		return
+	}
+	ip, _ := addrIPPort(client)
+	info := QueryInfo{
+		Time:   time.Now().UTC(),
+		Client: ip.String(),
+		Name:   r.Question[0].Name,
+		Type:   dns.TypeToString[r.Question[0].Qtype],
+	}
+	if loc, ok := ctx.Value(originKey{}).(geoip.Location); ok {
+		info.Origin = loc.String()
+	}
+	if m != nil {
+		info.Rcode, info.Answers = dns.RcodeToString[m.Rcode], len(m.Answer)
+	} else if len(packed) >= 12 {
+		// в кэше только успешные ответы, число ответов - ANCOUNT заголовка
+		info.Rcode, info.Answers, info.Cached = dns.RcodeToString[dns.RcodeSuccess], int(binary.BigEndian.Uint16(packed[6:8])), true
+	}
+	h.mutex.Lock()
+	h.items[h.next] = info
+	h.next = (h.next + 1) % len(h.items)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.mutex.Unlock()
+}
@@ -0,0 +1,63 @@
+package dnsserver
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SetLimits ограничивает число одновременно обрабатываемых запросов (workers, 0 - без ограничения)
+// и время на один запрос (timeout, 0 - без ограничения). Запрос, не дождавшийся свободного
+// обработчика или ответа хранилища за timeout, получает SERVFAIL, и валидатор повторит его.
+// Вызывается до Serve.
+func (ds *Server) SetLimits(workers int, timeout time.Duration) {
+	ds.workers = nil
+	if workers > 0 {
+		ds.workers = make(chan struct{}, workers)
+	}
+	ds.queryTimeout = timeout
+}
+
+// acquire занимает слот обработчика; false, если за время ctx слот не освободился
+func (ds *Server) acquire(ctx context.Context) bool {
+	if ds.workers == nil {
+		return true
+	}
+	select {
+	case ds.workers <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (ds *Server) release() {
+	if ds.workers != nil {
+		<-ds.workers
+	}
+}
+
+// lookupTXT читает значения динамической записи, но ждет хранилище не дольше ctx
+func (ds *Server) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	return ds.records.ValuesContext(ctx, name)
+}
+
+// serverFailure отвечает SERVFAIL без обработки вопросов
+func (ds *Server) serverFailure(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
+
+// notImplemented отвечает NOTIMP на неподдерживаемый опкод (IQUERY, STATUS)
+func (ds *Server) notImplemented(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNotImplemented)
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
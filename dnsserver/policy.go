@@ -0,0 +1,294 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// QtypeAction - что делать с запросом неподдерживаемого типа к нашему имени
+type QtypeAction int
+
+const (
+	// ActionStatic отвечает статическими записями, если их нет - NODATA
+	ActionStatic QtypeAction = iota
+	// ActionNoData всегда отвечает NOERROR с пустым ответом
+	ActionNoData
+	// ActionForward пересылает запрос на upstream резолвер
+	ActionForward
+)
+
+var qtypeActionNames = map[string]QtypeAction{
+	"static":  ActionStatic,
+	"nodata":  ActionNoData,
+	"forward": ActionForward,
+}
+
+func (a QtypeAction) String() string {
+	for name, action := range qtypeActionNames {
+		if action == a {
+			return name
+		}
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// QtypePolicy - таблица действий по типу запроса
+type QtypePolicy struct {
+	actions       map[uint16]QtypeAction
+	defaultAction QtypeAction
+}
+
+func NewQtypePolicy() *QtypePolicy {
+	return &QtypePolicy{
+		actions:       make(map[uint16]QtypeAction),
+		defaultAction: ActionStatic,
+	}
+}
+
+// ParseQtypePolicy разбирает таблицу вида "A=static,AAAA=forward,default=nodata"
+func ParseQtypePolicy(s string) (*QtypePolicy, error) {
+	p := NewQtypePolicy()
+	if s == "" {
+		return p, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		qtypeName, actionName, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid policy entry %q, expected TYPE=action", item)
+		}
+		action, ok := qtypeActionNames[strings.ToLower(actionName)]
+		if !ok {
+			return nil, fmt.Errorf("unknown action %q for %s", actionName, qtypeName)
+		}
+		if strings.EqualFold(qtypeName, "default") {
+			p.defaultAction = action
+			continue
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(qtypeName)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", qtypeName)
+		}
+		p.actions[qtype] = action
+	}
+	return p, nil
+}
+
+func (p *QtypePolicy) Action(qtype uint16) QtypeAction {
+	if action, ok := p.actions[qtype]; ok {
+		return action
+	}
+	return p.defaultAction
+}
+
+// NeedsUpstream сообщает, используется ли где-то пересылка
+func (p *QtypePolicy) NeedsUpstream() bool {
+	if p.defaultAction == ActionForward {
+		return true
+	}
+	for _, action := range p.actions {
+		if action == ActionForward {
+			return true
+		}
+	}
+	return false
+}
+
+// StaticRecords хранит записи из статической конфигурации
+type StaticRecords struct {
+	records map[string]map[uint16][]dns.RR // ключ - storage.NormalizeDomain(имя)
+	mutex   sync.RWMutex
+}
+
+func NewStaticRecords() *StaticRecords {
+	return &StaticRecords{
+		records: make(map[string]map[uint16][]dns.RR),
+	}
+}
+
+// Replace подменяет все записи записями из other
+func (s *StaticRecords) Replace(other *StaticRecords) {
+	other.mutex.RLock()
+	records := other.records
+	other.mutex.RUnlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+}
+
+// AddString разбирает запись в формате зонного файла и добавляет ее
+func (s *StaticRecords) AddString(text string) error {
+	rr, err := dns.NewRR(text)
+	if err != nil {
+		return fmt.Errorf("invalid static record %q: %w", text, err)
+	}
+	if rr == nil {
+		return fmt.Errorf("empty static record")
+	}
+	s.Add(rr)
+	return nil
+}
+
+func (s *StaticRecords) Add(rr dns.RR) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := storage.NormalizeDomain(rr.Header().Name)
+	if s.records[name] == nil {
+		s.records[name] = make(map[uint16][]dns.RR)
+	}
+	s.records[name][rr.Header().Rrtype] = append(s.records[name][rr.Header().Rrtype], rr)
+}
+
+// Lookup возвращает копии записей с именем из запроса (сохраняя регистр)
+func (s *StaticRecords) Lookup(qname string, qtype uint16) []dns.RR {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []dns.RR
+	for _, rr := range s.records[storage.NormalizeDomain(qname)][qtype] {
+		c := dns.Copy(rr)
+		c.Header().Name = qname
+		result = append(result, c)
+	}
+	return result
+}
+
+// LookupAll возвращает копии записей всех типов с именем из запроса
+func (s *StaticRecords) LookupAll(qname string) []dns.RR {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []dns.RR
+	for _, rrs := range s.records[storage.NormalizeDomain(qname)] {
+		for _, rr := range rrs {
+			c := dns.Copy(rr)
+			c.Header().Name = qname
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// ByType возвращает все записи типа qtype (для проверки конфигурации)
+func (s *StaticRecords) ByType(qtype uint16) []dns.RR {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []dns.RR
+	for _, types := range s.records {
+		result = append(result, types[qtype]...)
+	}
+	return result
+}
+
+func (s *StaticRecords) HasName(qname string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, exists := s.records[storage.NormalizeDomain(qname)]
+	return exists
+}
+
+// ZoneSOA возвращает копию SOA ближайшей зоны, в которую входит qname (сама qname или ее
+// предки); false - статического SOA для имени нет
+func (s *StaticRecords) ZoneSOA(qname string) (*dns.SOA, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	name := storage.NormalizeDomain(qname)
+	for {
+		if rrs := s.records[name][dns.TypeSOA]; len(rrs) > 0 {
+			if soa, ok := rrs[0].(*dns.SOA); ok {
+				return dns.Copy(soa).(*dns.SOA), true
+			}
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return nil, false
+		}
+		name = name[i+1:]
+	}
+}
+
+// ZoneApex - ближайшее к qname (или оно само) имя со статическими NS, то есть вершина зоны;
+// пусто - такого нет
+func (s *StaticRecords) ZoneApex(qname string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	name := storage.NormalizeDomain(qname)
+	for {
+		if len(s.records[name][dns.TypeNS]) > 0 {
+			return dns.Fqdn(name)
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return ""
+		}
+		name = name[i+1:]
+	}
+}
+
+// ownsName - отвечаем ли мы за это имя (есть динамическая или статическая запись)
+func (ds *Server) ownsName(static *StaticRecords, qname string) bool {
+	if len(ds.records.Values(qname)) > 0 {
+		return true
+	}
+	return static.HasName(qname)
+}
+
+// answerByPolicy заполняет ответ для не-TXT запроса согласно таблице политик
+func (ds *Server) answerByPolicy(m *dns.Msg, static *StaticRecords, q dns.Question) {
+	switch ds.policy.Action(q.Qtype) {
+	case ActionStatic:
+		m.Answer = append(m.Answer, static.Lookup(q.Name, q.Qtype)...)
+	case ActionNoData:
+	case ActionForward:
+		if ds.upstream == "" {
+			log.Printf("No upstream configured for forward policy, returning SERVFAIL")
+			m.Rcode = dns.RcodeServerFailure
+			return
+		}
+		resp, err := exchange(ds.upstream, q)
+		if err != nil {
+			m.Rcode = dns.RcodeServerFailure
+			return
+		}
+		// ответ апстрима целиком, как в forwardFallback: rcode и authority его, AA - не наш
+		m.Authoritative = false
+		m.Rcode = resp.Rcode
+		m.Answer = append(m.Answer, resp.Answer...)
+		m.Ns = append(m.Ns, resp.Ns...)
+	}
+}
+
+// forwardFallback отвечает на запрос к чужому имени ответом -fallback-upstream целиком:
+// с rcode (NXDOMAIN) и секцией authority, но без флага AA, раз зона не наша
+func (ds *Server) forwardFallback(m *dns.Msg, q dns.Question) {
+	resp, err := exchange(ds.fallback, q)
+	if err != nil {
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+	log.Printf("Forwarded %s %s to fallback %s: %s", dns.TypeToString[q.Qtype], q.Name, ds.fallback, dns.RcodeToString[resp.Rcode])
+	m.Authoritative = resp.Authoritative
+	m.Rcode = resp.Rcode
+	m.Answer = append(m.Answer, resp.Answer...)
+	m.Ns = append(m.Ns, resp.Ns...)
+}
+
+// exchange пересылает вопрос q на upstream и возвращает ответ
+func exchange(upstream string, q dns.Question) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	client := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, upstream)
+	if err != nil {
+		log.Printf("Forwarding %s %s to %s failed: %v", dns.TypeToString[q.Qtype], q.Name, upstream, err)
+		return nil, err
+	}
+	return resp, nil
+}
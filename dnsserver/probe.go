@@ -0,0 +1,37 @@
+package dnsserver
+
+import (
+	"sync"
+
+	"dns-acme-server/storage"
+)
+
+// probeRecords - TXT записи проверок доступности сервера снаружи, живут только в памяти
+type probeRecords struct {
+	mutex  sync.Mutex
+	values map[string]string // storage.NormalizeDomain(имя) -> значение
+}
+
+// AddProbe отвечает на TXT запрос name значением value, минуя хранилище, пока не вызвана
+// возвращенная функция: так демон проверяет, что запросы к его публичному адресу доходят до него
+func (ds *Server) AddProbe(name, value string) (remove func()) {
+	key := storage.NormalizeDomain(name)
+	ds.probes.mutex.Lock()
+	if ds.probes.values == nil {
+		ds.probes.values = make(map[string]string)
+	}
+	ds.probes.values[key] = value
+	ds.probes.mutex.Unlock()
+	return func() {
+		ds.probes.mutex.Lock()
+		delete(ds.probes.values, key)
+		ds.probes.mutex.Unlock()
+	}
+}
+
+func (ds *Server) probeValue(qname string) (string, bool) {
+	ds.probes.mutex.Lock()
+	defer ds.probes.mutex.Unlock()
+	value, ok := ds.probes.values[storage.NormalizeDomain(qname)]
+	return value, ok
+}
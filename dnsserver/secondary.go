@@ -0,0 +1,323 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// SecondaryInterface - Source.Interface изменений, пришедших с первичного сервера
+const SecondaryInterface = "axfr"
+
+// Secondary держит копию зоны первичного сервера в локальном хранилище: проверяет serial SOA
+// по таймерам refresh/retry из SOA (или сразу по NOTIFY) и забирает зону через IXFR/AXFR.
+// TXT записи зоны становятся локальными записями с TTL первичного, остальные типы
+// не переносятся; записи зоны, которых нет у первичного, удаляются.
+type Secondary struct {
+	records *storage.RecordManager
+	zone    string
+	primary string // host:port
+	notify  chan struct{}
+
+	keyMutex sync.Mutex
+	key      *TSIGKey
+
+	soa *dns.SOA // SOA последней загруженной копии, nil - копии нет
+}
+
+// NewSecondary создает вторичный сервер зоны zone; key (может быть nil) подписывает запросы
+func NewSecondary(records *storage.RecordManager, zone, primary string, key *TSIGKey) *Secondary {
+	return &Secondary{
+		records: records,
+		zone:    dns.Fqdn(strings.ToLower(zone)),
+		primary: primary,
+		key:     key,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Notify - первичный сообщил об изменении зоны, проверить serial сейчас
+func (s *Secondary) Notify() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run обновляет копию зоны, пока не закрыт stop
+func (s *Secondary) Run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	refreshed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		case <-s.notify:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		err := s.refresh()
+		wait := time.Duration(transferRetry) * time.Second
+		switch {
+		case err == nil:
+			refreshed = time.Now()
+			wait = time.Duration(s.soa.Refresh) * time.Second
+		case s.soa != nil:
+			log.Printf("Refresh of zone %s from %s failed: %v", s.zone, s.primary, err)
+			wait = time.Duration(s.soa.Retry) * time.Second
+			if time.Since(refreshed) > time.Duration(s.soa.Expire)*time.Second {
+				// первичный недоступен дольше expire: копия устарела, отдавать ее нельзя
+				log.Printf("Zone %s expired, removing its records", s.zone)
+				s.apply(nil, true)
+				s.soa = nil
+			}
+		default:
+			log.Printf("Refresh of zone %s from %s failed: %v", s.zone, s.primary, err)
+		}
+		if wait <= 0 {
+			wait = time.Duration(transferRetry) * time.Second
+		}
+		timer.Reset(wait)
+	}
+}
+
+// refresh сверяет serial с первичным и забирает зону, если она изменилась
+func (s *Secondary) refresh() error {
+	q := new(dns.Msg)
+	q.SetQuestion(s.zone, dns.TypeSOA)
+	c := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := c.Exchange(q, s.primary)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(q, s.primary)
+	}
+	if err != nil {
+		return err
+	}
+	var primary *dns.SOA
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			primary = soa
+		}
+	}
+	if primary == nil {
+		return fmt.Errorf("no SOA for %s (%s)", s.zone, dns.RcodeToString[resp.Rcode])
+	}
+	if s.soa != nil && int32(primary.Serial-s.soa.Serial) <= 0 {
+		s.soa = primary
+		return nil
+	}
+	return s.transfer()
+}
+
+// transfer забирает зону: IXFR от известного serial (первичный может ответить и полной зоной)
+// или AXFR, если копии еще нет
+func (s *Secondary) transfer() error {
+	q := new(dns.Msg)
+	if s.soa != nil {
+		q.SetIxfr(s.zone, s.soa.Serial, s.soa.Ns, s.soa.Mbox)
+	} else {
+		q.SetAxfr(s.zone)
+	}
+	key := s.currentKey()
+	signTSIG(q, key)
+	tr := &dns.Transfer{TsigSecret: tsigSecret(key), ReadTimeout: 30 * time.Second}
+	envelopes, err := tr.In(q, s.primary)
+	if err != nil {
+		zoneTransfers.Inc("secondary", "failed")
+		return err
+	}
+	var rrs []dns.RR
+	for env := range envelopes {
+		if env.Error != nil {
+			zoneTransfers.Inc("secondary", "failed")
+			return env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	var first *dns.SOA
+	if len(rrs) > 0 {
+		first, _ = rrs[0].(*dns.SOA)
+	}
+	if first == nil {
+		zoneTransfers.Inc("secondary", "failed")
+		return fmt.Errorf("transfer of %s does not start with SOA", s.zone)
+	}
+	if len(rrs) == 1 {
+		// копия актуальна
+		zoneTransfers.Inc("secondary", "uptodate")
+		s.soa = first
+		return nil
+	}
+	if second, ok := rrs[1].(*dns.SOA); ok && len(rrs) > 2 && second.Serial != first.Serial {
+		// IXFR: последовательности SOA(старый), удаленные, SOA(новый), добавленные
+		removing := false
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			if _, ok := rr.(*dns.SOA); ok {
+				removing = !removing
+				continue
+			}
+			s.change(rr, removing)
+		}
+		log.Printf("Zone %s updated incrementally to serial %d", s.zone, first.Serial)
+	} else {
+		s.apply(rrs[1:len(rrs)-1], false)
+		log.Printf("Zone %s transferred from %s, serial %d", s.zone, s.primary, first.Serial)
+	}
+	zoneTransfers.Inc("secondary", "ok")
+	s.soa = first
+	return nil
+}
+
+// apply приводит записи зоны в хранилище к rrs; expired - зона истекла
+func (s *Secondary) apply(rrs []dns.RR, expired bool) {
+	want := make(map[[2]string]bool)
+	for _, rr := range rrs {
+		if name, value, _, ok := zoneTXT(rr); ok {
+			want[[2]string{name, value}] = true
+		}
+	}
+	snap, err := storage.ExportSnapshot(s.records, nil)
+	if err != nil {
+		log.Printf("Failed to list records of zone %s: %v", s.zone, err)
+		return
+	}
+	have := make(map[[2]string]bool)
+	for _, record := range snap.Records {
+		if !dns.IsSubDomain(s.zone, record.FQDN) {
+			continue
+		}
+		for _, value := range record.Values {
+			pair := [2]string{storage.NormalizeDomain(record.FQDN), value}
+			have[pair] = true
+			if !want[pair] {
+				s.write(record.FQDN, value, 0, true)
+			}
+		}
+	}
+	if expired {
+		return
+	}
+	for _, rr := range rrs {
+		if name, value, ttl, ok := zoneTXT(rr); ok && !have[[2]string{name, value}] {
+			s.write(name, value, ttl, false)
+		}
+	}
+}
+
+// change применяет одну запись из IXFR
+func (s *Secondary) change(rr dns.RR, remove bool) {
+	if name, value, ttl, ok := zoneTXT(rr); ok {
+		s.write(name, value, ttl, remove)
+	}
+}
+
+func (s *Secondary) write(name, value string, ttl uint32, remove bool) {
+	src := storage.Source{Interface: SecondaryInterface, Addr: s.primary}
+	var err error
+	if remove {
+		err = s.records.Remove(src, name, value)
+	} else {
+		err = s.records.AddWithTTL(src, name, value, ttl)
+	}
+	if err != nil {
+		log.Printf("Failed to copy %s from zone %s: %v", name, s.zone, err)
+	}
+}
+
+// zoneTXT - имя, значение и TTL TXT записи зоны
+func zoneTXT(rr dns.RR) (name, value string, ttl uint32, ok bool) {
+	txt, ok := rr.(*dns.TXT)
+	if !ok {
+		return "", "", 0, false
+	}
+	return storage.NormalizeDomain(txt.Hdr.Name), strings.Join(txt.Txt, ""), txt.Hdr.Ttl, true
+}
+
+// SetTSIGKey меняет ключ запросов к первичному (ротация секрета)
+func (s *Secondary) SetTSIGKey(key *TSIGKey) {
+	s.keyMutex.Lock()
+	defer s.keyMutex.Unlock()
+	s.key = key
+}
+
+func (s *Secondary) currentKey() *TSIGKey {
+	s.keyMutex.Lock()
+	defer s.keyMutex.Unlock()
+	return s.key
+}
+
+func signTSIG(m *dns.Msg, key *TSIGKey) {
+	if key != nil {
+		m.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+	}
+}
+
+func tsigSecret(key *TSIGKey) map[string]string {
+	if key == nil {
+		return nil
+	}
+	return map[string]string{key.Name: key.Secret}
+}
+
+// fromPrimary - NOTIFY пришел с адреса первичного сервера
+func (s *Secondary) fromPrimary(ip net.IP) bool {
+	host, _, err := net.SplitHostPort(s.primary)
+	if err != nil {
+		host = s.primary
+	}
+	if addr := net.ParseIP(host); addr != nil {
+		return addr.Equal(ip)
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSecondary включает прием NOTIFY для зоны s от первичного сервера
+func (ds *Server) SetSecondary(s *Secondary) {
+	ds.secondary = s
+}
+
+// handleNotify принимает NOTIFY (RFC 1996) от первичного сервера или подписанный -tsig-key
+func (ds *Server) handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	s := ds.secondary
+	if s == nil || len(r.Question) != 1 || !strings.EqualFold(dns.Fqdn(r.Question[0].Name), s.zone) {
+		ds.refuse(w, r)
+		return
+	}
+	key := ds.currentKey()
+	signed := r.IsTsig() != nil && key != nil && strings.EqualFold(r.IsTsig().Hdr.Name, key.Name) && w.TsigStatus() == nil
+	if !signed && !s.fromPrimary(clientIP(w.RemoteAddr())) {
+		log.Printf("NOTIFY for %s from %s refused: not the primary", s.zone, w.RemoteAddr())
+		ds.refuse(w, r)
+		return
+	}
+	s.Notify()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if t := r.IsTsig(); t != nil && signed {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// selfTTL - TTL собственных A/AAAA записей сервера
+const selfTTL = 3600
+
+// SetSelfAddresses задает A/AAAA записи самого сервера под именем name (имя NS из делегирования,
+// например ns.acme.example.com), чтобы валидаторы могли разрешить его без glue записей в
+// родительской зоне. На эти имена сервер отвечает всегда, независимо от -qtype-policy.
+// Вызывается до Serve.
+func (ds *Server) SetSelfAddresses(name string, addrs []string) error {
+	self := NewStaticRecords()
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", addr)
+		}
+		hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: selfTTL}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			self.Add(&dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			self.Add(&dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	ds.self = self
+	return nil
+}
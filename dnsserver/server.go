@@ -0,0 +1,680 @@
+// Package dnsserver - авторитетный DNS сервер, отдающий TXT записи ACME challenge
+// из storage.RecordManager, а также статические записи, CAA и RFC 2136 обновления.
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/geoip"
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+)
+
+// Server отвечает на запросы к TXT записям challenge и обслуживает RFC 2136 обновления
+type Server struct {
+	records *storage.RecordManager
+	servers []*dns.Server
+
+	tsigMutex sync.RWMutex
+	tsigKey   *TSIGKey // nil - динамические обновления выключены
+
+	static   *StaticRecords
+	views    []*View                // split-horizon, пусто - все клиенты видят static
+	hosted   *storage.HostedRecords // постоянные TXT записи, nil - выключены
+	self     *StaticRecords         // собственные A/AAAA сервера
+	caa      *CAAPolicy
+	policy   *QtypePolicy
+	upstream string // куда пересылать запросы с политикой forward
+	fallback string // куда пересылать TXT запросы к именам, которыми мы не управляем; пусто - отвечаем пустым
+
+	zoneListeners map[string]string // адрес сокета -> зона -zone-listen, см. SetZones
+
+	transfer  *zoneTransfer // выдача зоны вторичным, nil - выключена
+	secondary *Secondary    // копия зоны первичного, nil - не вторичный
+
+	maxUDPSize   int // наибольший ответ по UDP с EDNS
+	cookies      CookieMode
+	cookieMutex  sync.RWMutex
+	cookieSecret [16]byte
+	cookieOld    *[16]byte // прежний секрет после ротации, его cookie еще принимаются
+
+	tcpMaxConns    int           // 0 - без ограничения
+	tcpIdleTimeout time.Duration // 0 - по умолчанию miekg/dns
+	tcpMaxQueries  int           // 0 - по умолчанию miekg/dns
+
+	answerObservers []func(name, client string)
+	negativeTTL     int // TTL SOA в пустых ответах, <0 - SOA синтезируется только из статического
+	anyPolicy       AnyPolicy
+	dnstap          *Dnstap
+	geo             geoip.Locator // nil - страна и ASN резолверов не определяются
+	history         *queryHistory // nil - последние запросы не запоминаются
+	probes          probeRecords  // проверки публичного адреса, см. AddProbe
+	version         string        // ответ на CH TXT version.bind, пусто - REFUSED
+
+	workers      chan struct{}  // слоты обработки запросов, nil - без ограничения
+	queryTimeout time.Duration  // 0 - без ограничения
+	cache        *responseCache // nil - ответы не кэшируются
+
+	errors chan error // ошибки серверов, случившиеся уже после запуска
+}
+
+func NewServer(records *storage.RecordManager) *Server {
+	return &Server{
+		records: records,
+		servers: make([]*dns.Server, 0),
+		static:  NewStaticRecords(),
+		self:    NewStaticRecords(),
+		caa:     NewCAAPolicy(),
+		policy:  NewQtypePolicy(),
+		errors:  make(chan error, 1),
+
+		negativeTTL: -1,
+		maxUDPSize:  DefaultMaxUDPSize,
+	}
+}
+
+// SetHostedRecords включает ответы постоянными TXT записями; вызывается до SetCache и Serve
+func (ds *Server) SetHostedRecords(h *storage.HostedRecords) {
+	ds.hosted = h
+}
+
+// SetDnstap включает запись всех запросов и ответов в dnstap
+func (ds *Server) SetDnstap(t *Dnstap) {
+	ds.dnstap = t
+}
+
+// SetNegativeTTL включает SOA в пустых ответах для имен без статического SOA зоны, чтобы
+// резолверы кэшировали отсутствие записи не дольше ttl секунд, и ограничивает ttl отрицательное
+// кэширование по статическому SOA; ttl < 0 - SOA добавляется только из статических записей
+func (ds *Server) SetNegativeTTL(ttl int) {
+	ds.negativeTTL = ttl
+}
+
+// negativeSOA - SOA для секции authority пустого ответа или NXDOMAIN (RFC 2308, 3): SOA зоны из
+// статических записей с TTL = min(TTL, MINIMUM, negativeTTL), иначе синтезированный SOA известной
+// зоны с TTL и MINIMUM равными negativeTTL. nil - SOA добавлять не нужно
+func (ds *Server) negativeSOA(static *StaticRecords, qname string) *dns.SOA {
+	if soa, ok := static.ZoneSOA(qname); ok {
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		if ds.negativeTTL >= 0 && uint32(ds.negativeTTL) < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = uint32(ds.negativeTTL)
+		}
+		return soa
+	}
+	if ds.negativeTTL < 0 {
+		return nil
+	}
+	// SOA с владельцем qname объявил бы qname вершиной зоны; без известной зоны SOA не нужен
+	zone := ds.negativeZone(static, qname)
+	if zone == "" {
+		return nil
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(ds.negativeTTL)},
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(ds.negativeTTL),
+	}
+}
+
+// negativeZone - вершина самой близкой к qname зоны без статического SOA: зона передачи
+// (-transfer-zone), вторичная зона или имя со статическими NS; пусто - зона qname неизвестна
+func (ds *Server) negativeZone(static *StaticRecords, qname string) string {
+	name := dns.Fqdn(strings.ToLower(qname))
+	zone := static.ZoneApex(name)
+	for _, candidate := range ds.configuredZones() {
+		if len(candidate) > len(zone) && dns.IsSubDomain(candidate, name) {
+			zone = candidate
+		}
+	}
+	return zone
+}
+
+// configuredZones - зоны, заданные флагами, а не статическими записями
+func (ds *Server) configuredZones() []string {
+	var zones []string
+	if ds.transfer != nil {
+		zones = append(zones, ds.transfer.zone)
+	}
+	if ds.secondary != nil {
+		zones = append(zones, ds.secondary.zone)
+	}
+	return zones
+}
+
+// Errors возвращает канал ошибок, из-за которых DNS сервер перестал обслуживать сокет
+func (ds *Server) Errors() <-chan error {
+	return ds.errors
+}
+
+// SetQtypePolicy задает таблицу политик для не-TXT запросов к нашим именам
+func (ds *Server) SetQtypePolicy(policy *QtypePolicy, upstream string) {
+	ds.policy = policy
+	ds.upstream = upstream
+}
+
+// SetFallbackUpstream включает пересылку TXT запросов к чужим именам на резолвер addr
+// (host:port) вместо пустого ответа: так сервер можно поставить перед старым DNS при переезде
+func (ds *Server) SetFallbackUpstream(addr string) {
+	ds.fallback = addr
+}
+
+// AddCAAPolicy добавляет CAA политику для домена (см. CAAPolicy.Add)
+func (ds *Server) AddCAAPolicy(entry string) error {
+	return ds.caa.Add(entry)
+}
+
+// LoadZoneFile загружает статические записи из зонного файла
+func (ds *Server) LoadZoneFile(path string) error {
+	count, err := ds.static.LoadZoneFile(path)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d static records from %s", count, path)
+	return nil
+}
+
+// LoadStatic заново собирает статические записи из флагов и зонных файлов
+// и подменяет текущие только если все разобралось без ошибок
+func (ds *Server) LoadStatic(records, zoneFiles []string) error {
+	static := NewStaticRecords()
+	for _, record := range records {
+		if err := static.AddString(record); err != nil {
+			return err
+		}
+	}
+	for _, path := range zoneFiles {
+		count, err := static.LoadZoneFile(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("Loaded %d static records from %s", count, path)
+	}
+	if err := ds.loadViews(static); err != nil {
+		return err
+	}
+	ds.static.Replace(static)
+	ds.PurgeCache()
+	return nil
+}
+
+// AddStaticRecord добавляет статическую запись в формате зонного файла
+func (ds *Server) AddStaticRecord(text string) error {
+	return ds.static.AddString(text)
+}
+
+// OnTXTAnswer регистрирует функцию, вызываемую когда динамическая TXT запись отдана в ответе;
+// client - IP адрес запросившего резолвера
+func (ds *Server) OnTXTAnswer(f func(name, client string)) {
+	ds.answerObservers = append(ds.answerObservers, f)
+}
+
+func (ds *Server) notifyAnswered(name string, client net.Addr) {
+	if len(ds.answerObservers) == 0 {
+		return
+	}
+	ip, _ := addrIPPort(client)
+	for _, f := range ds.answerObservers {
+		f(name, ip.String())
+	}
+}
+
+// EnableUpdates включает прием RFC 2136 обновлений, подписанных ключом key
+func (ds *Server) EnableUpdates(key *TSIGKey) {
+	ds.SetTSIGKey(key)
+}
+
+// Serve запускает DNS на уже открытых сокетах: UDP на conns, TCP на listeners.
+// Возвращается только после того, как каждый сервер подтвердил запуск,
+// либо с ошибкой первого сервера, который не смог запуститься.
+func (ds *Server) Serve(conns []net.PacketConn, listeners []net.Listener) error {
+	for _, conn := range conns {
+		udpServer := &dns.Server{
+			PacketConn:   conn,
+			Net:          "udp",
+			Handler:      ds,
+			UDPSize:      65535,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		ds.configureUpdates(udpServer)
+		if err := ds.start(udpServer, "UDP", conn.LocalAddr().String()); err != nil {
+			return err
+		}
+	}
+
+	for _, listener := range listeners {
+		tcpServer := &dns.Server{
+			Listener:      ds.limitTCP(listener),
+			Net:           "tcp",
+			Handler:       ds,
+			ReadTimeout:   10 * time.Second,
+			WriteTimeout:  10 * time.Second,
+			MaxTCPQueries: ds.tcpMaxQueries,
+		}
+		if ds.tcpIdleTimeout > 0 {
+			idle := ds.tcpIdleTimeout
+			tcpServer.IdleTimeout = func() time.Duration { return idle }
+		}
+		ds.configureUpdates(tcpServer)
+		if err := ds.start(tcpServer, "TCP", listener.Addr().String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start запускает сервер и ждет NotifyStartedFunc. Ошибка до запуска возвращается,
+// после запуска - отправляется в Errors()
+func (ds *Server) start(s *dns.Server, proto, addr string) error {
+	started := make(chan struct{})
+	failed := make(chan error, 1)
+	s.NotifyStartedFunc = func() { close(started) }
+
+	log.Printf("Starting DNS %s server on %s", proto, addr)
+	go func() {
+		err := s.ActivateAndServe()
+		if err == nil {
+			return
+		}
+		err = fmt.Errorf("DNS %s server on %s: %w", proto, addr, err)
+		select {
+		case <-started:
+			log.Printf("%v", err)
+			ds.reportError(err)
+		default:
+			failed <- err
+		}
+	}()
+
+	select {
+	case <-started:
+		ds.servers = append(ds.servers, s)
+		return nil
+	case err := <-failed:
+		return err
+	}
+}
+
+// reportError передает ошибку в Errors(), не блокируясь, если ее никто не читает
+func (ds *Server) reportError(err error) {
+	select {
+	case ds.errors <- err:
+	default:
+	}
+}
+
+func (ds *Server) configureUpdates(s *dns.Server) {
+	// UPDATE принимается и без ключа: ServeDNS ответит REFUSED, а не NOTIMP
+	s.MsgAcceptFunc = updateMsgAcceptFunc
+	if ds.currentKey() == nil {
+		return
+	}
+	s.TsigProvider = tsigProvider{ds}
+}
+
+func (ds *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if ds.dnstap != nil {
+		now := time.Now()
+		ds.dnstap.Query(w, r, now)
+		w = &dnstapResponseWriter{ResponseWriter: w, tap: ds.dnstap, queryAt: now}
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		ds.handleUpdate(w, r)
+		return
+	}
+	if r.Opcode == dns.OpcodeNotify {
+		ds.handleNotify(w, r)
+		return
+	}
+	if r.Opcode != dns.OpcodeQuery {
+		log.Printf("Opcode %s from %s is not implemented", dns.OpcodeToString[r.Opcode], w.RemoteAddr())
+		ds.notImplemented(w, r)
+		return
+	}
+	// обычный запрос содержит ровно один вопрос (RFC 9619): общий ответ на несколько
+	// вопросов не определен, а без вопроса отвечать не на что
+	if len(r.Question) != 1 {
+		log.Printf("Query from %s with %d questions, returning FORMERR", w.RemoteAddr(), len(r.Question))
+		ds.formatError(w, r)
+		return
+	}
+	if ds.answerVersion(w, r) {
+		return
+	}
+	// зона есть только в классе IN; CH (кроме версии), HS и прочие классы не обслуживаем
+	if q := r.Question[0]; q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		log.Printf("Query %s %s in class %s from %s refused", dns.TypeToString[q.Qtype], q.Name, dns.ClassToString[q.Qclass], w.RemoteAddr())
+		ds.refuse(w, r)
+		return
+	}
+	if zone := ds.listenerZone(w.LocalAddr()); zone != "" && !dns.IsSubDomain(zone, strings.ToLower(r.Question[0].Name)) {
+		log.Printf("Query %s from %s refused: outside zone %s of %s", r.Question[0].Name, w.RemoteAddr(), zone, w.LocalAddr())
+		ds.refuse(w, r)
+		return
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		ds.badVersion(w, r)
+		return
+	}
+	if ds.isTransfer(r) {
+		ds.handleTransfer(w, r)
+		return
+	}
+
+	ctx := context.Background()
+	if ds.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ds.queryTimeout)
+		defer cancel()
+	}
+	if !ds.acquire(ctx) {
+		log.Printf("No free worker for query from %s within %v, returning SERVFAIL", w.RemoteAddr(), ds.queryTimeout)
+		ds.serverFailure(w, r)
+		return
+	}
+	defer ds.release()
+
+	ctx, span := tracing.StartSpan(ctx, "dns.query", tracing.KindServer)
+	defer span.End()
+	span.SetAttr("net.peer.addr", w.RemoteAddr().String())
+	ctx = ds.locateClient(ctx, span, w.RemoteAddr())
+
+	cookie, ok := ds.checkCookie(r, w.RemoteAddr())
+	if !ok {
+		ds.formatError(w, r)
+		return
+	}
+	if cookie.valid {
+		// клиент уже получал наш ответ с этого адреса: адрес не подделан
+		span.SetAttr("dns.cookie", "valid")
+	} else if cookie.invalid {
+		span.SetAttr("dns.cookie", "invalid")
+	}
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); ds.cookies == CookiesRequire && cookie.client != nil && !cookie.valid && !tcp {
+		ds.rejectCookie(w, r, cookie)
+		return
+	}
+
+	key, cacheable := ds.cache.key(w, r)
+	if view := ds.matchView(w.RemoteAddr()); view != nil {
+		key.view = view.Name
+	}
+	key.cookie = cookie.client != nil
+	if cacheable {
+		if cached, ok := ds.cache.get(key); ok {
+			span.SetAttr("dns.cache", "hit")
+			for _, name := range cached.dynamic {
+				ds.notifyAnswered(name, w.RemoteAddr())
+				tracing.LinkPublished(span, name)
+			}
+			var tail []byte
+			if key.cookie {
+				tail = ds.cookieBytes(cookie, w.RemoteAddr())
+			}
+			if err := writePacked(w, r.Id, cached.packed, tail); err != nil {
+				log.Printf("Failed to write DNS response: %v", err)
+				span.SetError(err)
+			}
+			ds.recordQuery(ctx, r, w.RemoteAddr(), nil, cached.packed)
+			return
+		}
+	}
+	m, dynamic, forwarded := ds.resolve(ctx, span, r, w.RemoteAddr(), nil)
+	if forwarded {
+		// ответ апстрима не кэшируем: его TTL и содержимое нам не принадлежат
+		cacheable = false
+	}
+
+	ds.addCookie(m, r, cookie, w.RemoteAddr())
+	ds.fitResponse(m, r, w.RemoteAddr())
+	if m.Truncated {
+		span.SetAttr("dns.truncated", "true")
+	}
+	span.SetAttr("dns.rcode", dns.RcodeToString[m.Rcode])
+	span.SetAttr("dns.answers", strconv.Itoa(len(m.Answer)))
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+		span.SetError(err)
+	}
+	ds.recordQuery(ctx, r, w.RemoteAddr(), m, nil)
+	if cacheable && m.Rcode == dns.RcodeSuccess {
+		ds.cache.put(key, m, dynamic)
+	}
+}
+
+// resolve отвечает на вопросы запроса r. client nil у отладочных запросов: они не отмечают
+// записи как запрошенные. trace (может быть nil) записывает шаги принятия решения.
+// forwarded - ответ получен от апстрима и не должен кэшироваться.
+func (ds *Server) resolve(ctx context.Context, span *tracing.Span, r *dns.Msg, client net.Addr, trace *QueryTrace) (m *dns.Msg, dynamic []string, forwarded bool) {
+	m = new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = false
+
+	view := ds.matchView(client)
+	staticRecords := ds.staticFor(view)
+	if view != nil {
+		trace.Step("view", "client %s matches view %s", client, view.Name)
+	}
+
+	answered := func(qname string) {
+		if client != nil {
+			ds.notifyAnswered(qname, client)
+		}
+		tracing.LinkPublished(span, qname)
+		dynamic = append(dynamic, qname)
+	}
+
+	for _, question := range r.Question {
+		qname := question.Name
+		qtype := question.Qtype
+
+		// Нормализуем запрошенное имя для сравнения
+		normalizedQname := storage.NormalizeDomain(qname)
+
+		if client != nil {
+			log.Printf("DNS Query: %s %s (normalized: %s) from %s%s", dns.TypeToString[qtype], qname, normalizedQname, client, clientOrigin(ctx))
+		} else {
+			log.Printf("DNS Query: %s %s (normalized: %s)", dns.TypeToString[qtype], qname, normalizedQname)
+		}
+		span.SetAttr("dns.question.name", qname)
+		span.SetAttr("dns.question.type", dns.TypeToString[qtype])
+		trace.Step("normalize", "%s %s as %s", dns.TypeToString[qtype], qname, normalizedQname)
+
+		if qtype == dns.TypeANY {
+			values, err := ds.traceLookupTXT(ctx, qname, trace)
+			if err != nil {
+				log.Printf("TXT lookup for %s timed out: %v", qname, err)
+				span.SetError(err)
+				m.Answer, m.Rcode = nil, dns.RcodeServerFailure
+				trace.Step("rcode", "SERVFAIL: storage lookup timed out")
+				break
+			}
+			if len(values) > 0 || staticRecords.HasName(qname) || ds.self.HasName(qname) {
+				ds.answerAny(m, staticRecords, qname, values)
+				trace.Step("any", "%d records", len(m.Answer))
+				if len(values) > 0 && ds.anyPolicy == AnyFull {
+					answered(qname)
+				}
+			} else {
+				trace.Step("zone", "%s is not served, ANY ignored", qname)
+			}
+		} else if value, ok := ds.probeValue(qname); ok && qtype == dns.TypeTXT {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{value},
+			})
+			trace.Step("probe", "public address probe record")
+		} else if qtype == dns.TypeTXT {
+			// статические TXT из конфигурации (-apex-txt, SPF у вершины зоны) отдаются
+			// вместе с динамическими одним RRset
+			first := len(m.Answer)
+			static := staticRecords.Lookup(qname, dns.TypeTXT)
+			m.Answer = append(m.Answer, static...)
+			trace.Step("static", "%d TXT records", len(static))
+			if ds.hosted != nil {
+				hosted := ds.hosted.Lookup(qname)
+				for _, record := range hosted {
+					m.Answer = append(m.Answer, hostedTXT(qname, record))
+				}
+				trace.Step("hosted", "%d TXT records", len(hosted))
+			}
+			values, err := ds.traceLookupTXT(ctx, qname, trace)
+			if err != nil {
+				log.Printf("TXT lookup for %s timed out: %v", qname, err)
+				span.SetError(err)
+				m.Answer, m.Rcode = nil, dns.RcodeServerFailure
+				trace.Step("rcode", "SERVFAIL: storage lookup timed out")
+				break
+			}
+			if len(values) > 0 {
+				for _, value := range values {
+					m.Answer = append(m.Answer, ds.txtRecord(qname, value))
+				}
+				// TTL внутри RRset должны совпадать (RFC 2181, 5.2)
+				uniformTTL(m.Answer[first:])
+				// ID запроса хука, добавившего значение, связывает вопрос CA с журналом выпуска
+				if id := ds.records.RequestID(qname); id != "" {
+					log.Printf("Returning TXT: %s = %s (request %s)", qname, strings.Join(values, ", "), id)
+				} else {
+					log.Printf("Returning TXT: %s = %s", qname, strings.Join(values, ", "))
+				}
+				answered(qname)
+			} else if ds.fallback != "" && len(m.Answer) == 0 && !staticRecords.HasName(qname) {
+				forwarded = true
+				ds.forwardFallback(m, question)
+				trace.Step("fallback", "%s is not managed, forwarded to %s: %s with %d answers",
+					qname, ds.fallback, dns.RcodeToString[m.Rcode], len(m.Answer))
+			} else {
+				uniformTTL(m.Answer[first:])
+				log.Printf("No TXT record found for: %s", qname)
+			}
+		} else if caa, ok := ds.lookupCAA(staticRecords, qname, qtype); ok {
+			m.Answer = append(m.Answer, caa...)
+			log.Printf("Returning %d CAA records for %s", len(caa), qname)
+			trace.Step("zone", "CAA policy matched, %d records", len(caa))
+		} else if ds.self.HasName(qname) {
+			m.Answer = append(m.Answer, ds.self.Lookup(qname, qtype)...)
+			trace.Step("zone", "%s is the server's own name (-ns-name)", qname)
+		} else if ds.ownsName(staticRecords, qname) {
+			action := ds.policy.Action(qtype)
+			forwarded = forwarded || action == ActionForward
+			trace.Step("zone", "%s is served, qtype policy for %s: %s", qname, dns.TypeToString[qtype], action)
+			ds.answerByPolicy(m, staticRecords, question)
+		} else {
+			log.Printf("Ignoring non-TXT query for unknown name: %s %s", dns.TypeToString[qtype], qname)
+			trace.Step("zone", "%s is not served, %s query ignored", qname, dns.TypeToString[qtype])
+		}
+	}
+
+	// Если нет ответов, возвращаем NOERROR с пустым ответом. NXDOMAIN не используется: у
+	// отсутствующего имени могут появиться challenge записи ниже, а NXDOMAIN скрыл бы их (RFC 8020)
+	if len(m.Answer) == 0 && m.Rcode == dns.RcodeSuccess {
+		log.Printf("No records found for query, returning NOERROR")
+		trace.Step("rcode", "NOERROR with empty answer (NODATA)")
+	} else {
+		trace.Step("rcode", "%s with %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	// Отрицательный ответ несет SOA зоны, иначе резолверы не кэшируют его и повторяют запрос
+	negative := len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError)
+	if negative && !forwarded && len(m.Ns) == 0 && len(r.Question) > 0 {
+		if soa := ds.negativeSOA(staticRecords, r.Question[0].Name); soa != nil {
+			m.Ns = append(m.Ns, soa)
+			trace.Step("authority", "SOA %s, negative TTL %d", soa.Hdr.Name, soa.Hdr.Ttl)
+		}
+	}
+	return m, dynamic, forwarded
+}
+
+// uniformTTL выставляет всем записям RRset наименьший TTL из них
+func uniformTTL(rrset []dns.RR) {
+	if len(rrset) < 2 {
+		return
+	}
+	ttl := rrset[0].Header().Ttl
+	for _, rr := range rrset[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	for _, rr := range rrset {
+		rr.Header().Ttl = ttl
+	}
+}
+
+// txtRecord - динамическая TXT запись для ответа
+func (ds *Server) txtRecord(qname, value string) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   qname, // сохраняем оригинальный регистр в ответе
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    ds.records.TTL(qname),
+		},
+		Txt: []string{value},
+	}
+}
+
+// hostedTXT - постоянная TXT запись; длинные значения (SPF) делятся на строки по 255 байт
+func hostedTXT(qname string, record storage.HostedRecord) dns.RR {
+	var parts []string
+	value := record.Value
+	for len(value) > 255 {
+		parts = append(parts, value[:255])
+		value = value[255:]
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: record.TTL},
+		Txt: append(parts, value),
+	}
+}
+
+// lookupCAA отвечает на CAA запрос по настроенной политике, если в статике нет своих CAA
+func (ds *Server) lookupCAA(static *StaticRecords, qname string, qtype uint16) ([]dns.RR, bool) {
+	if qtype != dns.TypeCAA || len(static.Lookup(qname, dns.TypeCAA)) > 0 {
+		return nil, false
+	}
+	rrs, fallback, ok := ds.caa.Lookup(qname)
+	if ok && fallback && !ds.servesName(static, qname) {
+		// политика "." - для наших имен, а не авторитетный CAA для любого домена
+		return nil, false
+	}
+	return rrs, ok
+}
+
+// servesName - входит ли имя в то, за что отвечает сервер: свои записи, зоны из статики
+// (SOA), постоянные записи или имя самого сервера
+func (ds *Server) servesName(static *StaticRecords, qname string) bool {
+	if ds.ownsName(static, qname) || ds.self.HasName(qname) {
+		return true
+	}
+	if _, ok := static.ZoneSOA(qname); ok {
+		return true
+	}
+	return ds.hosted != nil && len(ds.hosted.Lookup(qname)) > 0
+}
+
+func (ds *Server) Stop() {
+	for _, server := range ds.servers {
+		if err := server.Shutdown(); err != nil {
+			log.Printf("Error shutting down DNS server: %v", err)
+		}
+	}
+}
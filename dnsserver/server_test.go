@@ -0,0 +1,1033 @@
+package dnsserver
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// recorder - dns.ResponseWriter, запоминающий отправленный ответ
+type recorder struct {
+	msg  *dns.Msg
+	tcp  bool
+	size int // размер ответа на проводе
+}
+
+func (r *recorder) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (r *recorder) RemoteAddr() net.Addr {
+	if r.tcp {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	packed, err := m.Pack()
+	r.size = len(packed)
+	return err
+}
+func (r *recorder) Write(b []byte) (int, error) {
+	r.msg = new(dns.Msg)
+	r.size = len(b)
+	return len(b), r.msg.Unpack(b)
+}
+func (r *recorder) Close() error        { return nil }
+func (r *recorder) TsigStatus() error   { return nil }
+func (r *recorder) TsigTimersOnly(bool) {}
+func (r *recorder) Hijack()             {}
+
+func query(t *testing.T, ds *Server, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &recorder{}
+	ds.ServeDNS(w, req)
+	if w.msg == nil {
+		t.Fatalf("no response to %s", name)
+	}
+	return w.msg
+}
+
+// Валидаторы с 0x20 спрашивают имя в случайном регистре и сверяют его в ответе
+func TestTXTAnswerPreservesQueryCase(t *testing.T) {
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	if err := records.Add(storage.Source{}, "_acme-challenge.example.com", "token"); err != nil {
+		t.Fatal(err)
+	}
+	ds := NewServer(records)
+	ds.SetCache(16, time.Minute)
+
+	for _, name := range []string{
+		"_aCmE-ChAlLeNgE.eXaMpLe.CoM.",
+		"_ACME-CHALLENGE.EXAMPLE.COM.",
+		"_aCmE-ChAlLeNgE.eXaMpLe.CoM.", // второй раз - из кэша
+	} {
+		resp := query(t, ds, name, dns.TypeTXT)
+		if len(resp.Answer) != 1 {
+			t.Fatalf("%s: got %d answers, want 1", name, len(resp.Answer))
+		}
+		txt, ok := resp.Answer[0].(*dns.TXT)
+		if !ok || txt.Txt[0] != "token" {
+			t.Fatalf("%s: unexpected answer %v", name, resp.Answer[0])
+		}
+		if txt.Hdr.Name != name || resp.Question[0].Name != name {
+			t.Errorf("answer name %q, question %q, want %q", txt.Hdr.Name, resp.Question[0].Name, name)
+		}
+	}
+}
+
+// challengeServer - сервер с n значениями у _acme-challenge.example.com (как у SAN сертификата
+// с wildcard: много значений у одного имени)
+func challengeServer(t testing.TB, n int) *Server {
+	t.Helper()
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	for i := 0; i < n; i++ {
+		value := fmt.Sprintf("%043d", i) // длина как у base64url SHA-256
+		if err := records.Add(storage.Source{}, "_acme-challenge.example.com", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewServer(records)
+}
+
+func TestResponseSize(t *testing.T) {
+	// 15 значений: без сжатия имен больше 1232 байт, со сжатием - меньше
+	ds := challengeServer(t, 15)
+	ds.SetCache(16, time.Minute)
+
+	for _, tc := range []struct {
+		name      string
+		udpSize   uint16 // 0 - запрос без EDNS
+		tcp       bool
+		limit     int
+		truncated bool
+	}{
+		// stub резолверы без EDNS: 512 байт, TC и повтор по TCP
+		{name: "plain udp", limit: 512, truncated: true},
+		// Unbound и BIND по умолчанию (Let's Encrypt): 1232
+		{name: "edns 1232", udpSize: 1232, limit: 1232},
+		// клиент просит больше, чем мы отдаем по UDP
+		{name: "edns 4096", udpSize: 4096, limit: DefaultMaxUDPSize},
+		{name: "tcp", tcp: true, limit: dns.MaxMsgSize},
+		// повтор из кэша должен дать тот же результат для каждого размера
+		{name: "plain udp cached", limit: 512, truncated: true},
+		{name: "edns 1232 cached", udpSize: 1232, limit: 1232},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+			if tc.udpSize > 0 {
+				req.SetEdns0(tc.udpSize, false)
+			}
+			w := &recorder{tcp: tc.tcp}
+			ds.ServeDNS(w, req)
+			if w.size > tc.limit {
+				t.Errorf("response is %d bytes, limit %d", w.size, tc.limit)
+			}
+			if w.msg.Truncated != tc.truncated {
+				t.Errorf("TC = %v, want %v", w.msg.Truncated, tc.truncated)
+			}
+			switch {
+			case tc.truncated && len(w.msg.Answer) != 0:
+				t.Errorf("truncated response has %d answers, want a whole RRset or nothing", len(w.msg.Answer))
+			case !tc.truncated && len(w.msg.Answer) != 15:
+				t.Errorf("got %d answers, want 15", len(w.msg.Answer))
+			}
+			opt := w.msg.IsEdns0()
+			if (opt != nil) != (tc.udpSize > 0) {
+				t.Errorf("OPT in response: %v, in request: %v", opt != nil, tc.udpSize > 0)
+			}
+			if opt != nil && opt.UDPSize() != DefaultMaxUDPSize {
+				t.Errorf("advertised UDP size %d, want %d", opt.UDPSize(), DefaultMaxUDPSize)
+			}
+		})
+	}
+}
+
+// Запрос без EDNS и с EDNS 512 ждут ответ одного размера, но OPT и бит DO - только во втором
+func TestCacheKeyEDNS(t *testing.T) {
+	ds := challengeServer(t, 1)
+	ds.SetCache(16, time.Minute)
+
+	for _, tc := range []struct {
+		name string
+		edns bool
+		do   bool
+		tcp  bool
+	}{
+		{name: "edns 512", edns: true},
+		{name: "plain udp"},
+		{name: "edns 512 do", edns: true, do: true},
+		{name: "edns 512 again", edns: true},
+		{name: "tcp edns", tcp: true, edns: true},
+		{name: "tcp plain", tcp: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+			if tc.edns {
+				req.SetEdns0(dns.MinMsgSize, tc.do)
+			}
+			w := &recorder{tcp: tc.tcp}
+			ds.ServeDNS(w, req)
+			opt := w.msg.IsEdns0()
+			if (opt != nil) != tc.edns {
+				t.Fatalf("OPT in response: %v, in request: %v", opt != nil, tc.edns)
+			}
+			if opt != nil && opt.Do() != tc.do {
+				t.Errorf("DO in response: %v, in request: %v", opt.Do(), tc.do)
+			}
+		})
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	ds := challengeServer(t, 3)
+	req := new(dns.Msg)
+	req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+	w := &recorder{}
+	ds.ServeDNS(w, req)
+	if !w.msg.Compress {
+		t.Fatal("response is not compressed")
+	}
+	compressed, err := w.msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.msg.Compress = false
+	plain, err := w.msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(plain) {
+		t.Errorf("compressed response is %d bytes, uncompressed %d", len(compressed), len(plain))
+	}
+}
+
+// rawQuery собирает запрос вручную: заголовок с qdcount, затем questions как есть.
+// dns.Msg.Pack всегда пишет qdcount по числу вопросов, поэтому некорректные
+// пакеты приходится собирать из байтов
+func rawQuery(qdcount uint16, questions ...[]byte) []byte {
+	b := []byte{0x12, 0x34, 0x01, 0x00, byte(qdcount >> 8), byte(qdcount), 0, 0, 0, 0, 0, 0}
+	for _, q := range questions {
+		b = append(b, q...)
+	}
+	return b
+}
+
+// exampleTXT - вопрос example.com. TXT IN в формате провода
+var exampleTXT = []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0x00, 0x10, 0x00, 0x01}
+
+func TestQuestionCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		rcode  int
+	}{
+		{"one question", rawQuery(1, exampleTXT), dns.RcodeSuccess},
+		{"two questions", rawQuery(2, exampleTXT, exampleTXT), dns.RcodeFormatError},
+		{"no questions", rawQuery(0), dns.RcodeFormatError},
+		{"truncated question", rawQuery(1, exampleTXT[:9]), dns.RcodeFormatError},
+		{"qdcount larger than packet", rawQuery(2, exampleTXT), dns.RcodeFormatError},
+	}
+	key, err := ParseTSIGKey("update.example.com.:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// с -tsig-key и без него: проверка заголовка не должна зависеть от ключа
+	for _, updates := range []bool{false, true} {
+		ds := NewServer(storage.NewRecordManager(storage.NewMemory(), ""))
+		if updates {
+			ds.EnableUpdates(key)
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.Serve([]net.PacketConn{conn}, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/updates=%v", tt.name, updates), func(t *testing.T) {
+				client, err := net.Dial("udp", conn.LocalAddr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				if _, err := client.Write(tt.packet); err != nil {
+					t.Fatal(err)
+				}
+				client.SetReadDeadline(time.Now().Add(2 * time.Second))
+				buf := make([]byte, 512)
+				n, err := client.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp := new(dns.Msg)
+				if err := resp.Unpack(buf[:n]); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Id != 0x1234 || !resp.Response {
+					t.Errorf("reply id %#x response %v", resp.Id, resp.Response)
+				}
+				if resp.Rcode != tt.rcode {
+					t.Errorf("rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+				}
+			})
+		}
+		ds.Stop()
+	}
+}
+
+// ServeDNS вызывается и в обход проверки заголовка (тесты, обработчики поверх dns.Handler)
+func TestServeDNSQuestionCount(t *testing.T) {
+	ds := challengeServer(t, 1)
+	for _, n := range []int{0, 2} {
+		req := new(dns.Msg)
+		req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+		req.Question = nil
+		for i := 0; i < n; i++ {
+			req.Question = append(req.Question, dns.Question{Name: "_acme-challenge.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+		}
+		w := &recorder{}
+		ds.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Fatalf("%d questions: no response", n)
+		}
+		if w.msg.Rcode != dns.RcodeFormatError || len(w.msg.Answer) != 0 || len(w.msg.Question) != 0 {
+			t.Errorf("%d questions: rcode %s, %d answers, %d questions", n, dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer), len(w.msg.Question))
+		}
+	}
+}
+
+func TestOpcodeAndClass(t *testing.T) {
+	ds := challengeServer(t, 1)
+	tests := []struct {
+		name   string
+		opcode int
+		qclass uint16
+		rcode  int
+	}{
+		{"query IN", dns.OpcodeQuery, dns.ClassINET, dns.RcodeSuccess},
+		{"query ANY", dns.OpcodeQuery, dns.ClassANY, dns.RcodeSuccess},
+		{"query CH", dns.OpcodeQuery, dns.ClassCHAOS, dns.RcodeRefused},
+		{"query HS", dns.OpcodeQuery, dns.ClassHESIOD, dns.RcodeRefused},
+		{"iquery", dns.OpcodeIQuery, dns.ClassINET, dns.RcodeNotImplemented},
+		{"status", dns.OpcodeStatus, dns.ClassINET, dns.RcodeNotImplemented},
+		{"update without key", dns.OpcodeUpdate, dns.ClassINET, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+			req.Opcode = tt.opcode
+			req.Question[0].Qclass = tt.qclass
+			w := &recorder{}
+			ds.ServeDNS(w, req)
+			if w.msg == nil {
+				t.Fatal("no response")
+			}
+			if w.msg.Rcode != tt.rcode || w.msg.Opcode != tt.opcode {
+				t.Errorf("rcode %s opcode %s, want %s", dns.RcodeToString[w.msg.Rcode], dns.OpcodeToString[w.msg.Opcode], dns.RcodeToString[tt.rcode])
+			}
+			if wantAnswer := tt.rcode == dns.RcodeSuccess; (len(w.msg.Answer) > 0) != wantAnswer {
+				t.Errorf("%d answers", len(w.msg.Answer))
+			}
+		})
+	}
+}
+
+func TestChaosVersion(t *testing.T) {
+	ds := challengeServer(t, 0)
+	req := new(dns.Msg)
+	req.SetQuestion("VERSION.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	for _, version := range []string{"", "dns-acme-server 1.4.0"} {
+		ds.SetVersion(version)
+		w := &recorder{}
+		ds.ServeDNS(w, req)
+		if version == "" {
+			if w.msg.Rcode != dns.RcodeRefused {
+				t.Errorf("without version: rcode %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+			}
+			continue
+		}
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("rcode %s, %d answers", dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer))
+		}
+		txt := w.msg.Answer[0].(*dns.TXT)
+		if txt.Hdr.Class != dns.ClassCHAOS || txt.Txt[0] != version {
+			t.Errorf("answer %s", txt)
+		}
+	}
+}
+
+// quietLog отключает журнал запросов на время теста: запись каждого запроса в stderr
+// заслоняет измеряемый код
+// testUpstream запускает на 127.0.0.1 UDP резолвер с обработчиком handler и возвращает его адрес
+func testUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// Политика forward отдает ответ апстрима как есть: NXDOMAIN не превращается в NODATA,
+// а чужие данные не помечаются AA
+func TestForwardPolicyKeepsRcode(t *testing.T) {
+	quietLog(t)
+	upstream := testUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Authoritative = true
+		soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300")
+		m.Ns = append(m.Ns, soa)
+		w.WriteMsg(m)
+	})
+	ds := NewServer(storage.NewRecordManager(storage.NewMemory(), ""))
+	if err := ds.static.AddString("www.example.com. 300 IN A 192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := ParseQtypePolicy("MX=forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.SetQtypePolicy(policy, upstream)
+
+	resp := query(t, ds, "www.example.com.", dns.TypeMX)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	if resp.Authoritative {
+		t.Error("forwarded response has AA set")
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("authority %v, want the upstream SOA", resp.Ns)
+	}
+	if resp := query(t, ds, "www.example.com.", dns.TypeA); len(resp.Answer) != 1 || !resp.Authoritative {
+		t.Errorf("static A: %d answers, AA %v", len(resp.Answer), resp.Authoritative)
+	}
+}
+
+// TestNegativeSOA - секция authority пустого ответа: SOA зоны со статического SOA с TTL
+// min(TTL, MINIMUM, -negative-ttl), синтезированный SOA только с владельцем - вершиной известной зоны
+func TestNegativeSOA(t *testing.T) {
+	quietLog(t)
+	tests := []struct {
+		name        string
+		static      []string
+		transfer    string
+		negativeTTL int
+		qname       string
+		owner       string // пусто - SOA быть не должно
+		ttl         uint32
+		minimum     uint32
+	}{
+		{name: "static SOA, MINIMUM below TTL", static: []string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+			negativeTTL: -1, qname: "_acme-challenge.example.com.", owner: "example.com.", ttl: 300, minimum: 300},
+		{name: "static SOA, TTL below MINIMUM", static: []string{"example.com. 100 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+			negativeTTL: -1, qname: "_acme-challenge.example.com.", owner: "example.com.", ttl: 100, minimum: 300},
+		{name: "static SOA capped by negative TTL", static: []string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+			negativeTTL: 30, qname: "_acme-challenge.www.example.com.", owner: "example.com.", ttl: 30, minimum: 300},
+		{name: "negative TTL above static", static: []string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+			negativeTTL: 600, qname: "_acme-challenge.example.com.", owner: "example.com.", ttl: 300, minimum: 300},
+		{name: "no SOA without negative TTL", transfer: "example.com.", negativeTTL: -1, qname: "_acme-challenge.example.com."},
+		{name: "no SOA for unknown zone", negativeTTL: 30, qname: "_acme-challenge.example.com."},
+		{name: "transfer zone", transfer: "example.com.", negativeTTL: 30, qname: "_acme-challenge.www.example.com.", owner: "example.com.", ttl: 30, minimum: 30},
+		{name: "name outside transfer zone", transfer: "example.com.", negativeTTL: 30, qname: "_acme-challenge.example.org."},
+		{name: "static NS apex", static: []string{"acme.example.net. 3600 IN NS ns1.example.net."},
+			negativeTTL: 60, qname: "_acme-challenge.www.ACME.example.net.", owner: "acme.example.net.", ttl: 60, minimum: 60},
+		{name: "closest of NS apex and transfer zone", static: []string{"acme.example.com. 3600 IN NS ns1.example.com."}, transfer: "example.com.",
+			negativeTTL: 60, qname: "_acme-challenge.acme.example.com.", owner: "acme.example.com.", ttl: 60, minimum: 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewServer(storage.NewRecordManager(storage.NewMemory(), ""))
+			if err := ds.LoadStatic(tt.static, nil); err != nil {
+				t.Fatal(err)
+			}
+			if tt.transfer != "" {
+				ds.SetTransfer(tt.transfer, "", nil, nil)
+			}
+			ds.SetNegativeTTL(tt.negativeTTL)
+
+			resp := query(t, ds, tt.qname, dns.TypeTXT)
+			if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+				t.Fatalf("%s with %d answers, want NODATA", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+			}
+			if tt.owner == "" {
+				if len(resp.Ns) != 0 {
+					t.Errorf("authority %v, want none", resp.Ns)
+				}
+				return
+			}
+			if len(resp.Ns) != 1 {
+				t.Fatalf("authority %v, want the zone SOA", resp.Ns)
+			}
+			soa, ok := resp.Ns[0].(*dns.SOA)
+			if !ok {
+				t.Fatalf("authority %v, want SOA", resp.Ns[0])
+			}
+			if soa.Hdr.Name != tt.owner || soa.Hdr.Ttl != tt.ttl || soa.Minttl != tt.minimum {
+				t.Errorf("SOA %s TTL %d MINIMUM %d, want %s TTL %d MINIMUM %d", soa.Hdr.Name, soa.Hdr.Ttl, soa.Minttl, tt.owner, tt.ttl, tt.minimum)
+			}
+		})
+	}
+}
+
+// NODATA у имени с записью другого типа несет SOA, NXDOMAIN апстрима - только его authority
+func TestNegativeAuthority(t *testing.T) {
+	quietLog(t)
+	upstreamSOA := "example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 300"
+	upstream := testUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		if r.Question[0].Name == "with-soa.example.org." {
+			soa, _ := dns.NewRR(upstreamSOA)
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	})
+	ds := challengeServer(t, 1)
+	if err := ds.LoadStatic([]string{"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 120"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ds.SetTransfer("example.org.", "", nil, nil)
+	ds.SetNegativeTTL(30)
+	ds.SetFallbackUpstream(upstream)
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		ns    string // владелец SOA в authority, пусто - authority пуст
+	}{
+		{"_acme-challenge.example.com.", dns.TypeA, dns.RcodeSuccess, "example.com."},
+		{"_acme-challenge.example.com.", dns.TypeAAAA, dns.RcodeSuccess, "example.com."},
+		{"with-soa.example.org.", dns.TypeTXT, dns.RcodeNameError, "example.org."},
+		{"without-soa.example.org.", dns.TypeTXT, dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		resp := query(t, ds, tt.qname, tt.qtype)
+		name := tt.qname + " " + dns.TypeToString[tt.qtype]
+		if resp.Rcode != tt.rcode || len(resp.Answer) != 0 {
+			t.Errorf("%s: %s with %d answers, want %s", name, dns.RcodeToString[resp.Rcode], len(resp.Answer), dns.RcodeToString[tt.rcode])
+		}
+		switch {
+		case tt.ns == "" && len(resp.Ns) != 0:
+			t.Errorf("%s: authority %v, want the empty upstream authority", name, resp.Ns)
+		case tt.ns != "" && (len(resp.Ns) != 1 || resp.Ns[0].Header().Name != tt.ns || resp.Ns[0].Header().Rrtype != dns.TypeSOA):
+			t.Errorf("%s: authority %v, want one SOA of %s", name, resp.Ns, tt.ns)
+		}
+	}
+	// NXDOMAIN апстрима отдается с его SOA как есть, без ограничения -negative-ttl
+	if resp := query(t, ds, "with-soa.example.org.", dns.TypeTXT); len(resp.Ns) == 1 && resp.Ns[0].Header().Ttl != 300 {
+		t.Errorf("upstream SOA TTL %d changed", resp.Ns[0].Header().Ttl)
+	}
+}
+
+// Политика "." - для имен сервера; на CAA чужого домена нет авторитетного ответа
+func TestCAADefaultPolicy(t *testing.T) {
+	quietLog(t)
+	ds := NewServer(storage.NewRecordManager(storage.NewMemory(), ""))
+	if err := ds.static.AddString("acme.example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300"); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{`.=issue "letsencrypt.org"`, `other.example=issue "pki.goog"`} {
+		if err := ds.AddCAAPolicy(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		answers int
+	}{
+		{"acme.example.com.", 1},
+		{"x.acme.example.com.", 1},
+		{"other.example.", 1},
+		{"unrelated.example.net.", 0},
+	} {
+		if resp := query(t, ds, tc.name, dns.TypeCAA); len(resp.Answer) != tc.answers {
+			t.Errorf("%s: %d CAA answers, want %d", tc.name, len(resp.Answer), tc.answers)
+		}
+	}
+}
+
+// updateServer запускает сервер с ключом key на 127.0.0.1 UDP и возвращает его адрес
+func updateServer(t *testing.T, records *storage.RecordManager, key *TSIGKey) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := NewServer(records)
+	ds.EnableUpdates(key)
+	if err := ds.Serve([]net.PacketConn{pc}, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ds.Stop)
+	return pc.LocalAddr().String()
+}
+
+func TestUpdate(t *testing.T) {
+	quietLog(t)
+	key, err := ParseTSIGKey("hmac-sha256:acme-key:c2VjcmV0c2VjcmV0c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	// у клиента ключа не больше двух значений: так обновление ломается на середине
+	records.SetQuota(storage.NewRecordQuota(0, 2, nil))
+	addr := updateServer(t, records, key)
+
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	send := func(zone, secret string, sign bool, rrs ...dns.RR) int {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		m.Ns = rrs
+		client := &dns.Client{}
+		if sign {
+			m.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+			client.TsigSecret = map[string]string{key.Name: secret}
+		}
+		resp, _, err := client.Exchange(m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Rcode
+	}
+	values := func(name string) []string {
+		return records.Values(name)
+	}
+
+	add := rr(`_acme-challenge.example.com. 60 IN TXT "one"`)
+	if rcode := send("example.com.", key.Secret, false, add); rcode != dns.RcodeRefused {
+		t.Errorf("unsigned: %s, want REFUSED", dns.RcodeToString[rcode])
+	}
+	if rcode := send("example.com.", "b3RoZXJzZWNyZXQ=", true, add); rcode != dns.RcodeNotAuth {
+		t.Errorf("bad MAC: %s, want NOTAUTH", dns.RcodeToString[rcode])
+	}
+	if rcode := send("example.org.", key.Secret, true, add); rcode != dns.RcodeNotZone {
+		t.Errorf("out of zone: %s, want NOTZONE", dns.RcodeToString[rcode])
+	}
+	if v := values("_acme-challenge.example.com"); len(v) != 0 {
+		t.Fatalf("rejected updates changed the record: %v", v)
+	}
+
+	if rcode := send("example.com.", key.Secret, true, add, rr(`_acme-challenge.example.com. 60 IN TXT "two"`)); rcode != dns.RcodeSuccess {
+		t.Fatalf("signed add: %s", dns.RcodeToString[rcode])
+	}
+	if ttl := records.TTL("_acme-challenge.example.com"); ttl != 60 {
+		t.Errorf("TTL %d, want 60 from the update", ttl)
+	}
+
+	// удаление одного значения (класс NONE) оставляет другие
+	del := rr(`_acme-challenge.example.com. 0 NONE TXT "one"`)
+	if rcode := send("example.com.", key.Secret, true, del); rcode != dns.RcodeSuccess {
+		t.Fatalf("delete: %s", dns.RcodeToString[rcode])
+	}
+	if v := values("_acme-challenge.example.com"); len(v) != 1 || v[0] != "two" {
+		t.Fatalf("after delete: %v, want [two]", v)
+	}
+
+	// второе добавление не проходит по лимиту - удаление из того же обновления не применяется
+	rcode := send("example.com.", key.Secret, true,
+		rr(`_acme-challenge.example.com. 0 NONE TXT "two"`),
+		rr(`_acme-challenge.a.example.com. 60 IN TXT "three"`),
+		rr(`_acme-challenge.b.example.com. 60 IN TXT "four"`))
+	if rcode != dns.RcodeRefused {
+		t.Errorf("over quota: %s, want REFUSED", dns.RcodeToString[rcode])
+	}
+	if v := values("_acme-challenge.example.com"); len(v) != 1 || v[0] != "two" {
+		t.Errorf("partially applied update: %v, want [two]", v)
+	}
+	if v := values("_acme-challenge.a.example.com"); len(v) != 0 {
+		t.Errorf("partially applied update: %v", v)
+	}
+}
+
+// TestCookiesRequire - с -dns-cookies require UDP запрос без нашего серверного cookie получает
+// BADCOOKIE с новым cookie, повтор с ним обслуживается, чужой серверный cookie не принимается
+func TestCookiesRequire(t *testing.T) {
+	quietLog(t)
+	ds := challengeServer(t, 1)
+	if err := ds.SetCookies(CookiesRequire, "0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	ask := func(cookie string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg).SetQuestion("_acme-challenge.example.com.", dns.TypeTXT).SetEdns0(1232, false)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		w := &recorder{}
+		ds.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Fatal("no response")
+		}
+		return w.msg
+	}
+	responseCookie := func(m *dns.Msg) string {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+					return c.Cookie
+				}
+			}
+		}
+		return ""
+	}
+
+	const client = "0102030405060708"
+	resp := ask(client)
+	if resp.Rcode != dns.RcodeBadCookie || len(resp.Answer) != 0 {
+		t.Fatalf("client cookie only: %s with %d answers, want BADCOOKIE", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+	cookie := responseCookie(resp)
+	if len(cookie) != 2*(clientCookieLen+serverCookieLen) || cookie[:len(client)] != client {
+		t.Fatalf("issued cookie %q", cookie)
+	}
+	if resp := ask(cookie); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("issued cookie: %s with %d answers", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+	// тот же серверный cookie с другим клиентским не подходит
+	forged := "0807060504030201" + cookie[len(client):]
+	if resp := ask(forged); resp.Rcode != dns.RcodeBadCookie {
+		t.Errorf("forged cookie: %s, want BADCOOKIE", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := ask("0102"); resp.Rcode != dns.RcodeFormatError {
+		t.Errorf("malformed cookie: %s, want FORMERR", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+// TestTransferACL - AXFR и IXFR только из -transfer-allow или с TSIG ключом; SOA зоны - всем
+func TestTransferACL(t *testing.T) {
+	quietLog(t)
+	transfer := func(allow string, qtype uint16) *dns.Msg {
+		t.Helper()
+		ds := challengeServer(t, 1)
+		_, network, _ := net.ParseCIDR(allow)
+		ds.SetTransfer("example.com.", "ns1.example.com.", []*net.IPNet{network}, nil)
+		req := new(dns.Msg).SetQuestion("example.com.", qtype)
+		w := &recorder{tcp: true}
+		ds.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Fatal("no response")
+		}
+		return w.msg
+	}
+
+	// recorder отвечает с 127.0.0.1
+	resp := transfer("127.0.0.0/8", dns.TypeAXFR)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 {
+		t.Errorf("allowed AXFR: %s with %d records, want SOA, TXT and SOA", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+	if resp := transfer("127.0.0.0/8", dns.TypeIXFR); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("allowed IXFR: %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		if resp := transfer("192.0.2.0/24", qtype); resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+			t.Errorf("%s from outside the ACL: %s with %d records, want REFUSED", dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		}
+	}
+	if resp := transfer("192.0.2.0/24", dns.TypeSOA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("zone SOA from outside the ACL: %s with %d records", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+}
+
+// testPrimary запускает на одном порту 127.0.0.1 UDP и TCP сервер с обработчиком handler
+// (SOA по UDP, передачи зоны по TCP) и возвращает его адрес
+func testPrimary(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Skipf("UDP port of the TCP listener is busy: %v", err)
+	}
+	for _, srv := range []*dns.Server{{Listener: l, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		srv := srv
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return l.Addr().String()
+}
+
+// TestSecondary - копия зоны: AXFR без копии, IXFR с известного serial (в том числе ответ
+// полной зоной), без передачи при том же serial; TXT записи зоны, которых нет у первичного, удаляются
+func TestSecondary(t *testing.T) {
+	quietLog(t)
+	const zone = "example.com."
+	soa := func(serial uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: serial, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 60}
+	}
+	txt := func(name, value string) dns.RR {
+		return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120}, Txt: []string{value}}
+	}
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "ns1.example.com."}
+	const (
+		a     = "_acme-challenge.a.example.com."
+		b     = "_acme-challenge.b.example.com."
+		local = "_acme-challenge.local.example.com."
+		other = "_acme-challenge.example.org."
+	)
+
+	tests := []struct {
+		name     string
+		copy     uint32 // serial локальной копии, 0 - копии нет
+		serial   uint32 // serial первичного, 0 - SOA нет
+		transfer []dns.RR
+		query    uint16 // ожидаемый запрос передачи, 0 - передачи нет
+		copied   uint32 // serial копии после обновления, 0 - serial первичного
+		wantErr  bool
+		want     map[string]string // значения имен после обновления через запятую
+	}{
+		{name: "initial axfr", serial: 1, transfer: []dns.RR{soa(1), ns, txt(a, "1"), txt(a, "2"), txt(b, "3"), soa(1)}, query: dns.TypeAXFR,
+			want: map[string]string{a: "1,2", b: "3", local: "", other: "kept"}},
+		{name: "serial unchanged", copy: 1, serial: 1,
+			want: map[string]string{a: "old", local: "local"}},
+		{name: "ixfr", copy: 1, serial: 2, transfer: []dns.RR{soa(2), soa(1), txt(a, "old"), soa(2), txt(a, "new"), txt(b, "3"), soa(2)}, query: dns.TypeIXFR,
+			want: map[string]string{a: "new", b: "3", local: "local"}},
+		{name: "ixfr answered with the full zone", copy: 1, serial: 2, transfer: []dns.RR{soa(2), txt(b, "3"), soa(2)}, query: dns.TypeIXFR,
+			want: map[string]string{a: "", b: "3", local: "", other: "kept"}},
+		// первичный отвечает на IXFR одним SOA с serial копии: копия актуальна
+		{name: "ixfr up to date", copy: 1, serial: 2, transfer: []dns.RR{soa(1)}, query: dns.TypeIXFR, copied: 1,
+			want: map[string]string{a: "old", local: "local"}},
+		{name: "no soa", wantErr: true,
+			want: map[string]string{a: "old", local: "local"}},
+		{name: "transfer refused", serial: 1, query: dns.TypeAXFR, wantErr: true,
+			want: map[string]string{a: "old", local: "local"}},
+		{name: "transfer without soa", serial: 1, transfer: []dns.RR{txt(a, "1")}, query: dns.TypeAXFR, wantErr: true,
+			want: map[string]string{a: "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var transfers []uint16
+			primary := testPrimary(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				switch qtype := r.Question[0].Qtype; qtype {
+				case dns.TypeSOA:
+					if tt.serial == 0 {
+						m.Rcode = dns.RcodeNameError
+					} else {
+						m.Answer = []dns.RR{soa(tt.serial)}
+					}
+				case dns.TypeAXFR, dns.TypeIXFR:
+					mutex.Lock()
+					transfers = append(transfers, qtype)
+					mutex.Unlock()
+					if tt.transfer == nil {
+						m.Rcode = dns.RcodeRefused
+					}
+					m.Answer = tt.transfer
+				}
+				w.WriteMsg(m)
+			})
+			records := storage.NewRecordManager(storage.NewMemory(), "")
+			for name, value := range map[string]string{a: "old", local: "local", other: "kept"} {
+				if err := records.Add(storage.Source{}, name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := NewSecondary(records, "Example.COM", primary, nil)
+			if tt.copy != 0 {
+				s.soa = soa(tt.copy).(*dns.SOA)
+			}
+
+			err := s.refresh()
+			mutex.Lock()
+			defer mutex.Unlock()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("refresh error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.query == 0 && len(transfers) != 0 || tt.query != 0 && (len(transfers) != 1 || transfers[0] != tt.query) {
+				t.Errorf("transfers %v, want %s", transfers, dns.TypeToString[tt.query])
+			}
+			for name, want := range tt.want {
+				if got := strings.Join(records.Values(name), ","); got != want {
+					t.Errorf("%s: %q, want %q", name, got, want)
+				}
+			}
+			copied := tt.copied
+			if copied == 0 {
+				copied = tt.serial
+			}
+			if !tt.wantErr && (s.soa == nil || s.soa.Serial != copied) {
+				t.Errorf("copy SOA %v, want serial %d", s.soa, copied)
+			}
+		})
+	}
+}
+
+func quietLog(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// BenchmarkServeDNS - горячий путь: вопрос валидатора о записи с двумя значениями (wildcard
+// и основное имя), тот же вопрос из кэша ответов и вопрос об отсутствующей записи
+func BenchmarkServeDNS(b *testing.B) {
+	quietLog(b)
+	for _, bc := range []struct {
+		name  string
+		qname string
+		cache bool
+	}{
+		{"txt", "_acme-challenge.example.com.", false},
+		{"txt-cached", "_acme-challenge.example.com.", true},
+		{"missing", "_acme-challenge.other.example.com.", false},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ds := challengeServer(b, 2)
+			if bc.cache {
+				ds.SetCache(16, time.Minute)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(bc.qname, dns.TypeTXT)
+			w := &recorder{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ds.ServeDNS(w, req)
+			}
+		})
+	}
+}
+
+// serveDNSAllocBudget - сколько выделений памяти допустимо на ответ TXT без кэша, включая
+// упаковку ответа. Рост выше бюджета - регрессия горячего пути: сначала найти ее причину
+// (go test -bench ServeDNS -benchmem -memprofile), бюджет поднимать только осознанно
+const serveDNSAllocBudget = 60
+
+func TestServeDNSAllocBudget(t *testing.T) {
+	quietLog(t)
+	ds := challengeServer(t, 2)
+	req := new(dns.Msg)
+	req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+	w := &recorder{}
+	allocs := testing.AllocsPerRun(100, func() {
+		ds.ServeDNS(w, req)
+	})
+	t.Logf("%.0f allocations per query", allocs)
+	if allocs > serveDNSAllocBudget {
+		t.Errorf("ServeDNS makes %.0f allocations per query, budget is %d", allocs, serveDNSAllocBudget)
+	}
+}
+
+// FuzzServeDNS подает в ServeDNS все, что разбирает dns.Msg.Unpack: сервер на открытом порту
+// получает произвольные пакеты, ни один из них не должен ронять процесс или давать ответ,
+// который нельзя упаковать. Сервер настроен со всеми обработчиками вопросов: кэш, cookies,
+// статические записи зоны, передача зоны, RFC 2136 и CH version.bind
+func FuzzServeDNS(f *testing.F) {
+	quietLog(f)
+	seeds := [][]byte{
+		rawQuery(1, exampleTXT),
+		rawQuery(2, exampleTXT, exampleTXT),
+		rawQuery(0),
+		rawQuery(1, exampleTXT[:9]),
+	}
+	for _, m := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("_acme-challenge.example.com.", dns.TypeTXT),
+		new(dns.Msg).SetQuestion("_ACME-challenge.Example.com.", dns.TypeANY),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeSOA),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeAXFR),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeIXFR),
+		new(dns.Msg).SetQuestion("nope.example.com.", dns.TypeNS),
+		new(dns.Msg).SetQuestion("_acme-challenge.example.com.", dns.TypeTXT).SetEdns0(4096, true),
+		new(dns.Msg).SetUpdate("example.com."),
+		new(dns.Msg).SetNotify("example.com."),
+	} {
+		packed, err := m.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, packed)
+	}
+	chaos := new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	cookie := new(dns.Msg).SetQuestion("_acme-challenge.example.com.", dns.TypeTXT).SetEdns0(1232, false)
+	cookie.IsEdns0().Option = append(cookie.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	for _, m := range []*dns.Msg{chaos, cookie} {
+		packed, err := m.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, packed)
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	ds := challengeServer(f, 2)
+	ds.SetCache(16, time.Minute)
+	ds.SetVersion("dns-acme-server fuzz")
+	if err := ds.SetCookies(CookiesRequire, "0123456789abcdef0123456789abcdef"); err != nil {
+		f.Fatal(err)
+	}
+	for _, rr := range []string{
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"ns1.example.com. 3600 IN A 192.0.2.53",
+	} {
+		if err := ds.AddStaticRecord(rr); err != nil {
+			f.Fatal(err)
+		}
+	}
+	key, err := ParseTSIGKey("update.example.com.:c2VjcmV0")
+	if err != nil {
+		f.Fatal(err)
+	}
+	ds.EnableUpdates(key)
+	ds.SetTransfer("example.com.", "ns1.example.com.", nil, nil)
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		req := new(dns.Msg)
+		if err := req.Unpack(packet); err != nil {
+			return
+		}
+		w := &recorder{}
+		ds.ServeDNS(w, req)
+		if w.msg == nil {
+			return
+		}
+		if _, err := w.msg.Pack(); err != nil {
+			t.Fatalf("response cannot be packed: %v\n%v", err, w.msg)
+		}
+		if !w.msg.Response || w.msg.Id != req.Id {
+			t.Fatalf("reply id %#x response %v to query %#x", w.msg.Id, w.msg.Response, req.Id)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package dnsserver
+
+import (
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultMaxUDPSize - наибольший ответ по UDP: 1232 байта не фрагментируются ни в IPv4, ни
+// в IPv6 (DNS Flag Day 2020), больший ответ клиент получит по TCP
+const DefaultMaxUDPSize = 1232
+
+// SetMaxUDPSize задает наибольший размер ответа по UDP, который объявляется в EDNS;
+// клиент без EDNS получает не больше 512 байт. Вызывается до Serve
+func (ds *Server) SetMaxUDPSize(size int) {
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	ds.maxUDPSize = size
+}
+
+// responseLimit - сколько байт может занять ответ на запрос r, пришедший от client
+func (ds *Server) responseLimit(r *dns.Msg, client net.Addr) int {
+	if _, tcp := client.(*net.TCPAddr); tcp {
+		return dns.MaxMsgSize
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := int(opt.UDPSize())
+	if size > ds.maxUDPSize {
+		size = ds.maxUDPSize
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	return size
+}
+
+// badVersion отвечает BADVERS с OPT версии 0 на запрос с неизвестной версией EDNS
+// (RFC 6891, 6.1.3): клиент повторит запрос с версией, которую мы понимаем
+func (ds *Server) badVersion(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeBadVers)
+	m.SetEdns0(uint16(ds.maxUDPSize), r.IsEdns0().Do())
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
+
+// fitResponse сжимает имена в ответе, отвечает OPT записью на запрос с EDNS и укладывает
+// ответ в размер, который может принять клиент. Если все ответы не помещаются, секции
+// ответа и authority отдаются пустыми с TC: часть RRset хуже, чем ничего (RFC 2181, 9),
+// а валидаторы (Let's Encrypt, Google Public DNS) повторяют такой запрос по TCP.
+func (ds *Server) fitResponse(m, r *dns.Msg, client net.Addr) {
+	if opt := r.IsEdns0(); opt != nil && m.IsEdns0() == nil {
+		m.SetEdns0(uint16(ds.maxUDPSize), opt.Do())
+	}
+	limit := ds.responseLimit(r, client)
+	answers := len(m.Answer)
+	m.Truncate(limit)
+	// Truncate выключает сжатие, если ответ помещается и без него; сжатый ответ меньше
+	// и быстрее доходит, поэтому сжимаем всегда
+	m.Compress = true
+	if len(m.Answer) < answers {
+		log.Printf("Response with %d answers does not fit in %d bytes, setting TC", answers, limit)
+		m.Answer, m.Ns = nil, nil
+		m.Truncated = true
+	}
+}
@@ -0,0 +1,90 @@
+package dnsserver
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dns-acme-server/metrics"
+)
+
+var (
+	tcpConnections = metrics.Default.NewGaugeVec("dns_acme_dns_tcp_connections",
+		"Open TCP DNS connections")
+	tcpRejected = metrics.Default.NewCounterVec("dns_acme_dns_tcp_rejected_total",
+		"TCP DNS connections closed right after accept because -dns-tcp-max-conns was reached")
+)
+
+// SetTCPLimits ограничивает TCP: не больше maxConns соединений (0 - без ограничения),
+// соединение без запросов закрывается через idleTimeout (0 - 8s по умолчанию miekg/dns),
+// на одно соединение не больше maxQueries запросов (0 - 128, -1 - без ограничения).
+// Вызывается до Serve.
+func (ds *Server) SetTCPLimits(maxConns int, idleTimeout time.Duration, maxQueries int) {
+	ds.tcpMaxConns = maxConns
+	ds.tcpIdleTimeout = idleTimeout
+	ds.tcpMaxQueries = maxQueries
+}
+
+// limitTCP оборачивает listener ограничением числа соединений
+func (ds *Server) limitTCP(listener net.Listener) net.Listener {
+	if ds.tcpMaxConns <= 0 {
+		return listener
+	}
+	return &tcpLimitListener{Listener: listener, slots: make(chan struct{}, ds.tcpMaxConns)}
+}
+
+// tcpLimitListener при исчерпании слотов сразу закрывает новое соединение (RST), а не
+// оставляет его в очереди accept: атакующий не держит наши сокеты, а резолвер валидатора
+// быстро получает отказ и повторяет запрос
+type tcpLimitListener struct {
+	net.Listener
+	slots chan struct{}
+	open  int64
+
+	mutex   sync.Mutex
+	lastLog time.Time
+}
+
+func (l *tcpLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			tcpConnections.Set(float64(atomic.AddInt64(&l.open, 1)))
+			return &limitedConn{Conn: conn, listener: l}, nil
+		default:
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+		tcpRejected.Inc()
+		l.mutex.Lock()
+		if time.Since(l.lastLog) > 10*time.Second {
+			l.lastLog = time.Now()
+			log.Printf("TCP DNS connection limit of %d reached, rejecting new connections", cap(l.slots))
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// limitedConn возвращает слот при закрытии
+type limitedConn struct {
+	net.Conn
+	listener *tcpLimitListener
+	once     sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		<-c.listener.slots
+		tcpConnections.Set(float64(atomic.AddInt64(&c.listener.open, -1)))
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/tracing"
+)
+
+// TraceStep - один шаг разбора запроса
+type TraceStep struct {
+	Step   string `json:"step"`
+	Detail string `json:"detail"`
+}
+
+// QueryTrace - пошаговое описание того, как сервер ответил бы на запрос
+type QueryTrace struct {
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Steps     []TraceStep `json:"steps"`
+	Rcode     string      `json:"rcode"`
+	Answer    []string    `json:"answer"`
+	Authority []string    `json:"authority"`
+}
+
+// Step добавляет шаг; у nil трассировки ничего не делает
+func (t *QueryTrace) Step(step, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{Step: step, Detail: fmt.Sprintf(format, args...)})
+}
+
+// traceLookupTXT - lookupTXT с записью попадания или промаха хранилища в trace
+func (ds *Server) traceLookupTXT(ctx context.Context, qname string, trace *QueryTrace) ([]string, error) {
+	start := time.Now()
+	values, err := ds.lookupTXT(ctx, qname)
+	switch {
+	case err != nil:
+		trace.Step("storage", "error after %v: %v", time.Since(start), err)
+	case len(values) == 0:
+		trace.Step("storage", "miss (%v)", time.Since(start))
+	default:
+		trace.Step("storage", "hit (%v): %s", time.Since(start), strings.Join(values, ", "))
+	}
+	return values, err
+}
+
+// Trace проходит тот же путь разрешения, что и ServeDNS, но без кэша и без отметки
+// записей как запрошенных, и возвращает шаги, rcode и секции ответа
+func (ds *Server) Trace(name string, qtype uint16) *QueryTrace {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	trace := &QueryTrace{Name: r.Question[0].Name, Type: dns.TypeToString[qtype], Steps: []TraceStep{}}
+	trace.Step("cache", "bypassed")
+
+	ctx := context.Background()
+	if ds.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ds.queryTimeout)
+		defer cancel()
+	}
+	ctx, span := tracing.StartSpan(ctx, "dns.debug_query", tracing.KindInternal)
+	defer span.End()
+
+	m, _, _ := ds.resolve(ctx, span, r, nil, trace)
+	trace.Rcode = dns.RcodeToString[m.Rcode]
+	trace.Answer, trace.Authority = []string{}, []string{}
+	for _, rr := range m.Answer {
+		trace.Answer = append(trace.Answer, rr.String())
+	}
+	for _, rr := range m.Ns {
+		trace.Authority = append(trace.Authority, rr.String())
+	}
+	return trace
+}
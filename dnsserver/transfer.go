@@ -0,0 +1,283 @@
+package dnsserver
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+var zoneTransfers = metrics.Default.NewCounterVec("dns_acme_zone_transfers_total",
+	"Zone transfers served to secondaries (role=primary) and pulled from the primary (role=secondary)", "role", "result")
+
+const (
+	// SOA зоны для вторичных: serial проверяется раз в минуту, NOTIFY ускоряет это
+	transferRefresh = 60
+	transferRetry   = 15
+	transferExpire  = 7 * 24 * 3600
+	transferMinimum = 60
+	// transferChunk - записей в одном сообщении AXFR
+	transferChunk = 100
+)
+
+// zoneTransfer - выдача зоны вторичным серверам и рассылка им NOTIFY
+type zoneTransfer struct {
+	zone    string
+	nsName  string
+	allowed []*net.IPNet
+	notify  []string
+	key     func() *TSIGKey // действующий -tsig-key
+	serial  uint32          // atomic, растет при каждом изменении записей зоны
+	changed chan struct{}   // сигнал рассыльщику NOTIFY
+}
+
+// SetTransfer разрешает передачу зоны zone (AXFR, IXFR отвечается полной зоной) клиентам из
+// allowed и запросам, подписанным -tsig-key. В зоне динамические и постоянные TXT записи.
+// nsName - MNAME в SOA, пусто - имя зоны. После изменения записей зоны на адреса notify
+// (host:port) отправляется NOTIFY. Вызывается после EnableUpdates и до Serve.
+func (ds *Server) SetTransfer(zone, nsName string, allowed []*net.IPNet, notify []string) {
+	t := &zoneTransfer{
+		zone:    dns.Fqdn(strings.ToLower(zone)),
+		nsName:  nsName,
+		allowed: allowed,
+		notify:  notify,
+		key:     ds.currentKey,
+		serial:  uint32(time.Now().Unix()),
+		changed: make(chan struct{}, 1),
+	}
+	if t.nsName == "" {
+		t.nsName = t.zone
+	}
+	ds.transfer = t
+	ds.records.Observe(t)
+	if ds.hosted != nil {
+		ds.hosted.Observe(t)
+	}
+	if len(notify) > 0 {
+		go t.sendNotifies()
+	}
+}
+
+func (t *zoneTransfer) RecordAdded(src storage.Source, name, value string) {
+	t.recordChanged(name)
+}
+
+func (t *zoneTransfer) RecordRemoved(src storage.Source, name, value string) {
+	t.recordChanged(name)
+}
+
+func (t *zoneTransfer) recordChanged(name string) {
+	if !dns.IsSubDomain(t.zone, dns.Fqdn(strings.ToLower(name))) {
+		return
+	}
+	for {
+		old := atomic.LoadUint32(&t.serial)
+		next := uint32(time.Now().Unix())
+		if int32(next-old) <= 0 {
+			next = old + 1
+		}
+		if atomic.CompareAndSwapUint32(&t.serial, old, next) {
+			break
+		}
+	}
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (t *zoneTransfer) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: t.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: transferMinimum},
+		Ns:      dns.Fqdn(t.nsName),
+		Mbox:    "hostmaster." + t.zone,
+		Serial:  atomic.LoadUint32(&t.serial),
+		Refresh: transferRefresh,
+		Retry:   transferRetry,
+		Expire:  transferExpire,
+		Minttl:  transferMinimum,
+	}
+}
+
+// sendNotifies рассылает NOTIFY после изменений, объединяя изменения за секунду в одно
+func (t *zoneTransfer) sendNotifies() {
+	for range t.changed {
+		time.Sleep(time.Second)
+		select {
+		case <-t.changed:
+		default:
+		}
+		soa := t.soa()
+		key := t.key()
+		c := &dns.Client{Timeout: 5 * time.Second}
+		if key != nil {
+			c.TsigSecret = map[string]string{key.Name: key.Secret}
+		}
+		for _, addr := range t.notify {
+			m := new(dns.Msg)
+			m.SetNotify(t.zone)
+			m.Answer = []dns.RR{soa}
+			if key != nil {
+				m.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+			}
+			if _, _, err := c.Exchange(m, addr); err != nil {
+				log.Printf("Failed to send NOTIFY for %s to %s: %v", t.zone, addr, err)
+			}
+		}
+	}
+}
+
+// transferAllowed - запрос подписан нашим TSIG ключом или пришел из разрешенной сети
+func (ds *Server) transferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if t := r.IsTsig(); t != nil {
+		key := ds.currentKey()
+		return key != nil && strings.EqualFold(t.Hdr.Name, key.Name) && w.TsigStatus() == nil
+	}
+	ip := clientIP(w.RemoteAddr())
+	for _, network := range ds.transfer.allowed {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransfer - AXFR, IXFR или SOA зоны передачи: serial SOA должен совпадать с выдаваемой зоной,
+// поэтому SOA отвечается здесь, а не из статических записей и кэша
+func (ds *Server) isTransfer(r *dns.Msg) bool {
+	if len(r.Question) != 1 {
+		return false
+	}
+	switch q := r.Question[0]; q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		return true
+	case dns.TypeSOA:
+		return ds.transfer != nil && strings.EqualFold(dns.Fqdn(q.Name), ds.transfer.zone)
+	}
+	return false
+}
+
+// handleTransfer отвечает на SOA (всем), AXFR и IXFR зоны. IXFR с текущим serial и любой
+// IXFR по UDP получают только SOA (по UDP вторичный повторит запрос по TCP, RFC 1995, 2)
+func (ds *Server) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	t := ds.transfer
+	q := r.Question[0]
+	if t == nil || !strings.EqualFold(dns.Fqdn(q.Name), t.zone) {
+		ds.refuse(w, r)
+		return
+	}
+	soa := t.soa()
+	if q.Qtype == dns.TypeSOA {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{soa}
+		ds.fitResponse(m, r, w.RemoteAddr())
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("Failed to write DNS response: %v", err)
+		}
+		return
+	}
+	if !ds.transferAllowed(w, r) {
+		zoneTransfers.Inc("primary", "refused")
+		log.Printf("Zone transfer of %s refused for %s", t.zone, w.RemoteAddr())
+		ds.refuse(w, r)
+		return
+	}
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	if q.Qtype == dns.TypeIXFR && (!tcp || clientSerial(r) == soa.Serial) {
+		zoneTransfers.Inc("primary", "uptodate")
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{soa}
+		if tsig := r.IsTsig(); tsig != nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("Failed to write DNS response: %v", err)
+		}
+		return
+	}
+	if !tcp {
+		ds.refuse(w, r)
+		return
+	}
+	records, err := ds.zoneRecords(t.zone)
+	if err != nil {
+		log.Printf("Zone transfer of %s failed: %v", t.zone, err)
+		zoneTransfers.Inc("primary", "failed")
+		ds.serverFailure(w, r)
+		return
+	}
+	rrs := append(append([]dns.RR{soa}, records...), soa)
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for len(rrs) > 0 {
+			n := transferChunk
+			if n > len(rrs) {
+				n = len(rrs)
+			}
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+	}()
+	if err := new(dns.Transfer).Out(w, r, ch); err != nil {
+		log.Printf("Zone transfer of %s to %s failed: %v", t.zone, w.RemoteAddr(), err)
+		zoneTransfers.Inc("primary", "failed")
+		for range ch {
+		}
+		return
+	}
+	zoneTransfers.Inc("primary", "ok")
+	log.Printf("Zone %s (serial %d, %d records) transferred to %s", t.zone, soa.Serial, len(records), w.RemoteAddr())
+}
+
+// zoneRecords - динамические и постоянные TXT записи зоны
+func (ds *Server) zoneRecords(zone string) ([]dns.RR, error) {
+	snap, err := storage.ExportSnapshot(ds.records, ds.hosted)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for _, record := range snap.Records {
+		if !dns.IsSubDomain(zone, record.FQDN) {
+			continue
+		}
+		for _, value := range record.Values {
+			rrs = append(rrs, ds.txtRecord(record.FQDN, value))
+		}
+	}
+	for _, record := range snap.Hosted {
+		if dns.IsSubDomain(zone, record.FQDN) {
+			rrs = append(rrs, hostedTXT(record.FQDN, record))
+		}
+	}
+	return rrs, nil
+}
+
+// clientSerial - serial из SOA в authority IXFR запроса
+func clientSerial(r *dns.Msg) uint32 {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial
+		}
+	}
+	return 0
+}
+
+// refuse отвечает REFUSED без обработки вопросов
+func (ds *Server) refuse(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS response: %v", err)
+	}
+}
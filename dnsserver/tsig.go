@@ -0,0 +1,79 @@
+package dnsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SetTSIGKey меняет ключ -tsig-key на работающем сервере (ротация секрета из Vault или файла).
+// Запросы, подписанные прежним ключом, после замены отклоняются. Прием обновлений
+// должен быть включен EnableUpdates до Serve, key не nil
+func (ds *Server) SetTSIGKey(key *TSIGKey) {
+	ds.tsigMutex.Lock()
+	defer ds.tsigMutex.Unlock()
+	ds.tsigKey = key
+}
+
+// currentKey - действующий ключ, nil - обновления выключены
+func (ds *Server) currentKey() *TSIGKey {
+	ds.tsigMutex.RLock()
+	defer ds.tsigMutex.RUnlock()
+	return ds.tsigKey
+}
+
+// tsigProvider проверяет и создает подписи действующим ключом сервера, чтобы замена ключа
+// не требовала перезапуска dns.Server
+type tsigProvider struct {
+	ds *Server
+}
+
+func (p tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key := p.ds.currentKey()
+	if key == nil || !strings.EqualFold(t.Hdr.Name, key.Name) {
+		return nil, dns.ErrSecret
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, secret)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, secret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, secret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, secret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (p tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// TSIGKey описывает ключ для подписи RFC 2136 обновлений
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// ParseTSIGKey разбирает ключ в формате nsupdate -y: [alg:]name:secret
+func ParseTSIGKey(s string) (*TSIGKey, error) {
+	parts := strings.Split(s, ":")
+	algorithm := "hmac-sha256"
+	switch len(parts) {
+	case 2:
+	case 3:
+		algorithm = strings.ToLower(parts[0])
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("invalid TSIG key %q, expected [alg:]name:secret", s)
+	}
+
+	alg, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm: %s", algorithm)
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid TSIG key %q: empty name or secret", s)
+	}
+
+	return &TSIGKey{
+		Name:      dns.Fqdn(strings.ToLower(parts[0])),
+		Algorithm: alg,
+		Secret:    parts[1],
+	}, nil
+}
+
+// updateMsgAcceptFunc пропускает UPDATE сообщения, остальное проверяет как обычно:
+// на прочие опкоды, кроме QUERY и NOTIFY, отвечает NOTIMP
+func updateMsgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode != dns.OpcodeUpdate {
+		return dns.DefaultMsgAcceptFunc(dh)
+	}
+	if isResponse := dh.Bits&(1<<15) != 0; isResponse {
+		return dns.MsgIgnore
+	}
+	// в UPDATE секция вопросов содержит ровно одну зону
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+func (ds *Server) handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Rcode = ds.applyUpdate(w, r)
+
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("Failed to write DNS UPDATE response: %v", err)
+	}
+}
+
+func (ds *Server) applyUpdate(w dns.ResponseWriter, r *dns.Msg) int {
+	if ds.currentKey() == nil {
+		log.Printf("DNS UPDATE refused: dynamic updates are disabled")
+		return dns.RcodeRefused
+	}
+
+	t := r.IsTsig()
+	if t == nil {
+		log.Printf("DNS UPDATE refused: request is not TSIG signed")
+		return dns.RcodeRefused
+	}
+	if err := w.TsigStatus(); err != nil {
+		log.Printf("DNS UPDATE rejected: TSIG verification failed for key %s: %v", t.Hdr.Name, err)
+		return dns.RcodeNotAuth
+	}
+
+	zone := r.Question[0]
+	if zone.Qtype != dns.TypeSOA || zone.Qclass != dns.ClassINET {
+		return dns.RcodeFormatError
+	}
+
+	// Пререквизиты не поддерживаем, certbot/lego/nsupdate их по умолчанию не шлют
+	if len(r.Answer) > 0 {
+		log.Printf("DNS UPDATE rejected: prerequisites are not supported")
+		return dns.RcodeNotImplemented
+	}
+
+	// Сначала проверяем все записи, чтобы не применить обновление частично
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone.Name, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		if err := ds.records.CheckAllowed(hdr.Name); err != nil {
+			log.Printf("DNS UPDATE refused for %s: %v", hdr.Name, err)
+			return dns.RcodeRefused
+		}
+		switch hdr.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			if hdr.Rrtype != dns.TypeTXT {
+				log.Printf("DNS UPDATE refused: unsupported record type %s", dns.TypeToString[hdr.Rrtype])
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Rrtype != dns.TypeTXT && hdr.Rrtype != dns.TypeANY {
+				log.Printf("DNS UPDATE refused: unsupported record type %s", dns.TypeToString[hdr.Rrtype])
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Изменения применяются пакетом: если одно не прошло (лимит, хук, хранилище),
+	// уже сделанные откатываются (RFC 2136, 3.4)
+	changes := make([]storage.UpdateChange, 0, len(r.Ns))
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		switch hdr.Class {
+		case dns.ClassINET:
+			// добавление записи с TTL из обновления
+			ttl := hdr.Ttl
+			changes = append(changes, storage.UpdateChange{Name: hdr.Name, Value: strings.Join(rr.(*dns.TXT).Txt, ""), TTL: &ttl})
+		case dns.ClassANY:
+			// удаление RRset (или всех RRset имени)
+			changes = append(changes, storage.UpdateChange{Name: hdr.Name, Remove: true})
+		case dns.ClassNONE:
+			// удаление конкретной записи, остальные значения имени остаются
+			changes = append(changes, storage.UpdateChange{Name: hdr.Name, Value: strings.Join(rr.(*dns.TXT).Txt, ""), Remove: true})
+		}
+	}
+	src := storage.Source{Interface: "rfc2136", Addr: w.RemoteAddr().String(), Identity: t.Hdr.Name}
+	err := ds.records.ApplyUpdate(context.Background(), src, changes)
+	if errors.Is(err, storage.ErrQuotaExceeded) || errors.Is(err, storage.ErrStorageFull) || errors.Is(err, storage.ErrReadOnly) ||
+		errors.Is(err, storage.ErrRateLimited) || errors.Is(err, storage.ErrRejectedByHook) || errors.Is(err, storage.ErrDomainNotAllowed) {
+		log.Printf("DNS UPDATE refused for zone %s: %v", zone.Name, err)
+		return dns.RcodeRefused
+	}
+	if err != nil {
+		log.Printf("DNS UPDATE failed for zone %s: %v", zone.Name, err)
+		return dns.RcodeServerFailure
+	}
+
+	log.Printf("DNS UPDATE applied for zone %s by key %s (%d changes)", zone.Name, t.Hdr.Name, len(r.Ns))
+	return dns.RcodeSuccess
+}
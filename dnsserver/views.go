@@ -0,0 +1,93 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// View - представление (split-horizon): клиенты из Networks видят статические записи
+// Records и ZoneFiles в дополнение к общим. Динамические challenge записи видны всем.
+type View struct {
+	Name      string
+	Networks  []*net.IPNet
+	Records   []string // записи в формате зонного файла
+	ZoneFiles []string
+
+	static *StaticRecords // общие записи и записи представления, собирается в LoadStatic
+}
+
+// SetViews задает представления; клиенту отвечает первое, в сети которого он попал,
+// остальным - общими записями. Вызывается до LoadStatic и Serve.
+func (ds *Server) SetViews(views []*View) {
+	for _, v := range views {
+		v.static = NewStaticRecords()
+	}
+	ds.views = views
+}
+
+// matchView возвращает представление клиента; nil - общие записи
+func (ds *Server) matchView(client net.Addr) *View {
+	if len(ds.views) == 0 || client == nil {
+		return nil
+	}
+	ip := clientIP(client)
+	if ip == nil {
+		return nil
+	}
+	for _, v := range ds.views {
+		for _, network := range v.Networks {
+			if network.Contains(ip) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// staticFor - статические записи, которые видит клиент
+func (ds *Server) staticFor(view *View) *StaticRecords {
+	if view == nil {
+		return ds.static
+	}
+	return view.static
+}
+
+// loadViews пересобирает записи представлений поверх общих записей base
+func (ds *Server) loadViews(base *StaticRecords) error {
+	merged := make([]*StaticRecords, len(ds.views))
+	for i, v := range ds.views {
+		static := NewStaticRecords()
+		static.addAll(base)
+		for _, record := range v.Records {
+			if err := static.AddString(record); err != nil {
+				return fmt.Errorf("view %s: %w", v.Name, err)
+			}
+		}
+		for _, path := range v.ZoneFiles {
+			count, err := static.LoadZoneFile(path)
+			if err != nil {
+				return fmt.Errorf("view %s: %w", v.Name, err)
+			}
+			log.Printf("Loaded %d static records for view %s from %s", count, v.Name, path)
+		}
+		merged[i] = static
+	}
+	for i, v := range ds.views {
+		v.static.Replace(merged[i])
+	}
+	return nil
+}
+
+// addAll добавляет все записи other
+func (s *StaticRecords) addAll(other *StaticRecords) {
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+	for _, types := range other.records {
+		for _, rrs := range types {
+			for _, rr := range rrs {
+				s.Add(rr)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/storage"
+)
+
+// ApexTXTRecord переводит значение -apex-txt ZONE=TEXT (SPF, строка подтверждения у вершины
+// делегированной зоны) в статическую TXT запись зонного формата с TTL постоянных записей;
+// текст длиннее 255 байт делится на строки
+func ApexTXTRecord(entry string) (string, error) {
+	zone, text, found := strings.Cut(entry, "=")
+	zone = strings.TrimSpace(zone)
+	if !found || zone == "" || text == "" {
+		return "", fmt.Errorf("invalid apex TXT %q, expected ZONE=TEXT", entry)
+	}
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return "", fmt.Errorf("invalid apex TXT %q: bad zone name", entry)
+	}
+	return hostedTXT(dns.Fqdn(zone), storage.HostedRecord{Value: text, TTL: storage.DefaultHostedTTL}).String(), nil
+}
+
+// Zone - зона, делегированная серверу (-zone): SOA и NS у ее вершины, клиенты, которым можно
+// менять ее записи (-zone-tokens), и адреса, отвечающие только на вопросы о ней (-zone-listen)
+type Zone struct {
+	Name   string
+	NS     []string
+	Tokens []string
+	Listen []string
+}
+
+// zoneNegativeTTL - MINIMUM в SOA зоны: валидатор, спросивший запись до ее появления,
+// не должен долго помнить отрицательный ответ
+const zoneNegativeTTL = 60
+
+// Records - SOA и NS вершины зоны в формате зонного файла; добавляются к статическим записям
+// и перечитываются вместе с ними. MNAME - первый NS, серийный номер - время сборки записей
+func (z *Zone) Records() []string {
+	zone := dns.Fqdn(strings.ToLower(z.Name))
+	records := []string{fmt.Sprintf("%s 3600 IN SOA %s hostmaster.%s %d 7200 3600 1209600 %d",
+		zone, dns.Fqdn(z.NS[0]), zone, time.Now().Unix(), zoneNegativeTTL)}
+	for _, ns := range z.NS {
+		records = append(records, fmt.Sprintf("%s 3600 IN NS %s", zone, dns.Fqdn(ns)))
+	}
+	return records
+}
+
+// SetZones включает ограничение адресов -zone-listen: на них отвечают только на вопросы об
+// их зоне, остальные получают REFUSED. Адреса должны быть среди слушаемых. Вызывается до Serve
+func (ds *Server) SetZones(zones []*Zone) error {
+	listeners := make(map[string]string)
+	for _, z := range zones {
+		for _, addr := range z.Listen {
+			udp, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return fmt.Errorf("zone %s: %w", z.Name, err)
+			}
+			listeners[udp.String()] = dns.Fqdn(strings.ToLower(z.Name))
+		}
+	}
+	ds.zoneListeners = listeners
+	return nil
+}
+
+// listenerZone - зона адреса, на который пришел вопрос; пусто - адрес общий для всех зон
+func (ds *Server) listenerZone(local net.Addr) string {
+	if len(ds.zoneListeners) == 0 || local == nil {
+		return ""
+	}
+	return ds.zoneListeners[local.String()]
+}
+
+// LoadZoneFile загружает записи из небольшого зонного файла (A/AAAA/CAA/MX/TXT и т.п.)
+func (s *StaticRecords) LoadZoneFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var records []dns.RR
+	zp := dns.NewZoneParser(f, "", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	// добавляем только если весь файл разобрался без ошибок
+	for _, rr := range records {
+		s.Add(rr)
+	}
+	return len(records), nil
+}
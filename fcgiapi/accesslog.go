@@ -0,0 +1,220 @@
+package fcgiapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessEntry - одна строка журнала доступа к FastCGI и HTTP API
+type AccessEntry struct {
+	Time       time.Time `json:"time"`
+	Interface  string    `json:"interface"` // fastcgi или api
+	Method     string    `json:"method"`
+	Path       string    `json:"path,omitempty"`
+	Hook       string    `json:"hook,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+type accessEntryKey struct{}
+
+// annotateAccess дополняет запись журнала доступа данными, которые известны только
+// обработчику (хук и домен после разбора запроса)
+func annotateAccess(ctx context.Context, hook, domain string) {
+	if e, ok := ctx.Value(accessEntryKey{}).(*AccessEntry); ok {
+		e.Hook = hook
+		e.Domain = domain
+	}
+}
+
+// annotateIdentity записывает в журнал доступа имя токена, прошедшего авторизацию
+func annotateIdentity(ctx context.Context, identity string) {
+	if e, ok := ctx.Value(accessEntryKey{}).(*AccessEntry); ok {
+		e.Identity = identity
+	}
+}
+
+// AccessLog пишет JSON строку на каждый запрос управления в отдельный файл
+// (не в поток логов приложения) и ротирует его по размеру и возрасту
+type AccessLog struct {
+	path       string
+	maxSize    int64         // 0 - без ротации по размеру
+	maxAge     time.Duration // 0 - без ротации по возрасту
+	maxBackups int           // 0 - хранить все ротированные файлы
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func OpenAccessLog(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*AccessLog, error) {
+	a := &AccessLog{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AccessLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	a.opened = info.ModTime()
+	if a.size == 0 {
+		a.opened = time.Now()
+	}
+	return nil
+}
+
+// Middleware оборачивает обработчик: засекает время, ловит статус и размер ответа
+func (a *AccessLog) Middleware(iface string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		entry := &AccessEntry{
+			Interface: iface,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			ClientIP:  clientIP(r.RemoteAddr),
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		entry.Time = started.UTC()
+		entry.Status = rec.status
+		entry.Bytes = rec.bytes
+		entry.DurationMs = float64(time.Since(started).Microseconds()) / 1000
+		a.write(entry)
+	})
+}
+
+func (a *AccessLog) write(entry *AccessEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode access log entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.needsRotation(int64(len(line))) {
+		if err := a.rotate(); err != nil {
+			log.Printf("Failed to rotate access log %s: %v", a.path, err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write access log %s: %v", a.path, err)
+	}
+}
+
+func (a *AccessLog) needsRotation(next int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.maxSize > 0 && a.size+next > a.maxSize {
+		return true
+	}
+	return a.maxAge > 0 && time.Since(a.opened) > a.maxAge
+}
+
+// rotate переименовывает текущий файл в path.YYYYMMDD-HHMMSS и открывает новый
+func (a *AccessLog) rotate() error {
+	a.file.Close()
+	rotated := fmt.Sprintf("%s.%s", a.path, time.Now().UTC().Format("20060102-150405"))
+	if err := os.Rename(a.path, rotated); err != nil {
+		// продолжаем писать в старый файл
+		if openErr := a.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	a.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups оставляет не больше maxBackups ротированных файлов
+func (a *AccessLog) removeOldBackups() {
+	if a.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return
+	}
+	// имена содержат время ротации, поэтому сортировка по имени - по возрасту
+	sort.Strings(backups)
+	for len(backups) > a.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("Failed to remove old access log %s: %v", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+func (a *AccessLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// statusRecorder запоминает статус и размер ответа для журнала
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush нужен потоку /events
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// clientIP отбрасывает порт из RemoteAddr
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return strings.TrimSpace(remoteAddr)
+}
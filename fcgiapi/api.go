@@ -0,0 +1,230 @@
+package fcgiapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+)
+
+// APIHandler - HTTP API управления для клиентов, которые не умеют FastCGI (certbot и т.п.)
+type APIHandler struct {
+	records *storage.RecordManager
+	mux     *http.ServeMux
+	auth    Authenticator // nil - авторизация выключена
+
+	propagation  *PropagationChecker // nil - не ждать распространения записи
+	strict       bool                // условные изменения по умолчанию, см. mutationCondition
+	anyValues    bool                // не проверять, что значения - дайджесты key authorization
+	keyAuth      KeyAuthPolicy       // обработка полного key authorization вместо дайджеста
+	timeout      time.Duration       // ограничение изменения записи, 0 - без ограничения
+	retry        *storage.RetryQueue // nil - ошибки хранилища возвращаются клиенту
+	registration bool                // POST /register без авторизации, см. EnableRegistration
+}
+
+func NewAPIHandler(records *storage.RecordManager) *APIHandler {
+	h := &APIHandler{
+		records: records,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/certbot/auth", h.handleCertbot("add"))
+	h.mux.HandleFunc("/certbot/cleanup", h.handleCertbot("remove"))
+	h.mux.HandleFunc("/present", h.handleLego("add"))
+	h.mux.HandleFunc("/cleanup", h.handleLego("remove"))
+	h.mux.HandleFunc("/batch/add", h.handleBatch("add"))
+	h.mux.HandleFunc("/batch/remove", h.handleBatch("remove"))
+	return h
+}
+
+// SetRequestTimeout ограничивает время изменения записи в запросе, включая ожидание
+// хранилища; по истечении запрос завершается ошибкой 504
+func (h *APIHandler) SetRequestTimeout(d time.Duration) {
+	h.timeout = d
+}
+
+// SetRetryQueue включает очередь повторов: изменение, которое не удалось записать из-за
+// недоступного хранилища, откладывается, и запрос получает 202 Accepted
+func (h *APIHandler) SetRetryQueue(q *storage.RetryQueue) {
+	h.retry = q
+}
+
+// SetPropagationChecker включает ожидание распространения записи в add запросах
+func (h *APIHandler) SetPropagationChecker(c *PropagationChecker) {
+	h.propagation = c
+}
+
+// SetStrictMutations включает условные изменения по умолчанию (отключаются параметром ?force=1)
+func (h *APIHandler) SetStrictMutations(strict bool) {
+	h.strict = strict
+}
+
+// AllowAnyValues отключает проверку формата значений при добавлении
+func (h *APIHandler) AllowAnyValues(allow bool) {
+	h.anyValues = allow
+}
+
+// SetKeyAuthPolicy задает обработку полного key authorization в значениях
+func (h *APIHandler) SetKeyAuthPolicy(p KeyAuthPolicy) {
+	h.keyAuth = p
+}
+
+// RequireAuth включает авторизацию для всех запросов API: токены -api-tokens-file и плагин -auth-plugin
+func (h *APIHandler) RequireAuth(auth Authenticator) {
+	h.auth = auth
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, span := tracing.StartRequestSpan(r, "api "+r.URL.Path)
+	defer span.End()
+	r = withRequestID(w, r, span)
+	logf(r, "API request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	if h.auth != nil && !uiPublic(r) && !h.registerPublic(r) {
+		_, authSpan := tracing.StartSpan(r.Context(), "auth", tracing.KindInternal)
+		identity, ok := h.auth.Authenticate(r)
+		authSpan.SetAttr("auth.identity", identity)
+		authSpan.End()
+		if !ok {
+			span.SetAttr("http.status_code", "401")
+			logf(r, "API request from %s rejected: invalid credentials", r.RemoteAddr)
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				// без Basic вызова браузер не показывает окно входа поверх панели управления
+				w.Header().Set("WWW-Authenticate", `Bearer realm="dns-acme-server"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dns-acme-server"`)
+			}
+			writeJSON(w, http.StatusUnauthorized, HookResponse{Status: "error", Error: "Unauthorized"})
+			return
+		}
+		annotateIdentity(r.Context(), identity)
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	} else if identity, ok := clientCertIdentity(r); ok {
+		// без токенов клиента называет его сертификат (mTLS)
+		annotateIdentity(r.Context(), identity)
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// handleCertbot принимает переменные --manual-auth-hook/--manual-cleanup-hook certbot
+func (h *APIHandler) handleCertbot(hook string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "POST required"})
+			return
+		}
+		// certbot передает переменные формой; JSON - {"domain":...,"validation":...}
+		if err := parseRequestForm(r, "CERTBOT_"); err != nil {
+			writeJSON(w, formErrorStatus(err), HookResponse{Status: "error", Error: "Error parsing form: " + err.Error()})
+			return
+		}
+
+		domain := r.PostFormValue("CERTBOT_DOMAIN")
+		validation := r.PostFormValue("CERTBOT_VALIDATION")
+		if domain == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "CERTBOT_DOMAIN is required"})
+			return
+		}
+
+		annotateAccess(r.Context(), hook, domain)
+		dnsName, err := h.domainRecordName(domain)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid CERTBOT_DOMAIN: " + err.Error()})
+			return
+		}
+		if validation, err = h.keyAuth.value(validation); err != nil {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid CERTBOT_VALIDATION: " + err.Error()})
+			return
+		}
+		switch hook {
+		case "add":
+			if validation == "" {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "CERTBOT_VALIDATION is required"})
+				return
+			}
+			if err := checkChallengeValue(validation); err != nil && !h.anyValues {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid CERTBOT_VALIDATION: " + err.Error()})
+				return
+			}
+			queued, err := h.store(r, storage.RecordChange{Source: sourceFromRequest(r, "certbot"), Name: dnsName, Value: validation, Condition: apiCondition(r, h.strict, hook, validation)})
+			if err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			if queued {
+				writeJSON(w, http.StatusAccepted, HookResponse{Status: "queued", Hook: hook, FQDN: dnsName, Value: validation})
+				return
+			}
+			tracing.RecordPublished(r.Context(), dnsName)
+			propagation := checkPropagation(h.propagation, w, r, dnsName, validation)
+			writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: hook, FQDN: dnsName, Value: validation, TTL: h.records.TTL(dnsName), Propagation: propagation})
+		case "remove":
+			queued, err := h.store(r, storage.RecordChange{Source: sourceFromRequest(r, "certbot"), Name: dnsName, Value: validation, Remove: true, Condition: apiCondition(r, h.strict, hook, validation)})
+			if err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			if queued {
+				writeJSON(w, http.StatusAccepted, HookResponse{Status: "queued", Hook: hook, FQDN: dnsName})
+				return
+			}
+			writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: hook, FQDN: dnsName})
+		}
+	}
+}
+
+// store выполняет изменение записи внутри спана storage.write с контекстом запроса;
+// queued - хранилище недоступно и изменение отложено в очередь повторов
+func (h *APIHandler) store(r *http.Request, change storage.RecordChange) (queued bool, err error) {
+	ctx, span := tracing.StartSpan(r.Context(), "storage.write", tracing.KindInternal)
+	defer span.End()
+	ctx, cancel := writeContext(ctx, h.timeout)
+	defer cancel()
+	queued, err = storeChange(ctx, h.records, h.retry, change)
+	span.SetError(err)
+	if queued {
+		span.SetAttr("storage.queued", "true")
+	}
+	return queued, err
+}
+
+// writeContext - контекст изменения записи: отменяется вместе с запросом (клиент
+// отключился) и по истечении timeout (0 - без ограничения)
+func writeContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// domainRecordName - имя записи проверки домена с префиксом менеджера записей
+func (h *APIHandler) domainRecordName(domain string) (string, error) {
+	return challengeName(h.records.ChallengePrefix(), domain)
+}
+
+// challengeName возвращает полное имя TXT записи для проверки домена: prefix (с завершающей
+// точкой) и домен; IDN домен переводится в punycode, некорректные метки отклоняются.
+// У wildcard домена запись та же, что у базового (RFC 8555, 8.4).
+func challengeName(prefix, domain string) (string, error) {
+	ascii, err := storage.ToASCII(strings.TrimPrefix(domain, "*."))
+	if err != nil {
+		return "", err
+	}
+	if err := checkHostname(strings.TrimSuffix(ascii, ".")); err != nil {
+		return "", err
+	}
+	return prefix + ascii + ".", nil
+}
+
+// fqdnName - имя записи, переданное целиком (ACME_FQDN, -no-auto-prefix):
+// префикс не добавляется, имя только переводится в punycode и проверяется
+func fqdnName(fqdn string) (string, error) {
+	ascii, err := storage.ToASCII(fqdn)
+	if err != nil {
+		return "", err
+	}
+	return ascii + ".", nil
+}
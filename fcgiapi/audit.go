@@ -0,0 +1,164 @@
+package fcgiapi
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// AuditEntry - одна запись журнала изменений
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"` // add или remove
+	FQDN      string    `json:"fqdn"`
+	ValueHash string    `json:"value_sha256,omitempty"`
+	Interface string    `json:"interface"`
+	Source    string    `json:"source,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"` // заказчик, в пространстве которого имя
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// AuditLog пишет все изменения записей в append-only файл (JSON строка на изменение)
+type AuditLog struct {
+	path    string
+	tenants *storage.Tenants // nil - без заказчиков
+	mutex   sync.Mutex
+	file    *os.File
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: f}, nil
+}
+
+// SetTenants отмечает в записях заказчика имени; вызывается до начала обслуживания
+func (a *AuditLog) SetTenants(t *storage.Tenants) {
+	a.tenants = t
+}
+
+func (a *AuditLog) RecordAdded(src storage.Source, name, value string) {
+	sum := sha256.Sum256([]byte(value))
+	a.write(AuditEntry{Action: "add", FQDN: name, ValueHash: hex.EncodeToString(sum[:])}, src)
+}
+
+func (a *AuditLog) RecordRemoved(src storage.Source, name, value string) {
+	entry := AuditEntry{Action: "remove", FQDN: name}
+	if value != "" {
+		sum := sha256.Sum256([]byte(value))
+		entry.ValueHash = hex.EncodeToString(sum[:])
+	}
+	a.write(entry, src)
+}
+
+func (a *AuditLog) write(entry AuditEntry, src storage.Source) {
+	entry.Time = time.Now().UTC()
+	entry.FQDN = storage.NormalizeDomain(entry.FQDN) + "."
+	entry.Interface = src.Interface
+	entry.Source = src.Addr
+	entry.Identity = src.Identity
+	entry.RequestID = src.RequestID
+	entry.Tenant = a.tenants.Owner(entry.FQDN)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log %s: %v", a.path, err)
+	}
+}
+
+// Query читает журнал и возвращает последние limit записей, подходящих под фильтры
+func (a *AuditLog) Query(fqdn, identity, tenant string, since time.Time, limit int) ([]AuditEntry, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fqdn = storage.NormalizeDomain(fqdn)
+	var result []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if fqdn != "" && storage.NormalizeDomain(entry.FQDN) != fqdn {
+			continue
+		}
+		if identity != "" && entry.Identity != identity {
+			continue
+		}
+		if tenant != "" && entry.Tenant != tenant {
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		result = append(result, entry)
+		if limit > 0 && len(result) > limit {
+			result = result[1:]
+		}
+	}
+	return result, scanner.Err()
+}
+
+// handleAudit - GET /audit?fqdn=&identity=&tenant=&since=RFC3339&limit=N; клиент
+// заказчика видит только записи своего пространства имен
+func (h *APIHandler) handleAudit(audit *AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		tenant := q.Get("tenant")
+		if own := audit.tenants.Of(identityFromContext(r.Context())); own != "" {
+			tenant = own
+		}
+		var since time.Time
+		if s := q.Get("since"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "since must be RFC3339"})
+				return
+			}
+			since = t
+		}
+		limit := 100
+		if s := q.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "invalid limit"})
+				return
+			}
+			limit = n
+		}
+
+		entries, err := audit.Query(q.Get("fqdn"), q.Get("identity"), tenant, since, limit)
+		if err != nil {
+			log.Printf("Audit query failed: %v", err)
+			writeJSON(w, http.StatusInternalServerError, HookResponse{Status: "error", Error: "audit query failed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+// EnableAudit подключает GET /audit
+func (h *APIHandler) EnableAudit(audit *AuditLog) {
+	h.mux.HandleFunc("/audit", h.handleAudit(audit))
+}
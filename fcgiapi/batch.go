@@ -0,0 +1,184 @@
+package fcgiapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+)
+
+// maxBatchItems ограничивает размер одного пакета
+const maxBatchItems = 1000
+
+// BatchItem - элемент пакетного хука: в запросе domain/keyauth, в ответе еще fqdn и ошибка
+type BatchItem struct {
+	Domain  string `json:"domain"`
+	KeyAuth string `json:"keyauth,omitempty"`
+	FQDN    string `json:"fqdn,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// applyBatch проверяет элементы и атомарно применяет пакет, заполняя FQDN и ошибки
+// элементов; recordName строит имя записи по домену элемента, condition - условие изменения
+// по keyauth, anyValues отключает проверку формата keyauth, keyAuth - обработка полного
+// key authorization.
+// Возвращает HTTP статус ответа и ошибку пакета
+func applyBatch(ctx context.Context, r *http.Request, records *storage.RecordManager, iface, hook string, items []BatchItem, ttl *uint32, anyValues bool, keyAuth KeyAuthPolicy, recordName func(domain string) (string, error), condition func(value string) storage.Condition) (int, error) {
+	if len(items) == 0 {
+		return http.StatusBadRequest, fmt.Errorf("empty batch")
+	}
+	if len(items) > maxBatchItems {
+		return http.StatusBadRequest, fmt.Errorf("batch too large: %d items, limit %d", len(items), maxBatchItems)
+	}
+	changes := make([]storage.BatchChange, len(items))
+	var invalid error
+	for i := range items {
+		item := &items[i]
+		annotateAccess(r.Context(), hook, item.Domain)
+		name, err := recordName(item.Domain)
+		if err == nil {
+			if item.KeyAuth, err = keyAuth.value(item.KeyAuth); err != nil {
+				err = fmt.Errorf("invalid keyauth: %v", err)
+			}
+		}
+		if err == nil && hook == "add" && item.KeyAuth == "" {
+			err = fmt.Errorf("keyauth is required for add hook")
+		}
+		if err == nil && hook == "add" && !anyValues {
+			if err = checkChallengeValue(item.KeyAuth); err != nil {
+				err = fmt.Errorf("invalid keyauth: %v", err)
+			}
+		}
+		if err != nil {
+			item.Error = err.Error()
+			if invalid == nil {
+				invalid = fmt.Errorf("invalid item %q: %v", item.Domain, err)
+			}
+			continue
+		}
+		item.FQDN = name
+		changes[i] = storage.BatchChange{Name: name, Value: item.KeyAuth, Condition: condition(item.KeyAuth)}
+	}
+	if invalid != nil {
+		for i := range items {
+			if items[i].Error == "" {
+				items[i].Error = storage.ErrBatchAborted.Error()
+			}
+		}
+		return http.StatusBadRequest, invalid
+	}
+
+	ctx, span := tracing.StartSpan(ctx, "storage.write", tracing.KindInternal)
+	span.SetAttr("batch.size", fmt.Sprint(len(changes)))
+	errs, err := records.ApplyBatch(ctx, sourceFromRequest(r, iface), hook == "remove", changes, ttl)
+	span.SetError(err)
+	span.End()
+	for i, itemErr := range errs {
+		if itemErr != nil {
+			items[i].Error = itemErr.Error()
+		}
+	}
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if hook == "add" {
+		for _, c := range changes {
+			tracing.RecordPublished(r.Context(), c.Name)
+		}
+	}
+	logf(r, "Batch %s of %d records applied", hook, len(changes))
+	return http.StatusOK, nil
+}
+
+// batchText - текстовый ответ пакетного хука, по строке на элемент
+func batchText(hook string, items []BatchItem) string {
+	var b strings.Builder
+	for _, item := range items {
+		switch {
+		case item.Error != "":
+			fmt.Fprintf(&b, "error: %s: %s\n", item.Domain, item.Error)
+		case hook == "add":
+			fmt.Fprintf(&b, "TXT record added: %s -> %s\n", item.FQDN, item.KeyAuth)
+		default:
+			fmt.Fprintf(&b, "TXT record removed: %s\n", item.FQDN)
+		}
+	}
+	return b.String()
+}
+
+// serveBatch обрабатывает FastCGI запрос с повторяющимися ACME_DOMAIN (и ACME_KEYAUTH для add)
+func (h *FastCGIHandler) serveBatch(w http.ResponseWriter, r *http.Request, hook string) {
+	if hook != "add" && hook != "remove" {
+		h.fail(w, r, http.StatusBadRequest, "Unknown hook: "+hook)
+		return
+	}
+	domains := r.Form["ACME_DOMAIN"]
+	keyauths := r.Form["ACME_KEYAUTH"]
+	// для remove ACME_KEYAUTH необязателен, но если передан - по одному на домен
+	if (hook == "add" || len(keyauths) > 0) && len(keyauths) != len(domains) {
+		h.fail(w, r, http.StatusBadRequest, fmt.Sprintf("ACME_KEYAUTH count (%d) must match ACME_DOMAIN count (%d)", len(keyauths), len(domains)))
+		return
+	}
+	ttl, err := parseTTLParam(r.FormValue("ACME_TTL"))
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, "Invalid ACME_TTL: "+r.FormValue("ACME_TTL"))
+		return
+	}
+	items := make([]BatchItem, len(domains))
+	for i, domain := range domains {
+		items[i].Domain = domain
+		if len(keyauths) > 0 {
+			items[i].KeyAuth = keyauths[i]
+		}
+	}
+	logf(r, "FastCGI batch: hook=%s, %d domains", hook, len(items))
+
+	ctx, cancel := writeContext(r.Context(), h.timeout)
+	defer cancel()
+	status, err := applyBatch(ctx, r, h.records, "fastcgi", hook, items, ttl, h.anyValues, h.keyAuth, h.domainRecordName, func(value string) storage.Condition {
+		return fastcgiCondition(r, h.strict, hook, value)
+	})
+	if !h.wantsJSON(r) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, batchText(hook, items))
+		return
+	}
+	resp := HookResponse{Status: "ok", Hook: hook, Items: items}
+	if err != nil {
+		resp.Status, resp.Error = "error", err.Error()
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleBatch принимает JSON массив {domain, keyauth} и применяет его атомарно
+func (h *APIHandler) handleBatch(hook string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "POST required"})
+			return
+		}
+		var items []BatchItem
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&items); err != nil {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid JSON body: " + err.Error()})
+			return
+		}
+		for i := range items {
+			items[i].FQDN, items[i].Error = "", ""
+		}
+		ctx, cancel := writeContext(r.Context(), h.timeout)
+		defer cancel()
+		status, err := applyBatch(ctx, r, h.records, "api", hook, items, nil, h.anyValues, h.keyAuth, h.domainRecordName, func(value string) storage.Condition {
+			return apiCondition(r, h.strict, hook, value)
+		})
+		resp := HookResponse{Status: "ok", Hook: hook, Items: items}
+		if err != nil {
+			resp.Status, resp.Error = "error", err.Error()
+		}
+		writeJSON(w, status, resp)
+	}
+}
@@ -0,0 +1,149 @@
+package fcgiapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// errUnsupportedMediaType - тело не форма и не JSON (415)
+type errUnsupportedMediaType struct {
+	contentType string
+}
+
+func (e *errUnsupportedMediaType) Error() string {
+	return fmt.Sprintf("unsupported Content-Type %s, expected application/x-www-form-urlencoded or application/json", e.contentType)
+}
+
+// isJSONBody определяет формат тела по Content-Type: false - форма (или тела нет),
+// true - JSON (application/json и application/*+json); остальное - errUnsupportedMediaType
+func isJSONBody(r *http.Request) (bool, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return false, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, &errUnsupportedMediaType{contentType: contentType}
+	}
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		return false, nil
+	case mediaType == "application/json" || strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"):
+		return true, nil
+	case r.ContentLength == 0 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		// Content-Type без тела ни на что не влияет
+		return false, nil
+	}
+	return false, &errUnsupportedMediaType{contentType: mediaType}
+}
+
+// parseJSONBody добавляет поля JSON объекта к форме после ParseForm, как будто они пришли
+// в теле формы: {"hook":"add","domain":"example.com"} с prefix ACME_ - ACME_HOOK и ACME_DOMAIN.
+// Значения - строки, числа, true/false или массивы из них (повторяющийся параметр)
+func parseJSONBody(r *http.Request, prefix string) error {
+	var fields map[string]json.RawMessage
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return err
+		}
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if dec.More() {
+		return errors.New("invalid JSON body: unexpected data after the object")
+	}
+	for key, raw := range fields {
+		name := strings.ToUpper(key)
+		if !strings.HasPrefix(name, prefix) {
+			name = prefix + name
+		}
+		values, err := jsonParamValues(raw)
+		if err != nil {
+			return fmt.Errorf("invalid JSON body: field %s: %v", key, err)
+		}
+		for _, v := range values {
+			r.Form.Add(name, v)
+			r.PostForm.Add(name, v)
+		}
+	}
+	return nil
+}
+
+// jsonParamValues переводит значение поля в значения параметра формы
+func jsonParamValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		var values []string
+		for _, item := range list {
+			v, err := jsonParamValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	v, err := jsonParamValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func jsonParamValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "", nil
+	case nil:
+		return "", nil
+	}
+	return "", errors.New("expected a string, number, boolean or array of them")
+}
+
+// parseRequestForm - ParseForm с телом в виде формы или JSON объекта (prefix - как у
+// parseJSONBody); ошибка формата тела - errUnsupportedMediaType
+func parseRequestForm(r *http.Request, prefix string) error {
+	isJSON, err := isJSONBody(r)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if !isJSON {
+		return nil
+	}
+	return parseJSONBody(r, prefix)
+}
+
+// formErrorStatus - 415 для неподдерживаемого Content-Type, иначе 400
+func formErrorStatus(err error) int {
+	var mediaErr *errUnsupportedMediaType
+	if errors.As(err, &mediaErr) {
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
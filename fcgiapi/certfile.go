@@ -0,0 +1,62 @@
+package fcgiapi
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// CertificateFile - сертификат HTTP API из пары файлов, который можно перечитать на ходу
+type CertificateFile struct {
+	certFile, keyFile string
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func LoadCertificateFile(certFile, keyFile string) (*CertificateFile, error) {
+	c := &CertificateFile{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload перечитывает сертификат и ключ; при ошибке остается прежний сертификат
+func (c *CertificateFile) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// GetCertificate - для tls.Config.GetCertificate
+func (c *CertificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// NewCertificatePEM - сертификат из PEM в памяти (секрет из Vault), меняется через SetPEM
+func NewCertificatePEM(certPEM, keyPEM []byte) (*CertificateFile, error) {
+	c := &CertificateFile{}
+	if err := c.SetPEM(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetPEM заменяет сертификат; при ошибке остается прежний
+func (c *CertificateFile) SetPEM(certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	return nil
+}
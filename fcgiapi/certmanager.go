@@ -0,0 +1,143 @@
+package fcgiapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+)
+
+// Типы ChallengeReview из acme.cert-manager.io/v1alpha1 (только используемые поля)
+type challengeReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *challengeRequest  `json:"request,omitempty"`
+	Response   *challengeResponse `json:"response,omitempty"`
+}
+
+type challengeRequest struct {
+	UID          string `json:"uid"`
+	Action       string `json:"action"`
+	Type         string `json:"type"`
+	DNSName      string `json:"dnsName"`
+	Key          string `json:"key"`
+	ResolvedFQDN string `json:"resolvedFQDN"`
+	ResolvedZone string `json:"resolvedZone"`
+}
+
+type challengeResponse struct {
+	UID     string        `json:"uid"`
+	Success bool          `json:"success"`
+	Status  *statusResult `json:"status,omitempty"`
+}
+
+type statusResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// EnableCertManager регистрирует webhook солвер cert-manager:
+// POST /apis/<group>/v1alpha1/<solver> и discovery документ группы
+func (h *APIHandler) EnableCertManager(group, solver string) {
+	base := fmt.Sprintf("/apis/%s/v1alpha1", group)
+	h.mux.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"kind":         "APIResourceList",
+			"apiVersion":   "v1",
+			"groupVersion": group + "/v1alpha1",
+			"resources": []map[string]interface{}{{
+				"name":         solver,
+				"singularName": solver,
+				"namespaced":   false,
+				"kind":         "ChallengePayload",
+				"verbs":        []string{"create"},
+			}},
+		})
+	})
+	h.mux.HandleFunc(base+"/"+solver, h.handleChallengeReview)
+	log.Printf("cert-manager webhook solver enabled at %s/%s", base, solver)
+}
+
+func (h *APIHandler) handleChallengeReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var review challengeReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "Invalid ChallengeReview", http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+	resp := &challengeResponse{UID: req.UID, Success: true}
+
+	fqdn := req.ResolvedFQDN
+	var nameErr error
+	if fqdn == "" && req.DNSName != "" {
+		fqdn, nameErr = h.domainRecordName(strings.TrimPrefix(req.DNSName, "*."))
+	}
+	fqdn = strings.TrimSuffix(fqdn, ".") + "."
+	key, keyErr := h.keyAuth.value(req.Key)
+
+	switch {
+	case nameErr != nil:
+		resp.Success = false
+		resp.Status = &statusResult{Status: "Failure", Message: "invalid dnsName: " + nameErr.Error(), Code: http.StatusBadRequest}
+	case keyErr != nil:
+		resp.Success = false
+		resp.Status = &statusResult{Status: "Failure", Message: "invalid key: " + keyErr.Error(), Code: http.StatusBadRequest}
+	case req.Type != "" && req.Type != "dns-01":
+		resp.Success = false
+		resp.Status = &statusResult{Status: "Failure", Message: "unsupported challenge type " + req.Type, Code: http.StatusBadRequest}
+	case fqdn == ".":
+		resp.Success = false
+		resp.Status = &statusResult{Status: "Failure", Message: "resolvedFQDN or dnsName is required", Code: http.StatusBadRequest}
+	case req.Action == "Present":
+		if req.Key == "" {
+			resp.Success = false
+			resp.Status = &statusResult{Status: "Failure", Message: "key is required", Code: http.StatusBadRequest}
+			break
+		}
+		if err := checkChallengeValue(key); err != nil && !h.anyValues {
+			resp.Success = false
+			resp.Status = &statusResult{Status: "Failure", Message: "invalid key: " + err.Error(), Code: http.StatusBadRequest}
+			break
+		}
+		queued, err := h.store(r, storage.RecordChange{Source: sourceFromRequest(r, "cert-manager"), Name: fqdn, Value: key, Condition: apiCondition(r, h.strict, "add", key)})
+		switch {
+		case err != nil:
+			resp.Success = false
+			resp.Status = &statusResult{Status: "Failure", Message: err.Error(), Code: errorStatus(err)}
+		case queued:
+			// cert-manager сам дождется записи в DNS перед проверкой
+			resp.Status = &statusResult{Status: "Success", Message: "queued for retry", Code: http.StatusAccepted}
+		default:
+			tracing.RecordPublished(r.Context(), fqdn)
+		}
+	case req.Action == "CleanUp":
+		queued, err := h.store(r, storage.RecordChange{Source: sourceFromRequest(r, "cert-manager"), Name: fqdn, Value: key, Remove: true, Condition: apiCondition(r, h.strict, "remove", key)})
+		if err != nil {
+			resp.Success = false
+			resp.Status = &statusResult{Status: "Failure", Message: err.Error(), Code: errorStatus(err)}
+		} else if queued {
+			resp.Status = &statusResult{Status: "Success", Message: "queued for retry", Code: http.StatusAccepted}
+		}
+	default:
+		resp.Success = false
+		resp.Status = &statusResult{Status: "Failure", Message: "unknown action " + req.Action, Code: http.StatusBadRequest}
+	}
+
+	log.Printf("cert-manager %s for %s: success=%v", req.Action, fqdn, resp.Success)
+	writeJSON(w, http.StatusOK, challengeReview{
+		APIVersion: review.APIVersion,
+		Kind:       "ChallengeReview",
+		Response:   resp,
+	})
+}
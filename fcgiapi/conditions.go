@@ -0,0 +1,44 @@
+package fcgiapi
+
+import (
+	"net/http"
+	"strings"
+
+	"dns-acme-server/storage"
+)
+
+// mutationCondition строит условие изменения записи. В строгом режиме add не перезаписывает
+// чужое значение, а remove удаляет запись, только если значение совпадает с переданным;
+// force отключает все проверки
+func mutationCondition(strict, force bool, hook, value string, ifNotExists bool, expected string) storage.Condition {
+	if force {
+		return storage.Condition{}
+	}
+	if hook == "add" {
+		return storage.Condition{IfNotExists: ifNotExists || strict}
+	}
+	if expected == "" && strict {
+		expected = value
+	}
+	return storage.Condition{Expected: expected}
+}
+
+// fastcgiCondition читает ACME_IF_NOT_EXISTS, ACME_EXPECT и ACME_FORCE
+func fastcgiCondition(r *http.Request, strict bool, hook, value string) storage.Condition {
+	return mutationCondition(strict, isTrue(r.FormValue("ACME_FORCE")), hook, value,
+		isTrue(r.FormValue("ACME_IF_NOT_EXISTS")), r.FormValue("ACME_EXPECT"))
+}
+
+// apiCondition читает заголовки If-None-Match: * и If-Match: "<value>" и параметр ?force=1
+func apiCondition(r *http.Request, strict bool, hook, value string) storage.Condition {
+	return mutationCondition(strict, isTrue(r.URL.Query().Get("force")), hook, value,
+		strings.TrimSpace(r.Header.Get("If-None-Match")) == "*", strings.Trim(strings.TrimSpace(r.Header.Get("If-Match")), `"`))
+}
+
+func isTrue(s string) bool {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package fcgiapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryTracer прогоняет запрос через DNS сервер и возвращает JSON-сериализуемую трассировку
+type QueryTracer func(name string, qtype uint16) interface{}
+
+// handleQueryDebug - GET /debug/query?name=&type=TXT
+func (h *APIHandler) handleQueryDebug(tracer QueryTracer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET required"})
+			return
+		}
+		q := r.URL.Query()
+		name := strings.TrimSpace(q.Get("name"))
+		if name == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "name is required"})
+			return
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "invalid name"})
+			return
+		}
+		qtype := dns.TypeTXT
+		if s := q.Get("type"); s != "" {
+			t, ok := dns.StringToType[strings.ToUpper(s)]
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "unknown type " + s})
+				return
+			}
+			qtype = t
+		}
+		writeJSON(w, http.StatusOK, tracer(name, qtype))
+	}
+}
+
+// EnableQueryDebug подключает GET /debug/query
+func (h *APIHandler) EnableQueryDebug(tracer QueryTracer) {
+	h.mux.HandleFunc("/debug/query", h.handleQueryDebug(tracer))
+}
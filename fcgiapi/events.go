@@ -0,0 +1,331 @@
+package fcgiapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+var webhookDeliveries = metrics.Default.NewCounterVec("dns_acme_event_webhook_deliveries_total",
+	"Record change events delivered to -event-webhook URLs", "result")
+
+const (
+	// eventHistory - сколько последних событий хранится для переподключения с Last-Event-ID
+	eventHistory = 1024
+	// eventStreamDuration - поток SSE закрывается раньше WriteTimeout HTTP API, EventSource
+	// переподключается сам и получает пропущенное по Last-Event-ID
+	eventStreamDuration = 50 * time.Second
+	// webhookQueue - сколько событий может ждать отправки в один вебхук
+	webhookQueue = 1024
+)
+
+// RecordEvent - изменение записи для SSE и вебхуков: add, remove или expire
+// (значение удалено уборкой забытых записей)
+type RecordEvent struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	FQDN      string    `json:"fqdn"`
+	Value     string    `json:"value,omitempty"` // пустое в remove - удалены все значения
+	Interface string    `json:"interface"`
+	Source    string    `json:"source,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+}
+
+// EventHub рассылает изменения записей подписчикам GET /events и в вебхуки
+type EventHub struct {
+	mutex       sync.Mutex
+	nextID      uint64
+	history     []RecordEvent
+	subscribers map[chan RecordEvent]string // канал -> фильтр по имени (storage.NormalizeDomain)
+	webhooks    []*eventWebhook
+	closed      bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{nextID: 1, subscribers: make(map[chan RecordEvent]string)}
+}
+
+// AddWebhook отправляет каждое событие POST запросом с JSON телом на url; с secret
+// добавляется заголовок X-Signature-256: sha256=<HMAC тела>. Вызывается до начала обслуживания
+func (h *EventHub) AddWebhook(url, secret string) {
+	w := &eventWebhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan RecordEvent, webhookQueue),
+		done:   make(chan struct{}),
+	}
+	w.secret.Store(secret)
+	h.webhooks = append(h.webhooks, w)
+	go w.run()
+}
+
+// SetWebhookSecret меняет секрет подписи всех вебхуков (ротация); следующие отправки
+// подписываются новым секретом
+func (h *EventHub) SetWebhookSecret(secret string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, w := range h.webhooks {
+		w.secret.Store(secret)
+	}
+}
+
+func (h *EventHub) RecordAdded(src storage.Source, name, value string) {
+	h.publish("add", src, name, value)
+}
+
+func (h *EventHub) RecordRemoved(src storage.Source, name, value string) {
+	if src.Interface == storage.ExpireInterface {
+		h.publish("expire", src, name, value)
+		return
+	}
+	h.publish("remove", src, name, value)
+}
+
+func (h *EventHub) publish(eventType string, src storage.Source, name, value string) {
+	key := storage.NormalizeDomain(name)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	event := RecordEvent{
+		ID:        h.nextID,
+		Type:      eventType,
+		Time:      time.Now().UTC(),
+		FQDN:      key + ".",
+		Value:     value,
+		Interface: src.Interface,
+		Source:    src.Addr,
+		Identity:  src.Identity,
+	}
+	h.nextID++
+	h.history = append(h.history, event)
+	if len(h.history) > eventHistory {
+		h.history = h.history[len(h.history)-eventHistory:]
+	}
+	for ch, filter := range h.subscribers {
+		if filter != "" && filter != key {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			// отставший подписчик переподключится и догонит по Last-Event-ID
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	for _, w := range h.webhooks {
+		select {
+		case w.queue <- event:
+		default:
+			webhookDeliveries.Inc("dropped")
+			log.Printf("Event webhook %s queue is full, dropping event %d", w.url, event.ID)
+		}
+	}
+}
+
+// subscribe возвращает события после lastID из истории и канал новых событий
+func (h *EventHub) subscribe(filter string, lastID uint64) ([]RecordEvent, chan RecordEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var missed []RecordEvent
+	if lastID > 0 {
+		for _, event := range h.history {
+			if event.ID > lastID && (filter == "" || storage.NormalizeDomain(event.FQDN) == filter) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	ch := make(chan RecordEvent, 64)
+	if h.closed {
+		close(ch)
+		return missed, ch
+	}
+	h.subscribers[ch] = filter
+	return missed, ch
+}
+
+// Recent - последние n событий из истории, новые первыми
+func (h *EventHub) Recent(n int) []RecordEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	result := []RecordEvent{}
+	for i := len(h.history) - 1; i >= 0 && len(result) < n; i-- {
+		result = append(result, h.history[i])
+	}
+	return result
+}
+
+func (h *EventHub) unsubscribe(ch chan RecordEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Close завершает потоки SSE (иначе остановка HTTP API ждет их) и дожидается отправки
+// очередей вебхуков, но не дольше 10 секунд
+func (h *EventHub) Close() {
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return
+	}
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	h.mutex.Unlock()
+
+	deadline := time.After(10 * time.Second)
+	for _, w := range h.webhooks {
+		close(w.queue)
+		select {
+		case <-w.done:
+		case <-deadline:
+			log.Printf("Event webhook %s did not finish in 10s", w.url)
+			return
+		}
+	}
+}
+
+// handleEvents - GET /events?fqdn=: поток Server-Sent Events, событие на изменение записи
+func (h *APIHandler) handleEvents(hub *EventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "method not allowed"})
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, HookResponse{Status: "error", Error: "streaming is not supported"})
+			return
+		}
+		var filter string
+		if fqdn := r.URL.Query().Get("fqdn"); fqdn != "" {
+			filter = storage.NormalizeDomain(fqdn)
+		}
+		var lastID uint64
+		if s := r.Header.Get("Last-Event-ID"); s != "" {
+			lastID, _ = strconv.ParseUint(s, 10, 64)
+		}
+		missed, events := hub.subscribe(filter, lastID)
+		defer hub.unsubscribe(events)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 1000\n\n")
+		for _, event := range missed {
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		end := time.NewTimer(eventStreamDuration)
+		defer end.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-end.C:
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				writeEvent(w, event)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event RecordEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// EnableEvents подключает GET /events
+func (h *APIHandler) EnableEvents(hub *EventHub) {
+	h.mux.HandleFunc("/events", h.handleEvents(hub))
+}
+
+// eventWebhook отправляет события по одному и по порядку, повторяя неудачные попытки
+type eventWebhook struct {
+	url    string
+	secret atomic.Value // string
+	client *http.Client
+	queue  chan RecordEvent
+	done   chan struct{}
+}
+
+func (w *eventWebhook) run() {
+	defer close(w.done)
+	for event := range w.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		delay := time.Second
+		for attempt := 1; ; attempt++ {
+			err := w.send(body)
+			if err == nil {
+				webhookDeliveries.Inc("ok")
+				break
+			}
+			if attempt == 3 {
+				webhookDeliveries.Inc("failed")
+				log.Printf("Event webhook %s failed for event %d (%s %s): %v", w.url, event.ID, event.Type, event.FQDN, err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (w *eventWebhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := w.secret.Load().(string); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
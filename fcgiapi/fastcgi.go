@@ -0,0 +1,262 @@
+// Package fcgiapi - интерфейсы изменения записей: FastCGI хуки Angie и HTTP API
+// (certbot, lego httpreq, cert-manager webhook) с авторизацией, аудитом и журналом доступа.
+package fcgiapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/fcgi"
+	"strconv"
+	"strings"
+	"time"
+
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+)
+
+// FastCGIHandler обрабатывает ACME_HOOK запросы модуля acme Angie
+type FastCGIHandler struct {
+	records       *storage.RecordManager
+	jsonResponses bool
+	propagation   *PropagationChecker // nil - не ждать распространения записи
+	strict        bool                // add не перезаписывает чужое значение, remove сверяет ACME_KEYAUTH
+	anyValues     bool                // не проверять, что ACME_KEYAUTH - дайджест key authorization
+	keyAuth       KeyAuthPolicy       // обработка полного key authorization вместо дайджеста
+	noAutoPrefix  bool                // ACME_DOMAIN - полное имя записи
+	timeout       time.Duration       // ограничение изменения записи, 0 - без ограничения
+	retry         *storage.RetryQueue // nil - ошибки хранилища возвращаются клиенту
+	maxForm       int64               // размер параметров хука, 0 - DefaultMaxFormSize
+	maxValue      int                 // длина ACME_KEYAUTH, 0 - DefaultMaxValueLength
+}
+
+func NewFastCGIHandler(records *storage.RecordManager) *FastCGIHandler {
+	return &FastCGIHandler{records: records}
+}
+
+// SetRequestTimeout ограничивает время изменения записи в хуке, включая ожидание хранилища
+func (h *FastCGIHandler) SetRequestTimeout(d time.Duration) {
+	h.timeout = d
+}
+
+// SetRetryQueue включает очередь повторов: изменение, которое не удалось записать из-за
+// недоступного хранилища, откладывается, и хук получает 202 Accepted
+func (h *FastCGIHandler) SetRetryQueue(q *storage.RetryQueue) {
+	h.retry = q
+}
+
+// SetPropagationChecker включает ожидание распространения записи в add хуке
+func (h *FastCGIHandler) SetPropagationChecker(c *PropagationChecker) {
+	h.propagation = c
+}
+
+// SetStrictMutations включает условные изменения по умолчанию (отключаются ACME_FORCE=1)
+func (h *FastCGIHandler) SetStrictMutations(strict bool) {
+	h.strict = strict
+}
+
+// AllowAnyValues отключает проверку формата ACME_KEYAUTH при добавлении
+func (h *FastCGIHandler) AllowAnyValues(allow bool) {
+	h.anyValues = allow
+}
+
+// SetKeyAuthPolicy задает обработку полного key authorization в ACME_KEYAUTH
+func (h *FastCGIHandler) SetKeyAuthPolicy(p KeyAuthPolicy) {
+	h.keyAuth = p
+}
+
+// SetNoAutoPrefix включает режим, в котором ACME_DOMAIN - уже полное имя записи
+// и префикс (-challenge-prefix) к нему не добавляется
+func (h *FastCGIHandler) SetNoAutoPrefix(raw bool) {
+	h.noAutoPrefix = raw
+}
+
+// domainRecordName - имя записи для ACME_DOMAIN с учетом -no-auto-prefix
+func (h *FastCGIHandler) domainRecordName(domain string) (string, error) {
+	if h.noAutoPrefix {
+		return fqdnName(domain)
+	}
+	return challengeName(h.records.ChallengePrefix(), domain)
+}
+
+// sourceFromRequest заполняет storage.Source для HTTP/FastCGI запроса
+func sourceFromRequest(r *http.Request, iface string) storage.Source {
+	return storage.Source{
+		Interface: iface,
+		Addr:      r.RemoteAddr,
+		Identity:  identityFromContext(r.Context()),
+		RequestID: requestIDFromContext(r.Context()),
+	}
+}
+
+func (h *FastCGIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, span := tracing.StartRequestSpan(r, "fastcgi.hook")
+	defer span.End()
+	r = withRequestID(w, r, span)
+	logf(r, "FastCGI Request Headers: %v", r.Header)
+
+	if err := h.limitForm(w, r); err != nil {
+		logf(r, "FastCGI request from %s rejected: %v", r.RemoteAddr, err)
+		span.SetError(err)
+		h.fail(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	_, parseSpan := tracing.StartSpan(r.Context(), "parse", tracing.KindInternal)
+	err := parseRequestForm(r, "ACME_")
+	parseSpan.SetError(err)
+	parseSpan.End()
+	if tooLarge := h.formTooLarge(err); tooLarge != nil {
+		logf(r, "FastCGI request from %s rejected: %v", r.RemoteAddr, tooLarge)
+		span.SetError(tooLarge)
+		h.fail(w, r, http.StatusRequestEntityTooLarge, tooLarge.Error())
+		return
+	}
+	if err != nil {
+		logf(r, "Error parsing form: %v", err)
+		span.SetError(err)
+		h.fail(w, r, formErrorStatus(err), "Error parsing form: "+err.Error())
+		return
+	}
+	addFastCGIParams(r)
+	if err := h.checkParamSizes(r); err != nil {
+		logf(r, "FastCGI request from %s rejected: %v", r.RemoteAddr, err)
+		span.SetError(err)
+		h.fail(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	hook := r.FormValue("ACME_HOOK")
+	domain := r.FormValue("ACME_DOMAIN")
+	fqdn := r.FormValue("ACME_FQDN") // полное имя записи вместо ACME_DOMAIN
+	keyauth := r.FormValue("ACME_KEYAUTH")
+	ttlParam := r.FormValue("ACME_TTL")
+
+	logf(r, "FastCGI Params: hook=%s, domain=%s, fqdn=%s, keyauth=%s", hook, domain, fqdn, keyauth)
+	span.SetAttr("acme.hook", hook)
+	if fqdn != "" {
+		span.SetAttr("acme.fqdn", fqdn)
+		annotateAccess(r.Context(), hook, fqdn)
+	} else {
+		span.SetAttr("acme.domain", domain)
+		annotateAccess(r.Context(), hook, domain)
+	}
+
+	if hook == "" || domain == "" && fqdn == "" {
+		h.fail(w, r, http.StatusBadRequest, "ACME_HOOK and ACME_DOMAIN (or ACME_FQDN) are required")
+		return
+	}
+	if domain != "" && fqdn != "" {
+		h.fail(w, r, http.StatusBadRequest, "ACME_DOMAIN and ACME_FQDN are mutually exclusive")
+		return
+	}
+
+	// Повторяющиеся ACME_DOMAIN - пакетный режим
+	if len(r.Form["ACME_DOMAIN"]) > 1 {
+		h.serveBatch(w, r, hook)
+		return
+	}
+
+	// Создаем полное DNS имя (будет нормализовано при сохранении)
+	var dnsName string
+	if fqdn != "" {
+		if dnsName, err = fqdnName(fqdn); err != nil {
+			h.fail(w, r, http.StatusBadRequest, "Invalid ACME_FQDN: "+err.Error())
+			return
+		}
+	} else if dnsName, err = h.domainRecordName(domain); err != nil {
+		h.fail(w, r, http.StatusBadRequest, "Invalid ACME_DOMAIN: "+err.Error())
+		return
+	}
+
+	if keyauth, err = h.keyAuth.value(keyauth); err != nil {
+		h.fail(w, r, http.StatusBadRequest, "Invalid ACME_KEYAUTH: "+err.Error())
+		return
+	}
+
+	switch hook {
+	case "add":
+		if keyauth == "" {
+			h.fail(w, r, http.StatusBadRequest, "ACME_KEYAUTH is required for add hook")
+			return
+		}
+		if err := checkChallengeValue(keyauth); err != nil && !h.anyValues {
+			h.fail(w, r, http.StatusBadRequest, "Invalid ACME_KEYAUTH: "+err.Error())
+			return
+		}
+		ttl, err := parseTTLParam(ttlParam)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "Invalid ACME_TTL: "+ttlParam)
+			return
+		}
+		ctx, writeSpan := tracing.StartSpan(r.Context(), "storage.write", tracing.KindInternal)
+		ctx, cancel := writeContext(ctx, h.timeout)
+		queued, err := storeChange(ctx, h.records, h.retry, storage.RecordChange{Source: sourceFromRequest(r, "fastcgi"), Name: dnsName, Value: keyauth, TTL: ttl, Condition: fastcgiCondition(r, h.strict, hook, keyauth)})
+		cancel()
+		writeSpan.SetError(err)
+		writeSpan.End()
+		if err != nil {
+			span.SetError(err)
+			h.fail(w, r, errorStatus(err), err.Error())
+			return
+		}
+		if queued {
+			h.accepted(w, r, HookResponse{Hook: hook, FQDN: dnsName, Value: keyauth},
+				fmt.Sprintf("TXT record queued: %s -> %s (storage unavailable, will retry)\n", dnsName, keyauth))
+			return
+		}
+		tracing.RecordPublished(r.Context(), dnsName)
+		text := fmt.Sprintf("TXT record added: %s -> %s\n", dnsName, keyauth)
+		propagation := checkPropagation(h.propagation, w, r, dnsName, keyauth)
+		if propagation != nil {
+			text += propagationText(propagation)
+		}
+		h.respond(w, r, HookResponse{Hook: hook, FQDN: dnsName, Value: keyauth, TTL: h.records.TTL(dnsName), Propagation: propagation}, text)
+		logf(r, "TXT record added successfully")
+
+	case "remove":
+		ctx, writeSpan := tracing.StartSpan(r.Context(), "storage.write", tracing.KindInternal)
+		ctx, cancel := writeContext(ctx, h.timeout)
+		queued, err := storeChange(ctx, h.records, h.retry, storage.RecordChange{Source: sourceFromRequest(r, "fastcgi"), Name: dnsName, Value: keyauth, Remove: true, Condition: fastcgiCondition(r, h.strict, hook, keyauth)})
+		cancel()
+		writeSpan.SetError(err)
+		writeSpan.End()
+		if err != nil {
+			span.SetError(err)
+			h.fail(w, r, errorStatus(err), err.Error())
+			return
+		}
+		if queued {
+			h.accepted(w, r, HookResponse{Hook: hook, FQDN: dnsName},
+				fmt.Sprintf("TXT record removal queued: %s (storage unavailable, will retry)\n", dnsName))
+			return
+		}
+		h.respond(w, r, HookResponse{Hook: hook, FQDN: dnsName},
+			fmt.Sprintf("TXT record removed: %s\n", dnsName))
+		logf(r, "TXT record removed successfully")
+
+	default:
+		h.fail(w, r, http.StatusBadRequest, "Unknown hook: "+hook)
+	}
+}
+
+// addFastCGIParams дополняет форму параметрами ACME_*, которые Angie передал как
+// fastcgi_param, а не в QUERY_STRING или теле: параметр формы с тем же именем важнее
+func addFastCGIParams(r *http.Request) {
+	for name, value := range fcgi.ProcessEnv(r) {
+		if strings.HasPrefix(name, "ACME_") && len(r.Form[name]) == 0 {
+			r.Form.Set(name, value)
+		}
+	}
+}
+
+// parseTTLParam разбирает ACME_TTL; пустое значение - TTL по умолчанию (nil)
+func parseTTLParam(param string) (*uint32, error) {
+	if param == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseUint(param, 10, 32)
+	if err != nil || value > storage.MaxTTL {
+		return nil, fmt.Errorf("invalid TTL %q", param)
+	}
+	ttl := uint32(value)
+	return &ttl, nil
+}
@@ -0,0 +1,1350 @@
+package fcgiapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"dns-acme-server/acmeclient"
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+// BenchmarkFastCGIHook - пара хуков add/remove модуля acme Angie: разбор параметров,
+// проверка значения, изменение записи в памяти и ответ
+func BenchmarkFastCGIHook(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	h := NewFastCGIHandler(storage.NewRecordManager(storage.NewMemory(), ""))
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ" // длина как у base64url SHA-256
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, query := range []string{
+			"/?ACME_HOOK=add&ACME_DOMAIN=example.com&ACME_KEYAUTH=" + value,
+			"/?ACME_HOOK=remove&ACME_DOMAIN=example.com&ACME_KEYAUTH=" + value,
+		} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+			if w.Code != 200 {
+				b.Fatalf("%s: %d %s", query, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+// FuzzFastCGIHook подает в хук произвольные параметры запроса и тело формы: повторяющиеся
+// и пустые ACME_*, длинные значения, битые escape-последовательности. Хук должен ответить
+// клиентской ошибкой или успехом, но не паниковать и не отвечать 5xx - хранилище в памяти не отказывает
+func FuzzFastCGIHook(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	for _, seed := range [][2]string{
+		{"ACME_HOOK=add&ACME_DOMAIN=example.com&ACME_KEYAUTH=" + value, ""},
+		{"ACME_HOOK=remove&ACME_DOMAIN=example.com", ""},
+		{"ACME_HOOK=add&ACME_FQDN=_acme-challenge.example.com.&ACME_KEYAUTH=" + value + "&ACME_TTL=60", ""},
+		{"ACME_HOOK=add&ACME_DOMAIN=a.example.com&ACME_DOMAIN=b.example.com&ACME_KEYAUTH=" + value, ""},
+		{"ACME_HOOK=add&ACME_DOMAIN=%ZZ&ACME_KEYAUTH=token.thumbprint", ""},
+		{"", "ACME_HOOK=add&ACME_DOMAIN=bücher.example&ACME_KEYAUTH=" + value + "&ACME_FORCE=1"},
+		{"ACME_HOOK=add", "ACME_DOMAIN=*.example.com&ACME_KEYAUTH=" + value},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	h := NewFastCGIHandler(storage.NewRecordManager(storage.NewMemory(), ""))
+	h.SetStrictMutations(true)
+	f.Fuzz(func(t *testing.T, query, body string) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.URL.RawQuery = query
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code >= 500 {
+			t.Fatalf("query %q body %q: %d %s", query, body, w.Code, w.Body)
+		}
+	})
+}
+
+func TestTokenRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# ci\nci:old\ndev:dev\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := tokens.Rotate("ci", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tokens.Rotate("unknown", time.Hour); err != ErrNotRotatable {
+		t.Errorf("rotate of unknown token: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "# ci\nci:"+secret+"\ndev:dev\n" {
+		t.Errorf("token file after rotate:\n%s", data)
+	}
+	for _, token := range []string{"old", secret} {
+		r := httptest.NewRequest("POST", "/present", nil)
+		r.SetBasicAuth("ci", token)
+		if identity, ok := tokens.Authenticate(r); !ok || identity != "ci" {
+			t.Errorf("token %s rejected during grace", token)
+		}
+	}
+	tokens.previous["ci"] = previousToken{token: "old", until: time.Now()}
+	r := httptest.NewRequest("POST", "/present", nil)
+	r.Header.Set("Authorization", "Bearer old")
+	if _, ok := tokens.Authenticate(r); ok {
+		t.Error("old token accepted after grace")
+	}
+}
+
+// TestFastCGIParams - параметры хука в fastcgi_param вместо QUERY_STRING: ACME_TTL из
+// параметров, ACME_DOMAIN из строки запроса важнее параметра
+func TestFastCGIParams(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fcgi.Serve(l, NewFastCGIHandler(records))
+
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	out := fastcgiRequest(t, l.Addr().String(), map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"QUERY_STRING":    "ACME_DOMAIN=example.com",
+		"ACME_HOOK":       "add",
+		"ACME_DOMAIN":     "other.example.com",
+		"ACME_KEYAUTH":    value,
+		"ACME_TTL":        "30",
+	})
+	if !strings.Contains(out, "TXT record added") {
+		t.Fatalf("response: %s", out)
+	}
+	if values := records.Values("_acme-challenge.example.com"); len(values) != 1 || values[0] != value {
+		t.Errorf("values: %q", values)
+	}
+	if ttl := records.TTL("_acme-challenge.example.com"); ttl != 30 {
+		t.Errorf("TTL %d, want 30 from fastcgi_param", ttl)
+	}
+}
+
+// fastcgiRequest отправляет запрос с параметрами params, как Angie, и возвращает stdout ответа
+func fastcgiRequest(t *testing.T, addr string, params map[string]string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	record := func(typ byte, content []byte) []byte {
+		header := []byte{1, typ, 0, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+		return append(header, content...)
+	}
+	var pairs []byte
+	for name, value := range params {
+		pairs = append(pairs, byte(len(name)), byte(len(value)))
+		pairs = append(append(pairs, name...), value...)
+	}
+	var req []byte
+	req = append(req, record(1, []byte{0, 1, 0, 0, 0, 0, 0, 0})...) // FCGI_BEGIN_REQUEST, responder
+	req = append(req, record(4, pairs)...)                          // FCGI_PARAMS
+	req = append(req, record(4, nil)...)
+	req = append(req, record(5, nil)...) // пустой FCGI_STDIN
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatal(err)
+		}
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+		if _, err := io.ReadFull(conn, content); err != nil {
+			t.Fatal(err)
+		}
+		switch header[1] {
+		case 6: // FCGI_STDOUT
+			stdout.Write(content[:binary.BigEndian.Uint16(header[4:])])
+		case 3: // FCGI_END_REQUEST
+			return stdout.String()
+		}
+	}
+}
+
+func TestFastCGIJSONBody(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	h := NewFastCGIHandler(records)
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	for _, tt := range []struct {
+		contentType, body string
+		code              int
+	}{
+		{"application/json", `{"hook":"add","domain":"example.com","keyauth":"` + value + `","ttl":60}`, 200},
+		{"application/json; charset=utf-8", `{"ACME_HOOK":"add","ACME_DOMAIN":["a.example.com","b.example.com"],"ACME_KEYAUTH":["` + value + `","` + value + `"]}`, 200},
+		{"application/json", `{"hook":"add","domain":"example.com"`, 400},
+		{"application/json", `{"hook":"add","domain":{"name":"example.com"}}`, 400},
+		{"application/json", `{"hook":"remove","domain":"example.com"} {}`, 400},
+		{"text/xml", `<hook>add</hook>`, 415},
+		{"application/x-www-form-urlencoded", "ACME_HOOK=remove&ACME_DOMAIN=a.example.com", 200},
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: %d %s, want %d", tt.contentType, tt.body, w.Code, w.Body, tt.code)
+		}
+	}
+	if ttl := records.TTL("_acme-challenge.example.com"); ttl != 60 {
+		t.Errorf("TTL %d, want 60 from JSON number", ttl)
+	}
+	if values := records.Values("_acme-challenge.b.example.com"); len(values) != 1 {
+		t.Errorf("batch from JSON arrays: %q", values)
+	}
+}
+
+// TestConditionalMutations - условия изменений в хуке FastCGI и в API lego: конфликт дает 409,
+// совпадение и отсутствующая запись - успех; -strict-mutations включает проверки по умолчанию
+func TestConditionalMutations(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const first = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	const second = "QPONMLKJIHGFEDCBAzyxwvutsrqponmlkjihgfedcbA"
+	hook := func(params string) *http.Request {
+		return httptest.NewRequest("GET", "/?ACME_DOMAIN=example.com&"+params, nil)
+	}
+	lego := func(path, value string, header ...string) *http.Request {
+		r := httptest.NewRequest("POST", path, strings.NewReader(`{"fqdn":"_acme-challenge.example.com.","value":"`+value+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+	type step struct {
+		r    *http.Request
+		code int
+	}
+	tests := []struct {
+		name   string
+		strict bool
+		api    bool
+		steps  []step
+		want   string
+	}{
+		{name: "fastcgi if not exists", steps: []step{
+			{hook("ACME_HOOK=add&ACME_IF_NOT_EXISTS=1&ACME_KEYAUTH=" + first), 200},
+			{hook("ACME_HOOK=add&ACME_IF_NOT_EXISTS=1&ACME_KEYAUTH=" + first), 200},
+			{hook("ACME_HOOK=add&ACME_IF_NOT_EXISTS=1&ACME_KEYAUTH=" + second), 409},
+		}, want: first},
+		{name: "fastcgi expect", steps: []step{
+			{hook("ACME_HOOK=add&ACME_KEYAUTH=" + first), 200},
+			{hook("ACME_HOOK=remove&ACME_EXPECT=" + second), 409},
+			{hook("ACME_HOOK=remove&ACME_EXPECT=" + first), 200},
+			{hook("ACME_HOOK=remove&ACME_EXPECT=" + first), 200},
+		}, want: ""},
+		{name: "fastcgi without conditions", steps: []step{
+			{hook("ACME_HOOK=add&ACME_KEYAUTH=" + first), 200},
+			{hook("ACME_HOOK=add&ACME_KEYAUTH=" + second), 200},
+		}, want: first + "," + second},
+		{name: "fastcgi strict", strict: true, steps: []step{
+			{hook("ACME_HOOK=add&ACME_KEYAUTH=" + first), 200},
+			{hook("ACME_HOOK=add&ACME_KEYAUTH=" + second), 409},
+			{hook("ACME_HOOK=remove&ACME_KEYAUTH=" + second), 409},
+			{hook("ACME_HOOK=remove&ACME_KEYAUTH=" + first), 200},
+			{hook("ACME_HOOK=add&ACME_KEYAUTH=" + second), 200},
+			{hook("ACME_HOOK=add&ACME_FORCE=1&ACME_KEYAUTH=" + first), 200},
+		}, want: second + "," + first},
+		{name: "api if-none-match and if-match", api: true, steps: []step{
+			{lego("/present", first, "If-None-Match", "*"), 200},
+			{lego("/present", second, "If-None-Match", "*"), 409},
+			{lego("/cleanup", first, "If-Match", `"`+second+`"`), 409},
+			{lego("/cleanup", first, "If-Match", `"`+first+`"`), 200},
+			{lego("/cleanup", first, "If-Match", `"`+first+`"`), 200},
+		}, want: ""},
+		{name: "api strict", strict: true, api: true, steps: []step{
+			{lego("/present", first), 200},
+			{lego("/present", second), 409},
+			{lego("/cleanup", second), 409},
+			{lego("/present?force=1", second), 200},
+			{lego("/cleanup", first), 200},
+		}, want: second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := storage.NewRecordManager(storage.NewMemory(), "")
+			var h http.Handler
+			if tt.api {
+				api := NewAPIHandler(records)
+				api.SetStrictMutations(tt.strict)
+				h = api
+			} else {
+				fastcgi := NewFastCGIHandler(records)
+				fastcgi.SetStrictMutations(tt.strict)
+				h = fastcgi
+			}
+			for i, st := range tt.steps {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, st.r)
+				if w.Code != st.code {
+					t.Errorf("step %d %s: %d %s, want %d", i, st.r.URL, w.Code, w.Body, st.code)
+				}
+			}
+			if got := strings.Join(records.Values("_acme-challenge.example.com"), ","); got != tt.want {
+				t.Errorf("values %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestChallengePrefix - имя записи строится из префикса своего менеджера записей во всех API
+func TestChallengePrefix(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	for _, prefix := range []string{"", "_delegation_challenge."} {
+		records := storage.NewRecordManager(storage.NewMemory(), prefix)
+		name := records.ChallengePrefix() + "example.com"
+		w := httptest.NewRecorder()
+		NewFastCGIHandler(records).ServeHTTP(w, httptest.NewRequest("GET", "/?ACME_HOOK=add&ACME_DOMAIN=example.com&ACME_KEYAUTH="+value, nil))
+		if w.Code != 200 || len(records.Values(name)) != 1 {
+			t.Errorf("FastCGI with prefix %q: %d, values of %s %q", prefix, w.Code, name, records.Values(name))
+		}
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/present", strings.NewReader(`{"domain":"www.example.com","keyAuth":"token.thumbprint"}`))
+		r.Header.Set("Content-Type", "application/json")
+		NewAPIHandler(records).ServeHTTP(w, r)
+		if name := records.ChallengePrefix() + "www.example.com"; w.Code != 200 || len(records.Values(name)) != 1 {
+			t.Errorf("lego RAW with prefix %q: %d %s, values of %s %q", prefix, w.Code, w.Body, name, records.Values(name))
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	h := NewFastCGIHandler(records)
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	r := httptest.NewRequest("GET", "/?ACME_HOOK=add&ACME_DOMAIN=example.com&ACME_KEYAUTH="+value, nil)
+	r.Header.Set(RequestIDHeader, "0123abcd")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get(RequestIDHeader); got != "0123abcd" {
+		t.Errorf("response request ID %q", got)
+	}
+	if got := records.RequestID("_acme-challenge.example.com"); got != "0123abcd" {
+		t.Errorf("record request ID %q", got)
+	}
+
+	// ID с пробелами и переводами строк мог бы подделать строку журнала - заменяется своим
+	r = httptest.NewRequest("GET", "/?ACME_HOOK=remove&ACME_DOMAIN=example.com", nil)
+	r.Header.Set(RequestIDHeader, "x\nforged line")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get(RequestIDHeader); len(got) != 32 {
+		t.Errorf("generated request ID %q", got)
+	}
+	if got := records.RequestID("_acme-challenge.example.com"); got != "" {
+		t.Errorf("request ID kept after remove: %q", got)
+	}
+}
+
+// TestRegister - POST /register только из -register-allow, выданный пароль подходит для
+// /present, неудачная запись файла не оставляет заказчика
+func TestRegister(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	tenants, err := storage.NewTenants(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	records.SetTenants(tenants)
+	records.SetRateLimit(storage.NewRateLimiter(60, 2))
+
+	register := func(h *APIHandler, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/register", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// без -register-allow регистрироваться нельзя никому
+	closed, err := OpenRegistrations(filepath.Join(t.TempDir(), "register.json"), "auth.example.net", 2, nil, tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAPIHandler(records)
+	h.EnableRegistration(closed)
+	if w := register(h, "192.0.2.1:1234"); w.Code != 403 {
+		t.Errorf("registration without -register-allow: %d %s", w.Code, w.Body)
+	}
+
+	_, allow, _ := net.ParseCIDR("192.0.2.0/24")
+	registered, err := OpenRegistrations(filepath.Join(t.TempDir(), "register.json"), "auth.example.net", 2, []*net.IPNet{allow}, tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = NewAPIHandler(records)
+	h.EnableRegistration(registered)
+	h.RequireAuth(registered)
+	if w := register(h, "198.51.100.1:1234"); w.Code != 403 {
+		t.Errorf("registration from outside -register-allow: %d %s", w.Code, w.Body)
+	}
+	w := register(h, "192.0.2.1:1234")
+	if w.Code != 201 {
+		t.Fatalf("registration: %d %s", w.Code, w.Body)
+	}
+	var resp RegisterResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	present := func(password string) int {
+		body := `{"fqdn":"` + resp.FullDomain + `","value":"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"}`
+		r := httptest.NewRequest("POST", "/present", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.SetBasicAuth(resp.Username, password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := present("wrong"); code != 401 {
+		t.Errorf("present with a wrong password: %d", code)
+	}
+	if code := present(resp.Password); code != 200 {
+		t.Errorf("present with the issued password: %d", code)
+	}
+
+	// лимит -change-rate: вторая регистрация уложилась в burst, третья - нет
+	register(h, "192.0.2.1:1234")
+	if w := register(h, "192.0.2.1:1234"); w.Code != 429 {
+		t.Errorf("registration over the rate limit: %d %s", w.Code, w.Body)
+	}
+
+	// файл не записался - заказчик не остается
+	broken, err := OpenRegistrations(filepath.Join(t.TempDir(), "missing", "register.json"), "auth.example.net", 2, []*net.IPNet{allow}, tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(tenants.List())
+	h = NewAPIHandler(storage.NewRecordManager(storage.NewMemory(), ""))
+	h.EnableRegistration(broken)
+	if w := register(h, "192.0.2.2:1234"); w.Code != 500 {
+		t.Errorf("registration with an unwritable file: %d %s", w.Code, w.Body)
+	}
+	if got := len(tenants.List()); got != before {
+		t.Errorf("%d tenants after a failed registration, want %d", got, before)
+	}
+}
+
+// testCA - CA для сертификатов тестов HTTPS и mTLS
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue выпускает сертификат сервера (на 127.0.0.1) или клиента с DNS именами names
+func (ca *testCA) issue(t *testing.T, client bool, names ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// tlsAPIServer запускает API с сертификатом сервера от ca, как responder: TLS слушатель с
+// GetCertificate; policy - проверка клиентов (mTLS). Возвращает https:// адрес
+func tlsAPIServer(t *testing.T, h http.Handler, ca *testCA, policy *ClientCertPolicy) string {
+	t.Helper()
+	cert, err := NewCertificatePEM(ca.issue(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTLS(t, h, cert, policy)
+}
+
+// serveTLS запускает h на TLS слушателе с сертификатом из source
+func serveTLS(t *testing.T, h http.Handler, source metrics.CertificateSource, policy *ClientCertPolicy) string {
+	t.Helper()
+	config := &tls.Config{GetCertificate: source.GetCertificate}
+	if policy != nil {
+		policy.Apply(config)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h, ErrorLog: metrics.HandshakeErrorLog("api")}
+	go srv.Serve(tls.NewListener(listener, config))
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+// tlsClient доверяет roots и предъявляет клиентский сертификат, если он задан
+func tlsClient(t *testing.T, roots *testCA, certPEM, keyPEM []byte) *http.Client {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(roots.cert)
+	config := &tls.Config{RootCAs: pool}
+	if certPEM != nil {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// TestHTTPSAPI - API по HTTPS с сертификатом CertificateFile: клиент, доверяющий CA, проходит,
+// не доверяющий и HTTP без TLS - нет; битый сертификат при замене не заменяет рабочий.
+// Webhook cert-manager на том же API публикует и убирает значение
+func TestHTTPSAPI(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	h := NewAPIHandler(records)
+	h.EnableCertManager("acme.example.com", "dns-acme")
+	ca := newTestCA(t)
+	base := tlsAPIServer(t, h, ca, nil)
+
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	review := func(client *http.Client, action, dnsName string) (challengeResponse, error) {
+		body := `{"apiVersion":"acme.cert-manager.io/v1alpha1","kind":"ChallengeReview","request":` +
+			`{"uid":"1","action":"` + action + `","type":"dns-01","dnsName":"` + dnsName + `","key":"` + value + `"}}`
+		resp, err := client.Post(base+"/apis/acme.example.com/v1alpha1/dns-acme", "application/json", strings.NewReader(body))
+		if err != nil {
+			return challengeResponse{}, err
+		}
+		defer resp.Body.Close()
+		var out challengeReview
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.Response == nil {
+			return challengeResponse{}, fmt.Errorf("%s: invalid ChallengeReview response", resp.Status)
+		}
+		return *out.Response, nil
+	}
+
+	client := tlsClient(t, ca, nil, nil)
+	if resp, err := review(client, "Present", "example.com"); err != nil || !resp.Success {
+		t.Fatalf("Present over HTTPS: %+v %v", resp, err)
+	}
+	if v := records.Values("_acme-challenge.example.com"); len(v) != 1 || v[0] != value {
+		t.Errorf("values after Present: %v", v)
+	}
+	if resp, err := review(client, "Present", "-bad-.example..com"); err != nil || resp.Success {
+		t.Errorf("Present with an invalid dnsName: %+v %v", resp, err)
+	}
+	if resp, err := review(client, "CleanUp", "example.com"); err != nil || !resp.Success {
+		t.Errorf("CleanUp over HTTPS: %+v %v", resp, err)
+	}
+	if v := records.Values("_acme-challenge.example.com"); len(v) != 0 {
+		t.Errorf("values after CleanUp: %v", v)
+	}
+
+	if _, err := review(tlsClient(t, newTestCA(t), nil, nil), "Present", "example.com"); err == nil {
+		t.Error("client not trusting the CA accepted the server certificate")
+	}
+	// Go на HTTP запрос к TLS слушателю отвечает 400 без обработчика
+	if resp, err := http.Post(strings.Replace(base, "https:", "http:", 1)+"/present", "application/json", strings.NewReader("{}")); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("plain HTTP on the HTTPS listener: %s", resp.Status)
+		}
+	}
+
+	if _, err := NewCertificatePEM([]byte("not a certificate"), nil); err == nil {
+		t.Error("invalid PEM accepted")
+	}
+}
+
+// TestClientCertPolicy - mTLS -api-client-ca с -api-client-allowed: клиент с разрешенным
+// именем проходит и называется по сертификату, без сертификата, с чужим именем или от
+// другого CA - нет
+func TestClientCertPolicy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	ca := newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadClientCertPolicy(caFile, []string{"*.clients.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identity string
+	h := NewAPIHandler(storage.NewRecordManager(storage.NewMemory(), ""))
+	h.mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		identity = identityFromContext(r.Context())
+	})
+	base := tlsAPIServer(t, h, ca, policy)
+
+	get := func(client *http.Client) error {
+		resp, err := client.Get(base + "/whoami")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	}
+	certPEM, keyPEM := ca.issue(t, true, "ci.clients.example")
+	if err := get(tlsClient(t, ca, certPEM, keyPEM)); err != nil {
+		t.Fatalf("allowed client certificate: %v", err)
+	}
+	if identity != "cert:ci.clients.example" {
+		t.Errorf("identity %q", identity)
+	}
+
+	certPEM, keyPEM = ca.issue(t, true, "ci.other.example")
+	if err := get(tlsClient(t, ca, certPEM, keyPEM)); err == nil {
+		t.Error("client certificate outside -api-client-allowed accepted")
+	}
+	if err := get(tlsClient(t, ca, nil, nil)); err == nil {
+		t.Error("client without a certificate accepted")
+	}
+	certPEM, keyPEM = newTestCA(t).issue(t, true, "ci.clients.example")
+	if err := get(tlsClient(t, ca, certPEM, keyPEM)); err == nil {
+		t.Error("client certificate from another CA accepted")
+	}
+}
+
+// TestTokenAuth - токены -api-tokens-file в HTTP API и в metadata gRPC: верный токен
+// проходит и называет клиента, неверный и отсутствующий - нет
+func TestTokenAuth(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("ci:secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := storage.NewRecordManager(storage.NewMemory(), "")
+	h := NewAPIHandler(records)
+	h.RequireAuth(tokens)
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	for _, tc := range []struct {
+		authorization string
+		code          int
+	}{
+		{"Bearer secret", 200},
+		{"Bearer wrong", 401},
+		{"", 401},
+	} {
+		r := httptest.NewRequest("POST", "/present", strings.NewReader(`{"fqdn":"_acme-challenge.example.com","value":"`+value+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("HTTP with %q: %d, want %d", tc.authorization, w.Code, tc.code)
+		}
+	}
+
+	s := NewGRPCServer(records, nil)
+	s.RequireAuth(tokens)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+	if ctx, err := s.authenticate(ctx); err != nil || identityFromContext(ctx) != "ci" {
+		t.Errorf("gRPC with a valid token: %v", err)
+	}
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong"))
+	if _, err := s.authenticate(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("gRPC with a wrong token: %v, want Unauthenticated", err)
+	}
+	if _, err := s.authenticate(context.Background()); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("gRPC without a token: %v, want Unauthenticated", err)
+	}
+}
+
+// headerAuth - проверка клиентов, какую возвращает плагин -auth-plugin: свой заголовок
+type headerAuth struct{}
+
+func (headerAuth) Authenticate(r *http.Request) (string, bool) {
+	if r.Header.Get("X-Internal-Auth") == "valid" {
+		return "plugin:internal", true
+	}
+	return "", false
+}
+
+// TestPluginAuth - плагин авторизации вместе с токенами, как их собирает main: клиент,
+// принятый плагином, проходит под его именем, отвергнутый плагином и без токена - нет
+func TestPluginAuth(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("ci:secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identity string
+	h := NewAPIHandler(storage.NewRecordManager(storage.NewMemory(), ""))
+	h.RequireAuth(Authenticators{tokens, headerAuth{}})
+	h.mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		identity = identityFromContext(r.Context())
+	})
+	for _, tc := range []struct {
+		header, value string
+		code          int
+		identity      string
+	}{
+		{"X-Internal-Auth", "valid", 200, "plugin:internal"},
+		{"Authorization", "Bearer secret", 200, "ci"},
+		{"X-Internal-Auth", "forged", 401, ""},
+		{"Authorization", "Bearer wrong", 401, ""},
+	} {
+		identity = ""
+		r := httptest.NewRequest("GET", "/whoami", nil)
+		r.Header.Set(tc.header, tc.value)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code || identity != tc.identity {
+			t.Errorf("%s: %s: %d as %q, want %d as %q", tc.header, tc.value, w.Code, identity, tc.code, tc.identity)
+		}
+	}
+}
+
+// metricValue - значение метрики name с меткой listener
+func metricValue(name, listener string) float64 {
+	for _, sample := range metrics.Default.Samples() {
+		if sample.Name == name && len(sample.Labels) == 1 && sample.Labels[0].Value == listener {
+			return sample.Value
+		}
+	}
+	return 0
+}
+
+// TestTLSMetrics - неудачные рукопожатия HTTPS API считаются, срок сертификата
+// CertificateFile попадает в gauge, Provisioner без сертификата не проверяется
+func TestTLSMetrics(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	ca := newTestCA(t)
+	base := tlsAPIServer(t, NewAPIHandler(storage.NewRecordManager(storage.NewMemory(), "")), ca, nil)
+
+	before := metricValue("dns_acme_tls_handshake_errors_total", "api")
+	if resp, err := tlsClient(t, ca, nil, nil).Get(base + "/"); err != nil {
+		t.Fatalf("trusted client: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if _, err := tlsClient(t, newTestCA(t), nil, nil).Get(base + "/"); err == nil {
+		t.Fatal("client not trusting the CA connected")
+	}
+	// сервер пишет ошибку после того, как клиент уже закрыл соединение
+	deadline := time.Now().Add(5 * time.Second)
+	for metricValue("dns_acme_tls_handshake_errors_total", "api") == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metricValue("dns_acme_tls_handshake_errors_total", "api") == before {
+		t.Error("failed handshake not counted")
+	}
+
+	cert, err := NewCertificatePEM(ca.issue(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter, err := metrics.NewCertificateWatch("api", cert, 14*24*time.Hour).Check(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Until(notAfter); left <= 0 || left > time.Hour {
+		t.Errorf("certificate expires in %v, want within the hour it was issued for", left)
+	}
+	if days := metricValue("dns_acme_tls_certificate_expiry_days", "api"); days <= 0 || days > 1.0/24 {
+		t.Errorf("expiry gauge %v days", days)
+	}
+
+	provisioner, err := acmeclient.NewProvisioner(acmeclient.Config{
+		Directory: "https://acme.invalid/directory",
+		Domains:   []string{"acme.example.com"},
+		CacheDir:  t.TempDir(),
+	}, storage.NewRecordManager(storage.NewMemory(), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := metrics.NewCertificateWatch("acme", provisioner, time.Hour).Check(time.Now()); err == nil {
+		t.Error("certificate checked before the provisioner obtained one")
+	}
+}
+
+// TestProvisionerCertificate - с -acme-directory, пока сертификат не получен, TLS соединения
+// к API отклоняются; сертификат из -acme-cache-dir принимается сразу после запуска
+func TestProvisionerCertificate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	ca := newTestCA(t)
+	config := acmeclient.Config{
+		Directory: "https://acme.invalid/directory",
+		Domains:   []string{"acme.example.com"},
+		CacheDir:  t.TempDir(),
+	}
+	h := NewAPIHandler(storage.NewRecordManager(storage.NewMemory(), ""))
+	get := func() error {
+		provisioner, err := acmeclient.NewProvisioner(config, storage.NewRecordManager(storage.NewMemory(), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tlsClient(t, ca, nil, nil).Get(serveTLS(t, h, provisioner, nil) + "/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(); err == nil {
+		t.Error("TLS connection accepted before a certificate was obtained")
+	}
+
+	certPEM, keyPEM := ca.issue(t, false, "acme.example.com")
+	for file, data := range map[string][]byte{"cert.pem": certPEM, "key.pem": keyPEM} {
+		if err := os.WriteFile(filepath.Join(config.CacheDir, file), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := get(); err != nil {
+		t.Errorf("cached certificate: %v", err)
+	}
+}
+
+// TestValueValidation - ACME_KEYAUTH должен быть дайджестом SHA-256 в base64url (если не
+// -allow-any-values), ACME_DOMAIN - именем хоста; IDN и wildcard приводятся к имени записи
+func TestValueValidation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const digest = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	tests := []struct {
+		name      string
+		domain    string
+		value     string
+		anyValues bool
+		code      int
+		error     string // подстрока ответа с ошибкой
+		record    string // имя записи при успехе
+	}{
+		{name: "digest", domain: "example.com", value: digest, code: 200, record: "_acme-challenge.example.com"},
+		{name: "wildcard", domain: "*.example.com", value: digest, code: 200, record: "_acme-challenge.example.com"},
+		{name: "idn", domain: "пример.рф", value: digest, code: 200, record: "_acme-challenge.xn--e1afmkfd.xn--p1ai"},
+		{name: "short value", domain: "example.com", value: digest[:42], code: 400, error: "got 42 characters"},
+		{name: "padded value", domain: "example.com", value: digest[:42] + "=", code: 400, error: "base64url"},
+		{name: "standard alphabet", domain: "example.com", value: digest[:42] + "+", code: 400, error: "base64url"},
+		{name: "trailing bits", domain: "example.com", value: digest[:42] + "B", code: 400, error: "base64url"},
+		{name: "any values", domain: "example.com", value: "not a digest", anyValues: true, code: 200, record: "_acme-challenge.example.com"},
+		{name: "ip address", domain: "192.0.2.1", value: digest, code: 400, error: "is an IP address"},
+		{name: "single label", domain: "localhost", value: digest, code: 400, error: "not a fully qualified"},
+		{name: "underscore", domain: "_acme-challenge.example.com", value: digest, code: 400, error: "contains an underscore"},
+		{name: "bad label", domain: "exa mple.com", value: digest, code: 400, error: "Invalid ACME_DOMAIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := storage.NewMemory()
+			records := storage.NewRecordManager(memory, "")
+			h := NewFastCGIHandler(records)
+			h.AllowAnyValues(tt.anyValues)
+			query := url.Values{"ACME_HOOK": {"add"}, "ACME_DOMAIN": {tt.domain}, "ACME_KEYAUTH": {tt.value}}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/?"+query.Encode(), nil))
+			if w.Code != tt.code {
+				t.Fatalf("%d %s, want %d", w.Code, w.Body, tt.code)
+			}
+			if tt.code != 200 {
+				if !strings.Contains(w.Body.String(), tt.error) {
+					t.Errorf("error %q, want %q", w.Body, tt.error)
+				}
+				if stored, _ := memory.ListTXTValues(); len(stored) != 0 {
+					t.Errorf("rejected value stored: %v", stored)
+				}
+				return
+			}
+			if values := records.Values(tt.record); len(values) != 1 || values[0] != tt.value {
+				t.Errorf("%s: %q, want %q", tt.record, values, tt.value)
+			}
+		})
+	}
+}
+
+// testDigest - значение TXT для key authorization (RFC 8555, 8.4)
+func testDigest(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// addHook отправляет хук add с ACME_KEYAUTH=value и возвращает ответ и опубликованные значения
+func addHook(t *testing.T, h *FastCGIHandler, records *storage.RecordManager, value string) (*httptest.ResponseRecorder, []string) {
+	t.Helper()
+	query := url.Values{"ACME_HOOK": {"add"}, "ACME_DOMAIN": {"example.com"}, "ACME_KEYAUTH": {value}}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?"+query.Encode(), nil))
+	return w, records.Values("_acme-challenge.example.com")
+}
+
+// TestThumbprints - полный key authorization принимается только для настроенных аккаунтов
+// и публикуется дайджестом; дайджест проходит без изменений
+func TestThumbprints(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const (
+		account = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+		other   = "0123456789_-abcdefghijklmnopqrstuvwxyzABCDE"
+	)
+	for _, tt := range []struct {
+		thumbprint string
+		ok         bool
+	}{
+		{account, true},
+		{other, true},
+		{account[:42], false},
+		{account[:42] + "=", false},
+		{account[:42] + "/", false},
+	} {
+		if err := CheckThumbprint(tt.thumbprint); (err == nil) != tt.ok {
+			t.Errorf("CheckThumbprint(%q) = %v, want ok %v", tt.thumbprint, err, tt.ok)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		code  int
+		error string
+		want  string // опубликованное значение
+	}{
+		{name: "own account", value: "token-1." + account, code: 200, want: testDigest("token-1." + account)},
+		{name: "second account", value: "token-2." + other, code: 200, want: testDigest("token-2." + other)},
+		{name: "digest", value: account, code: 200, want: account},
+		{name: "foreign account", value: "token-3.0123456789abcdefghijklmnopqrstuvwxyzABCDEFG", code: 400, error: "belongs to account"},
+		{name: "no token", value: "." + account, code: 400, error: "expected a key authorization"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := storage.NewRecordManager(storage.NewMemory(), "")
+			h := NewFastCGIHandler(records)
+			h.SetKeyAuthPolicy(KeyAuthPolicy{Thumbprints: []string{account, other}})
+			w, values := addHook(t, h, records, tt.value)
+			if w.Code != tt.code {
+				t.Fatalf("%d %s, want %d", w.Code, w.Body, tt.code)
+			}
+			if tt.code != 200 {
+				if !strings.Contains(w.Body.String(), tt.error) || len(values) != 0 {
+					t.Errorf("error %q, values %q, want %q and nothing published", w.Body, values, tt.error)
+				}
+				return
+			}
+			if len(values) != 1 || values[0] != tt.want {
+				t.Errorf("published %q, want %q", values, tt.want)
+			}
+		})
+	}
+}
+
+// TestDigestInput - с -digest-input полный key authorization публикуется дайджестом,
+// без него отклоняется как значение не того формата
+func TestDigestInput(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const thumbprint = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	tests := []struct {
+		name   string
+		digest bool
+		value  string
+		code   int
+		want   string
+	}{
+		{name: "key authorization", digest: true, value: "evaGxfADs6pSRb2LAv9IZf17Dt3juxGJ-PCt92wr-oA." + thumbprint, code: 200, want: testDigest("evaGxfADs6pSRb2LAv9IZf17Dt3juxGJ-PCt92wr-oA." + thumbprint)},
+		{name: "digest unchanged", digest: true, value: thumbprint, code: 200, want: thumbprint},
+		{name: "short thumbprint", digest: true, value: "token." + thumbprint[:40], code: 400},
+		{name: "token not base64url", digest: true, value: "to+ken." + thumbprint, code: 400},
+		{name: "digest input off", value: "token." + thumbprint, code: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := storage.NewRecordManager(storage.NewMemory(), "")
+			h := NewFastCGIHandler(records)
+			h.SetKeyAuthPolicy(KeyAuthPolicy{Digest: tt.digest})
+			w, values := addHook(t, h, records, tt.value)
+			if w.Code != tt.code {
+				t.Fatalf("%d %s, want %d", w.Code, w.Body, tt.code)
+			}
+			if tt.code != 200 {
+				if !strings.Contains(w.Body.String(), "Invalid ACME_KEYAUTH") || len(values) != 0 {
+					t.Errorf("error %q, values %q, want an invalid value and nothing published", w.Body, values)
+				}
+				return
+			}
+			if len(values) != 1 || values[0] != tt.want {
+				t.Errorf("published %q, want %q", values, tt.want)
+			}
+		})
+	}
+}
+
+// TestRollback - /history показывает последние изменения имени, /rollback возвращает
+// значение из истории и удаляет остальные
+func TestRollback(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const name = "_acme-challenge.example.com."
+	setup := func(t *testing.T) (*storage.RecordManager, *APIHandler) {
+		records := storage.NewRecordManager(storage.NewMemory(), "")
+		history := NewRecordHistory(3)
+		records.Observe(history)
+		api := NewAPIHandler(records)
+		api.EnableHistory(history)
+		// v1 add a, v2 remove a, v3 add b, v4 add c, v5 remove c: в истории остаются v3-v5
+		for _, change := range []struct {
+			remove bool
+			value  string
+		}{{false, "a"}, {true, "a"}, {false, "b"}, {false, "c"}, {true, "c"}} {
+			var err error
+			if change.remove {
+				err = records.Remove(storage.Source{Interface: "lego"}, name, change.value)
+			} else {
+				err = records.Add(storage.Source{Interface: "lego"}, name, change.value)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return records, api
+	}
+
+	t.Run("history", func(t *testing.T) {
+		_, api := setup(t)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/history?fqdn=_ACME-Challenge.Example.com", nil))
+		var versions []RecordVersion
+		if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+			t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+		}
+		var got []string
+		for _, v := range versions {
+			got = append(got, fmt.Sprintf("%d %s %s", v.Version, v.Action, v.Value))
+		}
+		if want := "5 remove c,4 add c,3 add b"; strings.Join(got, ",") != want {
+			t.Errorf("history %q, want %q", got, want)
+		}
+		w = httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/history", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("history without fqdn: %d", w.Code)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		code   int
+		error  string
+		want   string // значения после отката
+	}{
+		{name: "previous value", body: `{"fqdn":"` + name + `"}`, code: 200, want: "c"},
+		{name: "current value by version", body: `{"fqdn":"_acme-challenge.example.com","version":3}`, code: 200, want: "b"},
+		{name: "removed value by version", body: `{"fqdn":"` + name + `","version":4}`, code: 200, want: "c"},
+		{name: "removal version", body: `{"fqdn":"` + name + `","version":5}`, code: 404, error: "no added value with version 5", want: "b"},
+		{name: "forgotten version", body: `{"fqdn":"` + name + `","version":1}`, code: 404, error: "no added value with version 1", want: "b"},
+		{name: "unknown name", body: `{"fqdn":"_acme-challenge.other.example."}`, code: 404, error: "no previous value", want: "b"},
+		{name: "no fqdn", body: `{"version":3}`, code: 400, want: "b"},
+		{name: "get", method: "GET", code: 405, want: "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, api := setup(t)
+			method := tt.method
+			if method == "" {
+				method = "POST"
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(method, "/rollback", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("%d %s, want %d", w.Code, w.Body, tt.code)
+			}
+			if !strings.Contains(w.Body.String(), tt.error) {
+				t.Errorf("response %s, want %q", w.Body, tt.error)
+			}
+			if got := strings.Join(records.Values(name), ","); got != tt.want {
+				t.Errorf("values %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTokenReload - новый файл токенов заменяет прежние токены, ошибочный или пропавший
+// файл оставляет прежние
+func TestTokenReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // пусто - файл удален
+		tokens  int
+		wantErr bool
+		accept  string // пара имя:токен, которая принимается после перечитывания
+		reject  string
+	}{
+		{name: "rotated", content: "ci:new\ndev:dev\n", tokens: 2, accept: "ci:new", reject: "ci:old"},
+		{name: "comments", content: "# only ci\nci:new\n", tokens: 1, accept: "ci:new", reject: "dev:dev"},
+		{name: "malformed", content: "ci:new\ndev\n", wantErr: true, accept: "ci:old", reject: "ci:new"},
+		{name: "removed", wantErr: true, accept: "ci:old", reject: "ci:new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			if err := os.WriteFile(path, []byte("ci:old\ndev:dev\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			tokens, err := LoadTokenFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.content == "" {
+				err = os.Remove(path)
+			} else {
+				err = os.WriteFile(path, []byte(tt.content), 0o600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := tokens.Reload(path)
+			if (err != nil) != tt.wantErr || n != tt.tokens {
+				t.Errorf("reload: %d tokens, error %v; want %d tokens, error %v", n, err, tt.tokens, tt.wantErr)
+			}
+			for pair, want := range map[string]bool{tt.accept: true, tt.reject: false} {
+				name, token, _ := strings.Cut(pair, ":")
+				r := httptest.NewRequest("POST", "/present", nil)
+				r.SetBasicAuth(name, token)
+				if _, ok := tokens.Authenticate(r); ok != want {
+					t.Errorf("%s accepted %v, want %v", pair, ok, want)
+				}
+			}
+		})
+	}
+}
+
+// TestCertificateReload - перечитанная пара файлов сменяет сертификат API, ошибочная
+// (ключ от другого сертификата, пропавший файл) оставляет прежний
+func TestCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name    string
+		change  func(t *testing.T, certFile, keyFile string)
+		wantErr bool
+	}{
+		{name: "renewed", change: func(t *testing.T, certFile, keyFile string) {
+			certPEM, keyPEM := ca.issue(t, false, "renewed.example.com")
+			writePair(t, certFile, keyFile, certPEM, keyPEM)
+		}},
+		{name: "foreign key", wantErr: true, change: func(t *testing.T, certFile, keyFile string) {
+			certPEM, _ := ca.issue(t, false, "renewed.example.com")
+			_, keyPEM := ca.issue(t, false, "other.example.com")
+			writePair(t, certFile, keyFile, certPEM, keyPEM)
+		}},
+		{name: "certificate removed", wantErr: true, change: func(t *testing.T, certFile, keyFile string) {
+			os.Remove(certFile)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+			certPEM, keyPEM := ca.issue(t, false, "api.example.com")
+			writePair(t, certFile, keyFile, certPEM, keyPEM)
+			c, err := LoadCertificateFile(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, certFile, keyFile)
+
+			err = c.Reload()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("reload error %v, want error %v", err, tt.wantErr)
+			}
+			cert, err := c.GetCertificate(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "renewed.example.com"
+			if tt.wantErr {
+				want = "api.example.com"
+			}
+			if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != want {
+				t.Errorf("serving %v, want %s", leaf.DNSNames, want)
+			}
+		})
+	}
+}
+
+// writePair записывает сертификат и ключ в PEM файлы
+func writePair(t *testing.T, certFile, keyFile string, certPEM, keyPEM []byte) {
+	t.Helper()
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSizeLimits - слишком большие QUERY_STRING, тело (с Content-Length и без него) и
+// параметры хука отклоняются с 413 до разбора и записи
+func TestSizeLimits(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const value = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	longDomain := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 60) + ".com"
+	form := func(params ...string) string {
+		return "ACME_HOOK=add&" + strings.Join(params, "&")
+	}
+	tests := []struct {
+		name     string
+		maxForm  int64
+		maxValue int
+		query    string
+		body     string
+		chunked  bool // тело без Content-Length
+		json     bool
+		code     int
+		error    string
+	}{
+		{name: "within limits", query: form("ACME_DOMAIN=example.com", "ACME_KEYAUTH="+value), code: 200},
+		{name: "long query string", maxForm: 64, query: form("ACME_DOMAIN=example.com", "ACME_KEYAUTH="+value), code: 413, error: "QUERY_STRING is too large"},
+		{name: "declared body", maxForm: 64, body: form("ACME_DOMAIN=example.com", "ACME_KEYAUTH="+value), code: 413, error: "request body is too large"},
+		{name: "chunked form body", maxForm: 64, body: form("ACME_DOMAIN=example.com", "ACME_KEYAUTH="+value), chunked: true, code: 413, error: "request body is too large"},
+		{name: "chunked json body", maxForm: 64, body: `{"hook":"add","domain":"example.com","keyauth":"` + value + `"}`, chunked: true, json: true, code: 413, error: "request body is too large"},
+		{name: "long domain", query: form("ACME_DOMAIN="+longDomain, "ACME_KEYAUTH="+value), code: 413, error: "ACME_DOMAIN is too large: 256 bytes, limit 253"},
+		{name: "long fqdn", query: form("ACME_FQDN=_acme-challenge."+longDomain, "ACME_KEYAUTH="+value), code: 413, error: "ACME_FQDN is too large"},
+		{name: "long value", query: form("ACME_DOMAIN=example.com", "ACME_KEYAUTH="+strings.Repeat("v", 256)), code: 413, error: "ACME_KEYAUTH is too large: 256 bytes, limit 255"},
+		{name: "value over custom limit", maxValue: 40, query: form("ACME_DOMAIN=example.com", "ACME_KEYAUTH="+value), code: 413, error: "limit 40"},
+		{name: "long value in batch", query: form("ACME_DOMAIN=a.example.com", "ACME_DOMAIN=b.example.com", "ACME_KEYAUTH="+value, "ACME_KEYAUTH="+strings.Repeat("v", 300)), code: 413, error: "ACME_KEYAUTH is too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := storage.NewMemory()
+			h := NewFastCGIHandler(storage.NewRecordManager(memory, ""))
+			h.SetSizeLimits(tt.maxForm, tt.maxValue)
+			r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+			if tt.body != "" {
+				r = httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if tt.json {
+					r.Header.Set("Content-Type", "application/json")
+				}
+				if tt.chunked {
+					r.ContentLength = -1
+				}
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.error) {
+				t.Fatalf("%d %s, want %d %q", w.Code, w.Body, tt.code, tt.error)
+			}
+			stored, _ := memory.ListTXTValues()
+			if tt.code == 413 && len(stored) != 0 {
+				t.Errorf("oversized request stored %v", stored)
+			}
+		})
+	}
+}
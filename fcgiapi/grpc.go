@@ -0,0 +1,363 @@
+package fcgiapi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"dns-acme-server/fcgiapi/recordspb"
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+// watchBuffer - сколько событий может отстать подписчик Watch, прежде чем его поток закроется
+const watchBuffer = 256
+
+// GRPCServer - gRPC сервис Records (recordspb/records.proto) для control plane с типизированными
+// клиентами: те же изменения записей, что и в HTTP API, плюс поток изменений Watch
+type GRPCServer struct {
+	recordspb.UnimplementedRecordsServer
+
+	records   *storage.RecordManager
+	usage     *UsageTracker
+	auth      Authenticator // nil - авторизация выключена
+	anyValues bool
+	keyAuth   KeyAuthPolicy // обработка полного key authorization вместо дайджеста
+	server    *grpc.Server
+
+	mutex    sync.Mutex
+	watchers map[*grpcWatcher]bool
+}
+
+// grpcWatcher - подписчик Watch; events закрывается, если он не успевает читать
+type grpcWatcher struct {
+	fqdn   string // пустое - все имена
+	events chan *recordspb.RecordEvent
+}
+
+func NewGRPCServer(records *storage.RecordManager, usage *UsageTracker) *GRPCServer {
+	s := &GRPCServer{
+		records:  records,
+		usage:    usage,
+		watchers: make(map[*grpcWatcher]bool),
+	}
+	records.Observe(s)
+	return s
+}
+
+// RequireAuth включает авторизацию по metadata authorization (Bearer <токен> или Basic)
+func (s *GRPCServer) RequireAuth(auth Authenticator) {
+	s.auth = auth
+}
+
+// AllowAnyValues отключает проверку формата значений при добавлении
+func (s *GRPCServer) AllowAnyValues(allow bool) {
+	s.anyValues = allow
+}
+
+// SetKeyAuthPolicy задает обработку полного key authorization в значениях
+func (s *GRPCServer) SetKeyAuthPolicy(p KeyAuthPolicy) {
+	s.keyAuth = p
+}
+
+// Serve обслуживает listener до Stop; config nil - без TLS
+func (s *GRPCServer) Serve(listener net.Listener, config *tls.Config) error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.authUnary),
+		grpc.StreamInterceptor(s.authStream),
+	}
+	if config != nil {
+		opts = append(opts, grpc.Creds(handshakeCounter{credentials.NewTLS(config)}))
+	}
+	s.mutex.Lock()
+	s.server = grpc.NewServer(opts...)
+	recordspb.RegisterRecordsServer(s.server, s)
+	s.mutex.Unlock()
+	log.Printf("Starting gRPC server on %s", listener.Addr())
+	return s.server.Serve(listener)
+}
+
+// handshakeCounter считает неудачные TLS рукопожатия gRPC в dns_acme_tls_handshake_errors_total
+type handshakeCounter struct {
+	credentials.TransportCredentials
+}
+
+func (c handshakeCounter) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	secure, info, err := c.TransportCredentials.ServerHandshake(conn)
+	if err != nil {
+		metrics.TLSHandshakeErrors.Inc("grpc")
+	}
+	return secure, info, err
+}
+
+func (c handshakeCounter) Clone() credentials.TransportCredentials {
+	return handshakeCounter{c.TransportCredentials.Clone()}
+}
+
+// Stop закрывает потоки Watch и дожидается текущих вызовов, но не дольше 5 секунд
+func (s *GRPCServer) Stop() {
+	s.mutex.Lock()
+	server := s.server
+	for w := range s.watchers {
+		delete(s.watchers, w)
+		close(w.events)
+	}
+	s.mutex.Unlock()
+	if server == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		server.Stop()
+	}
+}
+
+// authenticate определяет клиента по токену или по клиентскому сертификату (mTLS)
+func (s *GRPCServer) authenticate(ctx context.Context) (context.Context, error) {
+	if s.auth != nil {
+		// проверка та же, что и в HTTP API: запрос с заголовком Authorization из metadata
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		r.RemoteAddr = peerAddr(ctx)
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+			r.Header.Set("Authorization", md.Get("authorization")[0])
+		}
+		identity, ok := s.auth.Authenticate(r)
+		if !ok {
+			log.Printf("gRPC request from %s rejected: invalid credentials", peerAddr(ctx))
+			return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+		}
+		return context.WithValue(ctx, identityKey{}, identity), nil
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			return context.WithValue(ctx, identityKey{}, "cert:"+certIdentity(info.State.PeerCertificates[0])), nil
+		}
+	}
+	return ctx, nil
+}
+
+func (s *GRPCServer) authUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	log.Printf("gRPC request: %s from %s", info.FullMethod, peerAddr(ctx))
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) authStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	log.Printf("gRPC stream: %s from %s", info.FullMethod, peerAddr(stream.Context()))
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream подменяет контекст потока контекстом с именем клиента
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+func grpcSource(ctx context.Context) storage.Source {
+	return storage.Source{Interface: "grpc", Addr: peerAddr(ctx), Identity: identityFromContext(ctx)}
+}
+
+// recordName - имя записи из domain (с префиксом) или fqdn (как есть)
+func (s *GRPCServer) recordName(domain, fqdn string) (string, error) {
+	switch {
+	case domain != "" && fqdn != "":
+		return "", status.Error(codes.InvalidArgument, "domain and fqdn are mutually exclusive")
+	case fqdn != "":
+		name, err := fqdnName(fqdn)
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid fqdn: %v", err)
+		}
+		return name, nil
+	case domain != "":
+		name, err := challengeName(s.records.ChallengePrefix(), domain)
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid domain: %v", err)
+		}
+		return name, nil
+	}
+	return "", status.Error(codes.InvalidArgument, "domain or fqdn is required")
+}
+
+// grpcError переводит ошибку изменения записи в статус gRPC
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrDomainNotAllowed), errors.Is(err, storage.ErrRejectedByHook):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, storage.ErrConflict), errors.Is(err, storage.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, storage.ErrQuotaExceeded), errors.Is(err, storage.ErrStorageFull), errors.Is(err, storage.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (s *GRPCServer) AddRecord(ctx context.Context, req *recordspb.AddRecordRequest) (*recordspb.Record, error) {
+	name, err := s.recordName(req.Domain, req.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	if req.Value == "" {
+		return nil, status.Error(codes.InvalidArgument, "value is required")
+	}
+	value, err := s.keyAuth.value(req.Value)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value: %v", err)
+	}
+	if err := checkChallengeValue(value); err != nil && !s.anyValues {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value: %v", err)
+	}
+	var ttl *uint32
+	if req.Ttl > 0 {
+		if req.Ttl > storage.MaxTTL {
+			return nil, status.Error(codes.InvalidArgument, "invalid ttl")
+		}
+		ttl = &req.Ttl
+	}
+	if err := s.records.AddIf(ctx, grpcSource(ctx), name, value, ttl, storage.Condition{IfNotExists: req.IfNotExists}); err != nil {
+		return nil, grpcError(err)
+	}
+	return &recordspb.Record{Fqdn: name, Value: value, Ttl: s.records.TTL(name), AddedAtUnix: time.Now().Unix()}, nil
+}
+
+func (s *GRPCServer) RemoveRecord(ctx context.Context, req *recordspb.RemoveRecordRequest) (*recordspb.RemoveRecordResponse, error) {
+	name, err := s.recordName(req.Domain, req.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.keyAuth.value(req.Value)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value: %v", err)
+	}
+	if err := s.records.RemoveIf(ctx, grpcSource(ctx), name, value, storage.Condition{}); err != nil {
+		return nil, grpcError(err)
+	}
+	return &recordspb.RemoveRecordResponse{Fqdn: name}, nil
+}
+
+func (s *GRPCServer) ListRecords(ctx context.Context, req *recordspb.ListRecordsRequest) (*recordspb.ListRecordsResponse, error) {
+	resp := &recordspb.ListRecordsResponse{}
+	for _, u := range s.usage.List(req.Fqdn) {
+		resp.Records = append(resp.Records, &recordspb.Record{
+			Fqdn:        u.FQDN,
+			Value:       u.Value,
+			Ttl:         u.TTL,
+			AddedAtUnix: u.AddedAt.Unix(),
+			Queries:     uint64(u.Queries),
+		})
+	}
+	return resp, nil
+}
+
+func (s *GRPCServer) Watch(req *recordspb.WatchRequest, stream recordspb.Records_WatchServer) error {
+	w := &grpcWatcher{events: make(chan *recordspb.RecordEvent, watchBuffer)}
+	if req.Fqdn != "" {
+		w.fqdn = storage.NormalizeDomain(req.Fqdn)
+	}
+	s.mutex.Lock()
+	s.watchers[w] = true
+	s.mutex.Unlock()
+	defer s.unsubscribe(w)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-w.events:
+			if !ok {
+				return status.Error(codes.Unavailable, "watch closed: server stopping or client too slow")
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *GRPCServer) unsubscribe(w *grpcWatcher) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.watchers[w] {
+		delete(s.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish рассылает событие подписчикам; отставший подписчик отключается, а не тормозит изменения
+func (s *GRPCServer) publish(eventType recordspb.RecordEvent_Type, src storage.Source, name, value string) {
+	event := &recordspb.RecordEvent{
+		Type:      eventType,
+		Fqdn:      name,
+		Value:     value,
+		Interface: src.Interface,
+		Identity:  src.Identity,
+		TimeUnix:  time.Now().Unix(),
+	}
+	normalized := storage.NormalizeDomain(name)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for w := range s.watchers {
+		if w.fqdn != "" && w.fqdn != normalized {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			log.Printf("gRPC watcher fell behind by %d events, closing its stream", watchBuffer)
+			delete(s.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// RecordAdded и RecordRemoved делают сервер наблюдателем RecordManager для Watch
+func (s *GRPCServer) RecordAdded(src storage.Source, name, value string) {
+	s.publish(recordspb.RecordEvent_ADDED, src, name, value)
+}
+
+func (s *GRPCServer) RecordRemoved(src storage.Source, name, value string) {
+	s.publish(recordspb.RecordEvent_REMOVED, src, name, value)
+}
@@ -0,0 +1,219 @@
+package fcgiapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// maxHistoryNames ограничивает число имен в истории; при переполнении забывается имя,
+// которое дольше всех не менялось
+const maxHistoryNames = 10000
+
+// RecordVersion - одно изменение имени в истории
+type RecordVersion struct {
+	Version   uint64    `json:"version"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`          // add, remove или expire
+	Value     string    `json:"value,omitempty"` // пустое у remove - удалены все значения
+	Interface string    `json:"interface"`
+	Source    string    `json:"source,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+}
+
+// nameHistory - последние изменения одного имени, старые в начале
+type nameHistory struct {
+	next     uint64
+	versions []RecordVersion
+}
+
+// RecordHistory хранит в памяти последние size изменений каждого имени со значениями, чтобы
+// можно было увидеть, кто перезаписал запись, и вернуть прежнее значение
+type RecordHistory struct {
+	size int
+
+	mutex sync.Mutex
+	names map[string]*nameHistory // ключ - storage.NormalizeDomain
+}
+
+// NewRecordHistory создает историю на size изменений на имя
+func NewRecordHistory(size int) *RecordHistory {
+	return &RecordHistory{size: size, names: make(map[string]*nameHistory)}
+}
+
+func (h *RecordHistory) RecordAdded(src storage.Source, name, value string) {
+	h.record(src, name, "add", value)
+}
+
+func (h *RecordHistory) RecordRemoved(src storage.Source, name, value string) {
+	action := "remove"
+	if src.Interface == storage.ExpireInterface {
+		action = "expire"
+	}
+	h.record(src, name, action, value)
+}
+
+func (h *RecordHistory) record(src storage.Source, name, action, value string) {
+	key := storage.NormalizeDomain(name)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := h.names[key]
+	if n == nil {
+		if len(h.names) >= maxHistoryNames {
+			h.evict()
+		}
+		n = &nameHistory{}
+		h.names[key] = n
+	}
+	n.next++
+	n.versions = append(n.versions, RecordVersion{
+		Version:   n.next,
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Value:     value,
+		Interface: src.Interface,
+		Source:    src.Addr,
+		Identity:  src.Identity,
+	})
+	if len(n.versions) > h.size {
+		n.versions = append(n.versions[:0:0], n.versions[len(n.versions)-h.size:]...)
+	}
+}
+
+// evict забывает имя с самым старым последним изменением; вызывается под h.mutex
+func (h *RecordHistory) evict() {
+	var oldest string
+	var oldestTime time.Time
+	for key, n := range h.names {
+		last := n.versions[len(n.versions)-1].Time
+		if oldest == "" || last.Before(oldestTime) {
+			oldest, oldestTime = key, last
+		}
+	}
+	delete(h.names, oldest)
+}
+
+// Versions возвращает историю имени, новые изменения первыми
+func (h *RecordHistory) Versions(name string) []RecordVersion {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := h.names[storage.NormalizeDomain(name)]
+	if n == nil {
+		return nil
+	}
+	result := make([]RecordVersion, len(n.versions))
+	for i, v := range n.versions {
+		result[len(result)-1-i] = v
+	}
+	return result
+}
+
+// rollbackTarget находит значение для отката: добавление с номером version или, если
+// version 0, последнее добавленное значение, которого сейчас нет среди current
+func (h *RecordHistory) rollbackTarget(name string, version uint64, current []string) (RecordVersion, error) {
+	for _, v := range h.Versions(name) {
+		if v.Action != "add" {
+			continue
+		}
+		if version != 0 && v.Version == version {
+			return v, nil
+		}
+		if version == 0 && !containsString(current, v.Value) {
+			return v, nil
+		}
+	}
+	if version != 0 {
+		return RecordVersion{}, fmt.Errorf("no added value with version %d in the history of %s", version, name)
+	}
+	return RecordVersion{}, fmt.Errorf("no previous value in the history of %s", name)
+}
+
+// rollbackRequest - тело POST /rollback; version 0 - предыдущее значение
+type rollbackRequest struct {
+	FQDN    string `json:"fqdn"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// handleHistory - GET /history?fqdn=NAME
+func (h *APIHandler) handleHistory(history *RecordHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET required"})
+			return
+		}
+		fqdn := r.URL.Query().Get("fqdn")
+		if fqdn == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "fqdn is required"})
+			return
+		}
+		versions := history.Versions(fqdn)
+		if versions == nil {
+			versions = []RecordVersion{}
+		}
+		writeJSON(w, http.StatusOK, versions)
+	}
+}
+
+// handleRollback - POST /rollback {"fqdn": ..., "version": N}: имя снова содержит только
+// значение из истории, остальные значения удаляются
+func (h *APIHandler) handleRollback(history *RecordHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "POST required"})
+			return
+		}
+		var req rollbackRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.FQDN == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid JSON body, fqdn is required"})
+			return
+		}
+		fqdn := strings.TrimSuffix(req.FQDN, ".") + "."
+		annotateAccess(r.Context(), "rollback", fqdn)
+
+		ctx, cancel := writeContext(r.Context(), h.timeout)
+		defer cancel()
+		current, err := h.records.ValuesContext(ctx, fqdn)
+		if err != nil {
+			writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		target, err := history.rollbackTarget(fqdn, req.Version, current)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, HookResponse{Status: "error", Error: err.Error()})
+			return
+		}
+
+		src := sourceFromRequest(r, "rollback")
+		if !containsString(current, target.Value) {
+			if err := h.records.AddIf(ctx, src, fqdn, target.Value, nil, storage.Condition{}); err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+		}
+		for _, value := range current {
+			if value == target.Value {
+				continue
+			}
+			if err := h.records.RemoveIf(ctx, src, fqdn, value, storage.Condition{}); err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+		}
+		log.Printf("Rolled back %s to version %d from %s", fqdn, target.Version, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: "rollback", FQDN: fqdn, Value: target.Value, TTL: h.records.TTL(fqdn)})
+	}
+}
+
+// EnableHistory подключает GET /history и POST /rollback
+func (h *APIHandler) EnableHistory(history *RecordHistory) {
+	h.mux.HandleFunc("/history", h.handleHistory(history))
+	h.mux.HandleFunc("/rollback", h.handleRollback(history))
+}
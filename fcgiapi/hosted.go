@@ -0,0 +1,96 @@
+package fcgiapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"dns-acme-server/storage"
+)
+
+// hostedRequest - тело POST и DELETE /txt
+type hostedRequest struct {
+	FQDN  string  `json:"fqdn"`
+	Value string  `json:"value"`
+	TTL   *uint32 `json:"ttl"`
+}
+
+// handleHosted - постоянные TXT записи: GET /txt?fqdn=, POST /txt {fqdn, value, ttl},
+// DELETE /txt {fqdn, value} (без value удаляются все значения имени)
+func (h *APIHandler) handleHosted(hosted *storage.HostedRecords) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			name := r.URL.Query().Get("fqdn")
+			if name != "" {
+				var err error
+				if name, err = fqdnName(name); err != nil {
+					writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid fqdn: " + err.Error()})
+					return
+				}
+			}
+			records, err := hosted.List(name)
+			if err != nil {
+				log.Printf("Failed to list hosted records: %v", err)
+				writeJSON(w, http.StatusInternalServerError, HookResponse{Status: "error", Error: "storage error"})
+				return
+			}
+			writeJSON(w, http.StatusOK, records)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET, POST or DELETE required"})
+			return
+		}
+
+		var req hostedRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid JSON body"})
+			return
+		}
+		name, err := fqdnName(req.FQDN)
+		if err != nil || req.FQDN == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "valid fqdn is required"})
+			return
+		}
+		annotateAccess(r.Context(), "txt", name)
+		if err := h.records.CheckAllowed(name); err != nil {
+			writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		src := sourceFromRequest(r, "hosted")
+		ctx, cancel := writeContext(r.Context(), h.timeout)
+		defer cancel()
+
+		if r.Method == http.MethodDelete {
+			if err := hosted.Remove(ctx, src, name, req.Value); err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: "remove", FQDN: name, Value: req.Value})
+			return
+		}
+		if req.Value == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "value is required"})
+			return
+		}
+		ttl := uint32(storage.DefaultHostedTTL)
+		if req.TTL != nil {
+			ttl = *req.TTL
+		}
+		if ttl > storage.MaxTTL {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "invalid ttl"})
+			return
+		}
+		if err := hosted.Set(ctx, src, name, req.Value, ttl); err != nil {
+			writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: "add", FQDN: name, Value: req.Value, TTL: ttl})
+	}
+}
+
+// EnableHostedRecords подключает /txt
+func (h *APIHandler) EnableHostedRecords(hosted *storage.HostedRecords) {
+	h.mux.HandleFunc("/txt", h.handleHosted(hosted))
+}
@@ -0,0 +1,109 @@
+package fcgiapi
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"dns-acme-server/storage"
+	"dns-acme-server/tracing"
+)
+
+// legoRequest - тело запроса провайдера lego httpreq (обычный и RAW режим)
+type legoRequest struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+
+	// RAW режим
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"keyAuth"`
+}
+
+// handleLego реализует POST /present и POST /cleanup провайдера lego httpreq
+func (h *APIHandler) handleLego(hook string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "POST required"})
+			return
+		}
+
+		var req legoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid JSON body"})
+			return
+		}
+
+		fqdn, value := req.FQDN, req.Value
+		if fqdn == "" && req.Domain != "" {
+			// RAW режим: значение TXT вычисляем сами из keyAuthorization
+			var err error
+			if fqdn, err = h.domainRecordName(req.Domain); err != nil {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid domain: " + err.Error()})
+				return
+			}
+			if req.KeyAuth != "" {
+				if err := h.keyAuth.checkThumbprint(req.KeyAuth); err != nil {
+					writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid keyAuth: " + err.Error()})
+					return
+				}
+				value = keyAuthDigest(req.KeyAuth)
+			}
+		}
+		if fqdn == "" {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "fqdn or domain is required"})
+			return
+		}
+		fqdn = strings.TrimSuffix(fqdn, ".") + "."
+		annotateAccess(r.Context(), hook, fqdn)
+		var err error
+		if value, err = h.keyAuth.value(value); err != nil {
+			writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid value: " + err.Error()})
+			return
+		}
+
+		switch hook {
+		case "add":
+			if value == "" {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "value or keyAuth is required"})
+				return
+			}
+			if err := checkChallengeValue(value); err != nil && !h.anyValues {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid value: " + err.Error()})
+				return
+			}
+			queued, err := h.store(r, storage.RecordChange{Source: sourceFromRequest(r, "lego"), Name: fqdn, Value: value, Condition: apiCondition(r, h.strict, hook, value)})
+			if err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			if queued {
+				writeJSON(w, http.StatusAccepted, HookResponse{Status: "queued", Hook: hook, FQDN: fqdn, Value: value})
+				return
+			}
+			tracing.RecordPublished(r.Context(), fqdn)
+			propagation := checkPropagation(h.propagation, w, r, fqdn, value)
+			writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: hook, FQDN: fqdn, Value: value, TTL: h.records.TTL(fqdn), Propagation: propagation})
+		case "remove":
+			queued, err := h.store(r, storage.RecordChange{Source: sourceFromRequest(r, "lego"), Name: fqdn, Value: value, Remove: true, Condition: apiCondition(r, h.strict, hook, value)})
+			if err != nil {
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			if queued {
+				writeJSON(w, http.StatusAccepted, HookResponse{Status: "queued", Hook: hook, FQDN: fqdn})
+				return
+			}
+			writeJSON(w, http.StatusOK, HookResponse{Status: "ok", Hook: hook, FQDN: fqdn})
+		}
+	}
+}
+
+// keyAuthDigest вычисляет значение TXT записи DNS-01: base64url(sha256(keyAuthorization))
+func keyAuthDigest(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,90 @@
+package fcgiapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// DefaultMaxFormSize - параметры хука: QUERY_STRING или тело, с запасом на пакет из
+	// maxBatchItems доменов
+	DefaultMaxFormSize = 1 << 20
+	// DefaultMaxValueLength - строка TXT записи не длиннее 255 байт (RFC 1035, 3.3)
+	DefaultMaxValueLength = 255
+	// maxDomainLength - имя в DNS не длиннее 253 символов в текстовой форме
+	maxDomainLength = 253
+)
+
+// errTooLarge - параметры хука превышают лимит, ответ 413
+type errTooLarge struct {
+	what  string
+	size  int64
+	limit int64
+}
+
+func (e *errTooLarge) Error() string {
+	return fmt.Sprintf("%s is too large: %d bytes, limit %d", e.what, e.size, e.limit)
+}
+
+// SetSizeLimits ограничивает размер параметров хука (QUERY_STRING и тела запроса) и длину
+// ACME_KEYAUTH, чтобы клиент не мог занять память гигантскими значениями; 0 - лимит по умолчанию
+func (h *FastCGIHandler) SetSizeLimits(maxForm int64, maxValue int) {
+	h.maxForm, h.maxValue = maxForm, maxValue
+}
+
+func (h *FastCGIHandler) formLimit() int64 {
+	if h.maxForm > 0 {
+		return h.maxForm
+	}
+	return DefaultMaxFormSize
+}
+
+func (h *FastCGIHandler) valueLimit() int {
+	if h.maxValue > 0 {
+		return h.maxValue
+	}
+	return DefaultMaxValueLength
+}
+
+// limitForm проверяет QUERY_STRING и ограничивает чтение тела до ParseForm
+func (h *FastCGIHandler) limitForm(w http.ResponseWriter, r *http.Request) error {
+	limit := h.formLimit()
+	if size := int64(len(r.URL.RawQuery)); size > limit {
+		return &errTooLarge{what: "QUERY_STRING", size: size, limit: limit}
+	}
+	if r.ContentLength > limit {
+		return &errTooLarge{what: "request body", size: r.ContentLength, limit: limit}
+	}
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	return nil
+}
+
+// formTooLarge - ParseForm не дочитал тело из-за лимита limitForm
+func (h *FastCGIHandler) formTooLarge(err error) error {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return nil
+	}
+	return &errTooLarge{what: "request body", size: maxErr.Limit + 1, limit: maxErr.Limit}
+}
+
+// checkParamSizes проверяет длину всех ACME_DOMAIN, ACME_FQDN и ACME_KEYAUTH, в том числе
+// повторяющихся в пакетном режиме
+func (h *FastCGIHandler) checkParamSizes(r *http.Request) error {
+	for _, param := range []string{"ACME_DOMAIN", "ACME_FQDN"} {
+		for _, v := range r.Form[param] {
+			if len(v) > maxDomainLength {
+				return &errTooLarge{what: param, size: int64(len(v)), limit: maxDomainLength}
+			}
+		}
+	}
+	for _, v := range r.Form["ACME_KEYAUTH"] {
+		if limit := h.valueLimit(); len(v) > limit {
+			return &errTooLarge{what: "ACME_KEYAUTH", size: int64(len(v)), limit: int64(limit)}
+		}
+	}
+	return nil
+}
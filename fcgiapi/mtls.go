@@ -0,0 +1,90 @@
+package fcgiapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ClientCertPolicy требует от клиентов HTTP API сертификат, подписанный заданным CA,
+// и (если список задан) одно из разрешенных имен в SAN
+type ClientCertPolicy struct {
+	pool    *x509.CertPool
+	allowed []string // DNS имена (*.suffix - поддомены), email и URI
+}
+
+// LoadClientCertPolicy читает PEM бандл CA из caFile
+func LoadClientCertPolicy(caFile string, allowed []string) (*ClientCertPolicy, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", caFile)
+	}
+	return &ClientCertPolicy{pool: pool, allowed: allowed}, nil
+}
+
+// Apply включает проверку клиентских сертификатов в конфигурации TLS слушателя API
+func (p *ClientCertPolicy) Apply(config *tls.Config) {
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = p.pool
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("client certificate required")
+		}
+		if !p.allows(state.PeerCertificates[0]) {
+			return fmt.Errorf("client certificate %q is not allowed", certIdentity(state.PeerCertificates[0]))
+		}
+		return nil
+	}
+}
+
+func (p *ClientCertPolicy) allows(cert *x509.Certificate) bool {
+	if len(p.allowed) == 0 {
+		return true
+	}
+	names := append([]string(nil), cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, name := range names {
+		for _, allowed := range p.allowed {
+			if strings.EqualFold(name, allowed) {
+				return true
+			}
+			if suffix := strings.TrimPrefix(allowed, "*"); suffix != allowed && strings.HasPrefix(suffix, ".") &&
+				strings.HasSuffix(strings.ToLower(name), strings.ToLower(suffix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certIdentity - имя клиента по сертификату для аудита: первое имя SAN или CN
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+// clientCertIdentity возвращает имя из проверенного клиентского сертификата запроса
+func clientCertIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	return "cert:" + certIdentity(r.TLS.PeerCertificates[0]), true
+}
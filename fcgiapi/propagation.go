@@ -0,0 +1,191 @@
+package fcgiapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/tracing"
+)
+
+// PropagationStatus - результат проверки видимости записи снаружи
+type PropagationStatus struct {
+	Propagated bool     `json:"propagated"`
+	Servers    []string `json:"servers"`
+	Pending    []string `json:"pending,omitempty"` // серверы, которые так и не вернули значение
+	ElapsedMs  int64    `json:"elapsed_ms"`
+}
+
+// PropagationChecker после добавления записи опрашивает внешние серверы (публичные NS зоны
+// или резолверы вроде 1.1.1.1), пока TXT не станет видна везде или не истечет таймаут
+type PropagationChecker struct {
+	servers  []string // host:port; "ns" - NS серверы зоны, определяются для каждого имени
+	timeout  time.Duration
+	interval time.Duration
+	client   *dns.Client
+}
+
+// NewPropagationChecker разбирает список серверов через запятую
+func NewPropagationChecker(servers string, timeout time.Duration) *PropagationChecker {
+	c := &PropagationChecker{
+		timeout:  timeout,
+		interval: 2 * time.Second,
+		client:   &dns.Client{Timeout: 3 * time.Second},
+	}
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if server != "ns" {
+			server = withDefaultPort(server, "53")
+		}
+		c.servers = append(c.servers, server)
+	}
+	return c
+}
+
+// Wait ждет, пока каждый сервер не вернет value для name. Возвращается по таймауту
+// или отмене ctx (клиент ушел) с Propagated=false и списком отстающих серверов.
+func (c *PropagationChecker) Wait(ctx context.Context, name, value string) PropagationStatus {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	servers := c.resolveServers(ctx, name)
+	status := PropagationStatus{Servers: servers}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			if !c.waitServer(ctx, server, name, value) {
+				mutex.Lock()
+				status.Pending = append(status.Pending, server)
+				mutex.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	status.Propagated = len(servers) > 0 && len(status.Pending) == 0
+	status.ElapsedMs = time.Since(started).Milliseconds()
+	if status.Propagated {
+		logContext(ctx, "TXT %s visible on %d servers after %v", name, len(servers), time.Since(started).Round(time.Millisecond))
+	} else {
+		logContext(ctx, "TXT %s not visible on %s after %v", name, strings.Join(status.Pending, ", "), time.Since(started).Round(time.Millisecond))
+	}
+	return status
+}
+
+// waitServer повторяет запрос к одному серверу, пока не увидит значение
+func (c *PropagationChecker) waitServer(ctx context.Context, server, name, value string) bool {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	for {
+		if resp, _, err := c.client.ExchangeContext(ctx, m, server); err == nil {
+			for _, rr := range resp.Answer {
+				if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+					return true
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// resolveServers раскрывает "ns" в адреса NS серверов ближайшей зоны, которой принадлежит name
+func (c *PropagationChecker) resolveServers(ctx context.Context, name string) []string {
+	var servers []string
+	for _, server := range c.servers {
+		if server != "ns" {
+			servers = append(servers, server)
+			continue
+		}
+		addrs, err := lookupZoneNS(ctx, name)
+		if err != nil {
+			log.Printf("Failed to find NS servers for %s: %v", name, err)
+			continue
+		}
+		servers = append(servers, addrs...)
+	}
+	return servers
+}
+
+// lookupZoneNS ищет NS записи, поднимаясь от name к корню, и возвращает адреса серверов
+func lookupZoneNS(ctx context.Context, name string) ([]string, error) {
+	var resolver net.Resolver
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		zone := strings.Join(labels[i:], ".")
+		nss, err := resolver.LookupNS(ctx, zone)
+		if err != nil || len(nss) == 0 {
+			continue
+		}
+		var addrs []string
+		for _, ns := range nss {
+			ips, err := resolver.LookupHost(ctx, ns.Host)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip, "53"))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, fmt.Errorf("no NS records found")
+}
+
+// propagationText - строка для текстового ответа хука
+func propagationText(s *PropagationStatus) string {
+	if s.Propagated {
+		return fmt.Sprintf("Propagation: ok (%d servers, %dms)\n", len(s.Servers), s.ElapsedMs)
+	}
+	if len(s.Pending) == 0 {
+		return "Propagation: no servers to check\n"
+	}
+	return fmt.Sprintf("Propagation: pending on %s (%dms)\n", strings.Join(s.Pending, ", "), s.ElapsedMs)
+}
+
+// checkPropagation ждет распространения, если проверка включена, и отмечает результат
+// в заголовке X-Propagation (propagated или pending)
+func checkPropagation(c *PropagationChecker, w http.ResponseWriter, r *http.Request, name, value string) *PropagationStatus {
+	if c == nil {
+		return nil
+	}
+	ctx, span := tracing.StartSpan(r.Context(), "propagation.wait", tracing.KindInternal)
+	status := c.Wait(ctx, name, value)
+	span.SetAttr("acme.propagated", strconv.FormatBool(status.Propagated))
+	span.End()
+	if status.Propagated {
+		w.Header().Set("X-Propagation", "propagated")
+	} else {
+		w.Header().Set("X-Propagation", "pending")
+	}
+	return &status
+}
+
+// withDefaultPort добавляет порт к адресу, если он не указан
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
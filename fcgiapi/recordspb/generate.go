@@ -0,0 +1,4 @@
+// Package recordspb - сгенерированные protobuf сообщения и gRPC сервис Records.
+package recordspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative records.proto
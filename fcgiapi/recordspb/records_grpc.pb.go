@@ -0,0 +1,258 @@
+// gRPC API управления записями ACME challenge, код Go - go generate (см. generate.go)
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.24.4
+// source: records.proto
+
+package recordspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Records_AddRecord_FullMethodName    = "/dnsacme.v1.Records/AddRecord"
+	Records_RemoveRecord_FullMethodName = "/dnsacme.v1.Records/RemoveRecord"
+	Records_ListRecords_FullMethodName  = "/dnsacme.v1.Records/ListRecords"
+	Records_Watch_FullMethodName        = "/dnsacme.v1.Records/Watch"
+)
+
+// RecordsClient is the client API for Records service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RecordsClient interface {
+	// AddRecord публикует значение; domain получает префикс _acme-challenge., fqdn берется как есть
+	AddRecord(ctx context.Context, in *AddRecordRequest, opts ...grpc.CallOption) (*Record, error)
+	// RemoveRecord удаляет значение; пустое value удаляет все значения имени
+	RemoveRecord(ctx context.Context, in *RemoveRecordRequest, opts ...grpc.CallOption) (*RemoveRecordResponse, error)
+	// ListRecords возвращает опубликованные значения и статистику запросов к ним
+	ListRecords(ctx context.Context, in *ListRecordsRequest, opts ...grpc.CallOption) (*ListRecordsResponse, error)
+	// Watch присылает изменения записей, пока клиент не закроет поток
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Records_WatchClient, error)
+}
+
+type recordsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRecordsClient(cc grpc.ClientConnInterface) RecordsClient {
+	return &recordsClient{cc}
+}
+
+func (c *recordsClient) AddRecord(ctx context.Context, in *AddRecordRequest, opts ...grpc.CallOption) (*Record, error) {
+	out := new(Record)
+	err := c.cc.Invoke(ctx, Records_AddRecord_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *recordsClient) RemoveRecord(ctx context.Context, in *RemoveRecordRequest, opts ...grpc.CallOption) (*RemoveRecordResponse, error) {
+	out := new(RemoveRecordResponse)
+	err := c.cc.Invoke(ctx, Records_RemoveRecord_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *recordsClient) ListRecords(ctx context.Context, in *ListRecordsRequest, opts ...grpc.CallOption) (*ListRecordsResponse, error) {
+	out := new(ListRecordsResponse)
+	err := c.cc.Invoke(ctx, Records_ListRecords_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *recordsClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Records_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Records_ServiceDesc.Streams[0], Records_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &recordsWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Records_WatchClient interface {
+	Recv() (*RecordEvent, error)
+	grpc.ClientStream
+}
+
+type recordsWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *recordsWatchClient) Recv() (*RecordEvent, error) {
+	m := new(RecordEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RecordsServer is the server API for Records service.
+// All implementations must embed UnimplementedRecordsServer
+// for forward compatibility
+type RecordsServer interface {
+	// AddRecord публикует значение; domain получает префикс _acme-challenge., fqdn берется как есть
+	AddRecord(context.Context, *AddRecordRequest) (*Record, error)
+	// RemoveRecord удаляет значение; пустое value удаляет все значения имени
+	RemoveRecord(context.Context, *RemoveRecordRequest) (*RemoveRecordResponse, error)
+	// ListRecords возвращает опубликованные значения и статистику запросов к ним
+	ListRecords(context.Context, *ListRecordsRequest) (*ListRecordsResponse, error)
+	// Watch присылает изменения записей, пока клиент не закроет поток
+	Watch(*WatchRequest, Records_WatchServer) error
+	mustEmbedUnimplementedRecordsServer()
+}
+
+// UnimplementedRecordsServer must be embedded to have forward compatible implementations.
+type UnimplementedRecordsServer struct {
+}
+
+func (UnimplementedRecordsServer) AddRecord(context.Context, *AddRecordRequest) (*Record, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddRecord not implemented")
+}
+func (UnimplementedRecordsServer) RemoveRecord(context.Context, *RemoveRecordRequest) (*RemoveRecordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveRecord not implemented")
+}
+func (UnimplementedRecordsServer) ListRecords(context.Context, *ListRecordsRequest) (*ListRecordsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRecords not implemented")
+}
+func (UnimplementedRecordsServer) Watch(*WatchRequest, Records_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedRecordsServer) mustEmbedUnimplementedRecordsServer() {}
+
+// UnsafeRecordsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RecordsServer will
+// result in compilation errors.
+type UnsafeRecordsServer interface {
+	mustEmbedUnimplementedRecordsServer()
+}
+
+func RegisterRecordsServer(s grpc.ServiceRegistrar, srv RecordsServer) {
+	s.RegisterService(&Records_ServiceDesc, srv)
+}
+
+func _Records_AddRecord_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRecordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecordsServer).AddRecord(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Records_AddRecord_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecordsServer).AddRecord(ctx, req.(*AddRecordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Records_RemoveRecord_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRecordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecordsServer).RemoveRecord(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Records_RemoveRecord_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecordsServer).RemoveRecord(ctx, req.(*RemoveRecordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Records_ListRecords_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRecordsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecordsServer).ListRecords(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Records_ListRecords_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecordsServer).ListRecords(ctx, req.(*ListRecordsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Records_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RecordsServer).Watch(m, &recordsWatchServer{stream})
+}
+
+type Records_WatchServer interface {
+	Send(*RecordEvent) error
+	grpc.ServerStream
+}
+
+type recordsWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *recordsWatchServer) Send(m *RecordEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Records_ServiceDesc is the grpc.ServiceDesc for Records service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Records_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dnsacme.v1.Records",
+	HandlerType: (*RecordsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddRecord",
+			Handler:    _Records_AddRecord_Handler,
+		},
+		{
+			MethodName: "RemoveRecord",
+			Handler:    _Records_RemoveRecord_Handler,
+		},
+		{
+			MethodName: "ListRecords",
+			Handler:    _Records_ListRecords_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Records_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "records.proto",
+}
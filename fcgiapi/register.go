@@ -0,0 +1,294 @@
+package fcgiapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+var registrations = metrics.Default.NewCounterVec("dns_acme_registrations_total",
+	"POST /register requests by result: ok, forbidden, limited or failed", "result")
+
+// Registration - учетная запись, выданная POST /register; хранится в -register-file.
+// Пароль - 32 случайных байта, поэтому достаточно SHA-256 без соли и растяжения
+type Registration struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_sha256"`
+	Subdomain    string    `json:"subdomain"`
+	Created      time.Time `json:"created"`
+	Source       string    `json:"source,omitempty"` // адрес, с которого зарегистрировались
+	// пароль до смены (POST /credentials/rotate), принимается до PreviousUntil
+	PreviousHash  string     `json:"previous_password_sha256,omitempty"`
+	PreviousUntil *time.Time `json:"previous_until,omitempty"`
+}
+
+// RegisterResponse - ответ POST /register, пароль показывается только здесь
+type RegisterResponse struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Subdomain  string `json:"subdomain"`
+	FullDomain string `json:"fulldomain"`
+	// CNAMETarget - куда заказчик направляет _acme-challenge каждого домена сертификата
+	CNAMETarget string `json:"cname_target"`
+}
+
+// Registrations выдает заказчикам учетные записи и поддомены зоны -register-zone, как acme-dns:
+// каждая регистрация - заказчик (storage.Tenants) с пространством из одного имени,
+// куда ведет CNAME _acme-challenge его домена. Реализует Authenticator для выданных паролей
+type Registrations struct {
+	path       string
+	zone       string
+	maxRecords int
+	allow      []*net.IPNet // пусто - регистрироваться нельзя ниоткуда
+	tenants    *storage.Tenants
+
+	mutex    sync.RWMutex
+	accounts map[string]Registration // имя -> учетная запись
+}
+
+// OpenRegistrations читает выданные учетные записи из path (отсутствующий файл - пока
+// никого) и регистрирует их заказчиками в tenants
+func OpenRegistrations(path, zone string, maxRecords int, allow []*net.IPNet, tenants *storage.Tenants) (*Registrations, error) {
+	r := &Registrations{
+		path:       path,
+		zone:       storage.NormalizeDomain(zone),
+		maxRecords: maxRecords,
+		allow:      allow,
+		tenants:    tenants,
+		accounts:   make(map[string]Registration),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Registration
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, reg := range list {
+		if err := tenants.Register(r.tenant(reg)); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		r.accounts[reg.Username] = reg
+	}
+	return r, nil
+}
+
+// Len - число выданных учетных записей
+func (r *Registrations) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.accounts)
+}
+
+func (r *Registrations) tenant(reg Registration) storage.Tenant {
+	return storage.Tenant{
+		Name:       reg.Username,
+		Domains:    []string{reg.Subdomain + "." + r.zone},
+		MaxRecords: r.maxRecords,
+	}
+}
+
+// Authenticate проверяет Basic авторизацию выданным именем и паролем
+func (r *Registrations) Authenticate(req *http.Request) (string, bool) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	r.mutex.RLock()
+	reg, exists := r.accounts[user]
+	r.mutex.RUnlock()
+	if !exists {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(pass))
+	hash := []byte(hex.EncodeToString(sum[:]))
+	if subtle.ConstantTimeCompare([]byte(reg.PasswordHash), hash) == 1 {
+		return user, true
+	}
+	if reg.PreviousUntil != nil && time.Now().Before(*reg.PreviousUntil) &&
+		subtle.ConstantTimeCompare([]byte(reg.PreviousHash), hash) == 1 {
+		return user, true
+	}
+	return "", false
+}
+
+// Rotate выдает учетной записи name новый пароль; прежний принимается еще grace
+func (r *Registrations) Rotate(name string, grace time.Duration) (string, time.Time, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reg, exists := r.accounts[name]
+	if !exists {
+		return "", time.Time{}, ErrNotRotatable
+	}
+	password, err := newSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	until := time.Now().UTC().Add(grace)
+	sum := sha256.Sum256([]byte(password))
+	updated := reg
+	updated.PreviousHash, updated.PreviousUntil = reg.PasswordHash, &until
+	updated.PasswordHash = hex.EncodeToString(sum[:])
+	r.accounts[name] = updated
+	if err := r.save(); err != nil {
+		r.accounts[name] = reg
+		return "", time.Time{}, err
+	}
+	return password, until, nil
+}
+
+// register создает учетную запись и сохраняет файл; при ошибке записи учетная запись не выдается
+func (r *Registrations) register(source string) (RegisterResponse, error) {
+	username, err := randomUUID()
+	if err != nil {
+		return RegisterResponse{}, err
+	}
+	subdomain, err := randomUUID()
+	if err != nil {
+		return RegisterResponse{}, err
+	}
+	password, err := newSecret()
+	if err != nil {
+		return RegisterResponse{}, err
+	}
+	sum := sha256.Sum256([]byte(password))
+	reg := Registration{
+		Username:     username,
+		PasswordHash: hex.EncodeToString(sum[:]),
+		Subdomain:    subdomain,
+		Created:      time.Now().UTC(),
+		Source:       source,
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.tenants.Register(r.tenant(reg)); err != nil {
+		return RegisterResponse{}, err
+	}
+	r.accounts[username] = reg
+	if err := r.save(); err != nil {
+		delete(r.accounts, username)
+		r.tenants.Unregister(username)
+		return RegisterResponse{}, err
+	}
+	fulldomain := subdomain + "." + r.zone
+	return RegisterResponse{
+		Username:    username,
+		Password:    password,
+		Subdomain:   subdomain,
+		FullDomain:  fulldomain,
+		CNAMETarget: fulldomain + ".",
+	}, nil
+}
+
+// save переписывает файл целиком через временный файл; вызывается под r.mutex
+func (r *Registrations) save() error {
+	list := make([]Registration, 0, len(r.accounts))
+	for _, reg := range r.accounts {
+		list = append(list, reg)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".register-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// randomUUID - случайный UUID версии 4, как имена и поддомены acme-dns
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// handleRegister - POST /register без авторизации, с адресов -register-allow; частоту
+// регистраций с одного адреса ограничивает -change-rate
+func (h *APIHandler) handleRegister(r *Registrations) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "POST required"})
+			return
+		}
+		if !r.allowed(req.RemoteAddr) {
+			registrations.Inc("forbidden")
+			log.Printf("Registration from %s rejected: not in -register-allow", req.RemoteAddr)
+			writeJSON(w, http.StatusForbidden, HookResponse{Status: "error", Error: "registration is not allowed from this address"})
+			return
+		}
+		if err := h.records.AllowChange(req.Context(), storage.Source{Interface: "register", Addr: req.RemoteAddr}, 1); err != nil {
+			registrations.Inc("limited")
+			log.Printf("Registration from %s rejected: %v", req.RemoteAddr, err)
+			writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		resp, err := r.register(req.RemoteAddr)
+		if err != nil {
+			registrations.Inc("failed")
+			log.Printf("Registration from %s failed: %v", req.RemoteAddr, err)
+			writeJSON(w, http.StatusInternalServerError, HookResponse{Status: "error", Error: "registration failed"})
+			return
+		}
+		registrations.Inc("ok")
+		log.Printf("Registered %s for %s from %s", resp.Username, resp.FullDomain, req.RemoteAddr)
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+func (r *Registrations) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range r.allow {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableRegistration подключает POST /register; он доступен без авторизации
+func (h *APIHandler) EnableRegistration(r *Registrations) {
+	h.registration = true
+	h.mux.HandleFunc("/register", h.handleRegister(r))
+}
+
+// registerPublic - запрос регистрации, он отдается без авторизации
+func (h *APIHandler) registerPublic(r *http.Request) bool {
+	return h.registration && r.URL.Path == "/register"
+}
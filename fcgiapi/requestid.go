@@ -0,0 +1,79 @@
+package fcgiapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/http/fcgi"
+
+	"dns-acme-server/tracing"
+)
+
+// RequestIDHeader - заголовок с ID запроса в вопросе и ответе
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength - длиннее ID клиента не принимается, вместо него выдается свой
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID берет ID запроса из X-Request-ID (в Angie: fastcgi_param HTTP_X_REQUEST_ID
+// $request_id или proxy_set_header) или FastCGI параметра REQUEST_ID, иначе создает новый;
+// отдает его в ответе и запоминает в контексте для журналов, аудита и хуков
+func withRequestID(w http.ResponseWriter, r *http.Request, span *tracing.Span) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = fcgi.ProcessEnv(r)["REQUEST_ID"]
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	if e, ok := r.Context().Value(accessEntryKey{}).(*AccessEntry); ok {
+		e.RequestID = id
+	}
+	span.SetAttr("request.id", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// validRequestID - непустой ID из печатных символов без пробелов, чтобы его нельзя было
+// использовать для подделки строк журнала
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID - 16 случайных байт в hex, как $request_id в Angie
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFromContext возвращает ID запроса, пустой вне обработчиков FastCGI и HTTP API
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf пишет строку журнала с ID запроса r в начале
+func logf(r *http.Request, format string, args ...interface{}) {
+	logContext(r.Context(), format, args...)
+}
+
+func logContext(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFromContext(ctx); id != "" {
+		log.Printf("[%s] "+format, append([]interface{}{id}, args...)...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,103 @@
+package fcgiapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"dns-acme-server/storage"
+)
+
+// HookResponse - ответ хука в JSON формате (FastCGI с -response-format json и HTTP API)
+type HookResponse struct {
+	Status string `json:"status"`
+	Hook   string `json:"hook,omitempty"`
+	FQDN   string `json:"fqdn,omitempty"`
+	Value  string `json:"value,omitempty"`
+	TTL    uint32 `json:"ttl,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Propagation *PropagationStatus `json:"propagation,omitempty"`
+	Items       []BatchItem        `json:"items,omitempty"` // результаты пакетного хука
+}
+
+// SetResponseFormat задает формат ответов по умолчанию: text или json
+func (h *FastCGIHandler) SetResponseFormat(format string) error {
+	switch format {
+	case "text":
+		h.jsonResponses = false
+	case "json":
+		h.jsonResponses = true
+	default:
+		return fmt.Errorf("unknown response format %q, expected text or json", format)
+	}
+	return nil
+}
+
+// wantsJSON - JSON включен флагом или запрошен через Accept
+func (h *FastCGIHandler) wantsJSON(r *http.Request) bool {
+	return h.jsonResponses || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// respond отправляет успешный ответ; text используется для текстового формата
+func (h *FastCGIHandler) respond(w http.ResponseWriter, r *http.Request, resp HookResponse, text string) {
+	if !h.wantsJSON(r) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, text)
+		return
+	}
+	resp.Status = "ok"
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// accepted отвечает 202: хранилище недоступно, изменение отложено в очередь повторов
+func (h *FastCGIHandler) accepted(w http.ResponseWriter, r *http.Request, resp HookResponse, text string) {
+	if !h.wantsJSON(r) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, text)
+		return
+	}
+	resp.Status = "queued"
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// fail отправляет ошибку в текстовом или JSON формате
+func (h *FastCGIHandler) fail(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if !h.wantsJSON(r) {
+		http.Error(w, message, status)
+		return
+	}
+	writeJSON(w, status, HookResponse{Status: "error", Error: message})
+}
+
+// errorStatus подбирает HTTP статус для ошибки изменения записей
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrDomainNotAllowed), errors.Is(err, storage.ErrReadOnly), errors.Is(err, storage.ErrRejectedByHook):
+		return http.StatusForbidden
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrQuotaExceeded), errors.Is(err, storage.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, storage.ErrStorageFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrNotListable):
+		return http.StatusNotImplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
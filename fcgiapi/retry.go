@@ -0,0 +1,34 @@
+package fcgiapi
+
+import (
+	"context"
+	"log"
+
+	"dns-acme-server/storage"
+)
+
+// storeChange выполняет изменение, а если хранилище недоступно - откладывает его в очередь
+// повторов q (nil - очередь выключена). queued - изменение отложено, клиенту отвечается 202
+func storeChange(ctx context.Context, records *storage.RecordManager, q *storage.RetryQueue, change storage.RecordChange) (queued bool, err error) {
+	if q != nil && q.Pending(change.Name) {
+		// за отложенными изменениями того же имени, чтобы не нарушить порядок
+		if err := records.AllowChange(ctx, change.Source, 1); err != nil {
+			return false, err
+		}
+		if err := q.Enqueue(change); err != nil {
+			log.Printf("Failed to queue change of %s from %s: %v", change.Name, change.Source, err)
+			return false, err
+		}
+		return true, nil
+	}
+	err = change.Apply(ctx, records)
+	if q == nil || !storage.Retryable(err) {
+		return false, err
+	}
+	if qerr := q.Enqueue(change); qerr != nil {
+		log.Printf("Failed to queue change of %s from %s: %v", change.Name, change.Source, qerr)
+		return false, err
+	}
+	log.Printf("Storage unavailable, change of %s from %s queued for retry: %v", change.Name, change.Source, err)
+	return true, nil
+}
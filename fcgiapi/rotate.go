@@ -0,0 +1,98 @@
+package fcgiapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrNotRotatable - учетные данные клиента выданы не этим хранилищем (другой файл,
+// плагин, сертификат), сменить их через API нельзя
+var ErrNotRotatable = errors.New("credentials cannot be rotated here")
+
+// Rotator меняет секрет клиента name, оставляя прежний действительным еще grace;
+// реализации - TokenStore и Registrations
+type Rotator interface {
+	Rotate(name string, grace time.Duration) (secret string, previousUntil time.Time, err error)
+}
+
+// RotateResponse - ответ POST /credentials/rotate, новый секрет показывается только здесь
+type RotateResponse struct {
+	Identity      string    `json:"identity"`
+	Secret        string    `json:"secret"`
+	PreviousUntil time.Time `json:"previous_valid_until"`
+}
+
+// newSecret - 32 случайных байта в hex для токенов и паролей
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// rotators - хранилища среди проверяющих клиентов, которые умеют менять секреты
+func rotators(auth Authenticator) []Rotator {
+	var result []Rotator
+	list, ok := auth.(Authenticators)
+	if !ok {
+		list = Authenticators{auth}
+	}
+	for _, a := range list {
+		if r, ok := a.(Rotator); ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// handleRotate - POST /credentials/rotate?grace=1h: клиент меняет собственный токен или пароль
+// регистрации, прежний принимается еще grace (не больше maxGrace), чтобы продления, уже
+// запущенные со старым секретом, успели закончиться
+func (h *APIHandler) handleRotate(maxGrace time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "POST required"})
+			return
+		}
+		identity := identityFromContext(r.Context())
+		if h.auth == nil || identity == "" {
+			writeJSON(w, http.StatusForbidden, HookResponse{Status: "error", Error: "authenticated client required"})
+			return
+		}
+		grace := maxGrace
+		if s := r.URL.Query().Get("grace"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 || d > maxGrace {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "grace must be a duration up to " + maxGrace.String()})
+				return
+			}
+			grace = d
+		}
+		for _, rotator := range rotators(h.auth) {
+			secret, until, err := rotator.Rotate(identity, grace)
+			if errors.Is(err, ErrNotRotatable) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to rotate credentials of %s: %v", identity, err)
+				writeJSON(w, http.StatusInternalServerError, HookResponse{Status: "error", Error: "rotation failed"})
+				return
+			}
+			log.Printf("Rotated credentials of %s from %s, previous valid until %s", identity, r.RemoteAddr, until.Format(time.RFC3339))
+			writeJSON(w, http.StatusOK, RotateResponse{Identity: identity, Secret: secret, PreviousUntil: until.UTC()})
+			return
+		}
+		writeJSON(w, http.StatusConflict, HookResponse{Status: "error", Error: ErrNotRotatable.Error()})
+	}
+}
+
+// EnableRotation подключает POST /credentials/rotate; maxGrace - наибольшее и умолчательное
+// время, пока принимается прежний секрет
+func (h *APIHandler) EnableRotation(maxGrace time.Duration) {
+	h.mux.HandleFunc("/credentials/rotate", h.handleRotate(maxGrace))
+}
@@ -0,0 +1,57 @@
+package fcgiapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"dns-acme-server/storage"
+)
+
+// snapshotResponse - ответ POST /snapshot
+type snapshotResponse struct {
+	Status string `json:"status"`
+	storage.SnapshotResult
+}
+
+// handleSnapshot - GET /snapshot выгружает все записи, POST /snapshot[?replace=1] загружает
+// выгрузку обратно (с replace удаляются записи, которых нет в выгрузке)
+func (h *APIHandler) handleSnapshot(hosted *storage.HostedRecords) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			snap, err := storage.ExportSnapshot(h.records, hosted)
+			if err != nil {
+				log.Printf("Failed to export snapshot: %v", err)
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, snap)
+		case http.MethodPost:
+			var snap storage.Snapshot
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&snap); err != nil {
+				writeJSON(w, http.StatusBadRequest, HookResponse{Status: "error", Error: "Invalid JSON body"})
+				return
+			}
+			replace := r.URL.Query().Get("replace") == "1"
+			ctx, cancel := writeContext(r.Context(), h.timeout)
+			defer cancel()
+			result, err := storage.ImportSnapshot(ctx, sourceFromRequest(r, "import"), h.records, hosted, &snap, replace)
+			if err != nil {
+				log.Printf("Snapshot import failed after %d restored, %d removed: %v", result.Restored, result.Removed, err)
+				writeJSON(w, errorStatus(err), HookResponse{Status: "error", Error: err.Error()})
+				return
+			}
+			log.Printf("Snapshot imported: %d values restored, %d removed", result.Restored, result.Removed)
+			writeJSON(w, http.StatusOK, snapshotResponse{Status: "ok", SnapshotResult: result})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET or POST required"})
+		}
+	}
+}
+
+// EnableSnapshots подключает /snapshot
+func (h *APIHandler) EnableSnapshots(hosted *storage.HostedRecords) {
+	h.mux.HandleFunc("/snapshot", h.handleSnapshot(hosted))
+}
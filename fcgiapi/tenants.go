@@ -0,0 +1,41 @@
+package fcgiapi
+
+import (
+	"net/http"
+
+	"dns-acme-server/storage"
+)
+
+// TenantInfo - заказчик и занятая им часть лимита
+type TenantInfo struct {
+	storage.Tenant
+	Records int `json:"records"` // значений опубликовано, если включены лимиты
+	Limit   int `json:"limit"`   // 0 - без лимита
+}
+
+// handleTenants - GET /tenants: клиент заказчика видит только своего заказчика, остальные - всех
+func (h *APIHandler) handleTenants(tenants *storage.Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET required"})
+			return
+		}
+		list := tenants.List()
+		if own := tenants.Of(identityFromContext(r.Context())); own != "" {
+			tenant, _ := tenants.Get(own)
+			list = []storage.Tenant{tenant}
+		}
+		result := make([]TenantInfo, 0, len(list))
+		for _, tenant := range list {
+			info := TenantInfo{Tenant: tenant}
+			info.Records, info.Limit = h.records.Usage(tenant.Name)
+			result = append(result, info)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// EnableTenants подключает GET /tenants
+func (h *APIHandler) EnableTenants(tenants *storage.Tenants) {
+	h.mux.HandleFunc("/tenants", h.handleTenants(tenants))
+}
@@ -0,0 +1,202 @@
+package fcgiapi
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenStore - токены доступа к HTTP API, формат файла: name:token на строку
+type TokenStore struct {
+	path     string
+	mutex    sync.RWMutex
+	tokens   map[string]string        // имя -> токен
+	previous map[string]previousToken // имя -> токен до Rotate, пока не истек
+}
+
+// previousToken - старый токен, который после смены еще принимается до until
+type previousToken struct {
+	token string
+	until time.Time
+}
+
+func LoadTokenFile(path string) (*TokenStore, error) {
+	tokens, err := readTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStore{path: path, tokens: tokens, previous: make(map[string]previousToken)}, nil
+}
+
+// Reload перечитывает файл токенов; при ошибке остаются прежние токены
+func (s *TokenStore) Reload(path string) (int, error) {
+	tokens, err := readTokenFile(path)
+	if err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = tokens
+	return len(tokens), nil
+}
+
+func readTokenFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:token", path, lineNo)
+		}
+		tokens[name] = token
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Authenticate проверяет Basic (имя/токен) или Bearer авторизацию и возвращает имя клиента
+func (s *TokenStore) Authenticate(r *http.Request) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if user, pass, ok := r.BasicAuth(); ok {
+		token, exists := s.tokens[user]
+		if exists && subtle.ConstantTimeCompare([]byte(token), []byte(pass)) == 1 {
+			return user, true
+		}
+		if prev, ok := s.previous[user]; ok && time.Now().Before(prev.until) &&
+			subtle.ConstantTimeCompare([]byte(prev.token), []byte(pass)) == 1 {
+			return user, true
+		}
+		return "", false
+	}
+
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if bearer == "" || bearer == r.Header.Get("Authorization") {
+		return "", false
+	}
+	return s.authenticateBearer(bearer)
+}
+
+// authenticateBearer ищет токен среди известных; вызывается под s.mutex
+func (s *TokenStore) authenticateBearer(bearer string) (string, bool) {
+	for name, token := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(bearer)) == 1 {
+			return name, true
+		}
+	}
+	now := time.Now()
+	for name, prev := range s.previous {
+		if now.Before(prev.until) && subtle.ConstantTimeCompare([]byte(prev.token), []byte(bearer)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Rotate заменяет токен name новым и записывает его в файл токенов вместо прежней строки;
+// прежний токен принимается еще grace. Старый токен помнится только в памяти процесса
+func (s *TokenStore) Rotate(name string, grace time.Duration) (string, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, exists := s.tokens[name]
+	if !exists {
+		return "", time.Time{}, ErrNotRotatable
+	}
+	token, err := newSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := rewriteTokenFile(s.path, name, token); err != nil {
+		return "", time.Time{}, err
+	}
+	until := time.Now().Add(grace)
+	s.tokens[name] = token
+	s.previous[name] = previousToken{token: old, until: until}
+	return token, until, nil
+}
+
+// rewriteTokenFile заменяет строку name:... через временный файл с теми же правами,
+// комментарии и остальные токены остаются
+func rewriteTokenFile(path, name, token string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	replaced := false
+	for i, line := range lines {
+		if n, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && n == name && !replaced {
+			lines[i] = name + ":" + token
+			replaced = true
+		}
+	}
+	if !replaced {
+		return fmt.Errorf("%s: no token %s", path, name)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "\n")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Authenticator проверяет клиента HTTP и gRPC API и возвращает его имя для журнала,
+// аудита и ACL; реализации - TokenStore и плагины -auth-plugin. Должен быть потокобезопасным
+type Authenticator interface {
+	Authenticate(r *http.Request) (identity string, ok bool)
+}
+
+// Authenticators проверяет клиента по очереди: подходит первый, кто его принял
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(r *http.Request) (string, bool) {
+	for _, auth := range a {
+		if identity, ok := auth.Authenticate(r); ok {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+type identityKey struct{}
+
+// identityFromContext возвращает имя клиента, прошедшего авторизацию
+func identityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
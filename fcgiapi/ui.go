@@ -0,0 +1,85 @@
+package fcgiapi
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+	"time"
+)
+
+// uiPage - панель управления: одна страница без внешних зависимостей, данные берет из
+// GET /ui/state, добавляет и удаляет записи через POST /present и /cleanup
+//
+//go:embed ui/index.html
+var uiPage []byte
+
+const (
+	// uiEvents - сколько последних изменений записей показывает панель
+	uiEvents = 50
+	// uiHealthTimeout ограничивает проверку хранилища при обновлении панели
+	uiHealthTimeout = 3 * time.Second
+)
+
+// UIHealth - состояние сервера для панели
+type UIHealth struct {
+	Status     string `json:"status"` // ok или degraded
+	Uptime     string `json:"uptime"`
+	Storage    string `json:"storage"` // ok или текст ошибки
+	RetryQueue int    `json:"retry_queue"`
+	Records    int    `json:"records"`
+}
+
+// UIState - все данные панели одним запросом
+type UIState struct {
+	Health  UIHealth      `json:"health"`
+	Records []RecordUsage `json:"records"`
+	Queries interface{}   `json:"queries"`
+	Events  []RecordEvent `json:"events"`
+}
+
+// EnableUI подключает панель управления: GET /ui/ отдает страницу без авторизации (токен
+// вводится на странице и передается заголовком Bearer), GET /ui/state - данные с обычной
+// авторизацией API. queries возвращает последние DNS запросы
+func (h *APIHandler) EnableUI(usage *UsageTracker, events *EventHub, queries func() interface{}) {
+	started := time.Now()
+	h.mux.HandleFunc("/ui/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ui/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+		w.Write(uiPage)
+	})
+	h.mux.HandleFunc("/ui/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET required"})
+			return
+		}
+		state := UIState{
+			Health:  UIHealth{Status: "ok", Uptime: time.Since(started).Round(time.Second).String(), Storage: "ok"},
+			Records: usage.List(""),
+			Queries: queries(),
+			Events:  events.Recent(uiEvents),
+		}
+		state.Health.Records = len(state.Records)
+		ctx, cancel := context.WithTimeout(r.Context(), uiHealthTimeout)
+		defer cancel()
+		if err := h.records.Check(ctx); err != nil {
+			state.Health.Status, state.Health.Storage = "degraded", err.Error()
+		}
+		if h.retry != nil {
+			if state.Health.RetryQueue = h.retry.Len(); state.Health.RetryQueue > 0 {
+				state.Health.Status = "degraded"
+			}
+		}
+		writeJSON(w, http.StatusOK, state)
+	})
+}
+
+// uiPublic - запрос страницы панели, она не содержит данных и отдается без авторизации
+func uiPublic(r *http.Request) bool {
+	return r.URL.Path == "/ui/" && r.Method == http.MethodGet
+}
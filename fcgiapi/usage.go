@@ -0,0 +1,214 @@
+package fcgiapi
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dns-acme-server/geoip"
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+var (
+	challengeNetworks = metrics.Default.NewHistogramVec("dns_acme_challenge_query_networks",
+		"Distinct resolver networks (/24 or /48) that queried a TXT value before it was removed", perspectiveBuckets)
+	challengeASNs = metrics.Default.NewHistogramVec("dns_acme_challenge_query_asns",
+		"Distinct resolver ASNs that queried a TXT value before it was removed (needs -asn-db)", perspectiveBuckets)
+)
+
+// perspectiveBuckets - число точек проверки: Let's Encrypt проверяет с основной и нескольких
+// удаленных точек, 0 - CA до нас не дошел
+var perspectiveBuckets = []float64{0, 1, 2, 3, 4, 5, 6, 8, 10}
+
+// maxUsageClients ограничивает число запоминаемых адресов резолверов на одно значение
+const maxUsageClients = 32
+
+// RecordUsage - опубликованное значение и то, как его запрашивали по DNS
+type RecordUsage struct {
+	FQDN       string     `json:"fqdn"`
+	Value      string     `json:"value"`
+	TTL        uint32     `json:"ttl"`
+	AddedAt    time.Time  `json:"added_at"`
+	RequestID  string     `json:"request_id,omitempty"` // ID запроса хука, добавившего значение
+	Queries    int        `json:"queries"`
+	FirstQuery *time.Time `json:"first_query,omitempty"`
+	LastQuery  *time.Time `json:"last_query,omitempty"`
+	Clients    []string   `json:"clients,omitempty"`  // IP резолверов, первые maxUsageClients
+	Networks   []string   `json:"networks,omitempty"` // их сети /24 и /48 - разные точки проверки CA
+	ASNs       []string   `json:"asns,omitempty"`     // их автономные системы, если задан -asn-db
+}
+
+// UsageTracker запоминает, запрашивались ли опубликованные записи по DNS, чтобы отличить
+// "CA до нас не дошел" (queries = 0) от "CA отверг значение"
+type UsageTracker struct {
+	records *storage.RecordManager
+	asns    geoip.ASNLookup // nil - ASN не определяются
+
+	mutex sync.Mutex
+	usage map[string]map[string]*RecordUsage // имя (storage.NormalizeDomain) -> значение -> использование
+}
+
+func NewUsageTracker(records *storage.RecordManager) *UsageTracker {
+	return &UsageTracker{
+		records: records,
+		usage:   make(map[string]map[string]*RecordUsage),
+	}
+}
+
+// SetASNLookup включает определение автономных систем резолверов; вызывается до начала обслуживания
+func (u *UsageTracker) SetASNLookup(l geoip.ASNLookup) {
+	u.asns = l
+}
+
+// RecordAdded и RecordRemoved делают UsageTracker наблюдателем RecordManager;
+// повторное добавление значения начинает учет заново
+func (u *UsageTracker) RecordAdded(src storage.Source, name, value string) {
+	key := storage.NormalizeDomain(name)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.usage[key] == nil {
+		u.usage[key] = make(map[string]*RecordUsage)
+	}
+	u.usage[key][value] = &RecordUsage{FQDN: key + ".", Value: value, AddedAt: time.Now().UTC(), RequestID: src.RequestID}
+}
+
+func (u *UsageTracker) RecordRemoved(src storage.Source, name, value string) {
+	key := storage.NormalizeDomain(name)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for v, usage := range u.usage[key] {
+		if value == "" || v == value {
+			u.observePerspectives(usage)
+			delete(u.usage[key], v)
+		}
+	}
+	if len(u.usage[key]) == 0 {
+		delete(u.usage, key)
+	}
+}
+
+// Queried вызывается DNS сервером, когда запись была отдана в ответе (со всеми значениями)
+func (u *UsageTracker) Queried(name, client string) {
+	now := time.Now().UTC()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, usage := range u.usage[storage.NormalizeDomain(name)] {
+		usage.Queries++
+		if usage.FirstQuery == nil {
+			usage.FirstQuery = &now
+		}
+		usage.LastQuery = &now
+		if len(usage.Clients) < maxUsageClients && !containsString(usage.Clients, client) {
+			usage.Clients = append(usage.Clients, client)
+		}
+		if network := clientNetwork(client); network != "" && len(usage.Networks) < maxUsageClients && !containsString(usage.Networks, network) {
+			usage.Networks = append(usage.Networks, network)
+		}
+		if asn := u.clientASN(client); asn != "" && len(usage.ASNs) < maxUsageClients && !containsString(usage.ASNs, asn) {
+			usage.ASNs = append(usage.ASNs, asn)
+		}
+	}
+}
+
+// observePerspectives записывает, из скольких сетей запрашивали удаляемое значение
+func (u *UsageTracker) observePerspectives(usage *RecordUsage) {
+	challengeNetworks.Observe(float64(len(usage.Networks)))
+	if u.asns != nil {
+		challengeASNs.Observe(float64(len(usage.ASNs)))
+	}
+	if usage.Queries == 0 {
+		return
+	}
+	sources := usage.Networks
+	if len(usage.ASNs) > 0 {
+		sources = usage.ASNs
+	}
+	log.Printf("TXT value of %s was queried %d times from %d networks: %s", usage.FQDN, usage.Queries, len(usage.Networks), strings.Join(sources, ", "))
+}
+
+// clientNetwork - сеть резолвера: /24 для IPv4, /48 для IPv6
+func clientNetwork(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+func (u *UsageTracker) clientASN(client string) string {
+	if u.asns == nil {
+		return ""
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return ""
+	}
+	if asn, ok := u.asns.ASN(ip); ok {
+		return asn.String()
+	}
+	return ""
+}
+
+// List возвращает текущие записи с учетом запросов; fqdn ограничивает список одним именем
+func (u *UsageTracker) List(fqdn string) []RecordUsage {
+	u.mutex.Lock()
+	result := []RecordUsage{}
+	for key, values := range u.usage {
+		if fqdn != "" && key != storage.NormalizeDomain(fqdn) {
+			continue
+		}
+		for _, usage := range values {
+			item := *usage
+			item.Clients = append([]string(nil), usage.Clients...)
+			item.Networks = append([]string(nil), usage.Networks...)
+			item.ASNs = append([]string(nil), usage.ASNs...)
+			result = append(result, item)
+		}
+	}
+	u.mutex.Unlock()
+
+	for i := range result {
+		result[i].TTL = u.records.TTL(result[i].FQDN)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].FQDN != result[j].FQDN {
+			return result[i].FQDN < result[j].FQDN
+		}
+		return result[i].AddedAt.Before(result[j].AddedAt)
+	})
+	return result
+}
+
+// handleRecords - GET /records?fqdn=
+func (h *APIHandler) handleRecords(usage *UsageTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, HookResponse{Status: "error", Error: "GET required"})
+			return
+		}
+		writeJSON(w, http.StatusOK, usage.List(r.URL.Query().Get("fqdn")))
+	}
+}
+
+// EnableRecordList подключает GET /records
+func (h *APIHandler) EnableRecordList(usage *UsageTracker) {
+	h.mux.HandleFunc("/records", h.handleRecords(usage))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
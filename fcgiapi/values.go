@@ -0,0 +1,101 @@
+package fcgiapi
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// checkChallengeValue проверяет, что значение TXT похоже на дайджест key authorization
+// (RFC 8555, 8.4): base64url без паддинга от SHA-256, ровно 43 символа
+func checkChallengeValue(value string) error {
+	if len(value) != 43 {
+		return fmt.Errorf("expected a 43 character base64url SHA-256 digest, got %d characters", len(value))
+	}
+	if _, err := base64.RawURLEncoding.Strict().DecodeString(value); err != nil {
+		return fmt.Errorf("expected a base64url SHA-256 digest: %v", err)
+	}
+	return nil
+}
+
+// CheckThumbprint проверяет формат отпечатка ACME аккаунта (RFC 7638): base64url без паддинга
+// от SHA-256 ключа аккаунта, как и дайджест
+func CheckThumbprint(thumbprint string) error {
+	if len(thumbprint) != 43 {
+		return fmt.Errorf("expected a 43 character base64url SHA-256 thumbprint, got %d characters", len(thumbprint))
+	}
+	if _, err := base64.RawURLEncoding.Strict().DecodeString(thumbprint); err != nil {
+		return fmt.Errorf("expected a base64url SHA-256 thumbprint: %v", err)
+	}
+	return nil
+}
+
+// KeyAuthPolicy - обработка полного key authorization ("токен.отпечаток", RFC 8555, 8.1),
+// который некоторые клиенты передают вместо дайджеста
+type KeyAuthPolicy struct {
+	// Digest - публиковать дайджест значений, похожих на key authorization
+	Digest bool
+	// Thumbprints - отпечатки своих ACME аккаунтов; key authorization для другого аккаунта
+	// отклоняется. Непустой список включает Digest
+	Thumbprints []string
+}
+
+// checkThumbprint проверяет, что key authorization выписан для одного из аккаунтов
+// Thumbprints; пустой список - проверка выключена
+func (p KeyAuthPolicy) checkThumbprint(keyAuth string) error {
+	if len(p.Thumbprints) == 0 {
+		return nil
+	}
+	i := strings.LastIndexByte(keyAuth, '.')
+	if i <= 0 {
+		return fmt.Errorf("expected a key authorization token.thumbprint")
+	}
+	for _, t := range p.Thumbprints {
+		if keyAuth[i+1:] == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("key authorization belongs to account %s, not to the configured account", keyAuth[i+1:])
+}
+
+// value - значение TXT для переданного клиентом: key authorization проверяется по отпечатку
+// аккаунта и заменяется дайджестом, остальное (дайджесты) возвращается как есть
+func (p KeyAuthPolicy) value(value string) (string, error) {
+	if len(p.Thumbprints) > 0 && strings.Contains(value, ".") {
+		if err := p.checkThumbprint(value); err != nil {
+			return "", err
+		}
+		return keyAuthDigest(value), nil
+	}
+	if p.Digest && isKeyAuthorization(value) {
+		return keyAuthDigest(value), nil
+	}
+	return value, nil
+}
+
+// isKeyAuthorization - значение имеет вид "токен.отпечаток": токен и отпечаток в base64url,
+// отпечаток - SHA-256 (43 символа). Дайджест точек не содержит, поэтому с ним не спутать
+func isKeyAuthorization(value string) bool {
+	i := strings.LastIndexByte(value, '.')
+	if i <= 0 || CheckThumbprint(value[i+1:]) != nil {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(value[:i])
+	return err == nil
+}
+
+// checkHostname проверяет домен сертификата после ToASCII: имя хоста минимум из двух меток,
+// без подчеркиваний (полное имя записи передается отдельно) и не IP адрес
+func checkHostname(domain string) error {
+	if net.ParseIP(domain) != nil {
+		return fmt.Errorf("%s is an IP address, dns-01 validates host names only", domain)
+	}
+	if !strings.Contains(domain, ".") {
+		return fmt.Errorf("%s is not a fully qualified host name", domain)
+	}
+	if strings.Contains(domain, "_") {
+		return fmt.Errorf("%s contains an underscore, expected a host name", domain)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package geoip определяет страну и автономную систему (ASN) резолвера по его IP адресу, чтобы
+// было видно, из каких сетей и стран CA проверял запись. Источники - базы MaxMind DB
+// (GeoLite2 Country/City/ASN) и таблица iptoasn.com.
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ASN - автономная система
+type ASN struct {
+	Number uint32
+	Name   string
+}
+
+func (a ASN) String() string {
+	if a.Name == "" {
+		return fmt.Sprintf("AS%d", a.Number)
+	}
+	return fmt.Sprintf("AS%d %s", a.Number, a.Name)
+}
+
+// ASNLookup находит автономную систему адреса; false - адрес не найден или не анонсируется
+type ASNLookup interface {
+	ASN(ip net.IP) (ASN, bool)
+}
+
+// asnRange - диапазон адресов одной автономной системы, адреса в 16-байтовой форме
+type asnRange struct {
+	start, end net.IP
+	asn        ASN
+}
+
+// ASNTable - таблица диапазонов адресов в формате iptoasn.com (ip2asn-combined.tsv[.gz]):
+// строки "начало<TAB>конец<TAB>ASN<TAB>страна<TAB>описание", ASN 0 - адреса не анонсируются
+type ASNTable struct {
+	ranges []asnRange // по возрастанию start, не пересекаются
+}
+
+// LoadASNTable читает таблицу из файла; .gz распаковывается
+func LoadASNTable(path string) (*ASNTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	t, err := ParseASNTable(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseASNTable разбирает таблицу iptoasn.com
+func ParseASNTable(r io.Reader) (*ASNTable, error) {
+	t := &ASNTable{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, "\t", 5)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected start, end and ASN", line)
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", line, fields[0], fields[1])
+		}
+		number, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid ASN %q", line, fields[2])
+		}
+		if number == 0 {
+			continue
+		}
+		asn := ASN{Number: uint32(number)}
+		if len(fields) == 5 {
+			asn.Name = strings.TrimSpace(fields[4])
+		}
+		t.ranges = append(t.ranges, asnRange{start: start.To16(), end: end.To16(), asn: asn})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(t.ranges, func(i, j int) bool {
+		return bytes.Compare(t.ranges[i].start, t.ranges[j].start) < 0
+	})
+	return t, nil
+}
+
+// Len - число диапазонов
+func (t *ASNTable) Len() int {
+	return len(t.ranges)
+}
+
+func (t *ASNTable) ASN(ip net.IP) (ASN, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return ASN{}, false
+	}
+	// последний диапазон, начинающийся не позже ip
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return bytes.Compare(t.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, t.ranges[i].end) > 0 {
+		return ASN{}, false
+	}
+	return t.ranges[i].asn, true
+}
@@ -0,0 +1,105 @@
+package geoip
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// Location - страна и автономная система адреса; пустые поля - не найдено
+type Location struct {
+	Country string // ISO код, например DE
+	ASN     ASN
+}
+
+// String - "DE AS3320 Deutsche Telekom AG", пустая строка - ничего не найдено
+func (l Location) String() string {
+	switch {
+	case l.ASN.Number == 0:
+		return l.Country
+	case l.Country == "":
+		return l.ASN.String()
+	}
+	return l.Country + " " + l.ASN.String()
+}
+
+// Locator определяет местоположение резолвера
+type Locator interface {
+	Locate(ip net.IP) Location
+}
+
+// DB - набор баз MaxMind: страна берется из Country или City, автономная система - из ASN
+type DB struct {
+	readers []*Reader
+}
+
+// Open открывает базы paths
+func Open(paths []string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		r, err := OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Types - типы открытых баз
+func (db *DB) Types() []string {
+	var types []string
+	for _, r := range db.readers {
+		types = append(types, r.Type())
+	}
+	return types
+}
+
+// HasASN - среди баз есть база автономных систем
+func (db *DB) HasASN() bool {
+	for _, t := range db.Types() {
+		if strings.Contains(t, "ASN") {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) Locate(ip net.IP) Location {
+	var loc Location
+	for _, r := range db.readers {
+		record, err := r.Lookup(ip)
+		if err != nil {
+			log.Printf("GeoIP lookup of %s in %s failed: %v", ip, r.Type(), err)
+			continue
+		}
+		if record == nil {
+			continue
+		}
+		if loc.Country == "" {
+			loc.Country = isoCode(record, "country")
+			if loc.Country == "" {
+				loc.Country = isoCode(record, "registered_country")
+			}
+		}
+		if loc.ASN.Number == 0 {
+			if number, ok := record["autonomous_system_number"].(uint64); ok {
+				loc.ASN.Number = uint32(number)
+				loc.ASN.Name, _ = record["autonomous_system_organization"].(string)
+			}
+		}
+	}
+	return loc
+}
+
+// ASN делает DB источником ASN для учета записей (ASNLookup)
+func (db *DB) ASN(ip net.IP) (ASN, bool) {
+	asn := db.Locate(ip).ASN
+	return asn, asn.Number != 0
+}
+
+func isoCode(record map[string]interface{}, key string) string {
+	country, _ := record[key].(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+	return code
+}
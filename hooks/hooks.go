@@ -0,0 +1,274 @@
+// Package hooks запускает внешние команды и HTTP вебхуки до и после изменения записей:
+// pre-хук может отклонить изменение (своя проверка значения), post-хук узнает о примененном
+// изменении (уведомления, отправка на вторичный DNS).
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"dns-acme-server/metrics"
+	"dns-acme-server/responder"
+	"dns-acme-server/storage"
+)
+
+var hookRuns = metrics.Default.NewCounterVec("dns_acme_hook_runs_total",
+	"Runs of -change-hook commands and webhooks by stage and result: ok, rejected (pre), failed or dropped (post)", "stage", "result")
+
+// Этапы, на которых вызываются хуки
+var stages = []string{"pre-add", "post-add", "pre-remove", "post-remove"}
+
+// postQueue - сколько изменений может ждать одного post-хука
+const postQueue = 1024
+
+// Change - изменение, о котором сообщается хуку; для вебхука - тело POST запроса
+type Change struct {
+	Stage     string `json:"stage"`  // pre-add, post-add, pre-remove, post-remove
+	Action    string `json:"action"` // add или remove
+	FQDN      string `json:"fqdn"`
+	Value     string `json:"value"` // пустое у remove - удаляются все значения
+	Interface string `json:"interface"`
+	Source    string `json:"source,omitempty"`
+	Identity  string `json:"identity,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// env - переменные окружения команды с описанием изменения
+func (c Change) env() []string {
+	return []string{
+		"ACME_HOOK=" + c.Action,
+		"ACME_HOOK_STAGE=" + c.Stage,
+		"ACME_FQDN=" + c.FQDN,
+		"ACME_VALUE=" + c.Value,
+		"ACME_INTERFACE=" + c.Interface,
+		"ACME_SOURCE=" + c.Source,
+		"ACME_IDENTITY=" + c.Identity,
+		"ACME_REQUEST_ID=" + c.RequestID,
+	}
+}
+
+// hook - одна команда или URL
+type hook struct {
+	stage   string
+	target  string   // для журнала
+	url     string   // http(s) вебхук
+	command []string // иначе команда с аргументами, без оболочки
+	queue   chan Change
+}
+
+// Hooks вызывает хуки, заданные флагами -change-hook; реализует storage.ChangeHook (Before)
+// и storage.RecordObserver (post-хуки)
+type Hooks struct {
+	hooks   []*hook
+	timeout time.Duration
+	env     []string
+	client  *http.Client
+}
+
+// New создает хуки с таймаутом одного вызова timeout; env (KEY=VALUE) добавляется
+// к окружению команд
+func New(timeout time.Duration, env []string) *Hooks {
+	return &Hooks{timeout: timeout, env: env, client: &http.Client{Timeout: timeout}}
+}
+
+// Add разбирает хук STAGE=COMMAND или STAGE=URL, например pre-add=/usr/local/bin/check
+// или post-remove=https://hooks.example.com/acme. Команда делится на аргументы по пробелам
+// и запускается без оболочки
+func (h *Hooks) Add(spec string) error {
+	stage, target, ok := strings.Cut(spec, "=")
+	stage, target = strings.TrimSpace(stage), strings.TrimSpace(target)
+	if !ok || target == "" {
+		return fmt.Errorf("invalid hook %q, expected STAGE=COMMAND or STAGE=URL", spec)
+	}
+	valid := false
+	for _, s := range stages {
+		valid = valid || s == stage
+	}
+	if !valid {
+		return fmt.Errorf("invalid hook stage %q, expected one of %s", stage, strings.Join(stages, ", "))
+	}
+	hk := &hook{stage: stage, target: target}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		hk.url = target
+	} else {
+		hk.command = strings.Fields(target)
+		if _, err := exec.LookPath(hk.command[0]); err != nil {
+			return fmt.Errorf("hook %s: %w", stage, err)
+		}
+	}
+	if strings.HasPrefix(stage, "post-") {
+		hk.queue = make(chan Change, postQueue)
+		go h.runPost(hk)
+	}
+	h.hooks = append(h.hooks, hk)
+	return nil
+}
+
+// Len - число хуков
+func (h *Hooks) Len() int {
+	return len(h.hooks)
+}
+
+// Before запускает pre-хуки по порядку; первый отказ отменяет изменение
+func (h *Hooks) Before(ctx context.Context, src storage.Source, action, name, value string) error {
+	change := newChange("pre-"+action, action, src, name, value)
+	for _, hk := range h.hooks {
+		if hk.stage != change.Stage {
+			continue
+		}
+		if err := h.run(ctx, hk, change); err != nil {
+			hookRuns.Inc(hk.stage, "rejected")
+			return err
+		}
+		hookRuns.Inc(hk.stage, "ok")
+	}
+	return nil
+}
+
+func (h *Hooks) RecordAdded(src storage.Source, name, value string) {
+	h.after(newChange("post-add", "add", src, name, value))
+}
+
+// RecordRemoved вызывается и для значений, удаленных уборкой (interface expire)
+func (h *Hooks) RecordRemoved(src storage.Source, name, value string) {
+	h.after(newChange("post-remove", "remove", src, name, value))
+}
+
+// after ставит изменение в очереди post-хуков, не дожидаясь их
+func (h *Hooks) after(change Change) {
+	for _, hk := range h.hooks {
+		if hk.stage != change.Stage {
+			continue
+		}
+		select {
+		case hk.queue <- change:
+		default:
+			hookRuns.Inc(hk.stage, "dropped")
+			log.Printf("Hook %s %s queue is full, dropping %s of %s", hk.stage, hk.target, change.Action, change.FQDN)
+		}
+	}
+}
+
+// runPost вызывает post-хук по очереди изменений; ошибки только пишутся в журнал
+func (h *Hooks) runPost(hk *hook) {
+	for change := range hk.queue {
+		if err := h.run(context.Background(), hk, change); err != nil {
+			hookRuns.Inc(hk.stage, "failed")
+			log.Printf("Hook %s %s failed for %s: %v", hk.stage, hk.target, change.FQDN, err)
+			continue
+		}
+		hookRuns.Inc(hk.stage, "ok")
+	}
+}
+
+func newChange(stage, action string, src storage.Source, name, value string) Change {
+	return Change{
+		Stage:     stage,
+		Action:    action,
+		FQDN:      name,
+		Value:     value,
+		Interface: src.Interface,
+		Source:    src.Addr,
+		Identity:  src.Identity,
+		RequestID: src.RequestID,
+	}
+}
+
+// run вызывает хук не дольше timeout. Отказ pre-хука (ненулевой код команды, ответ вебхука
+// не 2xx) - ErrRejectedByHook с текстом вывода или ответа; таймаут и ошибки запуска тоже
+// отклоняют изменение, чтобы неработающая проверка не пропускала все подряд
+func (h *Hooks) run(ctx context.Context, hk *hook, change Change) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	if hk.url != "" {
+		return h.post(ctx, hk, change)
+	}
+
+	// вывод пишется в файл, а не в pipe: иначе Wait после таймаута ждал бы потомков
+	// команды, которые унаследовали pipe и еще работают
+	output, err := os.CreateTemp("", "dns-acme-hook-*")
+	if err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrRejectedByHook, err)
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+	cmd := exec.CommandContext(ctx, hk.command[0], hk.command[1:]...)
+	cmd.Env = append(append(baseEnv(), h.env...), change.env()...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	release := responder.HoldChildren()
+	err = cmd.Run()
+	release()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s did not finish in %v", storage.ErrRejectedByHook, hk.command[0], h.timeout)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		text := make([]byte, 512)
+		n, _ := output.ReadAt(text, 0)
+		return fmt.Errorf("%w: %s exited with %d: %s", storage.ErrRejectedByHook, hk.command[0], exit.ExitCode(), firstLine(string(text[:n])))
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrRejectedByHook, err)
+	}
+	return nil
+}
+
+func (h *Hooks) post(ctx context.Context, hk *hook, change Change) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hk.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrRejectedByHook, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%w: %s answered %s: %s", storage.ErrRejectedByHook, hk.url, resp.Status, firstLine(string(text)))
+	}
+	return nil
+}
+
+// passedEnv - переменные демона, которые видят команды; остальное окружение (токены Vault
+// и Consul, ANGIE_DNS_FCGI_*) командам не передается
+var passedEnv = []string{"PATH", "HOME", "LANG", "LC_ALL", "TZ", "TMPDIR", "SYSTEMROOT"}
+
+func baseEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		for _, passed := range passedEnv {
+			if strings.EqualFold(name, passed) {
+				env = append(env, kv)
+			}
+		}
+	}
+	return env
+}
+
+// firstLine - первая непустая строка вывода для сообщения об ошибке
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return "no output"
+}
@@ -0,0 +1,200 @@
+package hooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// script создает исполняемый сценарий оболочки с телом body
+func script(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAddSpec(t *testing.T) {
+	for _, tt := range []struct {
+		spec  string
+		error string // пусто - хук принят
+	}{
+		{spec: "pre-add=https://hooks.example.com/acme"},
+		{spec: " post-remove = http://127.0.0.1:9000/ "},
+		{spec: "pre-add", error: "expected STAGE=COMMAND"},
+		{spec: "pre-add= ", error: "expected STAGE=COMMAND"},
+		{spec: "before-add=https://hooks.example.com/acme", error: "invalid hook stage"},
+		{spec: "pre-remove=/nonexistent/dns-acme-hook", error: "hook pre-remove"},
+	} {
+		err := New(time.Second, nil).Add(tt.spec)
+		if tt.error == "" && err != nil || tt.error != "" && (err == nil || !strings.Contains(err.Error(), tt.error)) {
+			t.Errorf("Add(%q) = %v, want %q", tt.spec, err, tt.error)
+		}
+	}
+}
+
+// TestPreHooks - pre-хук пропускает или отклоняет изменение до записи: команда по коду
+// выхода и таймауту, вебхук по статусу ответа
+func TestPreHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands are shell scripts")
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change Change
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if change.Value != "allowed" {
+			http.Error(w, "value "+change.Value+" is not allowed\nsecond line", http.StatusForbidden)
+		}
+	}))
+	defer webhook.Close()
+
+	tests := []struct {
+		name   string
+		hook   string // STAGE=TARGET, %s - путь сценария
+		script string
+		action string
+		value  string
+		error  string // пусто - изменение проходит
+	}{
+		{name: "command allows", hook: "pre-add=%s", script: `test "$ACME_HOOK_STAGE $ACME_FQDN $ACME_VALUE $ACME_INTERFACE $ACME_EXTRA" = "pre-add _acme-challenge.example.com. v1 fastcgi extra"`, action: "add", value: "v1"},
+		{name: "command rejects", hook: "pre-add=%s", script: "echo; echo value rejected by policy; exit 3", action: "add", value: "v1", error: "exited with 3: value rejected by policy"},
+		{name: "command times out", hook: "pre-add=%s", script: "sleep 5", action: "add", value: "v1", error: "did not finish"},
+		{name: "daemon environment hidden", hook: "pre-add=%s", script: `test -z "$DNS_ACME_TEST_SECRET"`, action: "add", value: "v1"},
+		{name: "other stage", hook: "pre-remove=%s", script: "exit 1", action: "add", value: "v1"},
+		{name: "remove rejected", hook: "pre-remove=%s", script: "exit 1", action: "remove", value: "v1", error: "exited with 1: no output"},
+		{name: "webhook allows", hook: "pre-add=" + webhook.URL, action: "add", value: "allowed"},
+		{name: "webhook rejects", hook: "pre-add=" + webhook.URL, action: "add", value: "v1", error: "403 Forbidden: value v1 is not allowed"},
+	}
+	t.Setenv("DNS_ACME_TEST_SECRET", "secret")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(500*time.Millisecond, []string{"ACME_EXTRA=extra"})
+			spec := tt.hook
+			if strings.Contains(spec, "%s") {
+				spec = strings.Replace(spec, "%s", script(t, tt.script), 1)
+			}
+			if err := h.Add(spec); err != nil {
+				t.Fatal(err)
+			}
+			m := storage.NewRecordManager(storage.NewMemory(), "")
+			m.SetChangeHook(h.Before)
+			src := storage.Source{Interface: "fastcgi"}
+			const name = "_acme-challenge.example.com."
+			var err error
+			if tt.action == "add" {
+				err = m.Add(src, name, tt.value)
+			} else {
+				if err := m.Add(src, name, tt.value); err != nil {
+					t.Fatal(err)
+				}
+				err = m.Remove(src, name, tt.value)
+			}
+
+			if tt.error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, storage.ErrRejectedByHook) || !strings.Contains(err.Error(), tt.error) {
+				t.Fatalf("error %v, want a hook rejection with %q", err, tt.error)
+			}
+			want := 0
+			if tt.action == "remove" {
+				want = 1
+			}
+			if values := m.Values(name); len(values) != want {
+				t.Errorf("values %q after a rejected %s", values, tt.action)
+			}
+		})
+	}
+}
+
+// logLines передает строки журнала в канал; при полном канале строка теряется,
+// чтобы журнал не блокировал остальные горутины
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	select {
+	case l <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+// TestPostHooks - post-хуки получают примененные изменения, их ошибки только пишутся
+// в журнал и изменений не отменяют
+func TestPostHooks(t *testing.T) {
+	lines := make(logLines, 16)
+	log.SetOutput(lines)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	changes := make(chan Change, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change Change
+		json.NewDecoder(r.Body).Decode(&change)
+		changes <- change
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer webhook.Close()
+	h := New(time.Second, nil)
+	for _, spec := range []string{"post-add=" + webhook.URL, "post-remove=" + webhook.URL} {
+		if err := h.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := storage.NewRecordManager(storage.NewMemory(), "")
+	m.SetChangeHook(h.Before)
+	m.Observe(h)
+	src := storage.Source{Interface: "lego", Identity: "ci", RequestID: "req-1"}
+	const name = "_acme-challenge.example.com."
+	if err := m.Add(src, name, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove(src, name, "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// у каждого хука своя очередь, порядок между этапами не гарантирован
+	want := map[string]Change{
+		"post-add":    {Stage: "post-add", Action: "add", FQDN: name, Value: "v1", Interface: "lego", Identity: "ci", RequestID: "req-1"},
+		"post-remove": {Stage: "post-remove", Action: "remove", FQDN: name, Value: "v1", Interface: "lego", Identity: "ci", RequestID: "req-1"},
+	}
+	failed := 0
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 || failed < 2 {
+		select {
+		case got := <-changes:
+			if got != want[got.Stage] {
+				t.Errorf("webhook got %+v, want %+v", got, want[got.Stage])
+			}
+			delete(want, got.Stage)
+		case line := <-lines:
+			if strings.Contains(line, "answered 500") {
+				failed++
+			}
+		case <-timeout:
+			t.Fatalf("webhook calls missing for %v, %d failures logged", want, failed)
+		}
+	}
+	if values := m.Values(name); len(values) != 0 {
+		t.Errorf("values %q, failed post hook undid the removal", values)
+	}
+}
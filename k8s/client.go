@@ -0,0 +1,149 @@
+// Package k8s - режим работы в Kubernetes без клиентских библиотек: обращения к API серверу
+// с токеном service account, хранение записей в ConfigMap и выбор лидера через Lease.
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir - куда kubelet монтирует токен, CA и namespace пода
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// StatusError - ответ API сервера с кодом ошибки
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kubernetes API: %d %s", e.Code, e.Message)
+}
+
+// IsNotFound и IsConflict проверяют код ошибки API сервера
+func IsNotFound(err error) bool { return statusCode(err) == http.StatusNotFound }
+func IsConflict(err error) bool { return statusCode(err) == http.StatusConflict }
+
+func statusCode(err error) int {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Code
+	}
+	return 0
+}
+
+// ObjectMeta - общие поля metadata, которые нужны демону
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// Client обращается к API серверу изнутри кластера
+type Client struct {
+	base      string
+	namespace string
+	http      *http.Client
+	// для долгих watch запросов: без общего таймаута
+	stream    *http.Client
+	tokenFile string
+}
+
+// InCluster создает клиента по переменным KUBERNETES_SERVICE_HOST/PORT и service account пода
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in service account ca.crt")
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		Proxy:           http.ProxyFromEnvironment,
+	}
+	return &Client{
+		base:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		http:      &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		stream:    &http.Client{Transport: transport},
+		tokenFile: serviceAccountDir + "/token",
+	}, nil
+}
+
+// Namespace - namespace пода, в нем создаются ConfigMap и Lease
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// do выполняет запрос к API; out может быть nil
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	resp, err := c.send(ctx, c.http, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send отправляет запрос и превращает ответ с ошибкой в StatusError
+func (c *Client) send(ctx context.Context, client *http.Client, method, path string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	// токен перечитывается на каждый запрос: kubelet периодически его обновляет
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&status)
+		return nil, &StatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	return resp, nil
+}
@@ -0,0 +1,413 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// ConfigMap - объект core/v1 ConfigMap
+type ConfigMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data"`
+}
+
+// storedValue - значение записи в ConfigMap и время его добавления (для очистки забытых)
+type storedValue struct {
+	Value string `json:"v"`
+	Added int64  `json:"t"`
+}
+
+// maxWriteRetries - сколько раз повторять запись при конфликте resourceVersion
+const maxWriteRetries = 10
+
+// writeTimeout - предел изменения без контекста запроса (уборка, вызовы без ctx)
+const writeTimeout = 30 * time.Second
+
+// ConfigMapStorage хранит записи в ConfigMap: ключ data - имя записи, значение - JSON массив
+// значений. Все реплики держат локальную копию, обновляемую watch запросом, и отвечают
+// на DNS из нее; изменения пишутся в API сервер с проверкой resourceVersion.
+type ConfigMapStorage struct {
+	client *Client
+	name   string
+
+	mutex   sync.RWMutex
+	records map[string][]storedValue
+	version string
+}
+
+// NewConfigMapStorage загружает ConfigMap name (создает, если его нет)
+func NewConfigMapStorage(client *Client, name string) (*ConfigMapStorage, error) {
+	s := &ConfigMapStorage{client: client, name: name}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cm, err := s.load(ctx)
+	if IsNotFound(err) {
+		cm, err = s.create(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.replace(cm)
+	return s, nil
+}
+
+func (s *ConfigMapStorage) path() string {
+	return "/api/v1/namespaces/" + url.PathEscape(s.client.namespace) + "/configmaps/" + url.PathEscape(s.name)
+}
+
+func (s *ConfigMapStorage) load(ctx context.Context) (*ConfigMap, error) {
+	var cm ConfigMap
+	if err := s.client.do(ctx, "GET", s.path(), nil, &cm); err != nil {
+		return nil, err
+	}
+	return &cm, nil
+}
+
+func (s *ConfigMapStorage) create(ctx context.Context) (*ConfigMap, error) {
+	cm := &ConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   ObjectMeta{Name: s.name, Namespace: s.client.namespace},
+	}
+	var created ConfigMap
+	err := s.client.do(ctx, "POST", "/api/v1/namespaces/"+url.PathEscape(s.client.namespace)+"/configmaps", cm, &created)
+	if IsConflict(err) {
+		// другая реплика успела создать его первой
+		return s.load(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Created ConfigMap %s/%s for records", s.client.namespace, s.name)
+	return &created, nil
+}
+
+// replace заменяет локальную копию содержимым ConfigMap, если оно новее копии: ответ watch
+// может прийти позже ответа на собственную запись, и старое содержимое не должно вернуться
+func (s *ConfigMapStorage) replace(cm *ConfigMap) {
+	s.store(cm, false)
+}
+
+// reload заменяет локальную копию безусловно: после обрыва watch копия могла разойтись
+// с API сервером (например, ConfigMap пересоздан и resourceVersion начался заново)
+func (s *ConfigMapStorage) reload(cm *ConfigMap) {
+	s.store(cm, true)
+}
+
+func (s *ConfigMapStorage) store(cm *ConfigMap, force bool) {
+	records := make(map[string][]storedValue, len(cm.Data))
+	for name, data := range cm.Data {
+		var values []storedValue
+		if err := json.Unmarshal([]byte(data), &values); err != nil {
+			log.Printf("Skipping malformed record %s in ConfigMap %s: %v", name, s.name, err)
+			continue
+		}
+		records[name] = values
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !force && !newerVersion(cm.Metadata.ResourceVersion, s.version) {
+		return
+	}
+	s.records = records
+	s.version = cm.Metadata.ResourceVersion
+}
+
+// newerVersion - новее ли resourceVersion version, чем current. Формат resourceVersion
+// не обещан, но у etcd это растущее число: числа сравниваются, иначе новым считается любое отличие
+func newerVersion(version, current string) bool {
+	if version == "" || current == "" {
+		return true
+	}
+	v, err := strconv.ParseUint(version, 10, 64)
+	c, cerr := strconv.ParseUint(current, 10, 64)
+	if err != nil || cerr != nil {
+		return version != current
+	}
+	return v > c
+}
+
+// update читает ConfigMap, применяет change к значениям name и записывает результат;
+// при конфликте с параллельной записью другой реплики повторяет попытку
+func (s *ConfigMapStorage) update(ctx context.Context, name string, change func([]storedValue) []storedValue) error {
+	for attempt := 0; ; attempt++ {
+		cm, err := s.load(ctx)
+		if err != nil {
+			return err
+		}
+		var values []storedValue
+		if data, ok := cm.Data[name]; ok {
+			if err := json.Unmarshal([]byte(data), &values); err != nil {
+				return fmt.Errorf("malformed record %s in ConfigMap %s: %w", name, s.name, err)
+			}
+		}
+		values = change(values)
+		if values == nil {
+			// ничего не изменилось
+			s.replace(cm)
+			return nil
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		if len(values) == 0 {
+			delete(cm.Data, name)
+		} else {
+			data, _ := json.Marshal(values)
+			cm.Data[name] = string(data)
+		}
+		var updated ConfigMap
+		err = s.client.do(ctx, "PUT", s.path(), cm, &updated)
+		if IsConflict(err) && attempt < maxWriteRetries {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.replace(&updated)
+		return nil
+	}
+}
+
+func (s *ConfigMapStorage) AddTXTValue(domain, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return s.AddTXTValueContext(ctx, domain, value)
+}
+
+func (s *ConfigMapStorage) AddTXTValueContext(ctx context.Context, domain, value string) error {
+	return s.change(ctx, domain, value, false, nil)
+}
+
+func (s *ConfigMapStorage) RemoveTXTValue(domain, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return s.RemoveTXTValueContext(ctx, domain, value)
+}
+
+func (s *ConfigMapStorage) RemoveTXTValueContext(ctx context.Context, domain, value string) error {
+	return s.change(ctx, domain, value, true, nil)
+}
+
+// UpdateTXTValue проверяет значения и меняет запись одним PUT с resourceVersion прочитанного
+// ConfigMap: если его успела изменить другая реплика, check вызывается снова на новых значениях
+func (s *ConfigMapStorage) UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	return s.change(ctx, domain, value, remove, check)
+}
+
+// change добавляет value или удаляет его (пустое - все значения), если check (может быть
+// nil) принимает текущие значения
+func (s *ConfigMapStorage) change(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	var rejected error
+	err := s.update(ctx, domain, func(values []storedValue) []storedValue {
+		if check != nil {
+			current := make([]string, len(values))
+			for i, v := range values {
+				current[i] = v.Value
+			}
+			if rejected = check(current); rejected != nil {
+				return nil
+			}
+		}
+		if remove {
+			return removeValue(values, value)
+		}
+		return addValue(values, value)
+	})
+	if rejected != nil {
+		return rejected
+	}
+	return err
+}
+
+// addValue - значения с value в конце, nil - value уже есть
+func addValue(values []storedValue, value string) []storedValue {
+	for _, stored := range values {
+		if stored.Value == value {
+			return nil
+		}
+	}
+	return append(values, storedValue{Value: value, Added: time.Now().Unix()})
+}
+
+// removeValue - значения без value (пустое - без всех), nil - удалять нечего
+func removeValue(values []storedValue, value string) []storedValue {
+	if len(values) == 0 {
+		return nil
+	}
+	if value == "" {
+		return []storedValue{}
+	}
+	kept := make([]storedValue, 0, len(values))
+	for _, stored := range values {
+		if stored.Value != value {
+			kept = append(kept, stored)
+		}
+	}
+	if len(kept) == len(values) {
+		return nil
+	}
+	return kept
+}
+
+func (s *ConfigMapStorage) GetTXTValues(domain string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stored := s.records[domain]
+	if len(stored) == 0 {
+		return nil, nil
+	}
+	values := make([]string, len(stored))
+	for i, v := range stored {
+		values[i] = v.Value
+	}
+	return values, nil
+}
+
+// GetTXTValuesContext читает локальную копию и не ждет API сервер
+func (s *ConfigMapStorage) GetTXTValuesContext(ctx context.Context, domain string) ([]string, error) {
+	return s.GetTXTValues(domain)
+}
+
+// ListTXTValues возвращает все записи локальной копии ConfigMap
+func (s *ConfigMapStorage) ListTXTValues() (map[string][]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	all := make(map[string][]string, len(s.records))
+	for name, stored := range s.records {
+		for _, v := range stored {
+			all[name] = append(all[name], v.Value)
+		}
+	}
+	return all, nil
+}
+
+// Watch поддерживает локальную копию актуальной, пока не закрыт stop
+func (s *ConfigMapStorage) Watch(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for ctx.Err() == nil {
+		if err := s.watch(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("ConfigMap %s watch failed: %v", s.name, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		// после обрыва перечитываем целиком: пропущенные события могли устареть
+		if cm, err := s.load(ctx); err == nil {
+			s.reload(cm)
+		}
+	}
+}
+
+func (s *ConfigMapStorage) watch(ctx context.Context) error {
+	s.mutex.RLock()
+	version := s.version
+	s.mutex.RUnlock()
+	query := url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + s.name},
+		"resourceVersion": {version},
+		"timeoutSeconds":  {"300"},
+	}
+	resp, err := s.client.send(ctx, s.client.stream, "GET", "/api/v1/namespaces/"+url.PathEscape(s.client.namespace)+"/configmaps?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var cm ConfigMap
+			if err := json.Unmarshal(event.Object, &cm); err != nil {
+				return err
+			}
+			if event.Type == "DELETED" {
+				cm.Data = nil
+			}
+			s.replace(&cm)
+		case "ERROR":
+			// обычно 410 Gone: resourceVersion устарел, Watch перечитает ConfigMap
+			return fmt.Errorf("watch error: %s", event.Object)
+		}
+	}
+}
+
+// Sweep удаляет значения старше maxAge: записи, которые клиент не удалил после выпуска.
+// Вызывается только лидером, чтобы реплики не конкурировали за одну и ту же запись.
+// expired (может быть nil) вызывается для каждого удаленного значения.
+func (s *ConfigMapStorage) Sweep(maxAge time.Duration, expired func(name, value string)) (int, error) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+	s.mutex.RLock()
+	var stale []string
+	for name, values := range s.records {
+		if storage.IsHostedKey(name) {
+			// постоянные записи не истекают
+			continue
+		}
+		for _, v := range values {
+			if v.Added < cutoff {
+				stale = append(stale, name)
+				break
+			}
+		}
+	}
+	s.mutex.RUnlock()
+
+	removed := 0
+	for _, name := range stale {
+		var dropped []string
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		err := s.update(ctx, name, func(values []storedValue) []storedValue {
+			kept := make([]storedValue, 0, len(values))
+			dropped = dropped[:0]
+			for _, v := range values {
+				if v.Added >= cutoff {
+					kept = append(kept, v)
+				} else {
+					dropped = append(dropped, v.Value)
+				}
+			}
+			if len(kept) == len(values) {
+				return nil
+			}
+			return kept
+		})
+		cancel()
+		if err != nil {
+			return removed, err
+		}
+		removed += len(dropped)
+		if expired != nil {
+			for _, value := range dropped {
+				expired(name, value)
+			}
+		}
+	}
+	return removed, nil
+}
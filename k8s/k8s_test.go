@@ -0,0 +1,296 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI - API сервер в памяти: GET, POST и PUT объектов с проверкой resourceVersion
+type fakeAPI struct {
+	t       *testing.T
+	mutex   sync.Mutex
+	version int
+	objects map[string]map[string]interface{} // путь объекта -> объект
+	puts    int
+	// beforePut вызывается до проверки resourceVersion и может изменить объект -
+	// так другая реплика успевает записать между чтением и записью
+	beforePut func(path string, stored map[string]interface{})
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	return &fakeAPI{t: t, objects: make(map[string]map[string]interface{})}
+}
+
+// set кладет объект по пути со следующим resourceVersion
+func (a *fakeAPI) set(path string, object map[string]interface{}) {
+	a.version++
+	meta, _ := object["metadata"].(map[string]interface{})
+	if meta == nil {
+		meta = make(map[string]interface{})
+		object["metadata"] = meta
+	}
+	meta["resourceVersion"] = strconv.Itoa(a.version)
+	a.objects[path] = object
+}
+
+func (a *fakeAPI) get(path string) map[string]interface{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.objects[path]
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		a.t.Errorf("%s %s: Authorization %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	status := func(code int, message string) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	}
+	var object map[string]interface{}
+	if r.Method == "POST" || r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+			status(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	path := r.URL.Path
+	switch r.Method {
+	case "GET":
+		stored, ok := a.objects[path]
+		if !ok {
+			status(http.StatusNotFound, "not found")
+			return
+		}
+		json.NewEncoder(w).Encode(stored)
+	case "POST":
+		path += "/" + object["metadata"].(map[string]interface{})["name"].(string)
+		if _, ok := a.objects[path]; ok {
+			status(http.StatusConflict, "already exists")
+			return
+		}
+		a.set(path, object)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(object)
+	case "PUT":
+		a.puts++
+		stored, ok := a.objects[path]
+		if !ok {
+			status(http.StatusNotFound, "not found")
+			return
+		}
+		if a.beforePut != nil {
+			a.beforePut(path, stored)
+			stored = a.objects[path]
+		}
+		meta, _ := object["metadata"].(map[string]interface{})
+		if meta["resourceVersion"] != stored["metadata"].(map[string]interface{})["resourceVersion"] {
+			status(http.StatusConflict, "the object has been modified")
+			return
+		}
+		a.set(path, object)
+		json.NewEncoder(w).Encode(object)
+	default:
+		status(http.StatusMethodNotAllowed, r.Method)
+	}
+}
+
+func testClient(t *testing.T, api *fakeAPI) *Client {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &Client{base: srv.URL, namespace: "default", http: srv.Client(), stream: srv.Client(), tokenFile: token}
+}
+
+const leasePath = "/apis/coordination.k8s.io/v1/namespaces/default/leases/dns-acme"
+
+func storedLease(holder string, renewed time.Time, transitions int) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "coordination.k8s.io/v1",
+		"kind":       "Lease",
+		"metadata":   map[string]interface{}{"name": "dns-acme", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"holderIdentity":       holder,
+			"leaseDurationSeconds": 15,
+			"acquireTime":          "2026-01-01T00:00:00.000000Z",
+			"renewTime":            renewed.Format(leaseTimeFormat),
+			"leaseTransitions":     transitions,
+		},
+	}
+}
+
+// TestLeaseTakeover - создание Lease, продление своего, захват просроченного чужого
+// и проигрыш гонки за него другой реплике
+func TestLeaseTakeover(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		stored      map[string]interface{} // nil - Lease еще нет
+		race        bool                   // другая реплика забирает Lease между GET и PUT
+		leader      bool
+		holder      string
+		transitions int
+		acquired    bool // acquireTime обновлен
+	}{
+		{name: "create", leader: true, holder: "pod-a", acquired: true},
+		{name: "renew own", stored: storedLease("pod-a", now.Add(-5*time.Second), 2), leader: true, holder: "pod-a", transitions: 2},
+		{name: "held by other", stored: storedLease("pod-b", now.Add(-5*time.Second), 2), holder: "pod-b", transitions: 2},
+		{name: "take over expired", stored: storedLease("pod-b", now.Add(-time.Minute), 2), leader: true, holder: "pod-a", transitions: 3, acquired: true},
+		{name: "take over released", stored: storedLease("", now.Add(-5*time.Second), 2), leader: true, holder: "pod-a", transitions: 3, acquired: true},
+		{name: "lose takeover race", stored: storedLease("pod-b", now.Add(-time.Minute), 2), race: true, holder: "pod-c", transitions: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeAPI(t)
+			if tt.stored != nil {
+				api.set(leasePath, tt.stored)
+			}
+			if tt.race {
+				api.beforePut = func(path string, stored map[string]interface{}) {
+					api.set(path, storedLease("pod-c", time.Now(), 3))
+				}
+			}
+			e := NewLeaderElector(testClient(t, api), "dns-acme", "pod-a", 15*time.Second)
+
+			leader, err := e.tryAcquire(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leader != tt.leader {
+				t.Errorf("leader %v, want %v", leader, tt.leader)
+			}
+			var lease Lease
+			data, _ := json.Marshal(api.get(leasePath))
+			if err := json.Unmarshal(data, &lease); err != nil {
+				t.Fatal(err)
+			}
+			if lease.Spec.HolderIdentity != tt.holder {
+				t.Errorf("holder %q, want %q", lease.Spec.HolderIdentity, tt.holder)
+			}
+			if lease.Spec.LeaseTransitions != tt.transitions {
+				t.Errorf("transitions %d, want %d", lease.Spec.LeaseTransitions, tt.transitions)
+			}
+			if acquired := lease.Spec.AcquireTime != "2026-01-01T00:00:00.000000Z"; acquired != tt.acquired {
+				t.Errorf("acquireTime %s, changed %v, want %v", lease.Spec.AcquireTime, acquired, tt.acquired)
+			}
+		})
+	}
+}
+
+const configMapPath = "/api/v1/namespaces/default/configmaps/records"
+
+// TestConfigMapUpdateConflict - запись, которую опередила другая реплика, повторяется на
+// свежем содержимом и не теряет чужое значение; после maxWriteRetries конфликтов - ошибка
+func TestConfigMapUpdateConflict(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		conflicts int
+		wantErr   bool
+	}{
+		{name: "no conflict"},
+		{name: "retried", conflicts: 3},
+		{name: "gives up", conflicts: maxWriteRetries + 1, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeAPI(t)
+			client := testClient(t, api)
+			s, err := NewConfigMapStorage(client, "records")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := 0
+			api.beforePut = func(path string, stored map[string]interface{}) {
+				if other == tt.conflicts {
+					return
+				}
+				other++
+				data, _ := stored["data"].(map[string]interface{})
+				if data == nil {
+					data = make(map[string]interface{})
+					stored["data"] = data
+				}
+				data["_acme-challenge.other"+strconv.Itoa(other)+".example."] = `[{"v":"other","t":1}]`
+				api.set(path, stored)
+			}
+
+			err = s.AddTXTValue("_acme-challenge.example.com.", "mine")
+			if tt.wantErr {
+				if !IsConflict(err) {
+					t.Fatalf("error %v, want a conflict", err)
+				}
+				if api.puts != maxWriteRetries+1 {
+					t.Errorf("%d writes, want %d", api.puts, maxWriteRetries+1)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if api.puts != tt.conflicts+1 {
+				t.Errorf("%d writes, want %d", api.puts, tt.conflicts+1)
+			}
+			data := api.get(configMapPath)["data"].(map[string]interface{})
+			if len(data) != tt.conflicts+1 || !strings.Contains(data["_acme-challenge.example.com."].(string), `"v":"mine"`) {
+				t.Errorf("stored %v, want our value and %d values of the other replica", data, tt.conflicts)
+			}
+			if values, _ := s.GetTXTValues("_acme-challenge.example.com."); len(values) != 1 || values[0] != "mine" {
+				t.Errorf("local copy %q after the write", values)
+			}
+		})
+	}
+}
+
+// TestConfigMapReplaceOrder - запоздавшее событие watch не возвращает старое содержимое,
+// resourceVersion сравниваются как числа; перечитывание после обрыва заменяет всегда
+func TestConfigMapReplaceOrder(t *testing.T) {
+	s := &ConfigMapStorage{name: "records"}
+	configMap := func(version, value string) *ConfigMap {
+		return &ConfigMap{
+			Metadata: ObjectMeta{ResourceVersion: version},
+			Data:     map[string]string{"_acme-challenge.example.com.": `[{"v":"` + value + `","t":1}]`},
+		}
+	}
+	for _, step := range []struct {
+		cm     *ConfigMap
+		reload bool
+		want   string
+	}{
+		{cm: configMap("9", "a"), want: "a"},
+		{cm: configMap("8", "stale"), want: "a"},
+		{cm: configMap("9", "same version"), want: "a"},
+		{cm: configMap("10", "b"), want: "b"},
+		{cm: configMap("3", "recreated"), reload: true, want: "recreated"},
+		{cm: configMap("4", "c"), want: "c"},
+		{cm: configMap("opaque", "d"), want: "d"},
+		{cm: configMap("opaque", "e"), want: "d"},
+	} {
+		if step.reload {
+			s.reload(step.cm)
+		} else {
+			s.replace(step.cm)
+		}
+		values, _ := s.GetTXTValues("_acme-challenge.example.com.")
+		if len(values) != 1 || values[0] != step.want {
+			t.Errorf("after version %s (reload %v): %q, want %q", step.cm.Metadata.ResourceVersion, step.reload, values, step.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package k8s
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"dns-acme-server/metrics"
+)
+
+var leaderGauge = metrics.Default.NewGaugeVec("dns_acme_leader",
+	"1 if this replica holds the leader Lease", "lease")
+
+// Lease - объект coordination.k8s.io/v1 Lease
+type Lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       LeaseSpec  `json:"spec"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// leaseTimeFormat - MicroTime из apimachinery
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// LeaderElector выбирает одну реплику через Lease: лидер продлевает его каждую треть
+// срока, остальные забирают Lease, если его не продлевали дольше срока. DNS отвечают
+// все реплики, лидер нужен только для фоновых записей, которые не должны дублироваться.
+type LeaderElector struct {
+	client   *Client
+	name     string
+	identity string
+	duration time.Duration
+
+	mutex     sync.Mutex
+	leader    bool
+	onElected []func(stop <-chan struct{})
+	resign    chan struct{}
+}
+
+func NewLeaderElector(client *Client, name, identity string, duration time.Duration) *LeaderElector {
+	leaderGauge.Set(0, name)
+	return &LeaderElector{client: client, name: name, identity: identity, duration: duration}
+}
+
+// IsLeader сообщает, держит ли реплика Lease сейчас
+func (e *LeaderElector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.leader
+}
+
+// OnElected запускает f в отдельной горутине при каждом получении лидерства;
+// stop закрывается, когда лидерство потеряно
+func (e *LeaderElector) OnElected(f func(stop <-chan struct{})) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.onElected = append(e.onElected, f)
+}
+
+// Run участвует в выборах, пока не закрыт stop; при остановке лидер освобождает Lease,
+// чтобы другая реплика не ждала истечения срока
+func (e *LeaderElector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	var renewed time.Time
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), e.duration/3)
+		leader, err := e.tryAcquire(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Lease %s: %v", e.name, err)
+			// сбой API не повод отдавать лидерство, пока наш Lease не истек
+			leader = e.IsLeader() && time.Since(renewed) < e.duration
+		} else if leader {
+			renewed = time.Now()
+		}
+		e.setLeader(leader)
+		select {
+		case <-stop:
+			if e.IsLeader() {
+				e.release()
+				e.setLeader(false)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaderElector) setLeader(leader bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+	if leader {
+		log.Printf("Became leader (Lease %s, identity %s)", e.name, e.identity)
+		leaderGauge.Set(1, e.name)
+		e.resign = make(chan struct{})
+		for _, f := range e.onElected {
+			go f(e.resign)
+		}
+	} else {
+		log.Printf("Lost leadership (Lease %s)", e.name)
+		leaderGauge.Set(0, e.name)
+		close(e.resign)
+	}
+}
+
+func (e *LeaderElector) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(e.client.namespace) + "/leases/" + url.PathEscape(e.name)
+}
+
+// tryAcquire продлевает свой Lease или забирает просроченный чужой
+func (e *LeaderElector) tryAcquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	var lease Lease
+	err := e.client.do(ctx, "GET", e.path(), nil, &lease)
+	if IsNotFound(err) {
+		lease = Lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   ObjectMeta{Name: e.name, Namespace: e.client.namespace},
+			Spec:       e.spec(now, now.Format(leaseTimeFormat), 0),
+		}
+		err = e.client.do(ctx, "POST", "/apis/coordination.k8s.io/v1/namespaces/"+url.PathEscape(e.client.namespace)+"/leases", &lease, nil)
+		if IsConflict(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity != e.identity && spec.HolderIdentity != "" {
+		renewed, err := time.Parse(time.RFC3339Nano, spec.RenewTime)
+		duration := time.Duration(spec.LeaseDurationSeconds) * time.Second
+		if err == nil && now.Before(renewed.Add(duration)) {
+			return false, nil
+		}
+		log.Printf("Lease %s of %s expired, taking over", e.name, spec.HolderIdentity)
+	}
+	if spec.HolderIdentity == e.identity {
+		lease.Spec = e.spec(now, spec.AcquireTime, spec.LeaseTransitions)
+	} else {
+		lease.Spec = e.spec(now, now.Format(leaseTimeFormat), spec.LeaseTransitions+1)
+	}
+	// resourceVersion из GET: если другая реплика успела раньше, получим 409
+	err = e.client.do(ctx, "PUT", e.path(), &lease, nil)
+	if IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (e *LeaderElector) spec(now time.Time, acquired string, transitions int) LeaseSpec {
+	return LeaseSpec{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int((e.duration + time.Second - 1) / time.Second),
+		AcquireTime:          acquired,
+		RenewTime:            now.Format(leaseTimeFormat),
+		LeaseTransitions:     transitions,
+	}
+}
+
+// release отдает Lease, обнуляя держателя
+func (e *LeaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var lease Lease
+	if err := e.client.do(ctx, "GET", e.path(), nil, &lease); err != nil || lease.Spec.HolderIdentity != e.identity {
+		return
+	}
+	lease.Spec.HolderIdentity = ""
+	if err := e.client.do(ctx, "PUT", e.path(), &lease, nil); err != nil {
+		log.Printf("Failed to release Lease %s: %v", e.name, err)
+	}
+}
@@ -0,0 +1,290 @@
+// Package metrics - минимальная реализация метрик в текстовом формате Prometheus
+// (exposition format 0.0.4), чтобы не тянуть client_golang ради нескольких счетчиков.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default - метрики демона, отдаются на -metrics-addr по /metrics
+var Default = NewRegistry()
+
+type metricFamily interface {
+	writeTo(w *bufio.Writer)
+	samples() []Sample
+}
+
+// Registry хранит семейства метрик в порядке регистрации
+type Registry struct {
+	mutex    sync.Mutex
+	families []metricFamily
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f metricFamily) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, f)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteText(w)
+}
+
+// ContentType - тип текстового формата Prometheus
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteText пишет все метрики в текстовом формате Prometheus
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.snapshot() {
+		f.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// Sample - одно значение метрики: счетчик, gauge, или _sum/_count гистограммы как счетчики
+type Sample struct {
+	Name   string
+	Kind   string // counter или gauge
+	Labels []Label
+	Value  float64
+}
+
+// Label - пара имя-значение метки
+type Label struct {
+	Name, Value string
+}
+
+// Samples возвращает текущие значения всех метрик (для отправки в statsd)
+func (r *Registry) Samples() []Sample {
+	var result []Sample
+	for _, f := range r.snapshot() {
+		result = append(result, f.samples()...)
+	}
+	return result
+}
+
+func (r *Registry) snapshot() []metricFamily {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]metricFamily(nil), r.families...)
+}
+
+// metricVec - общая часть семейств с метками
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex sync.Mutex
+	keys  []string // для стабильного порядка вывода
+}
+
+func (v *metricVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs - метки ключа key
+func (v *metricVec) labelPairs(key string) []Label {
+	if len(v.labels) == 0 {
+		return nil
+	}
+	var pairs []Label
+	for i, value := range strings.Split(key, "\xff") {
+		pairs = append(pairs, Label{v.labels[i], value})
+	}
+	return pairs
+}
+
+func (v *metricVec) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+// labelString форматирует {a="x",b="y"} с дополнительной парой extra (например, le)
+func (v *metricVec) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, v.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec - монотонные счетчики с метками
+type CounterVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricVec: metricVec{name: name, help: help, kind: "counter", labels: labels},
+		values:    make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.values[key]; !ok {
+		c.keys = append(c.keys, key)
+		sort.Strings(c.keys)
+	}
+	c.values[key] += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) writeTo(w *bufio.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w)
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+func (c *CounterVec) samples() []Sample {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var result []Sample
+	for _, key := range c.keys {
+		result = append(result, Sample{Name: c.name, Kind: c.kind, Labels: c.labelPairs(key), Value: c.values[key]})
+	}
+	return result
+}
+
+// GaugeVec - значения, которые могут расти и убывать
+type GaugeVec struct {
+	CounterVec
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{CounterVec{
+		metricVec: metricVec{name: name, help: help, kind: "gauge", labels: labels},
+		values:    make(map[string]float64),
+	}}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.values[key]; !ok {
+		g.keys = append(g.keys, key)
+		sort.Strings(g.keys)
+	}
+	g.values[key] = value
+}
+
+// HistogramVec - распределение значений по корзинам (le), плюс сумма и количество
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // по корзинам, не накопительно
+	sum    float64
+	count  uint64
+}
+
+// DefaultLatencyBuckets - корзины для задержек в секундах, от 0.5мс до 10с
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		metricVec: metricVec{name: name, help: help, kind: "histogram", labels: labels},
+		buckets:   buckets,
+		series:    make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.keys = append(h.keys, key)
+		sort.Strings(h.keys)
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) writeTo(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w)
+	for _, key := range h.keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), s.count)
+	}
+}
+
+func (h *HistogramVec) samples() []Sample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var result []Sample
+	for _, key := range h.keys {
+		s := h.series[key]
+		labels := h.labelPairs(key)
+		result = append(result,
+			Sample{Name: h.name + "_sum", Kind: "counter", Labels: labels, Value: s.sum},
+			Sample{Name: h.name + "_count", Kind: "counter", Labels: labels, Value: float64(s.count)})
+	}
+	return result
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// statsdPacket - размер UDP пакета statsd, чтобы он не фрагментировался
+const statsdPacket = 1432
+
+// Pusher периодически отправляет метрики туда, где их никто не собирает по /metrics:
+// в Prometheus Pushgateway и/или в statsd (DogStatsD)
+type Pusher struct {
+	registry *Registry
+	interval time.Duration
+	client   *http.Client
+
+	gateway string // URL группы Pushgateway, пусто - не отправлять
+
+	statsd     net.Conn // nil - не отправлять
+	prefix     string
+	tags       bool               // метки тегами DogStatsD, иначе частью имени
+	lastCounts map[string]float64 // отправленные значения счетчиков: statsd принимает приращения
+}
+
+func NewPusher(r *Registry, interval time.Duration) *Pusher {
+	return &Pusher{
+		registry:   r,
+		interval:   interval,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		lastCounts: make(map[string]float64),
+	}
+}
+
+// SetPushgateway включает отправку в Pushgateway base (http://host:9091) в группу job/instance;
+// каждая отправка заменяет метрики группы целиком (PUT)
+func (p *Pusher) SetPushgateway(base, job, instance string) {
+	p.gateway = strings.TrimRight(base, "/") + "/metrics/job/" + url.PathEscape(job)
+	if instance != "" {
+		p.gateway += "/instance/" + url.PathEscape(instance)
+	}
+}
+
+// SetStatsd включает отправку в statsd по UDP addr; имена получают prefix, метки передаются
+// тегами DogStatsD (tags) или добавляются к имени через точку
+func (p *Pusher) SetStatsd(addr, prefix string, tags bool) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	p.statsd, p.prefix, p.tags = conn, prefix, tags
+	return nil
+}
+
+// Run отправляет метрики каждые interval, пока не закрыт stop, и последний раз при остановке
+func (p *Pusher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			p.Push()
+			if p.statsd != nil {
+				p.statsd.Close()
+			}
+			return
+		case <-ticker.C:
+			p.Push()
+		}
+	}
+}
+
+// Push отправляет текущие значения; ошибки пишутся в журнал, следующая попытка - через interval
+func (p *Pusher) Push() {
+	if p.gateway != "" {
+		if err := p.pushGateway(); err != nil {
+			log.Printf("Failed to push metrics to %s: %v", p.gateway, err)
+		}
+	}
+	if p.statsd != nil {
+		if err := p.pushStatsd(); err != nil {
+			log.Printf("Failed to send metrics to statsd %s: %v", p.statsd.RemoteAddr(), err)
+		}
+	}
+}
+
+func (p *Pusher) pushGateway() error {
+	var body bytes.Buffer
+	if err := p.registry.WriteText(&body); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, p.gateway, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *Pusher) pushStatsd() error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := p.statsd.Write(bytes.TrimSuffix(packet.Bytes(), []byte("\n")))
+		packet.Reset()
+		return err
+	}
+	for _, s := range p.registry.Samples() {
+		line := p.statsdLine(s)
+		if line == "" {
+			continue
+		}
+		if packet.Len()+len(line) > statsdPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// statsdLine форматирует значение: счетчик - приращением с прошлой отправки (|c), gauge - как
+// есть (|g); пусто - счетчик не изменился
+func (p *Pusher) statsdLine(s Sample) string {
+	name := p.prefix + s.Name
+	var tags []string
+	for _, l := range s.Labels {
+		if p.tags {
+			tags = append(tags, statsdName(l.Name)+":"+statsdName(l.Value))
+		} else {
+			name += "." + statsdName(l.Value)
+		}
+	}
+	value, kind := s.Value, "g"
+	if s.Kind == "counter" {
+		key := name + "|" + strings.Join(tags, ",")
+		value, kind = s.Value-p.lastCounts[key], "c"
+		p.lastCounts[key] = s.Value
+		if value == 0 {
+			return ""
+		}
+	}
+	line := name + ":" + formatFloat(value) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line + "\n"
+}
+
+// statsdName заменяет символы, которые statsd считает разделителями
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"time"
+)
+
+// TLSHandshakeErrors - неудачные TLS рукопожатия: клиент не доверяет сертификату, не прошел
+// mTLS, сертификата еще нет или клиент говорит не TLS
+var TLSHandshakeErrors = Default.NewCounterVec("dns_acme_tls_handshake_errors_total",
+	"Failed TLS handshakes by listener: api or grpc", "listener")
+
+var certificateExpiry = Default.NewGaugeVec("dns_acme_tls_certificate_expiry_days",
+	"Days until the TLS certificate expires, negative once it has expired, by listener", "listener")
+
+// HandshakeErrorLog - журнал для http.Server.ErrorLog: строки об ошибках TLS рукопожатия
+// считаются в TLSHandshakeErrors, все строки пишутся в журнал демона
+func HandshakeErrorLog(listener string) *log.Logger {
+	return log.New(handshakeErrorWriter(listener), "", 0)
+}
+
+type handshakeErrorWriter string
+
+func (w handshakeErrorWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		TLSHandshakeErrors.Inc(string(w))
+	}
+	log.Print(string(p))
+	return len(p), nil
+}
+
+// CertificateSource - откуда TLS слушатель берет сертификат: fcgiapi.CertificateFile
+// или acmeclient.Provisioner
+type CertificateSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// certificateWarnEvery - как часто повторяется предупреждение о скором истечении
+const certificateWarnEvery = 24 * time.Hour
+
+// CertificateWatch следит за сроком сертификата слушателя: gauge
+// dns_acme_tls_certificate_expiry_days и предупреждение в журнале, когда до истечения
+// меньше warnBefore (не чаще раза в сутки)
+type CertificateWatch struct {
+	listener   string
+	source     CertificateSource
+	warnBefore time.Duration
+	warned     time.Time // последнее предупреждение
+}
+
+func NewCertificateWatch(listener string, source CertificateSource, warnBefore time.Duration) *CertificateWatch {
+	return &CertificateWatch{listener: listener, source: source, warnBefore: warnBefore}
+}
+
+// Check обновляет gauge и возвращает срок действия сертификата; ошибка - сертификата еще
+// нет (Provisioner до первого получения) или его не разобрать, gauge тогда не меняется
+func (c *CertificateWatch) Check(now time.Time) (time.Time, error) {
+	cert, err := c.source.GetCertificate(nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return time.Time{}, errors.New("no certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return time.Time{}, err
+		}
+	}
+	left := leaf.NotAfter.Sub(now)
+	certificateExpiry.Set(left.Hours()/24, c.listener)
+	if left < c.warnBefore && now.Sub(c.warned) >= certificateWarnEvery {
+		c.warned = now
+		if left <= 0 {
+			log.Printf("TLS certificate of the %s listener expired on %s", c.listener, leaf.NotAfter.Format(time.RFC3339))
+		} else {
+			log.Printf("TLS certificate of the %s listener expires in %.0f days, on %s", c.listener, left.Hours()/24, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return leaf.NotAfter, nil
+}
+
+// Run проверяет сертификат сразу и дальше каждый час, пока не закрыт stop
+func (c *CertificateWatch) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		c.Check(time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleValue - значение метрики name с меткой listener из вывода /metrics, -1 если ее нет
+func sampleValue(t *testing.T, name, listener string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Default.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	prefix := name + `{listener="` + listener + `"} `
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return -1
+}
+
+// captureLog перенаправляет журнал в буфер до конца теста
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestHandshakeErrorLog(t *testing.T) {
+	buf := captureLog(t)
+	logger := HandshakeErrorLog("test-write")
+	tests := []struct {
+		line    string
+		counted bool
+	}{
+		{"http: TLS handshake error from 192.0.2.1:51234: remote error: tls: bad certificate", true},
+		{"http: TLS handshake error from 192.0.2.1:51235: EOF", true},
+		{"http: Accept error: accept tcp [::]:8053: too many open files", false},
+		{"http: panic serving 192.0.2.1:51236: runtime error", false},
+	}
+	want := 0.0
+	for _, tt := range tests {
+		buf.Reset()
+		logger.Print(tt.line)
+		if tt.counted {
+			want++
+		}
+		if got := sampleValue(t, "dns_acme_tls_handshake_errors_total", "test-write"); got != want {
+			t.Errorf("%q: counter %v, want %v", tt.line, got, want)
+		}
+		if !strings.Contains(buf.String(), tt.line) {
+			t.Errorf("%q not passed to the daemon log, got %q", tt.line, buf.String())
+		}
+	}
+}
+
+// staticCertificate - источник с готовым сертификатом или ошибкой
+type staticCertificate struct {
+	cert *tls.Certificate
+	err  error
+}
+
+func (s staticCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert, s.err
+}
+
+// certificateUntil - самоподписанный сертификат, действующий до notAfter
+func certificateUntil(t *testing.T, notAfter time.Time) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "api.example.com"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateWatchCheck(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		source   CertificateSource
+		notAfter time.Time
+		days     float64
+		warning  string // подстрока предупреждения, пусто - без предупреждения
+		wantErr  bool
+	}{
+		{name: "valid", notAfter: now.Add(60 * day), days: 60},
+		{name: "near expiry", notAfter: now.Add(3 * day), days: 3, warning: "expires in 3 days"},
+		{name: "expired", notAfter: now.Add(-2 * day), days: -2, warning: "expired on"},
+		{name: "not obtained yet", source: staticCertificate{err: errors.New("no certificate obtained yet")}, wantErr: true},
+		{name: "empty", source: staticCertificate{cert: &tls.Certificate{}}, wantErr: true},
+		{name: "unparsable", source: staticCertificate{cert: &tls.Certificate{Certificate: [][]byte{[]byte("junk")}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLog(t)
+			listener := "test-" + strings.ReplaceAll(tt.name, " ", "-")
+			source := tt.source
+			if source == nil {
+				source = staticCertificate{cert: certificateUntil(t, tt.notAfter)}
+			}
+			watch := NewCertificateWatch(listener, source, 14*day)
+
+			notAfter, err := watch.Check(now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("no error without a usable certificate")
+				}
+				if buf.Len() != 0 {
+					t.Errorf("logged %q without a certificate", buf.String())
+				}
+				if got := sampleValue(t, "dns_acme_tls_certificate_expiry_days", listener); got != -1 {
+					t.Errorf("gauge set to %v without a certificate", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !notAfter.Equal(tt.notAfter) {
+				t.Errorf("expiry %v, want %v", notAfter, tt.notAfter)
+			}
+			if got := sampleValue(t, "dns_acme_tls_certificate_expiry_days", listener); got != tt.days {
+				t.Errorf("gauge %v days, want %v", got, tt.days)
+			}
+			if tt.warning == "" {
+				if buf.Len() != 0 {
+					t.Errorf("unexpected warning %q", buf.String())
+				}
+				return
+			}
+			if !strings.Contains(buf.String(), tt.warning) {
+				t.Fatalf("warning %q, want %q", buf.String(), tt.warning)
+			}
+
+			// повтор в течение суток не пишется, через сутки - снова
+			buf.Reset()
+			watch.Check(now.Add(time.Hour))
+			if buf.Len() != 0 {
+				t.Errorf("warning repeated within a day: %q", buf.String())
+			}
+			watch.Check(now.Add(day))
+			if buf.Len() == 0 {
+				t.Error("warning not repeated after a day")
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package plugins
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// Supported - можно ли загружать плагины в этой сборке
+const Supported = true
+
+func lookup(path, symbol string) (interface{}, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(symbol)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	return sym, nil
+}
@@ -0,0 +1,12 @@
+//go:build !cgo || !(linux || darwin || freebsd)
+
+package plugins
+
+import "fmt"
+
+// Supported: пакет plugin работает только с cgo в Linux, macOS и FreeBSD
+const Supported = false
+
+func lookup(path, symbol string) (interface{}, error) {
+	return nil, fmt.Errorf("plugin %s: this build cannot load plugins, rebuild with CGO_ENABLED=1 on linux, darwin or freebsd", path)
+}
@@ -0,0 +1,64 @@
+// Package plugins загружает хранилища записей и проверку клиентов API из плагинов Go
+// (go build -buildmode=plugin), чтобы подключать свои IPAM и внутреннюю авторизацию без форка.
+//
+// Плагин хранилища экспортирует
+//
+//	func NewStorage(config string) (storage.Storage, error)
+//
+// плагин авторизации -
+//
+//	func NewAuthenticator(config string) (fcgiapi.Authenticator, error)
+//
+// config - строка из -storage-dsn или -auth-plugin-config, ее формат решает плагин.
+// Плагин собирается той же версией Go и с теми же версиями зависимостей, что и демон.
+package plugins
+
+import (
+	"fmt"
+
+	"dns-acme-server/fcgiapi"
+	"dns-acme-server/storage"
+)
+
+// Имена функций, которые ищутся в плагине
+const (
+	StorageSymbol = "NewStorage"
+	AuthSymbol    = "NewAuthenticator"
+)
+
+// StoragePrefix - префикс -storage для хранилища из плагина: plugin:/usr/lib/dns-acme/ipam.so
+const StoragePrefix = "plugin:"
+
+// OpenStorage загружает плагин path и создает хранилище с настройками config
+func OpenStorage(path, config string) (storage.Storage, error) {
+	sym, err := lookup(path, StorageSymbol)
+	if err != nil {
+		return nil, err
+	}
+	newStorage, ok := sym.(func(string) (storage.Storage, error))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s has type %T, expected func(string) (storage.Storage, error)", path, StorageSymbol, sym)
+	}
+	backend, err := newStorage(config)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	return backend, nil
+}
+
+// OpenAuthenticator загружает плагин path и создает проверку клиентов с настройками config
+func OpenAuthenticator(path, config string) (fcgiapi.Authenticator, error) {
+	sym, err := lookup(path, AuthSymbol)
+	if err != nil {
+		return nil, err
+	}
+	newAuth, ok := sym.(func(string) (fcgiapi.Authenticator, error))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s has type %T, expected func(string) (fcgiapi.Authenticator, error)", path, AuthSymbol, sym)
+	}
+	auth, err := newAuth(config)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	return auth, nil
+}
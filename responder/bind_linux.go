@@ -0,0 +1,22 @@
+package responder
+
+import (
+	"net"
+	"syscall"
+)
+
+// interfaceListenConfig привязывает сокет к интерфейсу через SO_BINDTODEVICE
+func interfaceListenConfig(iface string) (net.ListenConfig, error) {
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.BindToDevice(int(fd), iface)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}, nil
+}
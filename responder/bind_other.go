@@ -0,0 +1,13 @@
+//go:build !linux
+
+package responder
+
+import (
+	"fmt"
+	"net"
+)
+
+// interfaceListenConfig: привязка к интерфейсу есть только в Linux
+func interfaceListenConfig(iface string) (net.ListenConfig, error) {
+	return net.ListenConfig{}, fmt.Errorf("binding to interface %s is only supported on Linux", iface)
+}
@@ -0,0 +1,106 @@
+package responder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// listenDNS открывает UDP и TCP сокеты одного DNS адреса. Если открылся только один из них,
+// ошибка говорит об этом и о том, кто занял порт. С fallbackPort > 0 адрес, порт которого
+// занят или недоступен без прав, открывается на том же хосте с портом fallbackPort
+func listenDNS(lc net.ListenConfig, spec, addr string, fallbackPort int) (net.PacketConn, net.Listener, error) {
+	conn, listener, err := listenDNSPair(lc, spec, addr)
+	if err == nil || fallbackPort <= 0 || !fallbackable(err) {
+		return conn, listener, err
+	}
+	host, _, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		return nil, nil, err
+	}
+	fallback := net.JoinHostPort(host, strconv.Itoa(fallbackPort))
+	conn, listener, fallbackErr := listenDNSPair(lc, spec, fallback)
+	if fallbackErr != nil {
+		return nil, nil, fmt.Errorf("%w; fallback to %s: %v", err, fallback, fallbackErr)
+	}
+	log.Printf("%v; serving DNS on %s instead (-dns-fallback-port)", err, fallback)
+	return conn, listener, nil
+}
+
+func listenDNSPair(lc net.ListenConfig, spec, addr string) (net.PacketConn, net.Listener, error) {
+	conn, udpErr := lc.ListenPacket(context.Background(), "udp", addr)
+	listener, tcpErr := lc.Listen(context.Background(), "tcp", addr)
+	switch {
+	case udpErr == nil && tcpErr == nil:
+		return conn, listener, nil
+	case udpErr != nil && tcpErr != nil:
+		return nil, nil, fmt.Errorf("DNS %s: %w%s", spec, udpErr, bindHint(addr, udpErr))
+	case udpErr != nil:
+		// например, systemd-resolved занимает 127.0.0.53:53: TCP с SO_REUSEADDR на 0.0.0.0:53
+		// открывается, а UDP нет
+		listener.Close()
+		return nil, nil, fmt.Errorf("DNS UDP %s: %w (TCP on the same address is free)%s", spec, udpErr, bindHint(addr, udpErr))
+	default:
+		conn.Close()
+		return nil, nil, fmt.Errorf("DNS TCP %s: %w (UDP on the same address is free)%s", spec, tcpErr, bindHint(addr, tcpErr))
+	}
+}
+
+// fallbackable - адрес существует, но порт занят или требует прав
+func fallbackable(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EACCES)
+}
+
+// bindHint объясняет ошибку bind и подсказывает, что сделать
+func bindHint(addr string, err error) string {
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	if port <= 0 {
+		return "" // unix сокет или адрес без порта
+	}
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		owners := portOwners(port)
+		if len(owners) == 0 {
+			return fmt.Sprintf("; another process listens on port %d, stop it or choose another address", port)
+		}
+		hint := fmt.Sprintf("; port %d is used by %s", port, owners[0])
+		for _, owner := range owners[1:] {
+			hint += ", " + owner.String()
+		}
+		for _, owner := range owners {
+			if owner.Process == "systemd-resolve" || owner.Process == "systemd-resolved" {
+				return hint + ": disable its stub listener (DNSStubListener=no in /etc/systemd/resolved.conf) " +
+					"or listen on a specific public address instead of the wildcard"
+			}
+			if owner.Process == "dnsmasq" {
+				return hint + ": restrict dnsmasq to its interfaces (bind-interfaces) or listen on a specific address"
+			}
+		}
+		return hint
+	case errors.Is(err, syscall.EACCES) && port < 1024:
+		return fmt.Sprintf("; port %d needs root or CAP_NET_BIND_SERVICE (AmbientCapabilities=CAP_NET_BIND_SERVICE in systemd)", port)
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "; the address is not configured on any interface"
+	}
+	return ""
+}
+
+// PortOwner - процесс, слушающий порт
+type PortOwner struct {
+	Process string
+	PID     int
+	Addr    string // локальный адрес сокета
+	Proto   string
+}
+
+func (o PortOwner) String() string {
+	if o.PID == 0 {
+		return fmt.Sprintf("an unknown process on %s/%s", o.Addr, o.Proto)
+	}
+	return fmt.Sprintf("%s (pid %d) on %s/%s", o.Process, o.PID, o.Addr, o.Proto)
+}
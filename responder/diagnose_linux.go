@@ -0,0 +1,92 @@
+package responder
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// portOwners находит слушающие port сокеты в /proc/net и процессы, которым они принадлежат.
+// Без root процессы других пользователей не видны, тогда остается только адрес
+func portOwners(port int) []PortOwner {
+	if port <= 0 {
+		return nil
+	}
+	sockets := map[string]PortOwner{} // inode -> сокет
+	for _, table := range []struct{ file, proto, listen string }{
+		{"/proc/net/udp", "udp", "07"}, {"/proc/net/udp6", "udp", "07"},
+		{"/proc/net/tcp", "tcp", "0A"}, {"/proc/net/tcp6", "tcp", "0A"},
+	} {
+		data, err := os.ReadFile(table.file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != table.listen {
+				continue
+			}
+			addr, p, ok := parseProcAddr(fields[1])
+			if !ok || p != port {
+				continue
+			}
+			sockets[fields[9]] = PortOwner{Addr: net.JoinHostPort(addr, strconv.Itoa(p)), Proto: table.proto}
+		}
+	}
+	if len(sockets) == 0 {
+		return nil
+	}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	found := map[string]bool{}
+	var owners []PortOwner
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		owner, ok := sockets[inode]
+		if !ok || found[inode] {
+			continue
+		}
+		found[inode] = true
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		owner.PID, _ = strconv.Atoi(filepath.Base(pidDir))
+		if comm, err := os.ReadFile(filepath.Join(pidDir, "comm")); err == nil {
+			owner.Process = strings.TrimSpace(string(comm))
+		}
+		owners = append(owners, owner)
+	}
+	for inode, owner := range sockets {
+		if !found[inode] {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// parseProcAddr разбирает адрес вида 0100007F:0035 из /proc/net: слова адреса записаны в
+// порядке байт хоста (little endian), порт - big endian
+func parseProcAddr(s string) (string, int, bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", 0, false
+	}
+	raw, err := hex.DecodeString(s[:i])
+	if err != nil || len(raw)%4 != 0 {
+		return "", 0, false
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	ip := make(net.IP, len(raw))
+	for w := 0; w < len(raw); w += 4 {
+		ip[w], ip[w+1], ip[w+2], ip[w+3] = raw[w+3], raw[w+2], raw[w+1], raw[w]
+	}
+	return ip.String(), int(port), true
+}
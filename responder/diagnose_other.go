@@ -0,0 +1,8 @@
+//go:build !linux
+
+package responder
+
+// portOwners: владельцы сокетов определяются только в Linux
+func portOwners(port int) []PortOwner {
+	return nil
+}
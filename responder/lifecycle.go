@@ -0,0 +1,138 @@
+package responder
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// LifecycleEvent отправляется после полного цикла add -> запрос по DNS -> remove
+type LifecycleEvent struct {
+	Event        string    `json:"event"`
+	FQDN         string    `json:"fqdn"`
+	AddedAt      time.Time `json:"added_at"`
+	FirstQueryAt time.Time `json:"first_query_at"`
+	LastQueryAt  time.Time `json:"last_query_at"`
+	RemovedAt    time.Time `json:"removed_at"`
+	Queries      int       `json:"queries"`
+	// от публикации до первого запроса и до удаления, в миллисекундах
+	TimeToFirstQueryMs int64 `json:"time_to_first_query_ms"`
+	TotalMs            int64 `json:"total_ms"`
+}
+
+type lifecycle struct {
+	added      time.Time
+	firstQuery time.Time
+	lastQuery  time.Time
+	queries    int
+}
+
+// LifecycleTracker отслеживает жизненный цикл challenge записей и сообщает
+// в вебхук, что проверка, скорее всего, прошла успешно
+type LifecycleTracker struct {
+	webhook string
+	client  *http.Client
+
+	mutex   sync.Mutex
+	records map[string]map[string]*lifecycle // имя (storage.NormalizeDomain) -> значение -> цикл
+}
+
+func NewLifecycleTracker(webhook string) *LifecycleTracker {
+	return &LifecycleTracker{
+		webhook: webhook,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		records: make(map[string]map[string]*lifecycle),
+	}
+}
+
+func (t *LifecycleTracker) RecordAdded(src storage.Source, name, value string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := storage.NormalizeDomain(name)
+	if t.records[key] == nil {
+		t.records[key] = make(map[string]*lifecycle)
+	}
+	t.records[key][value] = &lifecycle{added: time.Now()}
+}
+
+// Queried вызывается DNS сервером, когда запись была отдана в ответе (со всеми значениями)
+func (t *LifecycleTracker) Queried(name, client string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	for _, l := range t.records[storage.NormalizeDomain(name)] {
+		if l.queries == 0 {
+			l.firstQuery = now
+		}
+		l.lastQuery = now
+		l.queries++
+	}
+}
+
+// RecordRemoved завершает цикл удаленного значения; пустое value - всех значений имени
+func (t *LifecycleTracker) RecordRemoved(src storage.Source, name, value string) {
+	key := storage.NormalizeDomain(name)
+	var finished []*lifecycle
+	t.mutex.Lock()
+	for v, l := range t.records[key] {
+		if value == "" || v == value {
+			finished = append(finished, l)
+			delete(t.records[key], v)
+		}
+	}
+	if len(t.records[key]) == 0 {
+		delete(t.records, key)
+	}
+	t.mutex.Unlock()
+
+	for _, l := range finished {
+		t.finish(key, l)
+	}
+}
+
+// finish сообщает о завершенном цикле одного значения
+func (t *LifecycleTracker) finish(key string, l *lifecycle) {
+	if l.queries == 0 {
+		log.Printf("Challenge %s removed without being queried over DNS", key)
+		return
+	}
+
+	now := time.Now()
+	event := LifecycleEvent{
+		Event:              "validation_likely_succeeded",
+		FQDN:               key + ".",
+		AddedAt:            l.added,
+		FirstQueryAt:       l.firstQuery,
+		LastQueryAt:        l.lastQuery,
+		RemovedAt:          now,
+		Queries:            l.queries,
+		TimeToFirstQueryMs: l.firstQuery.Sub(l.added).Milliseconds(),
+		TotalMs:            now.Sub(l.added).Milliseconds(),
+	}
+	log.Printf("Challenge %s lifecycle complete: %d queries, first after %dms", key, l.queries, event.TimeToFirstQueryMs)
+	if t.webhook != "" {
+		go t.send(event)
+	}
+}
+
+func (t *LifecycleTracker) send(event LifecycleEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode lifecycle event: %v", err)
+		return
+	}
+	resp, err := t.client.Post(t.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Lifecycle webhook failed for %s: %v", event.FQDN, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Lifecycle webhook for %s returned %s", event.FQDN, resp.Status)
+	}
+}
@@ -0,0 +1,73 @@
+package responder
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// children не дает уборщику забрать код возврата собственного дочернего процесса: пока
+// такие процессы запущены (held > 0), уборка откладывается до их завершения
+var children struct {
+	sync.Mutex
+	held    int
+	pending bool
+}
+
+// ReapChildren забирает завершившиеся процессы, если демон работает PID 1 (контейнер без
+// init): осиротевшие потомки переподчиняются PID 1 и без wait остаются зомби. false - демон
+// не PID 1, уборка не нужна.
+func ReapChildren() bool {
+	if os.Getpid() != 1 {
+		return false
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGCHLD)
+	go func() {
+		for range signals {
+			reap()
+		}
+	}()
+	return true
+}
+
+func reap() {
+	children.Lock()
+	defer children.Unlock()
+	if children.held > 0 {
+		children.pending = true
+		return
+	}
+	children.pending = false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+	}
+}
+
+// HoldChildren откладывает уборку до вызова release; держать от запуска собственного
+// дочернего процесса до его Wait
+func HoldChildren() (release func()) {
+	children.Lock()
+	children.held++
+	children.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			children.Lock()
+			children.held--
+			pending := children.held == 0 && children.pending
+			children.Unlock()
+			if pending {
+				reap()
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package responder
+
+// ReapChildren: уборка за PID 1 нужна только в Linux контейнерах
+func ReapChildren() bool {
+	return false
+}
+
+// HoldChildren ничего не делает, уборки нет
+func HoldChildren() (release func()) {
+	return func() {}
+}
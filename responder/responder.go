@@ -0,0 +1,255 @@
+// Package responder собирает хранилище, DNS сервер и FastCGI/HTTP API в один
+// challenge responder поверх готовых сокетов, чтобы его можно было встроить в свою программу.
+package responder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"strings"
+	"time"
+
+	"dns-acme-server/dnsserver"
+	"dns-acme-server/fcgiapi"
+	"dns-acme-server/metrics"
+	"dns-acme-server/storage"
+)
+
+// Listeners - уже открытые сокеты, на которых работает демон
+type Listeners struct {
+	DNSPacketConns []net.PacketConn // DNS over UDP
+	DNSListeners   []net.Listener   // DNS over TCP
+	FastCGI        []net.Listener
+	API            []net.Listener // HTTP API управления
+	Metrics        []net.Listener // Prometheus /metrics, открывается и обслуживается вызывающим
+	GRPC           []net.Listener // gRPC API, открывается и обслуживается вызывающим
+}
+
+// ListenAll открывает DNS (UDP и TCP), FastCGI и HTTP API сокеты на указанных адресах.
+// DNS адрес может содержать интерфейс: 192.0.2.1:53@eth0 или [::]:53@eth1.
+// Если хоть один сокет не удалось открыть, закрываются все и возвращается ошибка с
+// объяснением (кто занял порт, нужны ли права).
+func ListenAll(dnsAddrs, fastcgiAddrs, apiAddrs []string) (Listeners, error) {
+	return ListenAllFallback(dnsAddrs, fastcgiAddrs, apiAddrs, 0)
+}
+
+// ListenAllFallback - ListenAll, но DNS адрес, порт которого занят или требует прав,
+// открывается на порту fallbackPort того же хоста (0 - не открывается)
+func ListenAllFallback(dnsAddrs, fastcgiAddrs, apiAddrs []string, fallbackPort int) (Listeners, error) {
+	var l Listeners
+	for _, spec := range dnsAddrs {
+		addr, iface := splitInterface(spec)
+		lc := net.ListenConfig{}
+		if iface != "" {
+			var err error
+			if lc, err = interfaceListenConfig(iface); err != nil {
+				l.Close()
+				return Listeners{}, fmt.Errorf("DNS %s: %w", spec, err)
+			}
+		}
+
+		conn, listener, err := listenDNS(lc, spec, addr, fallbackPort)
+		if err != nil {
+			l.Close()
+			return Listeners{}, err
+		}
+		l.DNSPacketConns = append(l.DNSPacketConns, conn)
+		l.DNSListeners = append(l.DNSListeners, listener)
+	}
+	for _, addr := range fastcgiAddrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			l.Close()
+			return Listeners{}, fmt.Errorf("FastCGI %s: %w%s", addr, err, bindHint(addr, err))
+		}
+		l.FastCGI = append(l.FastCGI, listener)
+	}
+	for _, addr := range apiAddrs {
+		listener, err := listenAPI(addr)
+		if err != nil {
+			l.Close()
+			return Listeners{}, fmt.Errorf("API %s: %w%s", addr, err, bindHint(addr, err))
+		}
+		l.API = append(l.API, listener)
+	}
+	return l, nil
+}
+
+// listenAPI открывает TCP адрес или unix сокет (unix:/run/dns-acme/api.sock); сокет доступен
+// владельцу и группе, старый файл сокета от предыдущего запуска удаляется
+func listenAPI(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// splitInterface отделяет имя интерфейса от адреса вида addr@iface
+func splitInterface(spec string) (addr, iface string) {
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// Close закрывает все сокеты
+func (l Listeners) Close() {
+	for _, conn := range l.DNSPacketConns {
+		conn.Close()
+	}
+	for _, listener := range l.DNSListeners {
+		listener.Close()
+	}
+	for _, listener := range l.FastCGI {
+		listener.Close()
+	}
+	for _, listener := range l.API {
+		listener.Close()
+	}
+	for _, listener := range l.Metrics {
+		listener.Close()
+	}
+	for _, listener := range l.GRPC {
+		listener.Close()
+	}
+}
+
+// Subsystem - пара функций запуска и остановки подсистемы
+type Subsystem struct {
+	Start func() error
+	Stop  func()
+}
+
+// Responder связывает хранилище с DNS и API (FastCGI и HTTP) подсистемами поверх готовых сокетов,
+// чтобы их можно было встроить в собственный супервизор
+type Responder struct {
+	Records   *storage.RecordManager
+	Hosted    *storage.HostedRecords // постоянные TXT записи (/txt в HTTP API)
+	DNSServer *dnsserver.Server      // можно донастроить до DNS.Start (TSIG, статика, политики)
+	Handler   *fcgiapi.FastCGIHandler
+	APIServer *fcgiapi.APIHandler
+	APITLS    *tls.Config        // если задан, HTTP API работает по HTTPS
+	AccessLog *fcgiapi.AccessLog // если задан, запросы FastCGI и HTTP API пишутся в журнал доступа
+
+	DNS Subsystem
+	API Subsystem
+
+	errors chan error
+}
+
+// Errors возвращает канал ошибок подсистем, случившихся уже после запуска
+// (например, сокет закрылся из-под сервера). Демон после такой ошибки не работает
+// полноценно, и супервизору стоит его перезапустить.
+func (r *Responder) Errors() <-chan error {
+	return r.errors
+}
+
+// EnablePropagationCheck включает ожидание распространения записи в add хуках FastCGI и HTTP API
+func (r *Responder) EnablePropagationCheck(c *fcgiapi.PropagationChecker) {
+	r.Handler.SetPropagationChecker(c)
+	r.APIServer.SetPropagationChecker(c)
+}
+
+func (r *Responder) reportError(err error) {
+	select {
+	case r.errors <- err:
+	default:
+	}
+}
+
+// NewResponder собирает подсистемы поверх backend и listeners; prefix - префикс имен
+// проверки (storage.ParseChallengePrefix), пусто - _acme-challenge
+func NewResponder(backend storage.Storage, listeners Listeners, prefix string) *Responder {
+	records := storage.NewRecordManager(backend, prefix)
+	r := &Responder{
+		Records:   records,
+		Hosted:    storage.NewHostedRecords(backend),
+		DNSServer: dnsserver.NewServer(records),
+		Handler:   fcgiapi.NewFastCGIHandler(records),
+		APIServer: fcgiapi.NewAPIHandler(records),
+		errors:    make(chan error, 1),
+	}
+	r.DNSServer.SetHostedRecords(r.Hosted)
+	r.APIServer.EnableHostedRecords(r.Hosted)
+	r.APIServer.EnableSnapshots(r.Hosted)
+	// DNS и API сообщают об ошибках в один канал
+	go func() {
+		for err := range r.DNSServer.Errors() {
+			r.reportError(err)
+		}
+	}()
+	httpServer := &http.Server{
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 60 * time.Second,
+		ErrorLog:     metrics.HandshakeErrorLog("api"),
+	}
+
+	r.DNS = Subsystem{
+		Start: func() error {
+			return r.DNSServer.Serve(listeners.DNSPacketConns, listeners.DNSListeners)
+		},
+		Stop: r.DNSServer.Stop,
+	}
+
+	r.API = Subsystem{
+		Start: func() error {
+			var fastcgiHandler http.Handler = r.Handler
+			httpServer.Handler = r.APIServer
+			if r.AccessLog != nil {
+				fastcgiHandler = r.AccessLog.Middleware("fastcgi", fastcgiHandler)
+				httpServer.Handler = r.AccessLog.Middleware("api", httpServer.Handler)
+			}
+			for _, listener := range listeners.FastCGI {
+				go func(l net.Listener) {
+					log.Printf("Starting FastCGI server on %s", l.Addr())
+					if err := fcgi.Serve(l, fastcgiHandler); err != nil && !errors.Is(err, net.ErrClosed) {
+						log.Printf("FastCGI server error on %s: %v", l.Addr(), err)
+						r.reportError(fmt.Errorf("FastCGI server on %s: %w", l.Addr(), err))
+					}
+				}(listener)
+			}
+			for _, listener := range listeners.API {
+				if r.APITLS != nil {
+					listener = tls.NewListener(listener, r.APITLS)
+				}
+				go func(l net.Listener) {
+					log.Printf("Starting HTTP API server on %s (TLS: %v)", l.Addr(), r.APITLS != nil)
+					if err := httpServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						log.Printf("HTTP API server error on %s: %v", l.Addr(), err)
+						r.reportError(fmt.Errorf("HTTP API server on %s: %w", l.Addr(), err))
+					}
+				}(listener)
+			}
+			return nil
+		},
+		Stop: func() {
+			for _, listener := range listeners.FastCGI {
+				listener.Close()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down HTTP API server: %v", err)
+			}
+		},
+	}
+	return r
+}
@@ -0,0 +1,167 @@
+package responder_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"dns-acme-server/responder"
+	"dns-acme-server/storage"
+)
+
+// TestMain в процессе, запущенном через responder.Upgrade, играет новую версию демона:
+// принимает переданные сокеты и на каждый отвечает его назначением
+func TestMain(m *testing.M) {
+	if _, ok := os.LookupEnv("DNS_ACME_UPGRADE_FDS"); ok {
+		os.Exit(serveUpgraded())
+	}
+	os.Exit(m.Run())
+}
+
+func serveUpgraded() int {
+	l, _, err := responder.InheritedListeners()
+	if err != nil {
+		log.Printf("inherited listeners: %v", err)
+		return 1
+	}
+	if err := responder.UpgradeReady(); err != nil {
+		log.Printf("upgrade ready: %v", err)
+		return 1
+	}
+	var wg sync.WaitGroup
+	serve := func(name string, listeners []net.Listener) {
+		for _, listener := range listeners {
+			wg.Add(1)
+			go func(listener net.Listener) {
+				defer wg.Done()
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name))
+				conn.Close()
+			}(listener)
+		}
+	}
+	serve("api", l.API)
+	serve("grpc", l.GRPC)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(10 * time.Second):
+		return 1
+	}
+}
+
+// TestUpgrade - после Upgrade и закрытия сокетов старым процессом на тех же адресах отвечает новый
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no descriptor passing to child processes on Windows")
+	}
+	api, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// короткий путь: длина пути unix сокета ограничена
+	dir, err := os.MkdirTemp("", "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "api.sock")
+	unix, err := responder.ListenAll(nil, nil, []string{"unix:" + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := responder.Listeners{API: append([]net.Listener{api}, unix.API...), GRPC: []net.Listener{grpc}}
+	if err := responder.Upgrade(listeners, 10*time.Second); err != nil {
+		listeners.Close()
+		t.Fatal(err)
+	}
+	// старый процесс останавливается
+	listeners.Close()
+
+	for _, tt := range []struct {
+		network, addr, want string
+	}{
+		{"tcp", api.Addr().String(), "api"},
+		{"tcp", grpc.Addr().String(), "grpc"},
+		{"unix", socket, "api"},
+	} {
+		conn, err := net.DialTimeout(tt.network, tt.addr, 5*time.Second)
+		if err != nil {
+			t.Errorf("%s socket not handed over: %v", tt.want, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s %s answered %q, %v; want the new process serving %s", tt.network, tt.addr, got, err, tt.want)
+		}
+	}
+}
+
+// Встраивание в чужой супервизор: сокеты открывает вызывающий, responder только обслуживает их
+func TestEmbeddedResponder(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := responder.Listeners{DNSPacketConns: []net.PacketConn{conn}, API: []net.Listener{api}}
+	t.Cleanup(listeners.Close)
+
+	r := responder.NewResponder(storage.NewMemory(), listeners, "")
+	for _, s := range []responder.Subsystem{r.DNS, r.API} {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Stop)
+	}
+
+	body := strings.NewReader(`{"fqdn":"_acme-challenge.example.com","value":"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"}`)
+	resp, err := http.Post("http://"+api.Addr().String()+"/present", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("present: %s", resp.Status)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+	answer, err := dns.Exchange(m, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("got %d answers, want the value published through the API", len(answer.Answer))
+	}
+}
@@ -0,0 +1,105 @@
+package responder
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart - первый дескриптор, переданный systemd
+const listenFDsStart = 3
+
+// SystemdListeners возвращает сокеты, переданные через socket activation (LISTEN_FDS).
+// Имена сокетов (FileDescriptorName=) определяют назначение: dns, fastcgi, api, metrics, grpc;
+// датаграммные сокеты без имени считаются DNS. ok=false, если активации не было.
+func SystemdListeners() (l Listeners, ok bool, err error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return Listeners{}, false, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return Listeners{}, false, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// чтобы дочерние процессы не приняли сокеты на свой счет
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	l, err = listenersFromFDs(count, names)
+	return l, true, err
+}
+
+// listenersFromFDs собирает count унаследованных сокетов, начиная с дескриптора 3
+func listenersFromFDs(count int, names []string) (Listeners, error) {
+	var l Listeners
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		if err := l.addFile(f, name); err != nil {
+			l.Close()
+			return Listeners{}, fmt.Errorf("socket %d (%s): %w", listenFDsStart+i, name, err)
+		}
+	}
+	return l, nil
+}
+
+// addFile распределяет унаследованный сокет по подсистемам
+func (l *Listeners) addFile(f *os.File, name string) error {
+	defer f.Close() // net.File* делают dup
+
+	if listener, err := net.FileListener(f); err == nil {
+		switch name {
+		case "dns":
+			l.DNSListeners = append(l.DNSListeners, listener)
+		case "fastcgi":
+			l.FastCGI = append(l.FastCGI, listener)
+		case "api":
+			l.API = append(l.API, listener)
+		case "metrics":
+			l.Metrics = append(l.Metrics, listener)
+		case "grpc":
+			l.GRPC = append(l.GRPC, listener)
+		default:
+			listener.Close()
+			return fmt.Errorf("stream socket needs FileDescriptorName=dns, fastcgi, api, metrics or grpc")
+		}
+		return nil
+	}
+
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return err
+	}
+	if name != "" && name != "dns" && !strings.HasSuffix(name, ".socket") {
+		conn.Close()
+		return fmt.Errorf("datagram socket can only be used for dns")
+	}
+	l.DNSPacketConns = append(l.DNSPacketConns, conn)
+	return nil
+}
+
+// Notify отправляет состояние в systemd (READY=1, RELOADING=1, STOPPING=1);
+// без NOTIFY_SOCKET ничего не делает
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
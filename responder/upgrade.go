@@ -0,0 +1,174 @@
+package responder
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Переменные окружения, через которые старый процесс передает новому сокеты при Upgrade
+const (
+	upgradeFDsEnv   = "DNS_ACME_UPGRADE_FDS"   // имена сокетов через ':', дескрипторы начиная с 3
+	upgradeReadyEnv = "DNS_ACME_UPGRADE_READY" // дескриптор pipe, в который новый процесс пишет о готовности
+)
+
+// InheritedListeners возвращает сокеты, переданные старым процессом через Upgrade.
+// ok=false, если процесс запущен не через Upgrade.
+func InheritedListeners() (l Listeners, ok bool, err error) {
+	value, ok := os.LookupEnv(upgradeFDsEnv)
+	if !ok {
+		return Listeners{}, false, nil
+	}
+	os.Unsetenv(upgradeFDsEnv)
+	names := strings.Split(value, ":")
+	l, err = listenersFromFDs(len(names), names)
+	return l, true, err
+}
+
+// UpgradeReady сообщает старому процессу, что новый обслуживает запросы и старый может
+// остановиться. Если процесс запущен не через Upgrade, ничего не делает.
+func UpgradeReady() error {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	// под systemd главным процессом сервиса теперь становится новый (нужен NotifyAccess=all)
+	if err := Notify(fmt.Sprintf("MAINPID=%d", os.Getpid())); err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// Upgrade запускает исполняемый файл заново (обычно уже новую версию) с теми же аргументами
+// и передает ему сокеты l, так что DNS, FastCGI и API продолжают принимать запросы во время деплоя.
+// Возвращается без ошибки, когда новый процесс сообщил о готовности (UpgradeReady) - после
+// этого старому нужно остановиться. При ошибке или таймауте новый процесс убивается,
+// а старый продолжает работать.
+func Upgrade(l Listeners, timeout time.Duration) error {
+	files, names, err := l.files()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		upgradeFDsEnv+"="+strings.Join(names, ":"),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, listenFDsStart+len(files)))
+	release := HoldChildren()
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		release()
+		return fmt.Errorf("start %s: %w", path, err)
+	}
+	go func() {
+		cmd.Wait()
+		release()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("new process %d exited before becoming ready", cmd.Process.Pid)
+		}
+		l.keepSocketFiles()
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d did not become ready in %v", cmd.Process.Pid, timeout)
+	}
+}
+
+// keepSocketFiles не дает старому процессу удалить при остановке файлы unix сокетов:
+// теперь их слушает новый процесс
+func (l Listeners) keepSocketFiles() {
+	for _, listeners := range [][]net.Listener{l.DNSListeners, l.FastCGI, l.API, l.Metrics, l.GRPC} {
+		for _, listener := range listeners {
+			if unix, ok := listener.(*net.UnixListener); ok {
+				unix.SetUnlinkOnClose(false)
+			}
+		}
+	}
+}
+
+// files дублирует сокеты для передачи в дочерний процесс; имена - как у systemd (FileDescriptorName)
+func (l Listeners) files() ([]*os.File, []string, error) {
+	var files []*os.File
+	var names []string
+	add := func(socket interface{}, name string) error {
+		s, ok := socket.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%T cannot be passed to another process", socket)
+		}
+		f, err := s.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, name)
+		return nil
+	}
+	for _, conn := range l.DNSPacketConns {
+		if err := add(conn, "dns"); err != nil {
+			return files, nil, err
+		}
+	}
+	for _, listener := range l.DNSListeners {
+		if err := add(listener, "dns"); err != nil {
+			return files, nil, err
+		}
+	}
+	for _, listener := range l.FastCGI {
+		if err := add(listener, "fastcgi"); err != nil {
+			return files, nil, err
+		}
+	}
+	for _, listener := range l.API {
+		if err := add(listener, "api"); err != nil {
+			return files, nil, err
+		}
+	}
+	for _, listener := range l.Metrics {
+		if err := add(listener, "metrics"); err != nil {
+			return files, nil, err
+		}
+	}
+	for _, listener := range l.GRPC {
+		if err := add(listener, "grpc"); err != nil {
+			return files, nil, err
+		}
+	}
+	return files, names, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// ErrDomainNotAllowed возвращается при попытке изменить запись домена вне белого списка
+var ErrDomainNotAllowed = errors.New("domain is not allowed")
+
+// DomainACL - белый список доменов: точные имена и суффиксы (*.example.com или .example.com).
+// Запись домена разрешает только имя проверки (_acme-challenge.example.com), а не сам домен:
+// иначе клиент мог бы публиковать на apex SPF и подтверждения владения. Имена записей как есть
+// (постоянные записи /txt, поддомены регистраций) разрешаются явно записями с "=":
+// =example.com, =*.auth.example.net
+type DomainACL struct {
+	exact    map[string]bool
+	suffixes []string // с ведущей точкой
+
+	names        map[string]bool // записи с "=": имя записи целиком
+	nameSuffixes []string
+
+	prefix string // префикс имени проверки с завершающей точкой
+}
+
+// ParseDomainACL разбирает список; prefix - префикс имени проверки, пусто - DefaultChallengePrefix
+func ParseDomainACL(list, prefix string) *DomainACL {
+	acl := &DomainACL{exact: make(map[string]bool), names: make(map[string]bool), prefix: challengeLabels(prefix)}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		exact, suffixes := acl.exact, &acl.suffixes
+		if strings.HasPrefix(item, "=") {
+			item = strings.TrimSpace(item[1:])
+			exact, suffixes = acl.names, &acl.nameSuffixes
+		}
+		item = NormalizeDomain(item)
+		switch {
+		case item == "":
+		case strings.HasPrefix(item, "*."):
+			*suffixes = append(*suffixes, item[1:])
+		case strings.HasPrefix(item, "."):
+			*suffixes = append(*suffixes, item)
+		default:
+			exact[item] = true
+		}
+	}
+	return acl
+}
+
+// LoadDomainACLFile читает белый список из файла: записи через запятую или по одной
+// на строку, строки с # - комментарии
+func LoadDomainACLFile(path, prefix string) (*DomainACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			items = append(items, line)
+		}
+	}
+	return ParseDomainACL(strings.Join(items, ","), prefix), nil
+}
+
+// Size - число записей списка
+func (acl *DomainACL) Size() int {
+	return len(acl.exact) + len(acl.suffixes) + len(acl.names) + len(acl.nameSuffixes)
+}
+
+// Allows проверяет имя записи: имя проверки домена из списка или имя, разрешенное через "="
+func (acl *DomainACL) Allows(name string) bool {
+	name = NormalizeDomain(name)
+	if matchDomain(name, acl.names, acl.nameSuffixes) {
+		return true
+	}
+	if !strings.HasPrefix(name, acl.prefix) {
+		return false
+	}
+	return matchDomain(strings.TrimPrefix(name, acl.prefix), acl.exact, acl.suffixes)
+}
+
+// covers - входит ли имя в пространство имен списка: сам домен или его имя проверки
+// (пространства заказчиков владеют и тем, и другим)
+func (acl *DomainACL) covers(name string) bool {
+	name = NormalizeDomain(name)
+	domain := strings.TrimPrefix(name, acl.prefix)
+	return matchDomain(name, acl.names, acl.nameSuffixes) || matchDomain(domain, acl.names, acl.nameSuffixes) ||
+		matchDomain(domain, acl.exact, acl.suffixes)
+}
+
+func matchDomain(domain string, exact map[string]bool, suffixes []string) bool {
+	if exact[domain] {
+		return true
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// ErrBatchAborted - элемент не применен, потому что пакет отменен из-за ошибки другого элемента
+var ErrBatchAborted = errors.New("batch aborted")
+
+// BatchChange - одно изменение пакета; пустое Value при удалении удаляет все значения имени
+type BatchChange struct {
+	Name      string
+	Value     string
+	Condition Condition
+}
+
+// ApplyBatch добавляет (remove=false) или удаляет записи пакетом: применяются либо все
+// изменения, либо ни одного. Сначала проверяются все имена, при ошибке хранилища уже
+// сделанные изменения откатываются. Возвращает ошибку каждого элемента (nil - применен)
+// и ошибку пакета; наблюдатели уведомляются только об успешно примененном пакете.
+func (m *RecordManager) ApplyBatch(ctx context.Context, src Source, remove bool, changes []BatchChange, ttl *uint32) ([]error, error) {
+	ops := make([]batchOp, len(changes))
+	for i, c := range changes {
+		ops[i] = batchOp{BatchChange: c, remove: remove, ttl: ttl}
+	}
+	return m.applyBatch(ctx, src, ops)
+}
+
+// UpdateChange - изменение из RFC 2136 UPDATE: добавление значения со своим TTL или удаление
+type UpdateChange struct {
+	Name   string
+	Value  string // пустое при удалении - все значения имени
+	Remove bool
+	TTL    *uint32 // nil - TTL по умолчанию
+}
+
+// ApplyUpdate применяет добавления и удаления вперемешку по правилам ApplyBatch: либо все,
+// либо ни одного (RFC 2136, 3.4)
+func (m *RecordManager) ApplyUpdate(ctx context.Context, src Source, changes []UpdateChange) error {
+	ops := make([]batchOp, len(changes))
+	for i, c := range changes {
+		ops[i] = batchOp{BatchChange: BatchChange{Name: c.Name, Value: c.Value}, remove: c.Remove, ttl: c.TTL}
+	}
+	_, err := m.applyBatch(ctx, src, ops)
+	return err
+}
+
+// batchOp - изменение пакета вместе с направлением и TTL
+type batchOp struct {
+	BatchChange
+	remove bool
+	ttl    *uint32
+}
+
+func (m *RecordManager) applyBatch(ctx context.Context, src Source, ops []batchOp) ([]error, error) {
+	errs := make([]error, len(ops))
+	var failed error
+	for i, c := range ops {
+		if err := m.checkChange(src, c.Name); err != nil {
+			log.Printf("Rejected batch change of %s from %s: %v", c.Name, src, err)
+			errs[i] = err
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		return abortBatch(errs), failed
+	}
+	if err := m.rateLimit.allow(ctx, src, len(ops)); err != nil {
+		log.Printf("Rejected batch of %d changes from %s: %v", len(ops), src, err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, err
+	}
+	for i, c := range ops {
+		if err := m.beforeChange(ctx, src, c.remove, c.Name, c.Value); err != nil {
+			errs[i] = err
+			return abortBatch(errs), err
+		}
+	}
+
+	names := make([]string, len(ops))
+	for i, c := range ops {
+		names[i] = c.Name
+	}
+	unlock, err := m.names.lock(ctx, names...)
+	if err != nil {
+		log.Printf("Failed batch of %d changes from %s: %v", len(ops), src, err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, err
+	}
+	var added []BatchChange
+	for _, c := range ops {
+		if !c.remove {
+			added = append(added, c.BatchChange)
+		}
+	}
+	release, err := m.quota.reserve(m.tenants.quotaOwner(src.Identity), added)
+	if err != nil {
+		unlock()
+		log.Printf("Rejected batch of %d changes from %s: %v", len(ops), src, err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, err
+	}
+	prev := make([][]string, len(ops))
+	for i, c := range ops {
+		values, err := getTXTValues(ctx, m.storage, storageKey(c.Name))
+		if err == nil {
+			err = c.Condition.check(c.remove, c.Value, values)
+		}
+		if err != nil {
+			log.Printf("Rejected batch change of %s from %s: %v", c.Name, src, err)
+			errs[i] = err
+			if failed == nil {
+				failed = err
+			}
+		}
+		prev[i] = values
+	}
+	if failed != nil {
+		release()
+		unlock()
+		return abortBatch(errs), failed
+	}
+
+	for i, c := range ops {
+		key := storageKey(c.Name)
+		var err error
+		switch {
+		case c.Condition != (Condition{}):
+			// условие проверяется еще раз вместе с записью: общее хранилище могла изменить
+			// другая реплика
+			err = updateTXTValue(ctx, m.storage, key, c.Value, c.remove, func(current []string) error {
+				prev[i] = current
+				return c.Condition.check(c.remove, c.Value, current)
+			})
+		case c.remove:
+			err = removeTXTValue(ctx, m.storage, key, c.Value)
+		default:
+			err = addTXTValue(ctx, m.storage, key, c.Value)
+		}
+		if err != nil {
+			log.Printf("Failed batch change of %s from %s, rolling back %d changes: %v", c.Name, src, i, err)
+			errs[i] = err
+			// откатываем в обратном порядке, чтобы повторы одного имени восстановились верно.
+			// Откат не зависит от ctx: запрос мог истечь, но сделанное нужно вернуть
+			for j := i - 1; j >= 0; j-- {
+				if rollbackErr := m.rollback(ops[j].remove, ops[j].BatchChange, prev[j]); rollbackErr != nil {
+					log.Printf("Failed to roll back %s: %v", ops[j].Name, rollbackErr)
+				}
+			}
+			release()
+			unlock()
+			return abortBatch(errs), err
+		}
+	}
+	// учет по порядку пакета: удаление всех значений имени и новое добавление (RFC 2136)
+	// оставляют добавленное значение учтенным
+	owner := m.tenants.quotaOwner(src.Identity)
+	for _, c := range ops {
+		if c.remove {
+			m.quota.removed(c.Name, c.Value)
+		} else {
+			m.quota.added(owner, c.Name, c.Value)
+		}
+	}
+	unlock()
+
+	m.mutex.Lock()
+	for _, c := range ops {
+		if c.remove {
+			m.valueRemoved(c.Name, c.Value)
+		} else {
+			m.valueAdded(c.Name, c.Value, c.ttl, src.RequestID)
+		}
+	}
+	m.mutex.Unlock()
+	observers := m.snapshotObservers()
+	for _, c := range ops {
+		for _, o := range observers {
+			if c.remove {
+				o.RecordRemoved(src, c.Name, c.Value)
+			} else {
+				o.RecordAdded(src, c.Name, c.Value)
+			}
+		}
+	}
+	return errs, nil
+}
+
+// rollback отменяет примененное изменение пакета по значениям имени до пакета
+func (m *RecordManager) rollback(remove bool, c BatchChange, prev []string) error {
+	key := storageKey(c.Name)
+	if !remove {
+		if containsValue(prev, c.Value) {
+			return nil
+		}
+		return m.storage.RemoveTXTValue(key, c.Value)
+	}
+	for _, value := range prev {
+		if c.Value == "" || value == c.Value {
+			if err := m.storage.AddTXTValue(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// abortBatch отмечает элементы без собственной ошибки как отмененные
+func abortBatch(errs []error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchAborted
+		}
+	}
+	return errs
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// ContextStorage - хранилище, операции которого прерываются по контексту запроса: SQL,
+// ConfigMap и Consul ходят по сети и могут зависнуть. Хранилища без него (память)
+// вызываются как есть
+type ContextStorage interface {
+	AddTXTValueContext(ctx context.Context, domain, value string) error
+	RemoveTXTValueContext(ctx context.Context, domain, value string) error
+	GetTXTValuesContext(ctx context.Context, domain string) ([]string, error)
+}
+
+func addTXTValue(ctx context.Context, s Storage, domain, value string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.AddTXTValueContext(ctx, domain, value)
+	}
+	return s.AddTXTValue(domain, value)
+}
+
+func removeTXTValue(ctx context.Context, s Storage, domain, value string) error {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.RemoveTXTValueContext(ctx, domain, value)
+	}
+	return s.RemoveTXTValue(domain, value)
+}
+
+func getTXTValues(ctx context.Context, s Storage, domain string) ([]string, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.GetTXTValuesContext(ctx, domain)
+	}
+	return s.GetTXTValues(domain)
+}
+
+// ConditionalStorage - хранилище, общее для нескольких реплик, которое само проверяет условие
+// изменения и меняет запись атомарно (транзакция SQL, check-and-set Consul, resourceVersion
+// ConfigMap); иначе две реплики могут обе пройти проверку и обе записать
+type ConditionalStorage interface {
+	// UpdateTXTValue передает текущие значения domain в check и, если она не вернула ошибку,
+	// добавляет value (remove=false) или удаляет его (пустое - все значения). При гонке с
+	// другой репликой check вызывается снова на новых значениях
+	UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func(current []string) error) error
+}
+
+// updateTXTValue - условное изменение: в ConditionalStorage атомарно, в остальных хранилищах
+// (память одного процесса) атомарность дает блокировка имени в RecordManager
+func updateTXTValue(ctx context.Context, s Storage, domain, value string, remove bool, check func([]string) error) error {
+	if cs, ok := s.(ConditionalStorage); ok {
+		return cs.UpdateTXTValue(ctx, domain, value, remove, check)
+	}
+	current, err := getTXTValues(ctx, s, domain)
+	if err != nil {
+		return err
+	}
+	if err := check(current); err != nil {
+		return err
+	}
+	if remove {
+		return removeTXTValue(ctx, s, domain, value)
+	}
+	return addTXTValue(ctx, s, domain, value)
+}
+
+// writeLock - мьютекс изменений, ожидание которого прерывается контекстом: запрос
+// не висит за изменением, застрявшим в хранилище
+type writeLock chan struct{}
+
+func newWriteLock() writeLock {
+	return make(writeLock, 1)
+}
+
+func (l writeLock) lock(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l writeLock) unlock() {
+	<-l
+}
+
+// nameLocks - блокировки изменений по имени записи: проверка условия и запись одного имени
+// не перемежаются с другими изменениями этого имени, а изменения разных имен идут параллельно
+type nameLocks struct {
+	mutex sync.Mutex
+	held  map[string]*nameLock
+}
+
+// nameLock - блокировка одного имени; удаляется, когда ее никто не держит и не ждет
+type nameLock struct {
+	lock writeLock
+	refs int
+}
+
+// lock берет блокировки имен в порядке сортировки, чтобы пакеты с общими именами не ждали
+// друг друга по кругу, и возвращает их снятие. Ожидание прерывается ctx
+func (l *nameLocks) lock(ctx context.Context, names ...string) (func(), error) {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		if key := NormalizeDomain(name); !containsValue(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var taken []string
+	unlock := func() {
+		for i := len(taken) - 1; i >= 0; i-- {
+			l.release(taken[i])
+		}
+	}
+	for _, key := range keys {
+		if err := l.acquire(ctx, key); err != nil {
+			unlock()
+			return nil, err
+		}
+		taken = append(taken, key)
+	}
+	return unlock, nil
+}
+
+func (l *nameLocks) acquire(ctx context.Context, key string) error {
+	l.mutex.Lock()
+	if l.held == nil {
+		l.held = make(map[string]*nameLock)
+	}
+	nl := l.held[key]
+	if nl == nil {
+		nl = &nameLock{lock: newWriteLock()}
+		l.held[key] = nl
+	}
+	nl.refs++
+	l.mutex.Unlock()
+	if err := nl.lock.lock(ctx); err != nil {
+		l.mutex.Lock()
+		l.forget(key, nl)
+		l.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *nameLocks) release(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	nl := l.held[key]
+	nl.lock.unlock()
+	l.forget(key, nl)
+}
+
+// forget отпускает ссылку на блокировку; вызывается под l.mutex
+func (l *nameLocks) forget(key string, nl *nameLock) {
+	if nl.refs--; nl.refs == 0 {
+		delete(l.held, key)
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix отмечает зашифрованные значения; значения без него (записанные до
+// включения шифрования) читаются как есть
+const encryptedPrefix = "enc1:"
+
+// agePrefix - начало identity age (age-keygen); ключ хранилища выводится из нее
+const agePrefix = "AGE-SECRET-KEY-1"
+
+// Encrypted шифрует значения записей AES-256-GCM перед записью в next, чтобы токены и
+// строки подтверждения не лежали на диске открытым текстом. Шифрование детерминированное:
+// nonce - HMAC от имени и значения, поэтому одинаковые значения совпадают в хранилище
+// и удаление по значению и проверка дубликатов работают без расшифровки. Имя записи
+// входит в проверяемые данные, значение нельзя перенести в другое имя
+type Encrypted struct {
+	next     Storage
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// NewEncrypted оборачивает next; key - 32 байта
+func NewEncrypted(next Storage, key []byte) (*Encrypted, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, "value"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypted{next: next, aead: aead, nonceKey: deriveKey(key, "nonce")}, nil
+}
+
+// ParseEncryptionKey разбирает ключ: 32 байта в hex или base64 либо identity age
+// (AGE-SECRET-KEY-1..., строки-комментарии файла age-keygen пропускаются)
+func ParseEncryptionKey(material string) ([]byte, error) {
+	scanner := bufio.NewScanner(strings.NewReader(material))
+	line := ""
+	for scanner.Scan() {
+		if text := strings.TrimSpace(scanner.Text()); text != "" && !strings.HasPrefix(text, "#") {
+			line = text
+			break
+		}
+	}
+	switch {
+	case line == "":
+		return nil, errors.New("empty encryption key")
+	case strings.HasPrefix(line, agePrefix):
+		return deriveKey([]byte(line), "age identity"), nil
+	}
+	if key, err := hex.DecodeString(line); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(line); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("expected 32 bytes in hex or base64, or an age identity")
+}
+
+// deriveKey - ключ для одной цели из общего ключа
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dns-acme-server storage " + purpose))
+	return mac.Sum(nil)
+}
+
+// encrypt шифрует значение; имя нормализуется, чтобы не зависеть от того, в каком виде
+// хранилище возвращает ключи в ListTXTValues
+func (s *Encrypted) encrypt(domain, value string) string {
+	domain = NormalizeDomain(domain)
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write([]byte(domain))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:s.aead.NonceSize()]
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), []byte(domain))
+	return encryptedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (s *Encrypted) decrypt(domain, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value[len(encryptedPrefix):])
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("record %s: malformed encrypted value", domain)
+	}
+	n := s.aead.NonceSize()
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(NormalizeDomain(domain)))
+	if err != nil {
+		return "", fmt.Errorf("record %s: cannot decrypt value, wrong encryption key?", domain)
+	}
+	return string(plain), nil
+}
+
+func (s *Encrypted) decryptAll(domain string, values []string) ([]string, error) {
+	if len(values) == 0 {
+		return values, nil
+	}
+	result := make([]string, len(values))
+	for i, v := range values {
+		plain, err := s.decrypt(domain, v)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = plain
+	}
+	return result, nil
+}
+
+// Reveal расшифровывает значение, прочитанное из хранилища в обход обертки (уборка
+// ConfigMap); нерасшифровываемое значение возвращается как есть
+func (s *Encrypted) Reveal(domain, value string) string {
+	if plain, err := s.decrypt(domain, value); err == nil {
+		return plain
+	}
+	return value
+}
+
+func (s *Encrypted) AddTXTValue(domain, value string) error {
+	return s.next.AddTXTValue(domain, s.encrypt(domain, value))
+}
+
+func (s *Encrypted) RemoveTXTValue(domain, value string) error {
+	return s.RemoveTXTValueContext(context.Background(), domain, value)
+}
+
+func (s *Encrypted) GetTXTValues(domain string) ([]string, error) {
+	return s.GetTXTValuesContext(context.Background(), domain)
+}
+
+func (s *Encrypted) AddTXTValueContext(ctx context.Context, domain, value string) error {
+	return addTXTValue(ctx, s.next, domain, s.encrypt(domain, value))
+}
+
+// RemoveTXTValueContext удаляет зашифрованное значение или такое же открытое, записанное
+// до включения шифрования
+func (s *Encrypted) RemoveTXTValueContext(ctx context.Context, domain, value string) error {
+	if value == "" {
+		return removeTXTValue(ctx, s.next, domain, "")
+	}
+	if err := s.removePlain(ctx, domain, value); err != nil {
+		return err
+	}
+	return removeTXTValue(ctx, s.next, domain, s.encrypt(domain, value))
+}
+
+// removePlain удаляет открытое значение, записанное до включения шифрования, если оно есть
+func (s *Encrypted) removePlain(ctx context.Context, domain, value string) error {
+	stored, err := getTXTValues(ctx, s.next, domain)
+	if err != nil {
+		return err
+	}
+	if containsValue(stored, value) {
+		return removeTXTValue(ctx, s.next, domain, value)
+	}
+	return nil
+}
+
+// UpdateTXTValue передает в check расшифрованные значения, а в next - зашифрованное value
+func (s *Encrypted) UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	sealed := value
+	if value != "" {
+		sealed = s.encrypt(domain, value)
+	}
+	err := updateTXTValue(ctx, s.next, domain, sealed, remove, func(current []string) error {
+		plain, err := s.decryptAll(domain, current)
+		if err != nil {
+			return err
+		}
+		return check(plain)
+	})
+	if err != nil || !remove || value == "" {
+		return err
+	}
+	return s.removePlain(ctx, domain, value)
+}
+
+func (s *Encrypted) GetTXTValuesContext(ctx context.Context, domain string) ([]string, error) {
+	values, err := getTXTValues(ctx, s.next, domain)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(domain, values)
+}
+
+func (s *Encrypted) ListTXTValues() (map[string][]string, error) {
+	lister, ok := s.next.(Lister)
+	if !ok {
+		return nil, ErrNotListable
+	}
+	all, err := lister.ListTXTValues()
+	if err != nil {
+		return nil, err
+	}
+	for domain, values := range all {
+		if all[domain], err = s.decryptAll(domain, values); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
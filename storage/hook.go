@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// ErrRejectedByHook - изменение отклонила проверка перед записью (-change-hook pre-add и pre-remove)
+var ErrRejectedByHook = errors.New("rejected by hook")
+
+// ChangeHook вызывается перед каждым изменением записи, action - add или remove; ошибка
+// отменяет изменение и возвращается клиенту (оборачивать в ErrRejectedByHook)
+type ChangeHook func(ctx context.Context, src Source, action, name, value string) error
+
+// SetChangeHook задает проверку перед изменениями; вызывается до начала обслуживания.
+// После изменения внешние обработчики узнают о нем через Observe
+func (m *RecordManager) SetChangeHook(hook ChangeHook) {
+	m.changeHook = hook
+}
+
+// beforeChange вызывает ChangeHook, если он задан
+func (m *RecordManager) beforeChange(ctx context.Context, src Source, remove bool, name, value string) error {
+	if m.changeHook == nil {
+		return nil
+	}
+	action := "add"
+	if remove {
+		action = "remove"
+	}
+	if err := m.changeHook(ctx, src, action, name, value); err != nil {
+		log.Printf("Rejected %s of %s from %s: %v", action, name, src, err)
+		return err
+	}
+	return nil
+}
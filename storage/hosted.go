@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Ключи пространства имен постоянных записей начинаются с метки -hosted-: имя с дефисом
+// в начале метки не пройдет проверку ToASCII, так что с записями проверки они не пересекаются
+const (
+	hostedKeyPrefix = "-hosted-."
+	hostedIndexKey  = "-hosted-index-." // значения - имена всех постоянных записей
+)
+
+// DefaultHostedTTL - TTL постоянной записи, если он не указан
+const DefaultHostedTTL = 3600
+
+// IsHostedKey - ключ хранилища принадлежит постоянным записям (не challenge, не истекает)
+func IsHostedKey(key string) bool {
+	return strings.HasPrefix(key, hostedKeyPrefix) || key == hostedIndexKey
+}
+
+// HostedRecord - постоянная TXT запись
+type HostedRecord struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+	TTL   uint32 `json:"ttl"`
+}
+
+// HostedRecords - долгоживущие TXT записи (подтверждение владения доменом у Google и Microsoft,
+// тестовые SPF) с явным TTL. Лежат в том же хранилище, что и challenge записи, но в отдельном
+// пространстве имен, и не удаляются автоматически. Значение хранится как "TTL значение".
+type HostedRecords struct {
+	storage Storage
+	writes  writeLock // изменения записи и индекса имен
+
+	mutex     sync.RWMutex
+	observers []RecordObserver
+}
+
+func NewHostedRecords(storage Storage) *HostedRecords {
+	return &HostedRecords{storage: storage, writes: newWriteLock()}
+}
+
+// Observe подписывает наблюдателя на изменения постоянных записей
+func (h *HostedRecords) Observe(o RecordObserver) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.observers = append(h.observers, o)
+}
+
+func hostedKey(name string) string {
+	return hostedKeyPrefix + storageKey(name)
+}
+
+// Set публикует значение с TTL; у уже опубликованного значения меняется TTL
+func (h *HostedRecords) Set(ctx context.Context, src Source, name, value string, ttl uint32) error {
+	if ttl > MaxTTL {
+		return fmt.Errorf("invalid TTL %d", ttl)
+	}
+	if err := h.writes.lock(ctx); err != nil {
+		return err
+	}
+	err := h.set(ctx, name, value, ttl)
+	h.writes.unlock()
+	if err != nil {
+		return err
+	}
+	for _, o := range h.snapshotObservers() {
+		o.RecordAdded(src, name, value)
+	}
+	return nil
+}
+
+func (h *HostedRecords) set(ctx context.Context, name, value string, ttl uint32) error {
+	key := hostedKey(name)
+	current, err := getTXTValues(ctx, h.storage, key)
+	if err != nil {
+		return err
+	}
+	for _, stored := range current {
+		if _, v := decodeHosted(stored); v == value {
+			if err := removeTXTValue(ctx, h.storage, key, stored); err != nil {
+				return err
+			}
+		}
+	}
+	if err := addTXTValue(ctx, h.storage, key, strconv.FormatUint(uint64(ttl), 10)+" "+value); err != nil {
+		return err
+	}
+	return addTXTValue(ctx, h.storage, hostedIndexKey, storageKey(name))
+}
+
+// Remove удаляет значение; пустое value удаляет все значения имени
+func (h *HostedRecords) Remove(ctx context.Context, src Source, name, value string) error {
+	if err := h.writes.lock(ctx); err != nil {
+		return err
+	}
+	err := h.remove(ctx, name, value)
+	h.writes.unlock()
+	if err != nil {
+		return err
+	}
+	for _, o := range h.snapshotObservers() {
+		o.RecordRemoved(src, name, value)
+	}
+	return nil
+}
+
+func (h *HostedRecords) remove(ctx context.Context, name, value string) error {
+	key := hostedKey(name)
+	current, err := getTXTValues(ctx, h.storage, key)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, stored := range current {
+		if _, v := decodeHosted(stored); value != "" && v != value {
+			remaining++
+			continue
+		}
+		if err := removeTXTValue(ctx, h.storage, key, stored); err != nil {
+			return err
+		}
+	}
+	if remaining == 0 {
+		return removeTXTValue(ctx, h.storage, hostedIndexKey, storageKey(name))
+	}
+	return nil
+}
+
+// Lookup возвращает значения имени; ошибка хранилища логируется и считается отсутствием записей
+func (h *HostedRecords) Lookup(name string) []HostedRecord {
+	records, err := h.lookup(storageKey(name))
+	if err != nil {
+		log.Printf("Failed to read hosted %s: %v", name, err)
+	}
+	return records
+}
+
+func (h *HostedRecords) lookup(key string) ([]HostedRecord, error) {
+	values, err := h.storage.GetTXTValues(hostedKeyPrefix + key)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]HostedRecord, 0, len(values))
+	for _, stored := range values {
+		ttl, value := decodeHosted(stored)
+		records = append(records, HostedRecord{FQDN: key, Value: value, TTL: ttl})
+	}
+	return records, nil
+}
+
+// List возвращает все постоянные записи (или записи одного имени, если name не пустое)
+func (h *HostedRecords) List(name string) ([]HostedRecord, error) {
+	names := []string{storageKey(name)}
+	if name == "" {
+		var err error
+		if names, err = h.storage.GetTXTValues(hostedIndexKey); err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+	}
+	result := []HostedRecord{}
+	for _, key := range names {
+		records, err := h.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, records...)
+	}
+	return result, nil
+}
+
+func (h *HostedRecords) snapshotObservers() []RecordObserver {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return append([]RecordObserver(nil), h.observers...)
+}
+
+// decodeHosted разбирает хранимое "TTL значение"
+func decodeHosted(stored string) (uint32, string) {
+	ttl, value, _ := strings.Cut(stored, " ")
+	n, err := strconv.ParseUint(ttl, 10, 32)
+	if err != nil {
+		return DefaultHostedTTL, stored
+	}
+	return uint32(n), value
+}
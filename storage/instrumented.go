@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"dns-acme-server/metrics"
+)
+
+var (
+	storageOperations = metrics.Default.NewCounterVec("dns_acme_storage_operations_total",
+		"Storage operations by backend and operation.", "backend", "operation")
+	storageErrors = metrics.Default.NewCounterVec("dns_acme_storage_errors_total",
+		"Failed storage operations by backend and operation.", "backend", "operation")
+	storageLatency = metrics.Default.NewHistogramVec("dns_acme_storage_operation_duration_seconds",
+		"Latency of storage operations in seconds.", metrics.DefaultLatencyBuckets, "backend", "operation")
+)
+
+// Instrumented считает операции, ошибки и задержки хранилища с меткой backend,
+// чтобы было видно медленное или сбоящее хранилище, задерживающее публикацию записей.
+// С SetTimeout еще и прерывает зависшие операции
+type Instrumented struct {
+	backend string
+	next    Storage
+	timeout time.Duration // 0 - без ограничения
+}
+
+func NewInstrumented(backend string, next Storage) *Instrumented {
+	return &Instrumented{backend: backend, next: next}
+}
+
+// SetTimeout ограничивает время одной операции хранилища, которое поддерживает ContextStorage;
+// вызывается до начала обслуживания
+func (s *Instrumented) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+func (s *Instrumented) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+func (s *Instrumented) observe(operation string, started time.Time, err error) {
+	storageOperations.Inc(s.backend, operation)
+	storageLatency.Observe(time.Since(started).Seconds(), s.backend, operation)
+	if err != nil {
+		storageErrors.Inc(s.backend, operation)
+	}
+}
+
+func (s *Instrumented) AddTXTValue(domain, value string) error {
+	return s.AddTXTValueContext(context.Background(), domain, value)
+}
+
+func (s *Instrumented) RemoveTXTValue(domain, value string) error {
+	return s.RemoveTXTValueContext(context.Background(), domain, value)
+}
+
+func (s *Instrumented) GetTXTValues(domain string) ([]string, error) {
+	return s.GetTXTValuesContext(context.Background(), domain)
+}
+
+func (s *Instrumented) AddTXTValueContext(ctx context.Context, domain, value string) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	started := time.Now()
+	err := addTXTValue(ctx, s.next, domain, value)
+	s.observe("set", started, err)
+	return err
+}
+
+func (s *Instrumented) RemoveTXTValueContext(ctx context.Context, domain, value string) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	started := time.Now()
+	err := removeTXTValue(ctx, s.next, domain, value)
+	s.observe("clear", started, err)
+	return err
+}
+
+func (s *Instrumented) GetTXTValuesContext(ctx context.Context, domain string) ([]string, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	started := time.Now()
+	values, err := getTXTValues(ctx, s.next, domain)
+	s.observe("get", started, err)
+	return values, err
+}
+
+func (s *Instrumented) UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	started := time.Now()
+	var rejected error
+	err := updateTXTValue(ctx, s.next, domain, value, remove, func(current []string) error {
+		rejected = check(current)
+		return rejected
+	})
+	operation := "set"
+	if remove {
+		operation = "clear"
+	}
+	if rejected != nil {
+		// отказ по условию - не ошибка хранилища
+		s.observe(operation, started, nil)
+		return err
+	}
+	s.observe(operation, started, err)
+	return err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"log"
+	"sync"
+)
+
+// memoryShards - число сегментов Memory; степень двойки, чтобы выбирать сегмент маской
+const memoryShards = 64
+
+// Memory хранит записи в памяти процесса, после перезапуска они теряются.
+// Записи разложены по сегментам с собственными блокировками, чтобы тысячи
+// одновременных запросов и изменений не ждали одну общую блокировку.
+type Memory struct {
+	shards [memoryShards]memoryShard
+}
+
+type memoryShard struct {
+	mutex   sync.RWMutex
+	records map[string][]string // ключ - storageKey(имя), значения в порядке добавления
+}
+
+func NewMemory() *Memory {
+	s := &Memory{}
+	for i := range s.shards {
+		s.shards[i].records = make(map[string][]string)
+	}
+	return s
+}
+
+// shard выбирает сегмент по FNV-1a хэшу имени
+func (s *Memory) shard(name string) *memoryShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= 16777619
+	}
+	return &s.shards[hash&(memoryShards-1)]
+}
+
+func (s *Memory) AddTXTValue(domain, value string) error {
+	shard := s.shard(domain)
+	shard.mutex.Lock()
+	if !containsValue(shard.records[domain], value) {
+		shard.records[domain] = append(shard.records[domain], value)
+	}
+	shard.mutex.Unlock()
+	log.Printf("DNS TXT record added: %s -> %s", domain, value)
+	return nil
+}
+
+func (s *Memory) RemoveTXTValue(domain, value string) error {
+	shard := s.shard(domain)
+	shard.mutex.Lock()
+	var kept []string
+	if value != "" {
+		for _, v := range shard.records[domain] {
+			if v != value {
+				kept = append(kept, v)
+			}
+		}
+	}
+	if len(kept) == 0 {
+		delete(shard.records, domain)
+	} else {
+		shard.records[domain] = kept
+	}
+	shard.mutex.Unlock()
+	if value != "" {
+		log.Printf("DNS TXT record removed: %s -> %s", domain, value)
+	} else {
+		log.Printf("DNS TXT record removed: %s", domain)
+	}
+	return nil
+}
+
+func (s *Memory) GetTXTValues(domain string) ([]string, error) {
+	shard := s.shard(domain)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	// копия, потому что слайс в map меняется при следующих изменениях
+	return append([]string(nil), shard.records[domain]...), nil
+}
+
+// Compact пересоздает map каждого сегмента, чтобы отдать память после массового удаления записей
+func (s *Memory) Compact() {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.Lock()
+		records := make(map[string][]string, len(shard.records))
+		for name, values := range shard.records {
+			records[name] = values
+		}
+		shard.records = records
+		shard.mutex.Unlock()
+	}
+}
+
+// containsValue - есть ли value среди значений записи
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultChallengePrefix - метка записи проверки DNS-01 (RFC 8555, 8.4)
+const DefaultChallengePrefix = "_acme-challenge"
+
+// ParseChallengePrefix проверяет префикс для других схем проверки через TXT
+// (_delegation_challenge, записи подтверждения владения у провайдеров); можно несколько меток.
+// Возвращает его в нижнем регистре с завершающей точкой
+func ParseChallengePrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, ".")
+	ascii, err := ToASCII(prefix)
+	if err != nil || prefix == "" {
+		return "", fmt.Errorf("invalid challenge prefix %q: %v", prefix, err)
+	}
+	return strings.ToLower(ascii) + ".", nil
+}
+
+// challengeLabels - префикс, переданный конструктору, с завершающей точкой; пусто - DefaultChallengePrefix
+func challengeLabels(prefix string) string {
+	if prefix == "" {
+		prefix = DefaultChallengePrefix
+	}
+	return strings.ToLower(strings.Trim(prefix, ".")) + "."
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Кодирование меток IDN в punycode (RFC 3492), чтобы bücher.example и xn--bcher-kva.example
+// считались одним именем. Полная UTS 46 нормализация не делается: метки приводятся
+// к нижнему регистру и кодируются как есть.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// toASCII кодирует не-ASCII метки имени в вид xn--...
+func toASCII(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punyEncode([]rune(label))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// ToASCII переводит доменное имя из запроса клиента в A-label форму: Unicode метки (IDN)
+// кодируются в xn--..., ASCII метки остаются как есть. Завершающая точка отбрасывается.
+// Метки проверяются: буквы, цифры, дефис (и _), не длиннее 63 октетов, имя - не длиннее 253.
+func ToASCII(domain string) (string, error) {
+	if !utf8.ValidString(domain) {
+		return "", fmt.Errorf("invalid UTF-8 in domain name")
+	}
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			for _, r := range label {
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r) && !unicode.Is(unicode.Mc, r) && r != '-' {
+					return "", fmt.Errorf("invalid character %q in label %q", r, label)
+				}
+			}
+			label = "xn--" + punyEncode([]rune(strings.ToLower(label)))
+			labels[i] = label
+		}
+		if err := checkLabel(label); err != nil {
+			return "", err
+		}
+	}
+	name := strings.Join(labels, ".")
+	if len(name) > 253 {
+		return "", fmt.Errorf("domain name is longer than 253 octets")
+	}
+	return name, nil
+}
+
+// checkLabel проверяет ASCII метку (LDH, подчеркивание допускается для служебных имен)
+func checkLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > 63 {
+		return fmt.Errorf("label %q is longer than 63 octets", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in label %q", c, label)
+		}
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punyEncode(runes []rune) string {
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		// следующий по величине еще не закодированный символ
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
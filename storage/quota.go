@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrStorageFull - достигнут общий лимит числа записей
+var ErrStorageFull = errors.New("record limit reached")
+
+// ErrQuotaExceeded - клиент (токен или TSIG ключ) достиг своего лимита записей
+var ErrQuotaExceeded = errors.New("record quota exceeded")
+
+// RecordQuota ограничивает число опубликованных значений: всего и на одного клиента.
+// Учитываются изменения, сделанные через RecordManager этого процесса; значение
+// принадлежит клиенту, который добавил его первым.
+type RecordQuota struct {
+	max         int            // 0 - без общего лимита
+	perIdentity int            // 0 - без лимита на клиента
+	overrides   map[string]int // лимиты отдельных клиентов вместо perIdentity
+	tenants     *Tenants       // max_records заказчиков, см. RecordManager.SetTenants
+
+	mutex  sync.Mutex
+	owners map[string]map[string]string // NormalizeDomain(имя) -> значение -> клиент
+	total  int
+	counts map[string]int // клиент -> число значений
+}
+
+func NewRecordQuota(max, perIdentity int, overrides map[string]int) *RecordQuota {
+	return &RecordQuota{
+		max:         max,
+		perIdentity: perIdentity,
+		overrides:   overrides,
+		owners:      make(map[string]map[string]string),
+		counts:      make(map[string]int),
+	}
+}
+
+// limit - лимит клиента или заказчика; клиенты без имени (FastCGI без токенов) ограничены
+// только общим лимитом
+func (q *RecordQuota) limit(identity string) int {
+	if n, ok := q.tenants.limit(identity); ok {
+		return n
+	}
+	if n, ok := q.overrides[identity]; ok {
+		return n
+	}
+	if identity == "" {
+		return 0
+	}
+	return q.perIdentity
+}
+
+// reserve проверяет, поместятся ли новые значения (уже опубликованные не считаются), и сразу
+// учитывает их: изменения разных имен идут параллельно, поэтому проверка и учет - один шаг.
+// release возвращает место, если запись в хранилище не удалась
+func (q *RecordQuota) reserve(identity string, changes []BatchChange) (release func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var added []BatchChange
+	seen := make(map[[2]string]bool)
+	for _, c := range changes {
+		name := NormalizeDomain(c.Name)
+		if _, exists := q.owners[name][c.Value]; exists || seen[[2]string{name, c.Value}] {
+			continue
+		}
+		seen[[2]string{name, c.Value}] = true
+		added = append(added, BatchChange{Name: name, Value: c.Value})
+	}
+	if q.max > 0 && len(added) > 0 && q.total+len(added) > q.max {
+		return nil, ErrStorageFull
+	}
+	if limit := q.limit(identity); limit > 0 && len(added) > 0 && q.counts[identity]+len(added) > limit {
+		return nil, ErrQuotaExceeded
+	}
+	for _, c := range added {
+		q.addLocked(identity, c.Name, c.Value)
+	}
+	return func() {
+		for _, c := range added {
+			q.removed(c.Name, c.Value)
+		}
+	}, nil
+}
+
+// added учитывает опубликованное значение, если оно еще не учтено
+func (q *RecordQuota) added(identity, name, value string) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.addLocked(identity, NormalizeDomain(name), value)
+}
+
+// addLocked - added под q.mutex, name уже нормализовано
+func (q *RecordQuota) addLocked(identity, name, value string) {
+	values := q.owners[name]
+	if values == nil {
+		values = make(map[string]string)
+		q.owners[name] = values
+	}
+	if _, exists := values[value]; exists {
+		return
+	}
+	values[value] = identity
+	q.total++
+	q.counts[identity]++
+}
+
+// removed освобождает значение; пустое value - все значения имени
+func (q *RecordQuota) removed(name, value string) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	name = NormalizeDomain(name)
+	for v, identity := range q.owners[name] {
+		if value != "" && v != value {
+			continue
+		}
+		delete(q.owners[name], v)
+		q.total--
+		if q.counts[identity]--; q.counts[identity] == 0 {
+			delete(q.counts, identity)
+		}
+	}
+	if len(q.owners[name]) == 0 {
+		delete(q.owners, name)
+	}
+}
+
+// Usage возвращает число значений клиента и его лимит (0 - без лимита)
+func (q *RecordQuota) Usage(identity string) (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.counts[identity], q.limit(identity)
+}
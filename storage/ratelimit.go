@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"dns-acme-server/metrics"
+)
+
+// ErrRateLimited - клиент меняет записи чаще, чем разрешено
+var ErrRateLimited = errors.New("change rate limit exceeded")
+
+var rateLimited = metrics.Default.NewCounterVec("dns_acme_rate_limited_changes_total",
+	"Record changes rejected by the per-client change rate limit, by interface", "interface")
+
+// maxRateBuckets - сколько клиентов помнит лимитер, прежде чем забыть полные корзины
+const maxRateBuckets = 4096
+
+// RateLimiter ограничивает частоту изменений записей одного клиента маркерной корзиной:
+// rate изменений в минуту, до burst подряд. Клиент - токен или TSIG ключ, без них - IP адрес.
+// Так зациклившийся продлеватель не заваливает хранилище, репликацию и NOTIFY
+type RateLimiter struct {
+	rate  float64 // маркеров в секунду
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+	now     func() time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter - perMinute изменений в минуту, burst подряд (0 - burst = perMinute)
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+		now:     time.Now,
+	}
+}
+
+// SetRateLimit включает ограничение частоты изменений; вызывается до начала обслуживания
+func (m *RecordManager) SetRateLimit(l *RateLimiter) {
+	m.rateLimit = l
+}
+
+// AllowChange забирает у клиента src n изменений из лимита частоты, не меняя записи: для
+// изменений, которые откладываются в очередь повторов в обход AddIf/RemoveIf
+func (m *RecordManager) AllowChange(ctx context.Context, src Source, n int) error {
+	return m.rateLimit.allow(ctx, src, n)
+}
+
+type noRateLimitKey struct{}
+
+// withoutRateLimit помечает изменения, которые уже прошли лимит (повтор из очереди)
+func withoutRateLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRateLimitKey{}, true)
+}
+
+// allow забирает n маркеров клиента src; уборка и импорт не ограничиваются
+func (l *RateLimiter) allow(ctx context.Context, src Source, n int) error {
+	if l == nil || src.Interface == ExpireInterface || src.Interface == "import" || ctx.Value(noRateLimitKey{}) != nil {
+		return nil
+	}
+	key := rateKey(src)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		b = &rateBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+	if b.tokens < float64(n) {
+		rateLimited.Inc(src.Interface)
+		wait := time.Duration((float64(n) - b.tokens) / l.rate * float64(time.Second))
+		if float64(n) > l.burst {
+			return fmt.Errorf("%w for %s: %d changes at once, burst is %d", ErrRateLimited, key, n, int(l.burst))
+		}
+		return fmt.Errorf("%w for %s, retry in %v", ErrRateLimited, key, wait.Round(time.Second)+time.Second)
+	}
+	b.tokens -= float64(n)
+	return nil
+}
+
+// prune забывает клиентов, чьи корзины уже снова полны
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateKey - клиент для лимита: имя токена или ключа, иначе IP без порта
+func rateKey(src Source) string {
+	if src.Identity != "" {
+		return src.Identity
+	}
+	if host, _, err := net.SplitHostPort(src.Addr); err == nil {
+		return host
+	}
+	return src.Addr
+}
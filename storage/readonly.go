@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrReadOnly - реплика запущена с -read-only и не меняет записи
+var ErrReadOnly = errors.New("replica is read-only")
+
+// ReadOnly отдает записи next и отказывает в любых изменениях: реплика только отвечает
+// на DNS из хранилища, которое наполняют другие экземпляры демона
+type ReadOnly struct {
+	next Storage
+}
+
+func NewReadOnly(next Storage) *ReadOnly {
+	return &ReadOnly{next: next}
+}
+
+func (s *ReadOnly) AddTXTValue(domain, value string) error {
+	return ErrReadOnly
+}
+
+func (s *ReadOnly) RemoveTXTValue(domain, value string) error {
+	return ErrReadOnly
+}
+
+func (s *ReadOnly) GetTXTValues(domain string) ([]string, error) {
+	return s.next.GetTXTValues(domain)
+}
+
+func (s *ReadOnly) AddTXTValueContext(ctx context.Context, domain, value string) error {
+	return ErrReadOnly
+}
+
+func (s *ReadOnly) RemoveTXTValueContext(ctx context.Context, domain, value string) error {
+	return ErrReadOnly
+}
+
+func (s *ReadOnly) UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	return ErrReadOnly
+}
+
+func (s *ReadOnly) GetTXTValuesContext(ctx context.Context, domain string) ([]string, error) {
+	return getTXTValues(ctx, s.next, domain)
+}
+
+func (s *ReadOnly) ListTXTValues() (map[string][]string, error) {
+	lister, ok := s.next.(Lister)
+	if !ok {
+		return nil, ErrNotListable
+	}
+	return lister.ListTXTValues()
+}
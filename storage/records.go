@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrConflict - условие изменения не выполнено: у имени другое значение
+var ErrConflict = errors.New("record has a different value")
+
+// Condition - условие изменения записи; нулевое значение - без условий
+type Condition struct {
+	IfNotExists bool   // add: отказать, если у имени уже другое значение (то же значение - успех)
+	Expected    string // remove: отказать, если у имени есть значения, но нет этого (пустое - без проверки)
+}
+
+// check проверяет условие против текущих значений записи
+func (c Condition) check(remove bool, value string, current []string) error {
+	if len(current) == 0 {
+		return nil
+	}
+	switch {
+	case !remove && c.IfNotExists && (len(current) > 1 || current[0] != value):
+		return ErrConflict
+	case remove && c.Expected != "" && !containsValue(current, c.Expected):
+		return ErrConflict
+	}
+	return nil
+}
+
+// Source описывает, кто и через какой интерфейс меняет записи
+type Source struct {
+	Interface string // fastcgi, certbot, lego, cert-manager, rfc2136, grpc, import, rollback, expire
+	Addr      string // адрес клиента
+	Identity  string // имя токена или TSIG ключа, если есть
+	RequestID string // X-Request-ID вызова хука, связывает строки журналов одного выпуска
+}
+
+// String - клиент для журнала: адрес, интерфейс и ID запроса
+func (s Source) String() string {
+	if s.RequestID != "" {
+		return fmt.Sprintf("%s (%s, request %s)", s.Addr, s.Interface, s.RequestID)
+	}
+	return fmt.Sprintf("%s (%s)", s.Addr, s.Interface)
+}
+
+// RecordObserver получает уведомления об изменениях записей;
+// value в RecordRemoved пустое, если удалены все значения имени
+type RecordObserver interface {
+	RecordAdded(src Source, name, value string)
+	RecordRemoved(src Source, name, value string)
+}
+
+// RecordManager - единая точка изменения записей для всех интерфейсов
+// (FastCGI, HTTP API, RFC 2136), через нее же наблюдатели узнают об изменениях
+type RecordManager struct {
+	storage Storage
+	names   nameLocks // изменения одного имени по очереди, чтобы проверка условия и запись были атомарны
+
+	mutex      sync.RWMutex
+	allowed    *DomainACL   // nil - разрешены любые домены
+	zones      *Zones       // nil - записи в любых зонах, см. SetZones
+	tenants    *Tenants     // nil - без заказчиков, см. SetTenants
+	quota      *RecordQuota // nil - без лимитов числа записей
+	rateLimit  *RateLimiter // nil - без ограничения частоты изменений
+	changeHook ChangeHook   // nil - без внешней проверки, см. SetChangeHook
+	observers  []RecordObserver
+	defaultTTL uint32
+	prefix     string                          // префикс имени проверки с завершающей точкой
+	added      map[string]map[string]valueMeta // NormalizeDomain(имя) -> значение -> сведения о добавлении
+
+	removeDelay time.Duration // 0 - удаление сразу, см. SetRemoveDelay
+	removals    map[removalKey]*pendingRemoval
+}
+
+// NewRecordManager создает менеджер записей поверх storage. prefix добавляется к домену при
+// публикации (см. ParseChallengePrefix), пусто - DefaultChallengePrefix
+func NewRecordManager(storage Storage, prefix string) *RecordManager {
+	return &RecordManager{
+		storage:    storage,
+		prefix:     challengeLabels(prefix),
+		defaultTTL: DefaultTXTTTL,
+		added:      make(map[string]map[string]valueMeta),
+		removals:   make(map[removalKey]*pendingRemoval),
+	}
+}
+
+// ChallengePrefix возвращает префикс имени проверки с завершающей точкой
+func (m *RecordManager) ChallengePrefix() string {
+	return m.prefix
+}
+
+// SetDefaultTTL задает TTL динамических TXT записей, для которых он не указан явно
+func (m *RecordManager) SetDefaultTTL(ttl uint32) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.defaultTTL = ttl
+}
+
+// valueMeta - сведения о добавлении одного значения. Хранятся по значению, а не по имени:
+// добавление второго значения (wildcard и apex одного сертификата) не меняет TTL и ID первого
+type valueMeta struct {
+	ttl       uint32
+	explicit  bool   // TTL задан при добавлении (ACME_TTL, RFC 2136)
+	requestID string // ID запроса добавления
+}
+
+// TTL возвращает TTL, с которым отдается запись name: наименьший из заданных при добавлении
+// ее значений (TTL внутри RRset одинаковые), если не задан ни один - TTL по умолчанию
+func (m *RecordManager) TTL(name string) uint32 {
+	ttl, ok := m.explicitTTL(name)
+	if ok {
+		return ttl
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.defaultTTL
+}
+
+// explicitTTL - наименьший TTL, заданный при добавлении значений name, если он был
+func (m *RecordManager) explicitTTL(name string) (uint32, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var ttl uint32
+	found := false
+	for _, meta := range m.added[NormalizeDomain(name)] {
+		if meta.explicit && (!found || meta.ttl < ttl) {
+			ttl, found = meta.ttl, true
+		}
+	}
+	return ttl, found
+}
+
+// RequestID возвращает ID запросов, которыми добавили значения имени, через запятую: DNS
+// сервер пишет их рядом с ответом, чтобы вопрос CA можно было найти по ID вызова хука
+func (m *RecordManager) RequestID(name string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var ids []string
+	for _, meta := range m.added[NormalizeDomain(name)] {
+		if meta.requestID != "" && !containsValue(ids, meta.requestID) {
+			ids = append(ids, meta.requestID)
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ", ")
+}
+
+// valueAdded запоминает TTL и ID запроса добавленного значения; без них (ttl nil, пустой id)
+// остаются прежние, если значение уже было. Вызывается под m.mutex
+func (m *RecordManager) valueAdded(name, value string, ttl *uint32, requestID string) {
+	name = NormalizeDomain(name)
+	byValue := m.added[name]
+	if byValue == nil {
+		byValue = make(map[string]valueMeta)
+		m.added[name] = byValue
+	}
+	meta := byValue[value]
+	if ttl != nil {
+		meta.ttl, meta.explicit = *ttl, true
+	}
+	if requestID != "" {
+		meta.requestID = requestID
+	}
+	byValue[value] = meta
+}
+
+// valueRemoved забывает удаленное значение (пустое - все значения имени); вызывается под m.mutex
+func (m *RecordManager) valueRemoved(name, value string) {
+	name = NormalizeDomain(name)
+	if value != "" {
+		delete(m.added[name], value)
+		if len(m.added[name]) > 0 {
+			return
+		}
+	}
+	delete(m.added, name)
+}
+
+// SetAllowedDomains ограничивает домены, для которых можно менять записи;
+// можно вызывать на ходу при перечитывании списка
+func (m *RecordManager) SetAllowedDomains(acl *DomainACL) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.allowed = acl
+}
+
+// CheckAllowed проверяет, можно ли менять запись с этим именем
+func (m *RecordManager) CheckAllowed(name string) error {
+	if IsHostedKey(storageKey(name)) {
+		// пространство постоянных записей меняется только через HostedRecords
+		return ErrDomainNotAllowed
+	}
+	m.mutex.RLock()
+	allowed := m.allowed
+	m.mutex.RUnlock()
+	if allowed != nil && !allowed.Allows(name) {
+		return ErrDomainNotAllowed
+	}
+	return nil
+}
+
+// SetZones ограничивает изменения зонами -zone и их клиентами; вызывается до начала обслуживания
+func (m *RecordManager) SetZones(z *Zones) {
+	m.zones = z
+}
+
+// SetTenants разделяет записи по пространствам имен заказчиков; вызывается до начала
+// обслуживания, сами заказчики меняются через Tenants.Replace
+func (m *RecordManager) SetTenants(t *Tenants) {
+	m.tenants = t
+	if m.quota != nil {
+		m.quota.tenants = t
+	}
+}
+
+// checkChange - CheckAllowed, граница зон и пространств заказчиков для изменения от src
+func (m *RecordManager) checkChange(src Source, name string) error {
+	if err := m.CheckAllowed(name); err != nil {
+		return err
+	}
+	if err := m.zones.check(src, name); err != nil {
+		return err
+	}
+	return m.tenants.check(src, name)
+}
+
+// SetQuota включает лимиты числа записей; вызывается до начала обслуживания
+func (m *RecordManager) SetQuota(q *RecordQuota) {
+	m.quota = q
+	if q != nil {
+		q.tenants = m.tenants
+	}
+}
+
+// Usage возвращает число значений клиента или заказчика и его лимит (0 - без лимита);
+// без SetQuota значения не учитываются
+func (m *RecordManager) Usage(owner string) (int, int) {
+	if m.quota == nil {
+		return 0, 0
+	}
+	return m.quota.Usage(owner)
+}
+
+// Observe подписывает наблюдателя на изменения
+func (m *RecordManager) Observe(o RecordObserver) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.observers = append(m.observers, o)
+}
+
+// Add добавляет значение к записи, не трогая другие значения того же имени
+func (m *RecordManager) Add(src Source, name, value string) error {
+	return m.AddIf(context.Background(), src, name, value, nil, Condition{})
+}
+
+// AddWithTTL добавляет запись с собственным TTL вместо TTL по умолчанию
+func (m *RecordManager) AddWithTTL(src Source, name, value string, ttl uint32) error {
+	return m.AddIf(context.Background(), src, name, value, &ttl, Condition{})
+}
+
+// AddIf добавляет запись, если выполнено условие; ttl nil - TTL по умолчанию.
+// ctx ограничивает ожидание других изменений и хранилища
+func (m *RecordManager) AddIf(ctx context.Context, src Source, name, value string, ttl *uint32, cond Condition) error {
+	if err := m.checkChange(src, name); err != nil {
+		log.Printf("Rejected add of %s from %s: %v", name, src, err)
+		return err
+	}
+	if err := m.rateLimit.allow(ctx, src, 1); err != nil {
+		log.Printf("Rejected add of %s from %s: %v", name, src, err)
+		return err
+	}
+	if err := m.beforeChange(ctx, src, false, name, value); err != nil {
+		return err
+	}
+	unlock, err := m.names.lock(ctx, name)
+	if err == nil {
+		var release func()
+		release, err = m.quota.reserve(m.tenants.quotaOwner(src.Identity), []BatchChange{{Name: name, Value: value}})
+		if err == nil {
+			if err = m.write(ctx, false, name, value, cond); err != nil {
+				release()
+			}
+		}
+		unlock()
+	}
+	if err != nil {
+		log.Printf("Failed to add %s from %s: %v", name, src, err)
+		return err
+	}
+	m.cancelRemoval(name, value)
+	m.mutex.Lock()
+	m.valueAdded(name, value, ttl, src.RequestID)
+	m.mutex.Unlock()
+	for _, o := range m.snapshotObservers() {
+		o.RecordAdded(src, name, value)
+	}
+	return nil
+}
+
+// Remove удаляет одно значение записи, другие значения имени остаются;
+// пустое value удаляет все значения
+func (m *RecordManager) Remove(src Source, name, value string) error {
+	return m.RemoveIf(context.Background(), src, name, value, Condition{})
+}
+
+// RemoveIf удаляет значение, если выполнено условие; удаление отсутствующей записи - успех.
+// С SetRemoveDelay запись удаляется не сразу, а по истечении задержки
+func (m *RecordManager) RemoveIf(ctx context.Context, src Source, name, value string, cond Condition) error {
+	if err := m.checkChange(src, name); err != nil {
+		log.Printf("Rejected remove of %s from %s: %v", name, src, err)
+		return err
+	}
+	if err := m.rateLimit.allow(ctx, src, 1); err != nil {
+		log.Printf("Rejected remove of %s from %s: %v", name, src, err)
+		return err
+	}
+	if err := m.beforeChange(ctx, src, true, name, value); err != nil {
+		return err
+	}
+	if m.removeDelay > 0 {
+		return m.scheduleRemove(ctx, src, name, value, cond)
+	}
+	return m.remove(ctx, src, name, value, cond)
+}
+
+// remove удаляет значение из хранилища сразу
+func (m *RecordManager) remove(ctx context.Context, src Source, name, value string, cond Condition) error {
+	unlock, err := m.names.lock(ctx, name)
+	if err == nil {
+		err = m.write(ctx, true, name, value, cond)
+		if err == nil {
+			m.quota.removed(name, value)
+		}
+		unlock()
+	}
+	if err != nil {
+		log.Printf("Failed to remove %s from %s: %v", name, src, err)
+		return err
+	}
+	m.mutex.Lock()
+	m.valueRemoved(name, value)
+	m.mutex.Unlock()
+	for _, o := range m.snapshotObservers() {
+		o.RecordRemoved(src, name, value)
+	}
+	return nil
+}
+
+// ExpireInterface - Source.Interface удалений, которые сделал не клиент, а уборка забытых записей
+const ExpireInterface = "expire"
+
+// Expired сообщает наблюдателям о значении, удаленном из хранилища в обход RecordManager
+// (уборка -k8s-record-max-age), и освобождает его место в лимитах
+func (m *RecordManager) Expired(name, value string) {
+	m.quota.removed(name, value)
+	m.mutex.Lock()
+	m.valueRemoved(name, value)
+	m.mutex.Unlock()
+	for _, o := range m.snapshotObservers() {
+		o.RecordRemoved(Source{Interface: ExpireInterface}, name, value)
+	}
+}
+
+// write меняет запись в хранилище, если выполнено условие; вызывается под блокировкой имени.
+// Общее хранилище (ConditionalStorage) проверяет условие само, вместе с записью
+func (m *RecordManager) write(ctx context.Context, remove bool, name, value string, cond Condition) error {
+	key := storageKey(name)
+	if cond == (Condition{}) {
+		if remove {
+			return removeTXTValue(ctx, m.storage, key, value)
+		}
+		return addTXTValue(ctx, m.storage, key, value)
+	}
+	return updateTXTValue(ctx, m.storage, key, value, remove, func(current []string) error {
+		return cond.check(remove, value, current)
+	})
+}
+
+// Values возвращает значения записи; ошибка хранилища логируется и считается отсутствием записи
+func (m *RecordManager) Values(name string) []string {
+	values, err := m.ValuesContext(context.Background(), name)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", name, err)
+	}
+	return values
+}
+
+// ValuesContext - Values, но ждет хранилище не дольше ctx: ошибка возвращается, только если
+// истек ctx или таймаут хранилища, другие ошибки логируются и считаются отсутствием записи
+func (m *RecordManager) ValuesContext(ctx context.Context, name string) ([]string, error) {
+	values, err := getTXTValues(ctx, m.storage, storageKey(name))
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		log.Printf("Failed to read %s: %v", name, err)
+		return nil, nil
+	}
+	return values, nil
+}
+
+// Check проверяет, что хранилище отвечает: читает заведомо отсутствующую запись
+func (m *RecordManager) Check(ctx context.Context) error {
+	_, err := getTXTValues(ctx, m.storage, storageKey("_health-check.invalid."))
+	return err
+}
+
+func (m *RecordManager) snapshotObservers() []RecordObserver {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]RecordObserver(nil), m.observers...)
+}
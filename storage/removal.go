@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"dns-acme-server/metrics"
+)
+
+var pendingRemovals = metrics.Default.NewGaugeVec("dns_acme_pending_removals",
+	"Removed records still served until -remove-delay expires")
+
+// removalKey - имя (NormalizeDomain) и значение отложенного удаления
+type removalKey struct {
+	name, value string
+}
+
+// pendingRemoval - удаление, ждущее истечения задержки
+type pendingRemoval struct {
+	src   Source
+	name  string
+	cond  Condition
+	timer *time.Timer
+}
+
+// SetRemoveDelay откладывает удаления: запись помечается удаленной, но отдается еще delay,
+// потому что некоторые CA повторяют проверку с других точек уже после очистки клиентом.
+// Добавление того же значения за это время отменяет удаление. Вызывается до начала обслуживания
+func (m *RecordManager) SetRemoveDelay(delay time.Duration) {
+	m.removeDelay = delay
+}
+
+// scheduleRemove проверяет условие сразу, чтобы клиент получил отказ, а удаляет позже
+func (m *RecordManager) scheduleRemove(ctx context.Context, src Source, name, value string, cond Condition) error {
+	unlock, err := m.names.lock(ctx, name)
+	if err == nil {
+		var current []string
+		if current, err = getTXTValues(ctx, m.storage, storageKey(name)); err == nil {
+			err = cond.check(true, value, current)
+		}
+		unlock()
+	}
+	if err != nil {
+		log.Printf("Failed to remove %s from %s: %v", name, src, err)
+		return err
+	}
+
+	key := removalKey{NormalizeDomain(name), value}
+	p := &pendingRemoval{src: src, name: name, cond: cond}
+	m.mutex.Lock()
+	if old, ok := m.removals[key]; ok {
+		old.timer.Stop()
+	}
+	m.removals[key] = p
+	p.timer = time.AfterFunc(m.removeDelay, func() { m.finishRemoval(key, p) })
+	pendingRemovals.Set(float64(len(m.removals)))
+	m.mutex.Unlock()
+	log.Printf("Removal of %s from %s delayed by %v", name, src, m.removeDelay)
+	return nil
+}
+
+// finishRemoval удаляет запись по истечении задержки, если удаление не отменено
+func (m *RecordManager) finishRemoval(key removalKey, p *pendingRemoval) {
+	m.mutex.Lock()
+	if m.removals[key] != p {
+		m.mutex.Unlock()
+		return
+	}
+	delete(m.removals, key)
+	pendingRemovals.Set(float64(len(m.removals)))
+	m.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryAttemptTimeout)
+	defer cancel()
+	// ошибку уже записал remove; запись остается, как при неудачном удалении клиентом
+	m.remove(ctx, p.src, p.name, key.value, p.cond)
+}
+
+// cancelRemoval отменяет отложенные удаления значения и всего имени после нового добавления:
+// клиент снова публикует запись, и она не должна пропасть по старому удалению
+func (m *RecordManager) cancelRemoval(name, value string) {
+	name = NormalizeDomain(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, key := range []removalKey{{name, value}, {name, ""}} {
+		if p, ok := m.removals[key]; ok {
+			p.timer.Stop()
+			delete(m.removals, key)
+			log.Printf("Delayed removal of %s canceled by a new add", p.name)
+		}
+	}
+	pendingRemovals.Set(float64(len(m.removals)))
+}
+
+// FlushRemovals сразу выполняет отложенные удаления; вызывается при остановке, чтобы
+// записи не остались в общем хранилище навсегда. Ошибка - сколько удалений не удалось
+// и последняя причина, каждое из них уже записано в журнал
+func (m *RecordManager) FlushRemovals() error {
+	m.mutex.Lock()
+	pending := m.removals
+	m.removals = make(map[removalKey]*pendingRemoval)
+	pendingRemovals.Set(0)
+	m.mutex.Unlock()
+	failed := 0
+	var lastErr error
+	for key, p := range pending {
+		// сработавший таймер уже не найдет удаление в m.removals
+		p.timer.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), retryAttemptTimeout)
+		if err := m.remove(ctx, p.src, p.name, key.value, p.cond); err != nil {
+			failed++
+			lastErr = err
+		}
+		cancel()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d delayed removals failed: %w", failed, len(pending), lastErr)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"dns-acme-server/metrics"
+)
+
+var (
+	retryQueueLength = metrics.Default.NewGaugeVec("dns_acme_retry_queue_length",
+		"Record changes waiting in the retry queue for the storage to come back")
+	retryChanges = metrics.Default.NewCounterVec("dns_acme_retry_queue_changes_total",
+		"Record changes passed through the retry queue by result (queued, applied, dropped).", "result")
+)
+
+const (
+	retryMinDelay       = time.Second
+	retryMaxDelay       = 5 * time.Minute
+	retryAttemptTimeout = 30 * time.Second
+)
+
+// RecordChange - одно изменение записи со всеми параметрами, чтобы его можно было
+// отложить и повторить позже от имени того же клиента
+type RecordChange struct {
+	Source    Source    `json:"source"`
+	Name      string    `json:"name"`
+	Value     string    `json:"value,omitempty"`
+	Remove    bool      `json:"remove,omitempty"`
+	TTL       *uint32   `json:"ttl,omitempty"`
+	Condition Condition `json:"condition"`
+}
+
+// Apply выполняет изменение через RecordManager
+func (c RecordChange) Apply(ctx context.Context, m *RecordManager) error {
+	if c.Remove {
+		return m.RemoveIf(ctx, c.Source, c.Name, c.Value, c.Condition)
+	}
+	return m.AddIf(ctx, c.Source, c.Name, c.Value, c.TTL, c.Condition)
+}
+
+// Retryable - ошибка временная (хранилище недоступно или не ответило вовремя) и изменение
+// стоит повторить; отказы по правилам (ACL, лимиты, условие, read-only) окончательные
+func Retryable(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, ErrDomainNotAllowed),
+		errors.Is(err, ErrConflict),
+		errors.Is(err, ErrQuotaExceeded),
+		errors.Is(err, ErrRateLimited),
+		errors.Is(err, ErrRejectedByHook),
+		errors.Is(err, ErrStorageFull),
+		errors.Is(err, ErrReadOnly):
+		return false
+	}
+	return true
+}
+
+// pendingChange - изменение в очереди
+type pendingChange struct {
+	RecordChange
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// RetryQueue - очередь изменений, которые не удалось записать из-за недоступного хранилища.
+// Очередь хранится в локальном файле и переживает перезапуск; изменения повторяются строго
+// по порядку с экспоненциальной задержкой, пока хранилище не ответит
+type RetryQueue struct {
+	records *RecordManager
+	path    string
+	maxAge  time.Duration // 0 - изменения не устаревают
+
+	mutex   sync.Mutex
+	pending []pendingChange
+	wake    chan struct{}
+}
+
+// NewRetryQueue открывает очередь в файле path (отложенные до перезапуска изменения
+// продолжают повторяться). Изменения старше maxAge отбрасываются: ACME авторизация,
+// для которой публиковалась запись, к тому времени уже истекла
+func NewRetryQueue(records *RecordManager, path string, maxAge time.Duration) (*RetryQueue, error) {
+	q := &RetryQueue{records: records, path: path, maxAge: maxAge, wake: make(chan struct{}, 1)}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &q.pending); err != nil {
+			return nil, fmt.Errorf("retry queue %s: %w", path, err)
+		}
+	}
+	if len(q.pending) > 0 {
+		log.Printf("Retry queue %s: %d pending changes", path, len(q.pending))
+	}
+	retryQueueLength.Set(float64(len(q.pending)))
+	return q, nil
+}
+
+// Enqueue откладывает изменение; очередь сохраняется на диск до возврата
+func (q *RetryQueue) Enqueue(c RecordChange) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = append(q.pending, pendingChange{RecordChange: c, Queued: time.Now()})
+	if err := q.save(); err != nil {
+		q.pending = q.pending[:len(q.pending)-1]
+		return err
+	}
+	retryChanges.Inc("queued")
+	retryQueueLength.Set(float64(len(q.pending)))
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending - есть ли отложенные изменения имени: новые изменения этого имени тоже
+// откладываются, иначе удаление обгонит отложенное добавление
+func (q *RetryQueue) Pending(name string) bool {
+	name = NormalizeDomain(name)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, c := range q.pending {
+		if NormalizeDomain(c.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Len - число отложенных изменений
+func (q *RetryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.pending)
+}
+
+// Run повторяет отложенные изменения, пока не закрыт stop: после неудачи задержка
+// удваивается от секунды до 5 минут, после успеха сбрасывается
+func (q *RetryQueue) Run(stop <-chan struct{}) {
+	delay := retryMinDelay
+	for {
+		if q.Len() == 0 {
+			select {
+			case <-stop:
+				return
+			case <-q.wake:
+			}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if q.retry() {
+			delay = retryMinDelay
+			continue
+		}
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// retry применяет изменения по порядку до первой временной ошибки;
+// false - хранилище все еще недоступно
+func (q *RetryQueue) retry() bool {
+	for {
+		q.mutex.Lock()
+		if len(q.pending) == 0 {
+			q.mutex.Unlock()
+			return true
+		}
+		c := q.pending[0]
+		q.mutex.Unlock()
+
+		result := "applied"
+		if q.maxAge > 0 && time.Since(c.Queued) > q.maxAge {
+			result = "dropped"
+			log.Printf("Dropped queued change of %s after %d attempts: older than %v", c.Name, c.Attempts, q.maxAge)
+		} else {
+			// изменение уже прошло лимит частоты, когда его поставили в очередь
+			ctx, cancel := context.WithTimeout(withoutRateLimit(context.Background()), retryAttemptTimeout)
+			err := c.Apply(ctx, q.records)
+			cancel()
+			switch {
+			case Retryable(err):
+				q.mutex.Lock()
+				q.pending[0].Attempts++
+				q.pending[0].LastError = err.Error()
+				if err := q.save(); err != nil {
+					log.Printf("Failed to save retry queue: %v", err)
+				}
+				q.mutex.Unlock()
+				log.Printf("Retry of queued change of %s failed (attempt %d): %v", c.Name, c.Attempts+1, err)
+				return false
+			case err != nil:
+				result = "dropped"
+				log.Printf("Dropped queued change of %s: %v", c.Name, err)
+			default:
+				log.Printf("Queued change of %s applied after %v", c.Name, time.Since(c.Queued).Round(time.Second))
+			}
+		}
+
+		q.mutex.Lock()
+		q.pending = q.pending[1:]
+		if err := q.save(); err != nil {
+			log.Printf("Failed to save retry queue: %v", err)
+		}
+		retryQueueLength.Set(float64(len(q.pending)))
+		q.mutex.Unlock()
+		retryChanges.Inc(result)
+	}
+}
+
+// save атомарно записывает очередь в файл; вызывается под q.mutex
+func (q *RetryQueue) save() error {
+	data, err := json.Marshal(q.pending)
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion - версия формата Snapshot
+const SnapshotVersion = 1
+
+// ErrNotListable - хранилище не умеет перечислять записи, экспорт невозможен
+var ErrNotListable = errors.New("storage backend cannot list records")
+
+// Lister - хранилище, которое умеет перечислить все записи; нужно для экспорта
+type Lister interface {
+	// ListTXTValues возвращает все записи: ключ хранилища -> значения в порядке добавления
+	ListTXTValues() (map[string][]string, error)
+}
+
+// Snapshot - все записи демона для переноса между хранилищами и хостами
+type Snapshot struct {
+	Version int              `json:"version"`
+	Created time.Time        `json:"created"`
+	Records []SnapshotRecord `json:"records"` // challenge записи
+	Hosted  []HostedRecord   `json:"hosted"`  // постоянные записи
+}
+
+// SnapshotRecord - challenge запись со всеми значениями
+type SnapshotRecord struct {
+	FQDN   string   `json:"fqdn"`
+	Values []string `json:"values"`
+	TTL    *uint32  `json:"ttl,omitempty"` // TTL, заданный при добавлении (ACME_TTL); нет - TTL по умолчанию
+}
+
+// SnapshotResult - сколько значений восстановлено и сколько удалено при замене
+type SnapshotResult struct {
+	Restored int `json:"restored"`
+	Removed  int `json:"removed"`
+}
+
+// ExportSnapshot собирает все challenge и постоянные записи (hosted nil - только challenge)
+func ExportSnapshot(records *RecordManager, hosted *HostedRecords) (*Snapshot, error) {
+	lister, ok := records.storage.(Lister)
+	if !ok {
+		return nil, ErrNotListable
+	}
+	all, err := lister.ListTXTValues()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{Version: SnapshotVersion, Created: time.Now().UTC(), Records: []SnapshotRecord{}}
+	for key, values := range all {
+		if IsHostedKey(key) || len(values) == 0 {
+			continue
+		}
+		record := SnapshotRecord{FQDN: key, Values: values}
+		if ttl, ok := records.explicitTTL(key); ok {
+			record.TTL = &ttl
+		}
+		snap.Records = append(snap.Records, record)
+	}
+	sort.Slice(snap.Records, func(i, j int) bool { return snap.Records[i].FQDN < snap.Records[j].FQDN })
+	snap.Hosted = []HostedRecord{}
+	if hosted != nil {
+		if snap.Hosted, err = hosted.List(""); err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+// ImportSnapshot восстанавливает записи snap через RecordManager и HostedRecords, то есть
+// с проверкой доменов, квот и уведомлением наблюдателей. Уже существующие значения не
+// меняются; replace удаляет записи, которых нет в snap. Повторный импорт ничего не меняет.
+func ImportSnapshot(ctx context.Context, src Source, records *RecordManager, hosted *HostedRecords, snap *Snapshot, replace bool) (SnapshotResult, error) {
+	var result SnapshotResult
+	if snap.Version != SnapshotVersion {
+		return result, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	if replace {
+		current, err := ExportSnapshot(records, hosted)
+		if err != nil {
+			return result, err
+		}
+		keep := make(map[[2]string]bool)
+		for _, r := range snap.Records {
+			for _, value := range r.Values {
+				keep[[2]string{storageKey(r.FQDN), value}] = true
+			}
+		}
+		keepHosted := make(map[[2]string]bool)
+		for _, r := range snap.Hosted {
+			keepHosted[[2]string{storageKey(r.FQDN), r.Value}] = true
+		}
+		for _, r := range current.Records {
+			for _, value := range r.Values {
+				if keep[[2]string{r.FQDN, value}] {
+					continue
+				}
+				// без -remove-delay: замена снимком - не очистка после проверки
+				err := records.CheckAllowed(r.FQDN)
+				if err == nil {
+					err = records.remove(ctx, src, r.FQDN, value, Condition{})
+				}
+				if err != nil {
+					return result, fmt.Errorf("remove %s: %w", r.FQDN, err)
+				}
+				result.Removed++
+			}
+		}
+		for _, r := range current.Hosted {
+			if keepHosted[[2]string{storageKey(r.FQDN), r.Value}] {
+				continue
+			}
+			if err := hosted.Remove(ctx, src, r.FQDN, r.Value); err != nil {
+				return result, fmt.Errorf("remove %s: %w", r.FQDN, err)
+			}
+			result.Removed++
+		}
+	}
+	for _, r := range snap.Records {
+		for _, value := range r.Values {
+			if err := records.AddIf(ctx, src, r.FQDN, value, r.TTL, Condition{}); err != nil {
+				return result, fmt.Errorf("restore %s: %w", r.FQDN, err)
+			}
+			result.Restored++
+		}
+	}
+	for _, r := range snap.Hosted {
+		if err := hosted.Set(ctx, src, r.FQDN, r.Value, r.TTL); err != nil {
+			return result, fmt.Errorf("restore %s: %w", r.FQDN, err)
+		}
+		result.Restored++
+	}
+	return result, nil
+}
+
+func (s *Memory) ListTXTValues() (map[string][]string, error) {
+	all := make(map[string][]string)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.RLock()
+		for name, values := range shard.records {
+			all[name] = append([]string(nil), values...)
+		}
+		shard.mutex.RUnlock()
+	}
+	return all, nil
+}
+
+func (s *SQL) ListTXTValues() (map[string][]string, error) {
+	rows, err := s.db.Query(`SELECT name, value FROM txt_values ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("list TXT records: %w", err)
+	}
+	defer rows.Close()
+	all := make(map[string][]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("list TXT records: %w", err)
+		}
+		all[name] = append(all[name], value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list TXT records: %w", err)
+	}
+	return all, nil
+}
+
+func (s *Instrumented) ListTXTValues() (map[string][]string, error) {
+	lister, ok := s.next.(Lister)
+	if !ok {
+		return nil, ErrNotListable
+	}
+	started := time.Now()
+	all, err := lister.ListTXTValues()
+	s.observe("list", started, err)
+	return all, err
+}
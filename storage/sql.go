@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sqlDialect - различия SQL диалектов, которые нужны хранилищу SQL.
+// Диалекты регистрируются в своих файлах (sql_sqlite.go и т.п.); все драйверы на чистом Go,
+// поэтому собираются в обычный бинарник с CGO_ENABLED=0.
+type sqlDialect struct {
+	driver string
+	// rebind переводит запрос с плейсхолдерами ? в синтаксис диалекта
+	rebind func(query string) string
+	// init выполняется при каждом открытии базы (PRAGMA и т.п.)
+	init []string
+	// migrations - схема по версиям, начиная с 1, инструкции через ";"; уже примененные
+	// версии не меняются
+	migrations []string
+	// insert - вставка значения txt_values(name, value, updated_at), если такой пары еще нет
+	insert string
+	// maxConns ограничивает пул соединений (0 - без ограничения)
+	maxConns int
+	// dsn дополняет строку подключения параметрами диалекта (nil - как есть)
+	dsn func(dsn string) string
+	// lock берет на соединении именованную блокировку, общую для всех реплик с этой базой
+	// (миграции, условное изменение записи), и возвращает ее снятие; nil - блокировку дает
+	// сама транзакция (SQLite пишет транзакции по одной, BEGIN IMMEDIATE)
+	lock func(ctx context.Context, conn *sql.Conn, key string) (unlock func(), err error)
+}
+
+// lockID - 64-битный ключ блокировки для pg_advisory_lock и GET_LOCK (имя до 64 символов)
+func lockID(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte("dns-acme-server " + key))
+	return h.Sum64()
+}
+
+// migrationLockTimeout - сколько реплика ждет, пока другая применяет миграции
+const migrationLockTimeout = 5 * time.Minute
+
+var sqlDialects = map[string]*sqlDialect{}
+
+func registerSQLDialect(name string, d *sqlDialect) {
+	sqlDialects[name] = d
+}
+
+// HistoryEntry - одно изменение записи в истории SQL хранилища
+type HistoryEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // set или clear (clear без value - удалены все значения)
+	FQDN   string    `json:"fqdn"`
+	Value  string    `json:"value,omitempty"`
+}
+
+// SQLPool - ограничения пула соединений к базе
+type SQLPool struct {
+	MaxOpen     int           // 0 - без ограничения
+	MaxIdle     int           // 0 - по умолчанию database/sql (2)
+	MaxLifetime time.Duration // 0 - соединения не пересоздаются
+}
+
+// SQL хранит TXT записи в SQL базе: данные переживают перезапуск,
+// а каждое изменение дописывается в таблицу txt_history. С PostgreSQL/MySQL
+// одну базу могут использовать несколько реплик демона.
+type SQL struct {
+	db      *sql.DB
+	dialect *sqlDialect
+
+	// подготовленные запросы горячего пути
+	get         *sql.Stmt
+	insert      *sql.Stmt
+	deleteValue *sql.Stmt
+	deleteAll   *sql.Stmt
+	history     *sql.Stmt
+}
+
+// OpenSQL открывает базу выбранного диалекта и применяет недостающие миграции
+func OpenSQL(dialect, dsn string, pool SQLPool) (*SQL, error) {
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL storage %q, this build supports %s", dialect, Backends())
+	}
+	if d.dsn != nil {
+		dsn = d.dsn(dsn)
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d.maxConns > 0 {
+		pool.MaxOpen = d.maxConns
+	}
+	db.SetMaxOpenConns(pool.MaxOpen)
+	if pool.MaxIdle > 0 {
+		db.SetMaxIdleConns(pool.MaxIdle)
+	}
+	db.SetConnMaxLifetime(pool.MaxLifetime)
+
+	s := &SQL{db: db, dialect: d}
+	if err := s.open(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQL) open() error {
+	for _, stmt := range s.dialect.init {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	if err := s.migrate(); err != nil {
+		return err
+	}
+
+	var err error
+	prepare := func(query string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		if stmt, err = s.db.Prepare(s.dialect.rebind(query)); err != nil {
+			err = fmt.Errorf("prepare %q: %w", query, err)
+		}
+		return stmt
+	}
+	s.get = prepare(`SELECT value FROM txt_values WHERE name = ? ORDER BY id`)
+	s.insert = prepare(s.dialect.insert)
+	s.deleteValue = prepare(`DELETE FROM txt_values WHERE name = ? AND value = ?`)
+	s.deleteAll = prepare(`DELETE FROM txt_values WHERE name = ?`)
+	s.history = prepare(`INSERT INTO txt_history (name, action, value, at) VALUES (?, ?, ?, ?)`)
+	return err
+}
+
+// migrate применяет миграции, которых еще нет в schema_migrations, каждую в своей транзакции.
+// Реплики, одновременно открывающие общую базу, применяют их по очереди: под блокировкой
+// диалекта версия схемы перечитывается в транзакции каждой миграции.
+func (s *SQL) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationLockTimeout)
+	defer cancel()
+	return s.withLock(ctx, "migrations", func(conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+			return fmt.Errorf("create schema_migrations: %w", err)
+		}
+		for {
+			version, err := s.migrateNext(ctx, conn)
+			if err != nil || version == 0 {
+				return err
+			}
+			log.Printf("Applied storage migration %d", version)
+		}
+	})
+}
+
+// migrateNext применяет первую недостающую миграцию и возвращает ее версию, 0 - схема последняя
+func (s *SQL) migrateNext(ctx context.Context, conn *sql.Conn) (int, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var current sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	version := int(current.Int64) + 1
+	if version > len(s.dialect.migrations) {
+		return 0, nil
+	}
+	for _, stmt := range splitStatements(s.dialect.migrations[version-1]) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return 0, fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+		return 0, fmt.Errorf("migration %d: %w", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("migration %d: %w", version, err)
+	}
+	return version, nil
+}
+
+// splitStatements делит миграцию на инструкции по ";"; в наших миграциях ";" внутри строк нет
+func splitStatements(migration string) []string {
+	var result []string
+	for _, stmt := range strings.Split(migration, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			result = append(result, stmt)
+		}
+	}
+	return result
+}
+
+func (s *SQL) AddTXTValue(name, value string) error {
+	return s.AddTXTValueContext(context.Background(), name, value)
+}
+
+func (s *SQL) AddTXTValueContext(ctx context.Context, name, value string) error {
+	err := s.inTx(ctx, s.db, func(tx *sql.Tx) error {
+		return s.add(ctx, tx, name, value)
+	})
+	if err != nil {
+		return fmt.Errorf("store TXT record %s: %w", name, err)
+	}
+	logChange(false, name, value)
+	return nil
+}
+
+func (s *SQL) RemoveTXTValue(name, value string) error {
+	return s.RemoveTXTValueContext(context.Background(), name, value)
+}
+
+func (s *SQL) RemoveTXTValueContext(ctx context.Context, name, value string) error {
+	err := s.inTx(ctx, s.db, func(tx *sql.Tx) error {
+		return s.remove(ctx, tx, name, value)
+	})
+	if err != nil {
+		return fmt.Errorf("remove TXT record %s: %w", name, err)
+	}
+	logChange(true, name, value)
+	return nil
+}
+
+// UpdateTXTValue проверяет и меняет запись в одной транзакции под блокировкой имени в базе
+// (pg_advisory_lock, GET_LOCK; в SQLite транзакции записи и так идут по одной), поэтому
+// реплики с общей базой не могут обе пройти проверку
+func (s *SQL) UpdateTXTValue(ctx context.Context, name, value string, remove bool, check func([]string) error) error {
+	var rejected error
+	err := s.withLock(ctx, "record "+name, func(conn *sql.Conn) error {
+		return s.inTx(ctx, conn, func(tx *sql.Tx) error {
+			current, err := scanValues(tx.StmtContext(ctx, s.get).QueryContext(ctx, name))
+			if err != nil {
+				return err
+			}
+			if rejected = check(current); rejected != nil {
+				return rejected
+			}
+			if remove {
+				return s.remove(ctx, tx, name, value)
+			}
+			return s.add(ctx, tx, name, value)
+		})
+	})
+	switch {
+	case rejected != nil:
+		return rejected
+	case err != nil && remove:
+		return fmt.Errorf("remove TXT record %s: %w", name, err)
+	case err != nil:
+		return fmt.Errorf("store TXT record %s: %w", name, err)
+	}
+	logChange(remove, name, value)
+	return nil
+}
+
+// withLock выполняет f на отдельном соединении под блокировкой диалекта key
+func (s *SQL) withLock(ctx context.Context, key string, f func(conn *sql.Conn) error) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.dialect.lock != nil {
+		unlock, err := s.dialect.lock(ctx, conn, key)
+		if err != nil {
+			return fmt.Errorf("lock %s: %w", key, err)
+		}
+		defer unlock()
+	}
+	return f(conn)
+}
+
+// add добавляет значение и строку истории в транзакции tx
+func (s *SQL) add(ctx context.Context, tx *sql.Tx, name, value string) error {
+	now := time.Now().Unix()
+	if _, err := tx.StmtContext(ctx, s.insert).ExecContext(ctx, name, value, now); err != nil {
+		return err
+	}
+	_, err := tx.StmtContext(ctx, s.history).ExecContext(ctx, name, "set", value, now)
+	return err
+}
+
+// remove удаляет значение (пустое - все значения) и пишет строку истории в транзакции tx
+func (s *SQL) remove(ctx context.Context, tx *sql.Tx, name, value string) error {
+	var err error
+	if value != "" {
+		_, err = tx.StmtContext(ctx, s.deleteValue).ExecContext(ctx, name, value)
+	} else {
+		_, err = tx.StmtContext(ctx, s.deleteAll).ExecContext(ctx, name)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.StmtContext(ctx, s.history).ExecContext(ctx, name, "clear", value, time.Now().Unix())
+	return err
+}
+
+// logChange пишет в журнал примененное изменение
+func logChange(remove bool, name, value string) {
+	switch {
+	case !remove:
+		log.Printf("DNS TXT record added: %s -> %s", name, value)
+	case value != "":
+		log.Printf("DNS TXT record removed: %s -> %s", name, value)
+	default:
+		log.Printf("DNS TXT record removed: %s", name)
+	}
+}
+
+func (s *SQL) GetTXTValues(domain string) ([]string, error) {
+	return s.GetTXTValuesContext(context.Background(), domain)
+}
+
+func (s *SQL) GetTXTValuesContext(ctx context.Context, domain string) ([]string, error) {
+	values, err := scanValues(s.get.QueryContext(ctx, domain))
+	if err != nil {
+		return nil, fmt.Errorf("read TXT record %s: %w", domain, err)
+	}
+	return values, nil
+}
+
+// scanValues читает значения из результата запроса s.get
+func scanValues(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// History возвращает последние limit изменений записи (или всех записей, если name пустое)
+func (s *SQL) History(name string, limit int) ([]HistoryEntry, error) {
+	query := `SELECT name, action, value, at FROM txt_history`
+	var args []interface{}
+	if name != "" {
+		query += ` WHERE name = ?`
+		args = append(args, storageKey(name))
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		var at int64
+		if err := rows.Scan(&e.FQDN, &e.Action, &e.Value, &at); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(at, 0).UTC()
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+// txBeginner - *sql.DB или *sql.Conn, на котором держится блокировка
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func (s *SQL) inTx(ctx context.Context, db txBeginner, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Backends перечисляет доступные в этой сборке хранилища для справки по флагу
+func Backends() string {
+	names := []string{"memory"}
+	for name := range sqlDialects {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return strings.Join(names, ", ")
+}
+
+// questionRebind - плейсхолдеры ? как есть (SQLite, MySQL)
+func questionRebind(query string) string {
+	return query
+}
+
+// dollarRebind заменяет ? на $1, $2, ... (PostgreSQL); в наших запросах ? внутри строк нет
+func dollarRebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // драйвер "mysql"
+)
+
+func init() {
+	registerSQLDialect("mysql", &sqlDialect{
+		driver: "mysql",
+		rebind: questionRebind,
+		lock:   mysqlLock,
+		// DDL в MySQL фиксируется сразу, транзакция миграции его не откатывает: каждая инструкция
+		// должна повторяться без ошибки после прерванной на середине миграции
+		migrations: []string{
+			// 1: текущие записи и история изменений; имя DNS не длиннее 253 символов
+			`CREATE TABLE IF NOT EXISTS txt_records (
+				name       VARCHAR(255) NOT NULL PRIMARY KEY,
+				value      TEXT NOT NULL,
+				updated_at BIGINT NOT NULL
+			) CHARACTER SET ascii COLLATE ascii_bin;
+			CREATE TABLE IF NOT EXISTS txt_history (
+				id     BIGINT AUTO_INCREMENT PRIMARY KEY,
+				name   VARCHAR(255) NOT NULL,
+				action VARCHAR(16) NOT NULL,
+				value  TEXT NOT NULL,
+				at     BIGINT NOT NULL,
+				INDEX txt_history_name_idx (name, id)
+			) CHARACTER SET ascii COLLATE ascii_bin`,
+			// 2: несколько значений на имя - каждая пара имя/значение отдельной строкой;
+			// значение VARCHAR, чтобы попасть в уникальный индекс (ACME значения - 43 символа)
+			`CREATE TABLE IF NOT EXISTS txt_values (
+				id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+				name       VARCHAR(255) NOT NULL,
+				value      VARCHAR(1024) NOT NULL,
+				updated_at BIGINT NOT NULL,
+				UNIQUE INDEX txt_values_name_value_idx (name, value)
+			) CHARACTER SET ascii COLLATE ascii_bin;
+			CREATE TABLE IF NOT EXISTS txt_records (
+				name       VARCHAR(255) NOT NULL PRIMARY KEY,
+				value      TEXT NOT NULL,
+				updated_at BIGINT NOT NULL
+			) CHARACTER SET ascii COLLATE ascii_bin;
+			INSERT IGNORE INTO txt_values (name, value, updated_at) SELECT name, value, updated_at FROM txt_records;
+			DROP TABLE IF EXISTS txt_records`,
+		},
+		insert: `INSERT INTO txt_values (name, value, updated_at) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE updated_at = updated_at`,
+	})
+}
+
+// mysqlLock берет именованную блокировку соединения, как pg_advisory_lock в PostgreSQL:
+// GET_LOCK ждет до срока ctx (без него - migrationLockTimeout) и снимается с закрытием сессии
+func mysqlLock(ctx context.Context, conn *sql.Conn, key string) (func(), error) {
+	name := fmt.Sprintf("dns_acme_%016x", lockID(key))
+	wait := migrationLockTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+	}
+	seconds := int(wait / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	var taken sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, name, seconds).Scan(&taken); err != nil {
+		return nil, err
+	}
+	if taken.Int64 != 1 {
+		return nil, errors.New("timed out waiting for another replica")
+	}
+	return func() {
+		conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, name)
+	}, nil
+}
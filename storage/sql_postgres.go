@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/jackc/pgx/v4/stdlib" // драйвер "pgx"
+)
+
+func init() {
+	registerSQLDialect("postgres", &sqlDialect{
+		driver: "pgx",
+		rebind: dollarRebind,
+		lock:   postgresLock,
+		migrations: []string{
+			// 1: текущие записи и история изменений; name - нормализованное (нижний регистр) имя
+			`CREATE TABLE txt_records (
+				name       TEXT PRIMARY KEY,
+				value      TEXT NOT NULL,
+				updated_at BIGINT NOT NULL
+			);
+			CREATE TABLE txt_history (
+				id     BIGSERIAL PRIMARY KEY,
+				name   TEXT NOT NULL,
+				action TEXT NOT NULL,
+				value  TEXT NOT NULL,
+				at     BIGINT NOT NULL
+			);
+			CREATE INDEX txt_history_name_idx ON txt_history (name, id)`,
+			// 2: несколько значений на имя - каждая пара имя/значение отдельной строкой
+			`CREATE TABLE txt_values (
+				id         BIGSERIAL PRIMARY KEY,
+				name       TEXT NOT NULL,
+				value      TEXT NOT NULL,
+				updated_at BIGINT NOT NULL,
+				UNIQUE (name, value)
+			);
+			INSERT INTO txt_values (name, value, updated_at) SELECT name, value, updated_at FROM txt_records;
+			DROP TABLE txt_records`,
+		},
+		insert: `INSERT INTO txt_values (name, value, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT (name, value) DO NOTHING`,
+	})
+}
+
+// postgresLock берет сессионную advisory блокировку: ее держит соединение, а если реплика
+// упадет, не сняв ее, PostgreSQL снимет ее вместе с сессией
+func postgresLock(ctx context.Context, conn *sql.Conn, key string) (func(), error) {
+	id := int64(lockID(key))
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, id); err != nil {
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, id)
+	}, nil
+}
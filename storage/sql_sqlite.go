@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"strings"
+
+	_ "modernc.org/sqlite" // драйвер "sqlite" на Go, собирается без тега и без CGO
+)
+
+func init() {
+	registerSQLDialect("sqlite", &sqlDialect{
+		driver: "sqlite",
+		rebind: questionRebind,
+		// один писатель: PRAGMA действуют на соединение, а SQLite все равно сериализует запись
+		maxConns: 1,
+		dsn:      sqliteDSN,
+		init: []string{
+			`PRAGMA journal_mode = WAL`,
+			`PRAGMA synchronous = NORMAL`,
+		},
+		migrations: []string{
+			// 1: текущие записи и история изменений; name - нормализованное (нижний регистр) имя
+			`CREATE TABLE txt_records (
+				name       TEXT PRIMARY KEY,
+				value      TEXT NOT NULL,
+				updated_at INTEGER NOT NULL
+			);
+			CREATE TABLE txt_history (
+				id     INTEGER PRIMARY KEY AUTOINCREMENT,
+				name   TEXT NOT NULL,
+				action TEXT NOT NULL,
+				value  TEXT NOT NULL,
+				at     INTEGER NOT NULL
+			);
+			CREATE INDEX txt_history_name_idx ON txt_history (name, id)`,
+			// 2: несколько значений на имя - каждая пара имя/значение отдельной строкой
+			`CREATE TABLE txt_values (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				name       TEXT NOT NULL,
+				value      TEXT NOT NULL,
+				updated_at INTEGER NOT NULL,
+				UNIQUE (name, value)
+			);
+			INSERT INTO txt_values (name, value, updated_at) SELECT name, value, updated_at FROM txt_records;
+			DROP TABLE txt_records`,
+		},
+		insert: `INSERT INTO txt_values (name, value, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT (name, value) DO NOTHING`,
+	})
+}
+
+// sqliteDSN добавляет к пути базы ожидание блокировки на каждом соединении (нужно уже для
+// PRAGMA journal_mode, когда базу открывают одновременно) и BEGIN IMMEDIATE: транзакция сразу
+// берет блокировку записи, поэтому миграции процессов над одним файлом идут по очереди
+func sqliteDSN(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + "_pragma=busy_timeout(5000)&_txlock=immediate"
+}
@@ -0,0 +1,40 @@
+// Package storage хранит TXT записи ACME challenge: интерфейс хранилища,
+// реализации (память, SQL) и RecordManager - единую точку изменения записей.
+package storage
+
+import "strings"
+
+// DefaultTXTTTL - TTL отдаваемых TXT записей, если не задан -txt-ttl
+const DefaultTXTTTL = 300
+
+// MaxTTL - верхняя граница TTL (RFC 2181, 2^31-1)
+const MaxTTL = 1<<31 - 1
+
+// Storage - хранилище TXT записей, реализации должны быть потокобезопасны.
+// Имена приходят уже нормализованными (см. storageKey), сравнивать их можно как есть.
+// У одного имени может быть несколько значений (параллельные выпуски сертификатов
+// для одного домена), каждая пара имя/значение хранится отдельно.
+type Storage interface {
+	// AddTXTValue добавляет значение к записи; повторное добавление того же значения ничего не меняет
+	AddTXTValue(domain, value string) error
+	// RemoveTXTValue удаляет одно значение записи, пустое value удаляет все значения
+	RemoveTXTValue(domain, value string) error
+	// GetTXTValues возвращает значения записи в порядке добавления (пусто - записи нет)
+	GetTXTValues(domain string) ([]string, error)
+}
+
+// NormalizeDomain нормализует доменное имя для сравнения: нижний регистр, IDN метки
+// в punycode, без завершающей точки. Это единственное место нормализации имен.
+func NormalizeDomain(domain string) string {
+	name := strings.ToLower(strings.TrimRight(domain, "."))
+	if !isASCII(name) {
+		name = toASCII(name)
+	}
+	return name
+}
+
+// storageKey - имя записи в хранилище: нормализованное имя с завершающей точкой,
+// в таком виде записи хранились и раньше
+func storageKey(name string) string {
+	return NormalizeDomain(name) + "."
+}
@@ -0,0 +1,1283 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com..", "example.com"},
+		{"_ACME-Challenge.ExAmPlE.CoM.", "_acme-challenge.example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example.", "xn--bcher-kva.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"_acme-challenge.münchen.de.", "_acme-challenge.xn--mnchen-3ya.de"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+		{"", ""},
+		{".", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeDomain(tt.in); got != tt.want {
+			t.Errorf("NormalizeDomain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	valid := map[string]string{
+		"example.com":           "example.com",
+		"Bücher.example.":       "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"sub.пример.рф":         "sub.xn--e1afmkfd.xn--p1ai",
+	}
+	for in, want := range valid {
+		if got, err := ToASCII(in); err != nil || got != want {
+			t.Errorf("ToASCII(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "a..b", "-a.example", "a-.example", "bad name.example", "a/b.example", strings.Repeat("a", 64) + ".example", "\xff.example"} {
+		if got, err := ToASCII(in); err == nil {
+			t.Errorf("ToASCII(%q) = %q, want error", in, got)
+		}
+	}
+}
+
+// Запись, добавленная под одним написанием имени, находится под любым другим:
+// с точкой и без, в смешанном регистре (0x20) и в виде IDN или punycode
+func TestRecordManagerNameVariants(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	if err := m.Add(Source{}, "_acme-challenge.Bücher.example", "token"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"_acme-challenge.bücher.example.",
+		"_ACME-CHALLENGE.XN--BCHER-KVA.EXAMPLE.",
+		"_aCmE-cHaLlEnGe.xn--bcher-kva.example",
+	} {
+		if values := m.Values(name); len(values) != 1 || values[0] != "token" {
+			t.Errorf("Values(%q) = %q", name, values)
+		}
+	}
+	if err := m.Remove(Source{}, "_acme-challenge.xn--bcher-kva.example.", ""); err != nil {
+		t.Fatal(err)
+	}
+	if values := m.Values("_acme-challenge.bücher.example"); len(values) != 0 {
+		t.Errorf("record still present after remove: %q", values)
+	}
+}
+
+func TestRecordManagerConcurrentValues(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	const name = "_acme-challenge.example.com"
+	for _, value := range []string{"first", "second", "first"} {
+		if err := m.Add(Source{}, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if values := m.Values(name); strings.Join(values, ",") != "first,second" {
+		t.Fatalf("Values = %q", values)
+	}
+	// очистка первого выпуска не трогает значение второго
+	if err := m.Remove(Source{}, name, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if values := m.Values(name); strings.Join(values, ",") != "second" {
+		t.Fatalf("Values after remove = %q", values)
+	}
+	if err := m.RemoveIf(context.Background(), Source{}, name, "first", Condition{Expected: "first"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("RemoveIf of a foreign value = %v, want ErrConflict", err)
+	}
+	if err := m.Remove(Source{}, name, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if values := m.Values(name); len(values) != 0 {
+		t.Errorf("Values after last remove = %q", values)
+	}
+}
+
+// TestConditions - условные add и remove (-strict-mutations, If-None-Match, If-Match):
+// конфликт, совпадение и отсутствующая запись
+func TestConditions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const name = "_acme-challenge.example.com"
+	tests := []struct {
+		name    string
+		initial []string
+		remove  bool
+		value   string
+		cond    Condition
+		wantErr error
+		want    string
+	}{
+		{name: "add to missing", value: "new", cond: Condition{IfNotExists: true}, want: "new"},
+		{name: "add same value", initial: []string{"new"}, value: "new", cond: Condition{IfNotExists: true}, want: "new"},
+		{name: "add over other value", initial: []string{"old"}, value: "new", cond: Condition{IfNotExists: true}, wantErr: ErrConflict, want: "old"},
+		{name: "add next to two values", initial: []string{"new", "old"}, value: "new", cond: Condition{IfNotExists: true}, wantErr: ErrConflict, want: "new,old"},
+		{name: "unconditional add", initial: []string{"old"}, value: "new", want: "old,new"},
+		{name: "remove matching", initial: []string{"old", "new"}, remove: true, value: "new", cond: Condition{Expected: "new"}, want: "old"},
+		{name: "remove all matching", initial: []string{"old", "new"}, remove: true, cond: Condition{Expected: "old"}, want: ""},
+		{name: "remove other value", initial: []string{"old"}, remove: true, value: "new", cond: Condition{Expected: "new"}, wantErr: ErrConflict, want: "old"},
+		{name: "remove missing", remove: true, value: "new", cond: Condition{Expected: "new"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewRecordManager(NewMemory(), "")
+			for _, v := range tt.initial {
+				if err := m.Add(Source{}, name, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var err error
+			if tt.remove {
+				err = m.RemoveIf(context.Background(), Source{}, name, tt.value, tt.cond)
+			} else {
+				err = m.AddIf(context.Background(), Source{}, name, tt.value, nil, tt.cond)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			}
+			if got := strings.Join(m.Values(name), ","); got != tt.want {
+				t.Errorf("values %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// pausedCheck задерживает запись после прошедшей проверки условия, чтобы реплики
+// гарантированно проверяли одновременно
+type pausedCheck struct {
+	Storage
+}
+
+func (s pausedCheck) UpdateTXTValue(ctx context.Context, domain, value string, remove bool, check func([]string) error) error {
+	return updateTXTValue(ctx, s.Storage, domain, value, remove, func(current []string) error {
+		if err := check(current); err != nil {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+}
+
+// TestConditionalReplicas - одновременные add с If-None-Match разных значений одного имени:
+// публикуется ровно одно. Реплики - отдельные RecordManager над общей базой SQLite,
+// проверку и запись для них делает само хранилище (ConditionalStorage)
+func TestConditionalReplicas(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	path := filepath.Join(t.TempDir(), "records.db")
+	key := make([]byte, 32)
+	replica := func(t *testing.T) *RecordManager {
+		s, err := OpenSQL("sqlite", path, SQLPool{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		encrypted, err := NewEncrypted(pausedCheck{s}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewRecordManager(NewInstrumented("sqlite", encrypted), "")
+	}
+	memory := NewRecordManager(NewMemory(), "")
+	for _, backend := range []struct {
+		name     string
+		replicas func(t *testing.T) []*RecordManager
+	}{
+		{"memory", func(t *testing.T) []*RecordManager { return []*RecordManager{memory} }},
+		{"shared sqlite", func(t *testing.T) []*RecordManager {
+			var replicas []*RecordManager
+			for i := 0; i < 12; i++ {
+				replicas = append(replicas, replica(t))
+			}
+			return replicas
+		}},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			replicas := backend.replicas(t)
+			const name = "_acme-challenge.race.example"
+			const writers = 12
+			errs := make([]error, writers)
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					m := replicas[i%len(replicas)]
+					<-start
+					errs[i] = m.AddIf(context.Background(), Source{}, name, fmt.Sprintf("value-%d", i), nil, Condition{IfNotExists: true})
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+			published := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					published++
+				case !errors.Is(err, ErrConflict):
+					t.Errorf("add failed: %v", err)
+				}
+			}
+			values := replicas[0].Values(name)
+			if published != 1 || len(values) != 1 {
+				t.Errorf("%d adds succeeded, values %q; want exactly one", published, values)
+			}
+		})
+	}
+}
+
+// slowStorage держит первую запись имени slow, пока не закрыт release
+type slowStorage struct {
+	*Memory
+	slow    string
+	once    *sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s slowStorage) AddTXTValue(domain, value string) error {
+	if domain == s.slow {
+		s.once.Do(func() {
+			close(s.started)
+			<-s.release
+		})
+	}
+	return s.Memory.AddTXTValue(domain, value)
+}
+
+// TestNameLocks - изменение, застрявшее в хранилище, задерживает только свое имя
+func TestNameLocks(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	s := slowStorage{NewMemory(), "_acme-challenge.slow.example.", new(sync.Once), make(chan struct{}), make(chan struct{})}
+	m := NewRecordManager(s, "")
+	done := make(chan error, 1)
+	go func() { done <- m.Add(Source{}, "_acme-challenge.slow.example", "slow") }()
+	<-s.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.AddIf(ctx, Source{}, "_acme-challenge.fast.example", "fast", nil, Condition{IfNotExists: true}); err != nil {
+		t.Errorf("other name waited for the stuck write: %v", err)
+	}
+	if err := m.ApplyUpdate(ctx, Source{}, []UpdateChange{{Name: "_acme-challenge.fast.example", Remove: true}, {Name: "_acme-challenge.other.example", Value: "x"}}); err != nil {
+		t.Errorf("batch of other names waited for the stuck write: %v", err)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if err := m.AddIf(short, Source{}, "_acme-challenge.SLOW.example", "second", nil, Condition{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("same name did not wait for the stuck write: %v", err)
+	}
+
+	close(s.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Source{}, "_acme-challenge.slow.example", "second"); err != nil {
+		t.Errorf("name still locked after the write finished: %v", err)
+	}
+	if len(m.names.held) != 0 {
+		t.Errorf("%d name locks left after all writes", len(m.names.held))
+	}
+}
+
+// Challenge wildcard и apex одного сертификата - два значения одного имени: второе добавление
+// без TTL не сбрасывает TTL первого, а удаление одного значения не забывает другое
+func TestRecordManagerValueTTL(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	m.SetDefaultTTL(120)
+	const name = "_acme-challenge.example.com"
+	ttl := uint32(30)
+	if err := m.AddIf(context.Background(), Source{RequestID: "apex"}, name, "apex", &ttl, Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Source{RequestID: "wildcard"}, name, "wildcard"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.TTL(name); got != 30 {
+		t.Errorf("TTL after second add = %d, want 30", got)
+	}
+	if got := m.RequestID(name); got != "apex, wildcard" {
+		t.Errorf("RequestID = %q", got)
+	}
+	if err := m.Remove(Source{}, name, "apex"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.TTL(name); got != 120 {
+		t.Errorf("TTL after remove = %d, want the default 120", got)
+	}
+	if got := m.RequestID(name); got != "wildcard" {
+		t.Errorf("RequestID after remove = %q", got)
+	}
+}
+
+// failingStorage отказывает в записи заданного имени
+type failingStorage struct {
+	*Memory
+	fail string
+}
+
+func (s failingStorage) AddTXTValue(domain, value string) error {
+	if domain == s.fail {
+		return errors.New("disk full")
+	}
+	return s.Memory.AddTXTValue(domain, value)
+}
+
+func TestApplyBatchRollback(t *testing.T) {
+	m := NewRecordManager(failingStorage{NewMemory(), "_acme-challenge.c.example."}, "")
+	if err := m.Add(Source{}, "_acme-challenge.a.example", "old"); err != nil {
+		t.Fatal(err)
+	}
+	errs, err := m.ApplyBatch(context.Background(), Source{}, false, []BatchChange{
+		{Name: "_acme-challenge.a.example", Value: "new"},
+		{Name: "_acme-challenge.b.example", Value: "b"},
+		{Name: "_acme-challenge.c.example", Value: "c"},
+	}, nil)
+	if err == nil {
+		t.Fatal("expected batch error")
+	}
+	if !errors.Is(errs[0], ErrBatchAborted) || !errors.Is(errs[1], ErrBatchAborted) || errs[2] == nil || errors.Is(errs[2], ErrBatchAborted) {
+		t.Errorf("unexpected item errors: %v", errs)
+	}
+	if values := m.Values("_acme-challenge.a.example"); strings.Join(values, ",") != "old" {
+		t.Errorf("a not restored: %q", values)
+	}
+	if values := m.Values("_acme-challenge.b.example"); len(values) != 0 {
+		t.Errorf("b not rolled back: %q", values)
+	}
+}
+
+func TestRecordQuota(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	m.SetQuota(NewRecordQuota(3, 2, map[string]int{"big": 5}))
+	alice := Source{Identity: "alice"}
+	for _, v := range []string{"1", "2", "2"} {
+		if err := m.Add(alice, "_acme-challenge.a.example", v); err != nil {
+			t.Fatalf("add %s: %v", v, err)
+		}
+	}
+	if err := m.Add(alice, "_acme-challenge.b.example", "3"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third record of alice: %v, want ErrQuotaExceeded", err)
+	}
+	if err := m.Add(Source{Identity: "big"}, "_acme-challenge.b.example", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ApplyBatch(context.Background(), Source{Identity: "big"}, false, []BatchChange{{Name: "_acme-challenge.c.example", Value: "4"}}, nil); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("fourth record: %v, want ErrStorageFull", err)
+	}
+	if err := m.Remove(Source{}, "_acme-challenge.a.example", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(alice, "_acme-challenge.b.example", "5"); err != nil {
+		t.Errorf("add after remove: %v", err)
+	}
+}
+
+// Домен из списка разрешает только свое имя проверки; apex и другие имена - только через "="
+func TestDomainACL(t *testing.T) {
+	acl := ParseDomainACL("example.com, *.example.org, =verify.example.net, =*.auth.example.net", "")
+	for _, tt := range []struct {
+		name    string
+		allowed bool
+	}{
+		{"_acme-challenge.example.com", true},
+		{"_ACME-Challenge.Example.COM.", true},
+		{"example.com", false},
+		{"www.example.com", false},
+		{"_acme-challenge.www.example.com", false},
+		{"_acme-challenge.www.example.org", true},
+		{"www.example.org", false},
+		{"_acme-challenge.example.org", false},
+		{"verify.example.net", true},
+		{"_acme-challenge.verify.example.net", false},
+		{"164e.auth.example.net", true},
+		{"_acme-challenge.example.net", false},
+	} {
+		if got := acl.Allows(tt.name); got != tt.allowed {
+			t.Errorf("Allows(%s) = %v, want %v", tt.name, got, tt.allowed)
+		}
+	}
+}
+
+// TestDomainACLFile - список доменов из файла (по строке или через запятую, с комментариями)
+// заменяется в RecordManager на ходу; ошибка чтения не трогает действующий список
+func TestDomainACLFile(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	m.SetAllowedDomains(ParseDomainACL("example.com", ""))
+	for _, tt := range []struct {
+		name    string
+		content string // пусто - файла нет
+		size    int
+		wantErr bool
+		allowed string // имя, которое разрешено после перечитывания
+		denied  string
+	}{
+		{name: "lines", content: "# staging\nexample.org\n\n*.example.net\n", size: 2, allowed: "_acme-challenge.www.example.net", denied: "_acme-challenge.example.com"},
+		{name: "commas", content: "example.com, example.org\n", size: 2, allowed: "_acme-challenge.example.com", denied: "_acme-challenge.www.example.net"},
+		{name: "missing file", wantErr: true, allowed: "_acme-challenge.example.com", denied: "_acme-challenge.www.example.net"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "domains")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			acl, err := LoadDomainACLFile(path, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if acl.Size() != tt.size {
+					t.Errorf("%d entries, want %d", acl.Size(), tt.size)
+				}
+				m.SetAllowedDomains(acl)
+			}
+			if err := m.CheckAllowed(tt.allowed); err != nil {
+				t.Errorf("%s: %v", tt.allowed, err)
+			}
+			if err := m.CheckAllowed(tt.denied); !errors.Is(err, ErrDomainNotAllowed) {
+				t.Errorf("%s: %v, want not allowed", tt.denied, err)
+			}
+		})
+	}
+}
+
+// TestChallengePrefix - префикс -challenge-prefix принадлежит менеджеру записей и списку
+// доменов, а не пакету: экземпляры с разными префиксами работают рядом
+func TestChallengePrefix(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range []struct {
+		prefix, want string
+		wantErr      bool
+	}{
+		{prefix: "_acme-challenge", want: "_acme-challenge."},
+		{prefix: "._Delegation_Challenge.", want: "_delegation_challenge."},
+		{prefix: "_verify.provider", want: "_verify.provider."},
+		{prefix: "", wantErr: true},
+		{prefix: "..", wantErr: true},
+	} {
+		got, err := ParseChallengePrefix(tt.prefix)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseChallengePrefix(%q) = %q, %v; want %q, error %v", tt.prefix, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	if got := NewRecordManager(NewMemory(), "").ChallengePrefix(); got != "_acme-challenge." {
+		t.Errorf("default prefix %q", got)
+	}
+	delegation := NewRecordManager(NewMemory(), "_delegation_challenge.")
+	delegation.SetAllowedDomains(ParseDomainACL("example.com", "_delegation_challenge."))
+	acme := NewRecordManager(NewMemory(), "")
+	acme.SetAllowedDomains(ParseDomainACL("example.com", ""))
+	for _, tt := range []struct {
+		m       *RecordManager
+		name    string
+		allowed bool
+	}{
+		{delegation, "_delegation_challenge.example.com", true},
+		{delegation, "_acme-challenge.example.com", false},
+		{acme, "_acme-challenge.example.com", true},
+		{acme, "_delegation_challenge.example.com", false},
+	} {
+		err := tt.m.Add(Source{}, tt.name, "v")
+		if allowed := !errors.Is(err, ErrDomainNotAllowed); allowed != tt.allowed || (allowed && err != nil) {
+			t.Errorf("%s with prefix %s: %v, want allowed %v", tt.name, tt.m.ChallengePrefix(), err, tt.allowed)
+		}
+	}
+
+	tenants, err := NewTenants([]Tenant{{Name: "one", Domains: []string{"example.com"}}}, "_delegation_challenge.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := tenants.Owner("_delegation_challenge.example.com"); owner != "one" {
+		t.Errorf("owner of the delegation name %q, want one", owner)
+	}
+}
+
+// Зоны разных заказчиков: токен одного не меняет записи другого, имена вне зон отклоняются
+func TestZones(t *testing.T) {
+	zones := NewZones()
+	for zone, identities := range map[string][]string{
+		"acme.one.example":     {"one"},
+		"sub.acme.one.example": {"sub"},
+		"acme.two.example":     nil,
+	} {
+		if err := zones.Add(zone, identities); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zones.Add("ACME.two.example.", nil); err == nil {
+		t.Error("duplicate zone accepted")
+	}
+	m := NewRecordManager(NewMemory(), "")
+	m.SetZones(zones)
+	for _, tt := range []struct {
+		src     Source
+		name    string
+		allowed bool
+	}{
+		{Source{Identity: "one"}, "_acme-challenge.www.acme.one.example", true},
+		{Source{Identity: "one"}, "_acme-challenge.sub.acme.one.example", false},
+		{Source{Identity: "sub"}, "_acme-challenge.x.sub.acme.one.example", true},
+		{Source{Identity: "sub"}, "_acme-challenge.acme.one.example", false},
+		{Source{Interface: "fastcgi"}, "_acme-challenge.acme.one.example", false},
+		{Source{Interface: "fastcgi"}, "_acme-challenge.acme.two.example", true},
+		{Source{Identity: "one"}, "_acme-challenge.example.com", false},
+		{Source{Identity: "one"}, "_acme-challenge.notacme.two.example", false},
+		{Source{Interface: "axfr"}, "_acme-challenge.example.com", true},
+	} {
+		err := m.Add(tt.src, tt.name, "token")
+		if tt.allowed && err != nil || !tt.allowed && !errors.Is(err, ErrDomainNotAllowed) {
+			t.Errorf("add %s by %+v: %v, allowed %v", tt.name, tt.src, err, tt.allowed)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tenants, err := NewTenants([]Tenant{
+		{Name: "one", Identities: []string{"one-ci", "one-dev"}, Domains: []string{"*.one.example"}, MaxRecords: 2},
+		{Name: "two", Domains: []string{"two.example"}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, list := range [][]Tenant{
+		{{Name: "a", Domains: []string{"*.example"}}, {Name: "b", Domains: []string{"x.example"}}},
+		{{Name: "a", Domains: []string{"a.example"}}, {Name: "b", Identities: []string{"a"}, Domains: []string{"b.example"}}},
+	} {
+		if _, err := NewTenants(list, ""); err == nil {
+			t.Errorf("overlapping tenants accepted: %+v", list)
+		}
+	}
+	if err := tenants.Register(Tenant{Name: "three", Domains: []string{"www.one.example"}}); err == nil {
+		t.Error("registered tenant overlapping tenant one")
+	}
+	if err := tenants.Register(Tenant{Name: "three", Domains: []string{"three.example"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.Replace([]Tenant{{Name: "one", Identities: []string{"one-ci", "one-dev"}, Domains: []string{"*.one.example"}, MaxRecords: 2}, {Name: "two", Domains: []string{"two.example"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if tenants.Owner("_acme-challenge.three.example") != "three" {
+		t.Error("registered tenant lost on replace")
+	}
+	m := NewRecordManager(NewMemory(), "")
+	m.SetTenants(tenants)
+	m.SetQuota(NewRecordQuota(0, 0, nil))
+	for _, tt := range []struct {
+		src  Source
+		name string
+		err  error
+	}{
+		{Source{Identity: "one-ci"}, "_acme-challenge.www.one.example", nil},
+		{Source{Identity: "one-dev"}, "_acme-challenge.api.one.example", nil},
+		{Source{Identity: "one-dev"}, "_acme-challenge.mail.one.example", ErrQuotaExceeded},
+		{Source{Identity: "one-ci"}, "_acme-challenge.two.example", ErrDomainNotAllowed},
+		{Source{Identity: "one-ci"}, "_acme-challenge.other.example", ErrDomainNotAllowed},
+		{Source{Identity: "two"}, "_acme-challenge.two.example", nil},
+		{Source{Interface: "fastcgi"}, "_acme-challenge.two.example", ErrDomainNotAllowed},
+		{Source{Interface: "fastcgi"}, "_acme-challenge.other.example", nil},
+	} {
+		if err := m.Add(tt.src, tt.name, "token"); !errors.Is(err, tt.err) {
+			t.Errorf("add %s by %+v: %v, want %v", tt.name, tt.src, err, tt.err)
+		}
+	}
+	if records, limit := m.Usage("one"); records != 2 || limit != 2 {
+		t.Errorf("usage of tenant one: %d of %d", records, limit)
+	}
+}
+
+func TestHostedRecords(t *testing.T) {
+	backend := NewMemory()
+	m := NewRecordManager(backend, "")
+	h := NewHostedRecords(backend)
+	if err := h.Set(context.Background(), Source{}, "Example.com", "verify=1", 86400); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Set(context.Background(), Source{}, "example.com.", "verify=1", 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Source{}, "example.com", "challenge"); err != nil {
+		t.Fatal(err)
+	}
+	records := h.Lookup("example.com")
+	if len(records) != 1 || records[0].Value != "verify=1" || records[0].TTL != 600 {
+		t.Errorf("hosted records: %+v", records)
+	}
+	if values := m.Values("example.com"); strings.Join(values, ",") != "challenge" {
+		t.Errorf("challenge values: %q", values)
+	}
+	if err := m.Add(Source{}, "-hosted-.example.com", "x"); !errors.Is(err, ErrDomainNotAllowed) {
+		t.Errorf("write into hosted namespace: %v", err)
+	}
+	if err := h.Remove(context.Background(), Source{}, "example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := h.List(""); err != nil || len(list) != 0 {
+		t.Errorf("after remove: %+v, %v", list, err)
+	}
+}
+
+func TestRemoveDelay(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	m.SetRemoveDelay(time.Hour)
+	name := "_acme-challenge.example.com"
+	if err := m.Add(Source{}, name, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Source{}, name, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove(Source{}, name, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove(Source{}, name, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if values := m.Values(name); len(values) != 2 {
+		t.Errorf("removed values must still be served: %q", values)
+	}
+	// новое добавление отменяет отложенное удаление
+	if err := m.Add(Source{}, name, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FlushRemovals(); err != nil {
+		t.Fatal(err)
+	}
+	if values := m.Values(name); strings.Join(values, ",") != "b" {
+		t.Errorf("after flush: %q", values)
+	}
+}
+
+// stuckRemovals не может удалить значения имени fail
+type stuckRemovals struct {
+	*Memory
+	fail string
+}
+
+func (s stuckRemovals) RemoveTXTValue(domain, value string) error {
+	if domain == s.fail {
+		return errors.New("storage unavailable")
+	}
+	return s.Memory.RemoveTXTValue(domain, value)
+}
+
+// TestFlushRemovalsError - неудачные удаления при остановке возвращаются ошибкой, остальные выполняются
+func TestFlushRemovalsError(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	m := NewRecordManager(stuckRemovals{NewMemory(), "_acme-challenge.stuck.example."}, "")
+	m.SetRemoveDelay(time.Hour)
+	for _, name := range []string{"_acme-challenge.stuck.example", "_acme-challenge.ok.example"} {
+		if err := m.Add(Source{}, name, "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Remove(Source{}, name, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.FlushRemovals()
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 delayed removals failed") {
+		t.Errorf("flush error %v", err)
+	}
+	if values := m.Values("_acme-challenge.ok.example"); len(values) != 0 {
+		t.Errorf("removal after a failed one not done: %q", values)
+	}
+	if values := m.Values("_acme-challenge.stuck.example"); len(values) != 1 {
+		t.Errorf("failed removal lost the record: %q", values)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	m := NewRecordManager(NewMemory(), "")
+	limiter := NewRateLimiter(60, 2)
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+	m.SetRateLimit(limiter)
+	alice := Source{Interface: "lego", Addr: "192.0.2.1:1000", Identity: "alice"}
+	name := "_acme-challenge.example.com"
+	for _, value := range []string{"a", "b"} {
+		if err := m.Add(alice, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Add(alice, name, "c"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("third change: %v, want ErrRateLimited", err)
+	}
+	// другие клиенты и уборка не ограничены лимитом alice
+	if err := m.Remove(Source{Interface: "fastcgi", Addr: "192.0.2.2:1000"}, name, "a"); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+	now = now.Add(time.Second)
+	if err := m.Add(alice, name, "c"); err != nil {
+		t.Errorf("after refill: %v", err)
+	}
+}
+
+func FuzzNormalizeDomain(f *testing.F) {
+	for _, seed := range []string{"example.com.", "_ACME-Challenge.Example.COM", "bücher.example", "xn--bcher-kva.example", "a..b.", "ÄÖÜ.ß", "\xff.example"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		got := NormalizeDomain(name)
+		if again := NormalizeDomain(got); again != got {
+			t.Fatalf("not idempotent: %q -> %q -> %q", name, got, again)
+		}
+		if strings.HasSuffix(got, ".") {
+			t.Fatalf("trailing dot in %q", got)
+		}
+		if !isASCII(got) {
+			t.Fatalf("non-ASCII result %q", got)
+		}
+		if strings.ToLower(got) != got {
+			t.Fatalf("upper case in %q", got)
+		}
+		if NormalizeDomain(strings.ToUpper(name)+".") != NormalizeDomain(strings.ToLower(name)) && isASCII(name) {
+			t.Fatalf("case or trailing dot changes result for %q", name)
+		}
+	})
+}
+
+func TestEncrypted(t *testing.T) {
+	key, err := ParseEncryptionKey(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemory()
+	const name = "_acme-challenge.example.com."
+	// значение, записанное до включения шифрования
+	if err := mem.AddTXTValue(name, "legacy"); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := NewEncrypted(mem, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewRecordManager(enc, "")
+	for _, value := range []string{"token", "token"} {
+		if err := m.Add(Source{}, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if values := m.Values(name); len(values) != 2 || values[0] != "legacy" || values[1] != "token" {
+		t.Fatalf("Values = %q", values)
+	}
+	raw, _ := mem.GetTXTValues(name)
+	if len(raw) != 2 || !strings.HasPrefix(raw[1], encryptedPrefix) || strings.Contains(raw[1], "token") {
+		t.Fatalf("stored values = %q, want the second one encrypted", raw)
+	}
+
+	// зашифрованное значение не расшифровывается под другим именем
+	if err := mem.AddTXTValue("_acme-challenge.example.org.", raw[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.GetTXTValues("_acme-challenge.example.org."); err == nil {
+		t.Error("value moved to another name was decrypted")
+	}
+
+	for _, value := range []string{"legacy", "token"} {
+		if err := m.Remove(Source{}, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if raw, _ := mem.GetTXTValues(name); len(raw) != 0 {
+		t.Errorf("stored values after remove = %q", raw)
+	}
+
+	if _, err := ParseEncryptionKey("# created: 2024-01-01\nAGE-SECRET-KEY-1QQQ\n"); err != nil {
+		t.Errorf("age identity: %v", err)
+	}
+	if _, err := ParseEncryptionKey("short"); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+// TestSQLite - миграции SQLite (WAL, индексы по нормализованному имени), круг
+// set/get/clear/history и повторное открытие той же базы без повторных миграций
+func TestSQLite(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	path := filepath.Join(t.TempDir(), "records.db")
+	s, err := OpenSQL("sqlite", path, SQLPool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode string
+	if err := s.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode %q %v, want wal", mode, err)
+	}
+	for _, table := range []string{"txt_values", "txt_history"} {
+		var n int
+		err := s.db.QueryRow(`SELECT COUNT(*) FROM pragma_index_list(?) AS l, pragma_index_info(l.name) AS i
+			WHERE i.seqno = 0 AND i.name = 'name'`, table).Scan(&n)
+		if err != nil || n == 0 {
+			t.Errorf("%s has no index on name: %v", table, err)
+		}
+	}
+
+	const name = "_acme-challenge.example.com."
+	m := NewRecordManager(s, "")
+	for _, value := range []string{"one", "two", "two"} {
+		if err := m.Add(Source{}, "_ACME-Challenge.Example.com", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if values, err := s.GetTXTValues(name); err != nil || strings.Join(values, ",") != "one,two" {
+		t.Errorf("values %q %v", values, err)
+	}
+	if err := m.Remove(Source{}, name, "one"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenSQL("sqlite", path, SQLPool{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	var version int
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil || version != len(sqlDialects["sqlite"].migrations) {
+		t.Errorf("schema version %d %v", version, err)
+	}
+	if values, err := s.GetTXTValues(name); err != nil || strings.Join(values, ",") != "two" {
+		t.Errorf("values after reopen %q %v", values, err)
+	}
+	if err := s.RemoveTXTValue(name, ""); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := s.GetTXTValues(name); err != nil || len(values) != 0 {
+		t.Errorf("values after clear %q %v", values, err)
+	}
+	history, err := s.History("_acme-challenge.EXAMPLE.com", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range history {
+		got = append(got, e.Action+" "+e.Value)
+	}
+	// повторное добавление "two" тоже пишется в историю
+	if want := "clear ,clear one,set two,set two,set one"; strings.Join(got, ",") != want {
+		t.Errorf("history %q, want %q", strings.Join(got, ","), want)
+	}
+}
+
+// TestSQLMigrateConcurrent - реплики, одновременно открывающие общую базу, применяют миграции
+// по очереди: все открываются без ошибок, каждая версия записана один раз
+func TestSQLMigrateConcurrent(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	path := filepath.Join(t.TempDir(), "records.db")
+
+	const replicas = 8
+	stores := make([]*SQL, replicas)
+	errs := make([]error, replicas)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			stores[i], errs[i] = OpenSQL("sqlite", path, SQLPool{})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("replica %d: %v", i, err)
+		}
+		defer stores[i].Close()
+	}
+
+	var versions, last int
+	if err := stores[0].db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&versions, &last); err != nil {
+		t.Fatal(err)
+	}
+	if want := len(sqlDialects["sqlite"].migrations); versions != want || last != want {
+		t.Errorf("%d migrations recorded up to version %d, want %d", versions, last, want)
+	}
+	if err := stores[0].AddTXTValue("_acme-challenge.example.com", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := stores[replicas-1].GetTXTValues("_acme-challenge.example.com"); err != nil || len(values) != 1 {
+		t.Errorf("other replica sees %q %v", values, err)
+	}
+}
+
+// TestSQLDialects - плейсхолдеры PostgreSQL, разбор миграций на инструкции, блокировка миграций
+// общих баз и повторяемость миграций MySQL, где DDL не откатывается транзакцией
+func TestSQLDialects(t *testing.T) {
+	for query, want := range map[string]string{
+		`SELECT value FROM txt_values WHERE name = ?`:                           `SELECT value FROM txt_values WHERE name = $1`,
+		`INSERT INTO txt_history (name, action, value, at) VALUES (?, ?, ?, ?)`: `INSERT INTO txt_history (name, action, value, at) VALUES ($1, $2, $3, $4)`,
+		`SELECT MAX(version) FROM schema_migrations`:                            `SELECT MAX(version) FROM schema_migrations`,
+	} {
+		if got := dollarRebind(query); got != want {
+			t.Errorf("dollarRebind(%q) = %q, want %q", query, got, want)
+		}
+	}
+
+	got := splitStatements("CREATE TABLE a (x INT);\n\t INSERT INTO a VALUES (1) ;\n;  DROP TABLE b  ")
+	if want := []string{"CREATE TABLE a (x INT)", "INSERT INTO a VALUES (1)", "DROP TABLE b"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("splitStatements = %q, want %q", got, want)
+	}
+	if got := splitStatements(" ;\n "); len(got) != 0 {
+		t.Errorf("splitStatements of an empty migration = %q", got)
+	}
+
+	for _, name := range []string{"postgres", "mysql"} {
+		if sqlDialects[name].lock == nil {
+			t.Errorf("%s replicas sharing a database migrate without a lock", name)
+		}
+	}
+	for name, d := range sqlDialects {
+		for i, migration := range d.migrations {
+			statements := splitStatements(migration)
+			if len(statements) == 0 {
+				t.Errorf("%s migration %d is empty", name, i+1)
+			}
+			if name != "mysql" {
+				continue
+			}
+			for _, stmt := range statements {
+				repeatable := false
+				for _, prefix := range []string{"CREATE TABLE IF NOT EXISTS ", "INSERT IGNORE INTO ", "DROP TABLE IF EXISTS "} {
+					repeatable = repeatable || strings.HasPrefix(stmt, prefix)
+				}
+				if !repeatable {
+					t.Errorf("mysql migration %d: %.40q... fails when the migration is repeated", i+1, stmt)
+				}
+			}
+		}
+	}
+}
+
+// quietLog отключает журнал изменений на время бенчмарка
+func quietLog(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// benchmarkBackend открывает хранилище для бенчмарка: memory, SQLite во временном файле;
+// PostgreSQL и MySQL - только если строка подключения к тестовой
+// базе задана в DNS_ACME_BENCH_POSTGRES или DNS_ACME_BENCH_MYSQL
+func benchmarkBackend(b *testing.B, name string) Storage {
+	if name == "memory" {
+		return NewMemory()
+	}
+	dsn := os.Getenv("DNS_ACME_BENCH_" + strings.ToUpper(name))
+	if name == "sqlite" {
+		dsn = filepath.Join(b.TempDir(), "records.db")
+	}
+	if dsn == "" {
+		b.Skipf("set DNS_ACME_BENCH_%s to benchmark %s", strings.ToUpper(name), name)
+	}
+	s, err := OpenSQL(name, dsn, SQLPool{MaxOpen: 10, MaxIdle: 2})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { s.Close() })
+	return s
+}
+
+// BenchmarkStorage - чтение записи (запрос DNS мимо кэша) и цикл add/remove (хук выпуска)
+// на каждом хранилище этой сборки
+func BenchmarkStorage(b *testing.B) {
+	quietLog(b)
+	for _, name := range strings.Split(Backends(), ", ") {
+		b.Run(name+"/get", func(b *testing.B) {
+			s := benchmarkBackend(b, name)
+			if err := s.AddTXTValue("_acme-challenge.example.com.", "token"); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetTXTValues("_acme-challenge.example.com."); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/add-remove", func(b *testing.B) {
+			s := benchmarkBackend(b, name)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.AddTXTValue("_acme-challenge.example.com.", "token"); err != nil {
+					b.Fatal(err)
+				}
+				if err := s.RemoveTXTValue("_acme-challenge.example.com.", "token"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRecordManager - те же операции через RecordManager: нормализация имени,
+// проверки и уведомления поверх хранилища в памяти
+func BenchmarkRecordManager(b *testing.B) {
+	quietLog(b)
+	b.Run("values", func(b *testing.B) {
+		m := NewRecordManager(NewMemory(), "")
+		if err := m.Add(Source{}, "_acme-challenge.example.com", "token"); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.Values("_ACME-Challenge.Example.com.")
+		}
+	})
+	b.Run("add-remove", func(b *testing.B) {
+		m := NewRecordManager(NewMemory(), "")
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := m.Add(Source{}, "_acme-challenge.example.com", "token"); err != nil {
+				b.Fatal(err)
+			}
+			if err := m.Remove(Source{}, "_acme-challenge.example.com", "token"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// outage - хранилище, недоступное, пока down
+type outage struct {
+	*Memory
+	down *bool
+}
+
+func (s outage) AddTXTValue(domain, value string) error {
+	if *s.down {
+		return errors.New("connection refused")
+	}
+	return s.Memory.AddTXTValue(domain, value)
+}
+
+func (s outage) RemoveTXTValue(domain, value string) error {
+	if *s.down {
+		return errors.New("connection refused")
+	}
+	return s.Memory.RemoveTXTValue(domain, value)
+}
+
+// TestRetryQueue - отложенные изменения читаются из файла после перезапуска и повторяются
+// по порядку: временная ошибка оставляет их в очереди, отказ по правилам и возраст - отбрасывают
+func TestRetryQueue(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const name = "_acme-challenge.example.com"
+	add := func(value string) RecordChange { return RecordChange{Name: name, Value: value} }
+	tests := []struct {
+		name     string
+		existing string // значение в хранилище до повтора
+		changes  []RecordChange
+		age      time.Duration // сколько изменения пролежали в очереди
+		down     bool
+		ok       bool
+		left     int
+		attempts int
+		want     string // значения имени после повтора через запятую
+	}{
+		{name: "applied in order", changes: []RecordChange{add("a"), add("b"), {Name: name, Value: "a", Remove: true}}, ok: true, want: "b"},
+		{name: "storage still down", changes: []RecordChange{add("a"), add("b")}, down: true, left: 2, attempts: 1},
+		{name: "conflict dropped", existing: "other", changes: []RecordChange{{Name: name, Value: "a", Condition: Condition{IfNotExists: true}}, add("b")}, ok: true, want: "other,b"},
+		{name: "expired dropped", changes: []RecordChange{add("a")}, age: 2 * time.Hour, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down := false
+			m := NewRecordManager(outage{NewMemory(), &down}, "")
+			if tt.existing != "" {
+				if err := m.Add(Source{}, name, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(t.TempDir(), "retry.json")
+			q, err := NewRetryQueue(m, path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tt.changes {
+				if err := q.Enqueue(c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.age > 0 {
+				for i := range q.pending {
+					q.pending[i].Queued = time.Now().Add(-tt.age)
+				}
+				if err := q.save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// очередь переживает перезапуск
+			q, err = NewRetryQueue(m, path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.Len() != len(tt.changes) || !q.Pending("_ACME-Challenge.Example.COM.") {
+				t.Fatalf("reopened queue has %d changes, want %d", q.Len(), len(tt.changes))
+			}
+
+			down = tt.down
+			if ok := q.retry(); ok != tt.ok {
+				t.Errorf("retry %v, want %v", ok, tt.ok)
+			}
+			if values := strings.Join(m.Values(name), ","); values != tt.want {
+				t.Errorf("values %q, want %q", values, tt.want)
+			}
+			reopened, err := NewRetryQueue(m, path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.Len() != tt.left {
+				t.Fatalf("%d changes left in the file, want %d", reopened.Len(), tt.left)
+			}
+			if tt.left > 0 && (reopened.pending[0].Attempts != tt.attempts || reopened.pending[0].LastError == "") {
+				t.Errorf("first change saved with %d attempts, error %q", reopened.pending[0].Attempts, reopened.pending[0].LastError)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "retry.json")
+	if err := os.WriteFile(path, []byte("{broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRetryQueue(NewRecordManager(NewMemory(), ""), path, 0); err == nil {
+		t.Error("broken queue file accepted")
+	}
+}
+
+// unlisted скрывает ListTXTValues хранилища
+type unlisted struct{ Storage }
+
+// TestSnapshot - выгрузка переносит challenge записи с TTL и постоянные записи, загрузка
+// дополняет или (replace) заменяет содержимое, повторная загрузка ничего не меняет
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	ttl := uint32(30)
+	source := NewMemory()
+	records := NewRecordManager(source, "")
+	hosted := NewHostedRecords(source)
+	if err := records.AddIf(ctx, Source{}, "_acme-challenge.example.com", "a", &ttl, Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"_acme-challenge.example.com", "_acme-challenge.www.example.com"} {
+		if err := records.Add(Source{}, name, "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hosted.Set(ctx, Source{}, "example.com", "verify=1", 600); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ExportSnapshot(records, hosted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Records) != 2 || len(snap.Hosted) != 1 || snap.Records[0].TTL == nil || *snap.Records[0].TTL != 30 {
+		t.Fatalf("exported %+v", snap)
+	}
+	if _, err := ExportSnapshot(NewRecordManager(unlisted{NewMemory()}, ""), nil); !errors.Is(err, ErrNotListable) {
+		t.Errorf("export without listing: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		existing string // значение _acme-challenge.other.example.com в целевом хранилище
+		acl      string
+		version  int
+		replace  bool
+		result   SnapshotResult
+		err      error
+		other    string // значения other после загрузки
+	}{
+		{name: "merge", existing: "x", result: SnapshotResult{Restored: 4}, other: "x"},
+		{name: "replace", existing: "x", replace: true, result: SnapshotResult{Restored: 4, Removed: 1}},
+		{name: "into empty", result: SnapshotResult{Restored: 4}},
+		{name: "unsupported version", existing: "x", version: 2, err: errors.New("unsupported snapshot version 2"), other: "x"},
+		{name: "domain not allowed", acl: "www.example.com", err: ErrDomainNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewMemory()
+			m := NewRecordManager(target, "")
+			h := NewHostedRecords(target)
+			if tt.existing != "" {
+				if err := m.Add(Source{}, "_acme-challenge.other.example.com", tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.acl != "" {
+				m.SetAllowedDomains(ParseDomainACL(tt.acl, ""))
+			}
+			imported := *snap
+			if tt.version != 0 {
+				imported.Version = tt.version
+			}
+
+			result, err := ImportSnapshot(ctx, Source{Interface: "import"}, m, h, &imported, tt.replace)
+			if tt.err != nil {
+				if err == nil || !errors.Is(err, tt.err) && err.Error() != tt.err.Error() {
+					t.Fatalf("import error %v, want %v", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.result {
+				t.Errorf("result %+v, want %+v", result, tt.result)
+			}
+			if got := strings.Join(m.Values("_acme-challenge.other.example.com"), ","); got != tt.other {
+				t.Errorf("other values %q, want %q", got, tt.other)
+			}
+			if tt.err != nil {
+				return
+			}
+			if got := strings.Join(m.Values("_acme-challenge.example.com"), ","); got != "a,b" {
+				t.Errorf("restored values %q", got)
+			}
+			if got := m.TTL("_acme-challenge.example.com"); got != 30 {
+				t.Errorf("restored TTL %d, want 30", got)
+			}
+			if list, _ := h.List(""); len(list) != 1 || list[0].Value != "verify=1" || list[0].TTL != 600 {
+				t.Errorf("restored hosted records %+v", list)
+			}
+			// повторная загрузка ничего не меняет
+			if _, err := ImportSnapshot(ctx, Source{Interface: "import"}, m, h, &imported, tt.replace); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(m.Values("_acme-challenge.example.com"), ","); got != "a,b" {
+				t.Errorf("values after a repeated import %q", got)
+			}
+			if list, _ := h.List(""); len(list) != 1 {
+				t.Errorf("hosted records after a repeated import %+v", list)
+			}
+		})
+	}
+}
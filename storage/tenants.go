@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"dns-acme-server/metrics"
+)
+
+var tenantChanges = metrics.Default.NewCounterVec("dns_acme_tenant_changes_total",
+	"Record values added and removed in tenant namespaces, by tenant and action", "tenant", "action")
+
+// Tenant - заказчик со своим пространством имен: его клиенты меняют записи только в нем,
+// а чужие клиенты - не меняют. Описывается в файле -tenants-file
+type Tenant struct {
+	Name string `json:"name"`
+	// Identities - имена API токенов, TSIG ключей или cert:SAN клиентов заказчика;
+	// пусто - один клиент с именем заказчика
+	Identities []string `json:"identities,omitempty"`
+	// Domains - пространство имен в синтаксисе -allowed-domains: example.com, *.example.com
+	Domains []string `json:"domains"`
+	// MaxRecords - лимит значений на всех клиентов заказчика, 0 - лимиты -max-records-per-token
+	MaxRecords int `json:"max_records,omitempty"`
+}
+
+// Tenants - заказчики и их пространства имен: из файла (Replace, можно заменять на ходу)
+// и зарегистрированные через POST /register (Register)
+type Tenants struct {
+	update     sync.Mutex // сериализует Replace и Register
+	static     []Tenant
+	registered []Tenant
+	prefix     string // префикс имени проверки для пространств имен
+
+	mutex      sync.RWMutex
+	tenants    []Tenant
+	acls       map[string]*DomainACL // заказчик -> пространство имен
+	identities map[string]string     // клиент -> заказчик
+}
+
+// NewTenants проверяет описания заказчиков: имена и клиенты не повторяются,
+// пространства имен разных заказчиков не пересекаются. prefix - как у NewRecordManager
+func NewTenants(list []Tenant, prefix string) (*Tenants, error) {
+	t := &Tenants{prefix: prefix}
+	if err := t.Replace(list); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadTenantsFile читает JSON массив заказчиков
+func LoadTenantsFile(path string) ([]Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return list, nil
+}
+
+// Replace заменяет заказчиков из файла, зарегистрированные остаются; при ошибке остаются прежние
+func (t *Tenants) Replace(list []Tenant) error {
+	t.update.Lock()
+	defer t.update.Unlock()
+	if err := t.build(list, t.registered); err != nil {
+		return err
+	}
+	t.static = list
+	return nil
+}
+
+// Register добавляет зарегистрированного заказчика; его имя и пространство не должны
+// пересекаться с уже известными
+func (t *Tenants) Register(tenant Tenant) error {
+	t.update.Lock()
+	defer t.update.Unlock()
+	registered := append(append([]Tenant(nil), t.registered...), tenant)
+	if err := t.build(t.static, registered); err != nil {
+		return err
+	}
+	t.registered = registered
+	return nil
+}
+
+// Unregister убирает зарегистрированного заказчика name, например если его регистрацию
+// не удалось сохранить
+func (t *Tenants) Unregister(name string) {
+	t.update.Lock()
+	defer t.update.Unlock()
+	registered := make([]Tenant, 0, len(t.registered))
+	for _, tenant := range t.registered {
+		if tenant.Name != name {
+			registered = append(registered, tenant)
+		}
+	}
+	if len(registered) == len(t.registered) {
+		return
+	}
+	// без заказчика пересечений стать больше не может
+	if err := t.build(t.static, registered); err == nil {
+		t.registered = registered
+	}
+}
+
+// build проверяет заказчиков и делает их текущими; вызывается под t.update
+func (t *Tenants) build(static, registered []Tenant) error {
+	list := append(append([]Tenant(nil), static...), registered...)
+	acls := make(map[string]*DomainACL)
+	identities := make(map[string]string)
+	entries := make(map[string][]string) // заказчик -> нормализованные записи пространства
+	for i, tenant := range list {
+		if tenant.Name == "" {
+			return fmt.Errorf("tenant %d has no name", i+1)
+		}
+		if _, exists := acls[tenant.Name]; exists {
+			return fmt.Errorf("duplicate tenant %s", tenant.Name)
+		}
+		if len(tenant.Domains) == 0 {
+			return fmt.Errorf("tenant %s has no domains", tenant.Name)
+		}
+		if tenant.MaxRecords < 0 {
+			return fmt.Errorf("tenant %s: max_records must not be negative", tenant.Name)
+		}
+		if len(tenant.Identities) == 0 {
+			list[i].Identities = []string{tenant.Name}
+		}
+		for _, identity := range list[i].Identities {
+			if other, exists := identities[identity]; exists {
+				return fmt.Errorf("client %s belongs to tenants %s and %s", identity, other, tenant.Name)
+			}
+			identities[identity] = tenant.Name
+		}
+		for _, domain := range tenant.Domains {
+			entry := NormalizeDomain(strings.TrimPrefix(strings.TrimSpace(domain), "="))
+			for other, otherEntries := range entries {
+				for _, e := range otherEntries {
+					if namespacesOverlap(entry, e) {
+						return fmt.Errorf("domain %s of tenant %s overlaps %s of tenant %s", domain, tenant.Name, e, other)
+					}
+				}
+			}
+			entries[tenant.Name] = append(entries[tenant.Name], entry)
+		}
+		acls[tenant.Name] = ParseDomainACL(strings.Join(tenant.Domains, ","), t.prefix)
+	}
+	sorted := append([]Tenant(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tenants = sorted
+	t.acls = acls
+	t.identities = identities
+	return nil
+}
+
+// namespacesOverlap - есть ли имя, которое входит в обе записи пространства имен
+func namespacesOverlap(a, b string) bool {
+	suffix := func(e string) (string, bool) {
+		switch {
+		case strings.HasPrefix(e, "*."):
+			return e[1:], true
+		case strings.HasPrefix(e, "."):
+			return e, true
+		}
+		return e, false
+	}
+	a, aSuffix := suffix(a)
+	b, bSuffix := suffix(b)
+	switch {
+	case a == b:
+		return true
+	case aSuffix && strings.HasSuffix(b, a):
+		return true
+	case bSuffix && strings.HasSuffix(a, b):
+		return true
+	}
+	return false
+}
+
+// List возвращает заказчиков по имени
+func (t *Tenants) List() []Tenant {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return append([]Tenant(nil), t.tenants...)
+}
+
+// Get возвращает заказчика по имени
+func (t *Tenants) Get(name string) (Tenant, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, tenant := range t.tenants {
+		if tenant.Name == name {
+			return tenant, true
+		}
+	}
+	return Tenant{}, false
+}
+
+// Of возвращает заказчика клиента; пусто - клиент не принадлежит заказчикам
+func (t *Tenants) Of(identity string) string {
+	if t == nil || identity == "" {
+		return ""
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.identities[identity]
+}
+
+// Owner возвращает заказчика, в пространство имен которого входит имя записи
+func (t *Tenants) Owner(name string) string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for tenant, acl := range t.acls {
+		if acl.covers(name) {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// quotaOwner - под каким именем учитываются значения клиента в RecordQuota:
+// клиенты одного заказчика делят его лимит
+func (t *Tenants) quotaOwner(identity string) string {
+	if tenant := t.Of(identity); tenant != "" {
+		return tenant
+	}
+	return identity
+}
+
+// limit - лимит max_records заказчика; false - не заказчик или лимит не задан
+func (t *Tenants) limit(owner string) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+	tenant, ok := t.Get(owner)
+	if !ok || tenant.MaxRecords == 0 {
+		return 0, false
+	}
+	return tenant.MaxRecords, true
+}
+
+// check проверяет, что клиент заказчика меняет имя в своем пространстве, а имена
+// пространства заказчика меняют только его клиенты
+func (t *Tenants) check(src Source, name string) error {
+	if t == nil || internalInterfaces[src.Interface] {
+		return nil
+	}
+	tenant, owner := t.Of(src.Identity), t.Owner(name)
+	switch {
+	case tenant == owner:
+		return nil
+	case tenant != "" && owner == "":
+		return fmt.Errorf("%w: %s is outside the namespace of tenant %s", ErrDomainNotAllowed, name, tenant)
+	}
+	return fmt.Errorf("%w: %s belongs to tenant %s", ErrDomainNotAllowed, name, owner)
+}
+
+// RecordAdded и RecordRemoved считают изменения в пространствах заказчиков для метрик
+func (t *Tenants) RecordAdded(src Source, name, value string) {
+	if tenant := t.Owner(name); tenant != "" {
+		tenantChanges.Inc(tenant, "add")
+	}
+}
+
+func (t *Tenants) RecordRemoved(src Source, name, value string) {
+	if tenant := t.Owner(name); tenant != "" {
+		tenantChanges.Inc(tenant, "remove")
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// internalInterfaces - изменения самого демона (уборка, копия с первичного сервера,
+// сертификат HTTP API): они не ограничиваются зонами, иначе уборка не удалила бы записи,
+// оставшиеся в хранилище от прежнего набора зон
+var internalInterfaces = map[string]bool{ExpireInterface: true, "axfr": true, "acme-client": true}
+
+// Zones - зоны, делегированные серверу (-zone): записи меняются только внутри них, а в зоне
+// со списком клиентов - только этими клиентами. Так один процесс обслуживает делегирования
+// разных заказчиков, и токен одного не может тронуть записи другого
+type Zones struct {
+	zones []zoneAccess // длинные имена первыми: вложенная зона важнее объемлющей
+}
+
+type zoneAccess struct {
+	name       string          // нормализованное имя
+	identities map[string]bool // пусто - любой клиент
+}
+
+func NewZones() *Zones {
+	return &Zones{}
+}
+
+// Add добавляет зону; identities - имена токенов, TSIG ключей или cert:SAN, которым можно
+// менять ее записи (пусто - всем, кому можно менять записи вообще)
+func (z *Zones) Add(name string, identities []string) error {
+	name = NormalizeDomain(name)
+	for _, existing := range z.zones {
+		if existing.name == name {
+			return fmt.Errorf("duplicate zone %s", name)
+		}
+	}
+	zone := zoneAccess{name: name, identities: make(map[string]bool)}
+	for _, identity := range identities {
+		zone.identities[identity] = true
+	}
+	z.zones = append(z.zones, zone)
+	sort.SliceStable(z.zones, func(i, j int) bool { return len(z.zones[i].name) > len(z.zones[j].name) })
+	return nil
+}
+
+// find возвращает зону, в которую входит имя записи; nil - имя вне зон
+func (z *Zones) find(name string) *zoneAccess {
+	name = NormalizeDomain(name)
+	for i, zone := range z.zones {
+		if name == zone.name || strings.HasSuffix(name, "."+zone.name) {
+			return &z.zones[i]
+		}
+	}
+	return nil
+}
+
+// check проверяет, что имя в одной из зон и src - клиент этой зоны
+func (z *Zones) check(src Source, name string) error {
+	if z == nil || len(z.zones) == 0 || internalInterfaces[src.Interface] {
+		return nil
+	}
+	zone := z.find(name)
+	switch {
+	case zone == nil:
+		return fmt.Errorf("%w: %s is outside the zones of this server", ErrDomainNotAllowed, name)
+	case len(zone.identities) == 0 || zone.identities[src.Identity]:
+		return nil
+	case src.Identity == "":
+		return fmt.Errorf("%w: zone %s requires an authenticated client", ErrDomainNotAllowed, zone.name)
+	}
+	return fmt.Errorf("%w: %s is not a client of zone %s", ErrDomainNotAllowed, src.Identity, zone.name)
+}
@@ -0,0 +1,328 @@
+// Package tracing - трассировка в формате OpenTelemetry с экспортом по OTLP/HTTP (JSON) без SDK:
+// спаны FastCGI/API хуков и DNS запросов, чтобы было видно, куда уходит время
+// от add хука Angie до первого успешного запроса валидатора.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dns-acme-server/storage"
+)
+
+// tracer - глобальный экспортер спанов, nil - трассировка выключена
+var tracer *Tracer
+
+// Enable делает t глобальным экспортером для StartSpan и RecordPublished
+func Enable(t *Tracer) {
+	tracer = t
+}
+
+// Виды спанов OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// Span - незавершенный спан; методы безопасно вызывать на nil (трассировка выключена)
+type Span struct {
+	spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	links  []spanContext
+	err    string
+}
+
+type spanKey struct{}
+
+// StartSpan начинает спан, дочерний к спану из ctx (или новый трейс)
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	if parent, ok := ctx.Value(spanKey{}).(spanContext); ok {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s.spanContext), s
+}
+
+// StartRequestSpan начинает серверный спан HTTP/FastCGI запроса, продолжая трейс
+// из заголовка traceparent (W3C), если клиент его передал
+func StartRequestSpan(r *http.Request, name string) (*http.Request, *Span) {
+	ctx := r.Context()
+	if parent, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		ctx = context.WithValue(ctx, spanKey{}, parent)
+	}
+	ctx, span := StartSpan(ctx, name, KindServer)
+	return r.WithContext(ctx), span
+}
+
+func (s *Span) SetAttr(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// SetError отмечает спан как завершившийся с ошибкой
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// End завершает спан и отдает его на экспорт
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	tracer.enqueue(s)
+}
+
+// parseTraceparent разбирает 00-<trace-id>-<parent-id>-<flags>
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	return sc, sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// Tracer копит завершенные спаны и пачками отправляет их на OTLP коллектор
+type Tracer struct {
+	endpoint string // полный URL .../v1/traces
+	service  string
+	client   *http.Client
+	spans    chan *Span
+
+	mutex sync.Mutex
+	// спаны, в которых запись была опубликована: DNS запросы ссылаются на них (links)
+	published map[string]published
+}
+
+type published struct {
+	sc spanContext
+	at time.Time
+}
+
+// NewTracer создает экспортер; endpoint - базовый адрес коллектора, например http://otel:4318
+func NewTracer(endpoint, service string) *Tracer {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	return &Tracer{
+		endpoint:  endpoint,
+		service:   service,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		spans:     make(chan *Span, 4096),
+		published: make(map[string]published),
+	}
+}
+
+// Endpoint возвращает URL, на который отправляются спаны
+func (t *Tracer) Endpoint() string {
+	return t.endpoint
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		// коллектор не успевает - теряем спан, но не задерживаем ответы
+	}
+}
+
+// RecordPublished запоминает в глобальном экспортере спан, в котором запись name была добавлена
+func RecordPublished(ctx context.Context, name string) {
+	tracer.RecordPublished(ctx, name)
+}
+
+// RecordPublished запоминает спан, в котором запись name была добавлена
+func (t *Tracer) RecordPublished(ctx context.Context, name string) {
+	if t == nil {
+		return
+	}
+	sc, ok := ctx.Value(spanKey{}).(spanContext)
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.published[storage.NormalizeDomain(name)] = published{sc: sc, at: time.Now()}
+}
+
+// RecordAdded и RecordRemoved делают Tracer наблюдателем RecordManager:
+// при удалении записи спан ее публикации забывается
+func (t *Tracer) RecordAdded(src storage.Source, name, value string) {}
+
+func (t *Tracer) RecordRemoved(src storage.Source, name, value string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.published, storage.NormalizeDomain(name))
+}
+
+// LinkPublished добавляет в спан DNS запроса ссылку на спан публикации записи
+// и время, прошедшее с публикации
+func LinkPublished(s *Span, name string) {
+	tracer.linkPublished(s, name)
+}
+
+func (t *Tracer) linkPublished(s *Span, name string) {
+	if t == nil || s == nil {
+		return
+	}
+	t.mutex.Lock()
+	p, ok := t.published[storage.NormalizeDomain(name)]
+	t.mutex.Unlock()
+	if ok {
+		s.links = append(s.links, p.sc)
+		s.SetAttr("acme.since_publish_ms", strconv.FormatInt(time.Since(p.at).Milliseconds(), 10))
+	}
+}
+
+// Run отправляет накопленные спаны раз в interval или по 512 штук
+func (t *Tracer) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// Структуры OTLP/JSON (opentelemetry-proto, ExportTraceServiceRequest)
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"` // 2 - ERROR
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttr(key, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for key, value := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpAttr(key, value))
+		}
+		for _, link := range s.links {
+			out.Links = append(out.Links, otlpLink{
+				TraceID: hex.EncodeToString(link.traceID[:]),
+				SpanID:  hex.EncodeToString(link.spanID[:]),
+			})
+		}
+		if s.err != "" {
+			out.Status.Code = 2
+			out.Status.Message = s.err
+		}
+		spans = append(spans, out)
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{otlpAttr("service.name", t.service)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "dns-acme-server"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Package vault - чтение секретов (TSIG ключей, HMAC секретов, TLS ключей) из HashiCorp Vault
+// через HTTP API, без клиентских библиотек. Поддерживаются KV v1/v2 и динамические секреты
+// с арендой, вход по токену или AppRole и продление токена.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatusError - ответ Vault с кодом ошибки
+type StatusError struct {
+	Code   int
+	Errors []string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("vault API: %d %s", e.Code, strings.Join(e.Errors, "; "))
+}
+
+// Secret - прочитанный секрет
+type Secret struct {
+	Data          map[string]interface{}
+	LeaseDuration time.Duration // 0 - секрет без аренды (KV)
+	Renewable     bool
+}
+
+// Field - строковое поле секрета
+func (s *Secret) Field(name string) (string, error) {
+	v, ok := s.Data[name]
+	if !ok {
+		return "", fmt.Errorf("no field %q", name)
+	}
+	text, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q is not a string", name)
+	}
+	return text, nil
+}
+
+// Client обращается к HTTP API Vault
+type Client struct {
+	base      string
+	namespace string
+	http      *http.Client
+
+	mutex sync.RWMutex
+	token string
+}
+
+// NewClient создает клиента Vault addr (https://vault:8200) с токеном token;
+// namespace - пространство имен Vault Enterprise, пусто - корневое
+func NewClient(addr, token, namespace string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "https://" + addr
+	}
+	return &Client{
+		base:      strings.TrimSuffix(addr, "/"),
+		namespace: namespace,
+		token:     token,
+		http:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SetToken меняет токен (новый токен Vault Agent)
+func (c *Client) SetToken(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.token = token
+}
+
+// response - общий конверт ответов Vault
+type response struct {
+	Data          map[string]interface{} `json:"data"`
+	LeaseDuration int64                  `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// TokenLease - срок действия токена после входа или продления
+type TokenLease struct {
+	TTL       time.Duration // 0 - бессрочный токен
+	Renewable bool
+}
+
+// LoginAppRole получает токен по AppRole (auth/<mount>/login) и дальше использует его
+func (c *Client) LoginAppRole(ctx context.Context, mount, roleID, secretID string) (TokenLease, error) {
+	var resp response
+	in := map[string]string{"role_id": roleID, "secret_id": secretID}
+	if err := c.do(ctx, http.MethodPost, "/v1/auth/"+strings.Trim(mount, "/")+"/login", in, &resp); err != nil {
+		return TokenLease{}, err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return TokenLease{}, errors.New("vault login: no token in response")
+	}
+	c.mutex.Lock()
+	c.token = resp.Auth.ClientToken
+	c.mutex.Unlock()
+	return TokenLease{TTL: time.Duration(resp.Auth.LeaseDuration) * time.Second, Renewable: resp.Auth.Renewable}, nil
+}
+
+// LookupSelf - срок действия текущего токена
+func (c *Client) LookupSelf(ctx context.Context) (TokenLease, error) {
+	var resp response
+	if err := c.do(ctx, http.MethodGet, "/v1/auth/token/lookup-self", nil, &resp); err != nil {
+		return TokenLease{}, err
+	}
+	ttl, _ := resp.Data["ttl"].(float64)
+	renewable, _ := resp.Data["renewable"].(bool)
+	return TokenLease{TTL: time.Duration(ttl) * time.Second, Renewable: renewable}, nil
+}
+
+// RenewSelf продлевает текущий токен
+func (c *Client) RenewSelf(ctx context.Context) (TokenLease, error) {
+	var resp response
+	if err := c.do(ctx, http.MethodPost, "/v1/auth/token/renew-self", struct{}{}, &resp); err != nil {
+		return TokenLease{}, err
+	}
+	if resp.Auth == nil {
+		return TokenLease{}, errors.New("vault renew: no auth in response")
+	}
+	return TokenLease{TTL: time.Duration(resp.Auth.LeaseDuration) * time.Second, Renewable: resp.Auth.Renewable}, nil
+}
+
+// Read читает секрет path (без /v1/). Для KV v2 (путь mount/data/...) возвращаются поля
+// самого секрета, а не конверт с метаданными версии
+func (c *Client) Read(ctx context.Context, path string) (*Secret, error) {
+	var resp response
+	if err := c.do(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), nil, &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok && strings.Contains(path, "/data/") {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("vault secret %s has no data", path)
+	}
+	return &Secret{
+		Data:          data,
+		LeaseDuration: time.Duration(resp.LeaseDuration) * time.Second,
+		Renewable:     resp.Renewable,
+	}, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	c.mutex.RLock()
+	token := c.token
+	c.mutex.RUnlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		status := &StatusError{Code: resp.StatusCode}
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&errs) == nil {
+			status.Errors = errs.Errors
+		}
+		return status
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}